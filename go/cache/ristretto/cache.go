@@ -22,8 +22,13 @@ package ristretto
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"math"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -33,18 +38,64 @@ import (
 )
 
 var (
-	// TODO: find the optimal value for this or make it configurable
+	// setBufSize is the default size of the set buffer, used unless
+	// Config.SetBufferSize is set.
+	// TODO: find the optimal value for this
 	setBufSize = 32 * 1024
 )
 
+// defaultAdmissionWindow is the number of admitted keys whose admission time is
+// tracked, unless Config.AdmissionWindow is set.
+const defaultAdmissionWindow = 100000
+
+// ErrCacheClosed is returned by the operations of a closed Cache that can fail.
+var ErrCacheClosed = errors.New("cache is closed")
+
+// errComputePanicked is returned by GetOrSet to the callers waiting for a
+// compute function that panicked.
+var errComputePanicked = errors.New("GetOrSet compute function panicked")
+
 func defaultStringHash(key string) (uint64, uint64) {
 	const Seed1 = uint64(0x1122334455667788)
 	const Seed2 = uint64(0x8877665544332211)
 	return hack.RuntimeStrhash(key, Seed1), hack.RuntimeStrhash(key, Seed2)
 }
 
+// seededStringHash returns the default hash function, with the given seeds
+// for the key hash and the conflict hash instead of the default ones.
+func seededStringHash(seeds [2]uint64) func(string) (uint64, uint64) {
+	return func(key string) (uint64, uint64) {
+		return hack.RuntimeStrhash(key, seeds[0]), hack.RuntimeStrhash(key, seeds[1])
+	}
+}
+
 type itemCallback func(*Item)
 
+// negativeValue is the value stored by SetNegative.
+type negativeValue struct{}
+
+// userValue returns a stored value as it's passed to the callers and the
+// callbacks, i.e. nil for the negatives stored by SetNegative.
+func userValue(value any) any {
+	if _, ok := value.(negativeValue); ok {
+		return nil
+	}
+	return value
+}
+
+// Clock is the source of the current time of a Cache, by which its items
+// expire.
+type Clock interface {
+	Now() time.Time
+}
+
+// wallClock is the default Clock, which reads the system time.
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
 // CacheItemSize is the overhead in bytes for every stored cache item
 var CacheItemSize = hack.RuntimeAllocSize(int64(unsafe.Sizeof(storeItem{})))
 
@@ -66,8 +117,14 @@ type Cache struct {
 	onEvict itemCallback
 	// onReject is called when an item is rejected via admission policy.
 	onReject itemCallback
+	// onAdmit is called when an item is admitted via admission policy, and
+	// when it's updated if onAdmitUpdates is set.
+	onAdmit        itemCallback
+	onAdmitUpdates bool
 	// onExit is called whenever a value goes out of scope from the cache.
 	onExit func(any)
+	// onClear is called at the end of every Clear.
+	onClear func()
 	// KeyToHash function is used to customize the key hashing algorithm.
 	// Each key will be hashed using the provided function. If keyToHash value
 	// is not set, the default keyToHash function is used.
@@ -76,11 +133,46 @@ type Cache struct {
 	stop chan struct{}
 	// indicates whether cache is closed.
 	isClosed atomic.Bool
+	// hasTTL indicates whether SetWithTTL has ever been called, so that Get
+	// only looks for expired items to purge when there can be any.
+	hasTTL atomic.Bool
+	// clock is the source of the current time for the expirations.
+	clock Clock
 	// cost calculates cost from a value.
 	cost func(value any) int64
 	// ignoreInternalCost dictates whether to ignore the cost of internally storing
 	// the item in the cost calculation.
 	ignoreInternalCost bool
+	// writeThrough persists sets to the backing store.
+	writeThrough func(key string, value any, cost int64) error
+	// deleteThrough persists deletes to the backing store.
+	deleteThrough func(key string) error
+	// writeThroughFailOpen dictates whether the cache is still updated when
+	// writeThrough or deleteThrough fail.
+	writeThroughFailOpen bool
+	// setLimiter limits the rate of sets, if MaxSetsPerSecond is set.
+	setLimiter *setLimiter
+	// blockSetsOverLimit dictates whether sets over the limit block or are
+	// dropped.
+	blockSetsOverLimit bool
+	// admissionWindow is the number of admitted keys whose admission time is
+	// tracked.
+	admissionWindow int
+	// admittedAt is the admission time of the tracked keys. It's only used by
+	// processItems, or while it's stopped, and it's kept when it restarts.
+	admittedAt map[uint64]time.Time
+	// callsMu protects calls.
+	callsMu sync.Mutex
+	// calls are the in-flight GetOrSet computations, by key hash.
+	calls map[uint64]*computeCall
+	// refreshAhead, refreshTTL and loader refresh the values about to expire.
+	refreshAhead time.Duration
+	refreshTTL   time.Duration
+	loader       func(key uint64) (any, int64, error)
+	// refreshMu protects refreshing.
+	refreshMu sync.Mutex
+	// refreshing are the key hashes of the in-flight refreshes.
+	refreshing map[uint64]struct{}
 	// Metrics contains a running log of important statistics like hits, misses,
 	// and dropped items.
 	Metrics *Metrics
@@ -106,29 +198,100 @@ type Config struct {
 	// eviction process will take care of making room for the new item and not
 	// overflowing the MaxCost value.
 	MaxCost int64
+	// MaxEntries bounds the number of entries of the cache, independently of
+	// MaxCost: the least frequently used entries are evicted when adding an
+	// entry would go over either limit, whichever is reached first. This is
+	// useful when the number of values matters more than their cost, e.g.
+	// when they hold handles. Zero means no limit.
+	MaxEntries int64
 	// BufferItems determines the size of Get buffers.
 	//
 	// Unless you have a rare use case, using `64` as the BufferItems value
 	// results in good performance.
 	BufferItems int64
+	// SetBufferSize determines how many Sets can be buffered until they are
+	// applied in the background. Sets are dropped while the buffer is full, so
+	// a larger buffer absorbs larger bursts of Sets. Zero means the default of
+	// 32768.
+	SetBufferSize int
+	// AdmissionWindow bounds how many of the most recently admitted keys have
+	// their admission time tracked, which is only done if Metrics is set.
+	// Zero means the default of 100000.
+	AdmissionWindow int
+	// TrackHotKeys is the number of most accessed keys to track, as estimated
+	// from the Gets, to be returned by HotKeys. Zero means that they aren't
+	// tracked, which avoids the overhead.
+	TrackHotKeys int
 	// Metrics determines whether cache statistics are kept during the cache's
 	// lifetime. There *is* some overhead to keeping statistics, so you should
 	// only set this flag to true when testing or throughput performance isn't a
 	// major factor.
 	Metrics bool
+	// RatioWindow is how far back WindowedRatio can look, which is only
+	// tracked if Metrics is set. Zero means the default of one minute.
+	RatioWindow time.Duration
+	// RatioBucket is the granularity of WindowedRatio: the hits and misses
+	// are counted by buckets of this duration. Zero means the default of one
+	// second.
+	RatioBucket time.Duration
 	// OnEvict is called for every eviction and passes the hashed key, value,
-	// and cost to the function.
+	// and cost to the function, as well as the reason of the eviction: the
+	// items removed because they expired or by Clear and ReplaceAll are
+	// evicted too, but explicit deletes aren't. It's called by the goroutine
+	// that admits the items, so a slow OnEvict slows down the cache; see
+	// EvictChan.
 	OnEvict func(item *Item)
-	// OnReject is called for every rejection done via the policy.
+	// EvictChan is an alternative to OnEvict, which can't be set with it: every
+	// eviction is sent to it without blocking, to be handled by other
+	// goroutines. An eviction is dropped if the channel is full at the time,
+	// and counted in Metrics.EvictsDropped; OnExit is still called for it.
+	EvictChan chan<- *Item
+	// OnReject is called for every rejection done via the policy, with a
+	// Reason of EvictRejected.
 	OnReject func(item *Item)
+	// OnAdmit is called for every item admitted via the policy, with its key
+	// hash, value and cost, e.g. to mirror the keys in the cache into an
+	// external index. It's not called when the value of an admitted key is
+	// updated, unless OnAdmitUpdates is set.
+	OnAdmit func(item *Item)
+	// OnAdmitUpdates makes OnAdmit also be called when the value or the cost
+	// of a key in the cache is updated.
+	OnAdmitUpdates bool
 	// OnExit is called whenever a value is removed from cache. This can be
 	// used to do manual memory deallocation. Would also be called on eviction
 	// and rejection of the value.
 	OnExit func(val any)
+	// OnClear is called once at the end of every Clear, after the cache is
+	// emptied. This can be used to wipe anything mirroring the cache contents,
+	// instead of relying on OnEvict and OnExit, which are only called for the
+	// items that have a value.
+	OnClear func()
 	// KeyToHash function is used to customize the key hashing algorithm.
 	// Each key will be hashed using the provided function. If keyToHash value
 	// is not set, the default keyToHash function is used.
 	KeyToHash func(string) (uint64, uint64)
+	// HashSeeds are the seeds of the key hash and the conflict hash of the
+	// default KeyToHash function, e.g. to get reproducible hashes in tests.
+	// They can't be set along with KeyToHash. Zero means the default seeds.
+	HashSeeds [2]uint64
+	// Clock is used to read the current time when setting, checking and
+	// purging the expiration of the items, so tests can control when they
+	// expire. It's the system clock by default. The rate limiting of
+	// MaxSetsPerSecond always uses the system clock, since it sleeps.
+	Clock Clock
+	// RefreshAhead is how long before their expiration the values are
+	// refreshed: a Get of a value that expires sooner returns it, and reloads
+	// it in the background with Loader, one reload per key at a time. Zero
+	// means that the values are never refreshed.
+	RefreshAhead time.Duration
+	// Loader loads the value of the given key hash and its cost, which is
+	// evaluated by the Cost function if it's 0, to refresh it. If it returns
+	// an error, the value is left as is until it expires. It must be set
+	// along with RefreshAhead.
+	Loader func(key uint64) (any, int64, error)
+	// RefreshTTL is the TTL of the values reloaded by Loader. It must be set
+	// along with RefreshAhead.
+	RefreshTTL time.Duration
 	// Cost evaluates a value and outputs a corresponding cost. This function
 	// is ran after Set is called for a new item or an item update with a cost
 	// param of 0.
@@ -138,6 +301,29 @@ type Config struct {
 	// cost passed to set is not using bytes as units. Keep in mind that setting
 	// this to true will increase the memory usage.
 	IgnoreInternalCost bool
+	// WriteThrough is called synchronously by Set and SetWithCost before the
+	// item is buffered, to persist it to a backing store. If it returns an
+	// error, the Set fails unless WriteThroughFailOpen is set. The item can
+	// still be dropped or rejected by the policy after being written through.
+	WriteThrough func(key string, value any, cost int64) error
+	// DeleteThrough is called synchronously by Delete before the item is
+	// removed, to remove it from the backing store. If it returns an error,
+	// the item is kept in the cache unless WriteThroughFailOpen is set.
+	DeleteThrough func(key string) error
+	// WriteThroughFailOpen set to true indicates to the cache that errors from
+	// WriteThrough and DeleteThrough should be ignored, and the cache updated
+	// anyway. By default the cache is left untouched, so that it doesn't get
+	// out of sync with the backing store.
+	WriteThroughFailOpen bool
+	// MaxSetsPerSecond limits how many Set and SetWithCost calls per second go
+	// through, e.g. to protect the WriteThrough backing store. Sets over the
+	// limit are dropped, and counted in Metrics.SetsLimited, unless
+	// BlockSetsOverLimit is set. The writes the cache does on its own, such
+	// as the restore of WithOverride, aren't limited. Zero means no limit.
+	MaxSetsPerSecond int
+	// BlockSetsOverLimit set to true indicates to the cache that sets over
+	// MaxSetsPerSecond should wait for their turn instead of being dropped.
+	BlockSetsOverLimit bool
 }
 
 type itemFlag byte
@@ -146,6 +332,11 @@ const (
 	itemNew itemFlag = iota
 	itemDelete
 	itemUpdate
+	// itemDeleteBatch deletes all the items in Item.batch.
+	itemDeleteBatch
+	// itemNewStored adds an item whose value is already in the store to the
+	// policy, see Increment.
+	itemNewStored
 )
 
 // Item is passed to setBuf so items can eventually be added to the cache.
@@ -155,7 +346,63 @@ type Item struct {
 	Conflict uint64
 	Value    any
 	Cost     int64
-	wg       *sync.WaitGroup
+	// Expiration is when the item expires, or zero if it never does.
+	Expiration time.Time
+	// Reason is why the item is passed to OnEvict, OnReject or EvictChan.
+	Reason EvictReason
+	// wait is closed once the item is reached in setBuf, for Wait.
+	wait chan struct{}
+	// batch holds the keys of an itemDeleteBatch.
+	batch []*Item
+}
+
+// EvictReason is why an item was removed from the cache.
+type EvictReason int
+
+const (
+	// EvictCapacity is for an item evicted by the policy to make room for
+	// others. It's the zero value, so it's the reason of Items that were
+	// built without one.
+	EvictCapacity EvictReason = iota
+	// EvictExpired is for an item whose TTL passed.
+	EvictExpired
+	// EvictDeleted is for an item removed by Clear, or a pending set discarded
+	// by Clear or ReplaceAll.
+	EvictDeleted
+	// EvictRejected is for an item that the admission policy didn't admit.
+	EvictRejected
+	// EvictReplaced is for an old item removed by ReplaceAll.
+	EvictReplaced
+)
+
+// String returns the name of the reason.
+func (r EvictReason) String() string {
+	switch r {
+	case EvictCapacity:
+		return "capacity"
+	case EvictExpired:
+		return "expired"
+	case EvictDeleted:
+		return "deleted"
+	case EvictRejected:
+		return "rejected"
+	case EvictReplaced:
+		return "replaced"
+	}
+	return fmt.Sprintf("EvictReason(%d)", int(r))
+}
+
+// Entry is an item of the cache as seen by the eviction policy.
+type Entry struct {
+	// Key is only used to pass entries to ReplaceAll; the entries returned by
+	// the cache leave it empty, since the cache doesn't keep the keys.
+	Key string
+	// KeyHash is the hash of the key, since the cache doesn't keep the keys.
+	KeyHash uint64
+	Value   any
+	Cost    int64
+	// Hits is the access frequency estimated by the policy.
+	Hits int64
 }
 
 // NewCache returns a new Cache instance and any configuration errors, if any.
@@ -167,40 +414,126 @@ func NewCache(config *Config) (*Cache, error) {
 		return nil, errors.New("Capacity can't be zero")
 	case config.BufferItems == 0:
 		return nil, errors.New("BufferItems can't be zero")
+	case config.SetBufferSize < 0:
+		return nil, errors.New("SetBufferSize can't be negative")
+	case config.AdmissionWindow < 0:
+		return nil, errors.New("AdmissionWindow can't be negative")
+	case config.OnEvict != nil && config.EvictChan != nil:
+		return nil, errors.New("OnEvict and EvictChan can't both be set")
+	case config.MaxSetsPerSecond < 0:
+		return nil, errors.New("MaxSetsPerSecond can't be negative")
+	case config.MaxEntries < 0:
+		return nil, errors.New("MaxEntries can't be negative")
+	case config.TrackHotKeys < 0:
+		return nil, errors.New("TrackHotKeys can't be negative")
+	case config.KeyToHash != nil && config.HashSeeds != [2]uint64{}:
+		return nil, errors.New("KeyToHash and HashSeeds can't both be set")
+	case config.RatioWindow < 0 || config.RatioBucket < 0:
+		return nil, errors.New("RatioWindow and RatioBucket can't be negative")
+	case config.RefreshAhead < 0:
+		return nil, errors.New("RefreshAhead can't be negative")
+	case config.RefreshAhead > 0 && (config.Loader == nil || config.RefreshTTL <= 0):
+		return nil, errors.New("RefreshAhead requires a Loader and a positive RefreshTTL")
+	}
+	ratioWindow, ratioBucket := defaultRatioWindow, defaultRatioBucket
+	if config.RatioWindow > 0 {
+		ratioWindow = config.RatioWindow
+	}
+	if config.RatioBucket > 0 {
+		ratioBucket = config.RatioBucket
+	}
+	if ratioBucket > ratioWindow {
+		return nil, errors.New("RatioBucket can't be longer than RatioWindow")
 	}
 	policy := newPolicy(config.NumCounters, config.MaxCost)
+	if config.MaxEntries > 0 {
+		policy.UpdateMaxEntries(config.MaxEntries)
+	}
+	if config.TrackHotKeys > 0 {
+		policy.TrackHotKeys(config.TrackHotKeys)
+	}
+	bufSize := setBufSize
+	if config.SetBufferSize > 0 {
+		bufSize = config.SetBufferSize
+	}
+	admissionWindow := defaultAdmissionWindow
+	if config.AdmissionWindow > 0 {
+		admissionWindow = config.AdmissionWindow
+	}
 	cache := &Cache{
-		store:              newStore(),
-		policy:             policy,
-		getBuf:             newRingBuffer(policy, config.BufferItems),
-		setBuf:             make(chan *Item, setBufSize),
-		keyToHash:          config.KeyToHash,
-		stop:               make(chan struct{}),
-		cost:               config.Cost,
-		ignoreInternalCost: config.IgnoreInternalCost,
+		store:                newStore(),
+		policy:               policy,
+		getBuf:               newRingBuffer(policy, config.BufferItems),
+		setBuf:               make(chan *Item, bufSize),
+		admissionWindow:      admissionWindow,
+		admittedAt:           make(map[uint64]time.Time),
+		keyToHash:            config.KeyToHash,
+		stop:                 make(chan struct{}),
+		onClear:              config.OnClear,
+		cost:                 config.Cost,
+		ignoreInternalCost:   config.IgnoreInternalCost,
+		writeThrough:         config.WriteThrough,
+		deleteThrough:        config.DeleteThrough,
+		writeThroughFailOpen: config.WriteThroughFailOpen,
+		blockSetsOverLimit:   config.BlockSetsOverLimit,
+		calls:                make(map[uint64]*computeCall),
+		refreshAhead:         config.RefreshAhead,
+		refreshTTL:           config.RefreshTTL,
+		loader:               config.Loader,
+		refreshing:           make(map[uint64]struct{}),
+	}
+	if config.MaxSetsPerSecond > 0 {
+		cache.setLimiter = newSetLimiter(config.MaxSetsPerSecond)
 	}
 	cache.onExit = func(val any) {
-		if config.OnExit != nil && val != nil {
+		if config.OnExit != nil && userValue(val) != nil {
 			config.OnExit(val)
 		}
 	}
 	cache.onEvict = func(item *Item) {
+		item.Value = userValue(item.Value)
 		if config.OnEvict != nil {
 			config.OnEvict(item)
 		}
+		if config.EvictChan != nil {
+			select {
+			case config.EvictChan <- item:
+			default:
+				cache.Metrics.add(dropEvicts, item.Key, 1)
+			}
+		}
 		cache.onExit(item.Value)
 	}
 	cache.onReject = func(item *Item) {
+		item.Reason = EvictRejected
+		item.Value = userValue(item.Value)
 		if config.OnReject != nil {
 			config.OnReject(item)
 		}
 		cache.onExit(item.Value)
 	}
+	cache.onAdmit = func(item *Item) {
+		if config.OnAdmit != nil {
+			item.Value = userValue(item.Value)
+			config.OnAdmit(item)
+		}
+	}
+	cache.onAdmitUpdates = config.OnAdmitUpdates
+	cache.clock = config.Clock
+	if cache.clock == nil {
+		cache.clock = wallClock{}
+	}
+	cache.store.SetClock(cache.clock)
 	if cache.keyToHash == nil {
-		cache.keyToHash = defaultStringHash
+		if config.HashSeeds != [2]uint64{} {
+			cache.keyToHash = seededStringHash(config.HashSeeds)
+		} else {
+			cache.keyToHash = defaultStringHash
+		}
 	}
 	if config.Metrics {
 		cache.collectMetrics()
+		cache.Metrics.window = newRatioWindow(cache.clock, ratioWindow, ratioBucket)
 	}
 	// NOTE: benchmarks seem to show that performance decreases the more
 	//       goroutines we have running cache.processItems(), so 1 should
@@ -214,15 +547,52 @@ func (c *Cache) Wait() {
 	if c == nil || c.isClosed.Load() {
 		return
 	}
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	c.setBuf <- &Item{wg: wg}
-	wg.Wait()
+	wait := make(chan struct{})
+	c.setBuf <- &Item{wait: wait}
+	<-wait
+}
+
+// WaitErr works like Wait, but returns ErrCacheClosed instead of returning
+// right away if the cache is closed, so that a Wait after Close can be told
+// apart from a Wait that let the operations be processed.
+func (c *Cache) WaitErr() error {
+	if c == nil || c.isClosed.Load() {
+		return ErrCacheClosed
+	}
+	c.Wait()
+	return nil
+}
+
+// WaitWithContext works like Wait, but gives up waiting when ctx is done and
+// returns its error. Like WaitErr, it returns ErrCacheClosed right away if the
+// cache is closed.
+func (c *Cache) WaitWithContext(ctx context.Context) error {
+	if c == nil || c.isClosed.Load() {
+		return ErrCacheClosed
+	}
+	return c.waitContext(ctx)
+}
+
+// waitContext implements WaitWithContext, once the cache was checked to be
+// open.
+func (c *Cache) waitContext(ctx context.Context) error {
+	wait := make(chan struct{})
+	select {
+	case c.setBuf <- &Item{wait: wait}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-wait:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Get returns the value (if any) and a boolean representing whether the
 // value was found or not. The value can be nil and the boolean can be true at
-// the same time.
+// the same time, e.g. for a negative stored by SetNegative.
 func (c *Cache) Get(key string) (any, bool) {
 	if c == nil || c.isClosed.Load() {
 		return nil, false
@@ -230,14 +600,223 @@ func (c *Cache) Get(key string) (any, bool) {
 	keyHash, conflictHash := c.keyToHash(key)
 	c.getBuf.Push(keyHash)
 	value, ok := c.store.Get(keyHash, conflictHash)
+	value = userValue(value)
 	if ok {
 		c.Metrics.add(hit, keyHash, 1)
+		if c.refreshAhead > 0 {
+			c.refreshIfExpiring(keyHash, conflictHash)
+		}
 	} else {
 		c.Metrics.add(miss, keyHash, 1)
+		if c.hasTTL.Load() {
+			c.purgeExpired(keyHash, conflictHash)
+		}
 	}
 	return value, ok
 }
 
+// refreshIfExpiring reloads the value of the key hash in the background if it
+// expires within refreshAhead, unless it's already being reloaded.
+func (c *Cache) refreshIfExpiring(keyHash, conflictHash uint64) {
+	expiration, ok := c.store.Expiration(keyHash, conflictHash)
+	if !ok || expiration.IsZero() || expiration.Sub(c.clock.Now()) >= c.refreshAhead {
+		return
+	}
+	c.refreshMu.Lock()
+	if _, ok := c.refreshing[keyHash]; ok {
+		c.refreshMu.Unlock()
+		return
+	}
+	c.refreshing[keyHash] = struct{}{}
+	c.refreshMu.Unlock()
+
+	go func() {
+		defer func() {
+			c.refreshMu.Lock()
+			delete(c.refreshing, keyHash)
+			c.refreshMu.Unlock()
+		}()
+		value, cost, err := c.loader(keyHash)
+		if err != nil || c.isClosed.Load() {
+			return
+		}
+		// The value is updated as with Set, but not written through since it
+		// was just loaded, and not added back if it was deleted meanwhile.
+		i := &Item{
+			flag:       itemUpdate,
+			Key:        keyHash,
+			Conflict:   conflictHash,
+			Value:      value,
+			Cost:       cost,
+			Expiration: c.clock.Now().Add(c.refreshTTL),
+		}
+		if prev, ok := c.store.Update(i); ok {
+			c.onExit(prev)
+			select {
+			case c.setBuf <- i:
+			default:
+			}
+		}
+	}()
+}
+
+// GetWithCost works like Get, and also returns the cost the policy recorded
+// for the value, including CacheItemSize unless IgnoreInternalCost is set. The
+// cost of a pending update is only recorded once it's applied, and the cost
+// of a value that isn't admitted yet, such as one just added by Increment, is
+// 0.
+func (c *Cache) GetWithCost(key string) (any, int64, bool) {
+	value, ok := c.Get(key)
+	if !ok {
+		return nil, 0, false
+	}
+	keyHash, _ := c.keyToHash(key)
+	return value, max(c.policy.Cost(keyHash), 0), true
+}
+
+// GetMulti works like Get for many keys at once, with less overhead than
+// calling Get for each of them. The returned map only has the keys that were
+// found, so a key with a nil value can be told apart from a missing key.
+func (c *Cache) GetMulti(keys []string) map[string]any {
+	if c == nil || c.isClosed.Load() {
+		return nil
+	}
+	keyHashes := make([]uint64, len(keys))
+	conflictHashes := make([]uint64, len(keys))
+	for i, key := range keys {
+		keyHashes[i], conflictHashes[i] = c.keyToHash(key)
+	}
+	c.getBuf.PushMany(keyHashes)
+
+	values := make(map[string]any, len(keys))
+	for i, key := range keys {
+		value, ok := c.store.Get(keyHashes[i], conflictHashes[i])
+		if ok {
+			c.Metrics.add(hit, keyHashes[i], 1)
+			values[key] = userValue(value)
+		} else {
+			c.Metrics.add(miss, keyHashes[i], 1)
+			if c.hasTTL.Load() {
+				c.purgeExpired(keyHashes[i], conflictHashes[i])
+			}
+		}
+	}
+	return values
+}
+
+// Peek works like Get, but doesn't count as an access of the key, so it doesn't
+// affect which keys are admitted or evicted, nor the hits and misses metrics.
+func (c *Cache) Peek(key string) (any, bool) {
+	if c == nil || c.isClosed.Load() {
+		return nil, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	value, ok := c.store.Get(keyHash, conflictHash)
+	return userValue(value), ok
+}
+
+// Has returns whether the key is in the cache and hasn't expired. Like Peek,
+// it doesn't count as an access of the key.
+func (c *Cache) Has(key string) bool {
+	_, ok := c.Peek(key)
+	return ok
+}
+
+// GetTTL returns the time left until the key-value pair expires and a boolean
+// representing whether the key was found and hasn't expired. The duration is
+// zero for a key-value pair that never expires. Unlike Get, GetTTL doesn't
+// count as an access of the key, so it doesn't affect which keys are evicted.
+func (c *Cache) GetTTL(key string) (time.Duration, bool) {
+	if c == nil || c.isClosed.Load() {
+		return 0, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	expiration, ok := c.store.Expiration(keyHash, conflictHash)
+	if !ok {
+		return 0, false
+	}
+	if expiration.IsZero() {
+		return 0, true
+	}
+	ttl := expiration.Sub(c.clock.Now())
+	if ttl <= 0 {
+		// The key-value pair expired since it was looked up.
+		return 0, false
+	}
+	return ttl, true
+}
+
+// purgeExpired deletes the item with the given key if it has expired.
+func (c *Cache) purgeExpired(keyHash, conflictHash uint64) {
+	prev, ok := c.store.DelExpired(keyHash, conflictHash)
+	if !ok {
+		return
+	}
+	c.onEvict(&Item{Key: keyHash, Conflict: conflictHash, Value: prev, Reason: EvictExpired})
+	// Keep the policy in sync, see Delete. Get shouldn't block, so if the set
+	// buffer is full the item stays in the policy until it's evicted.
+	select {
+	case c.setBuf <- &Item{flag: itemDelete, Key: keyHash, Conflict: conflictHash}:
+	default:
+	}
+}
+
+// computeCall is an in-flight GetOrSet computation.
+type computeCall struct {
+	conflict uint64
+	done     sync.WaitGroup
+	value    any
+	err      error
+}
+
+// GetOrSet returns the value of the key if it's in the cache. Otherwise it
+// calls compute and adds the value it returns to the cache with the given cost,
+// which is evaluated lazily by the Cost function if it's 0, as with
+// SetWithCost. Concurrent calls of GetOrSet for the same key only call compute
+// once: the others wait for it and return the same value. An error of compute
+// is returned to all of them, and nothing is added to the cache.
+func (c *Cache) GetOrSet(key string, cost int64, compute func() (any, error)) (any, error) {
+	if c == nil || c.isClosed.Load() {
+		return nil, ErrCacheClosed
+	}
+	if value, ok := c.Get(key); ok {
+		return value, nil
+	}
+
+	keyHash, conflictHash := c.keyToHash(key)
+	c.callsMu.Lock()
+	call, inFlight := c.calls[keyHash]
+	if inFlight && call.conflict == conflictHash {
+		c.callsMu.Unlock()
+		call.done.Wait()
+		return call.value, call.err
+	}
+	call = &computeCall{conflict: conflictHash, err: errComputePanicked}
+	call.done.Add(1)
+	// If a different key with the same hash is being computed, this one is
+	// computed without being shared.
+	shared := !inFlight
+	if shared {
+		c.calls[keyHash] = call
+	}
+	c.callsMu.Unlock()
+
+	defer func() {
+		if shared {
+			c.callsMu.Lock()
+			delete(c.calls, keyHash)
+			c.callsMu.Unlock()
+		}
+		call.done.Done()
+	}()
+	call.value, call.err = compute()
+	if call.err != nil {
+		return nil, call.err
+	}
+	c.SetWithCost(key, call.value, cost)
+	return call.value, nil
+}
+
 // Set attempts to add the key-value item to the cache. If it returns false,
 // then the Set was dropped and the key-value item isn't added to the cache. If
 // it returns true, there's still a chance it could be dropped by the policy if
@@ -253,17 +832,88 @@ func (c *Cache) Set(key string, value any) bool {
 // cost. The built-in Cost function will not be called to evaluate the object's cost
 // and instead the given value will be used.
 func (c *Cache) SetWithCost(key string, value any, cost int64) bool {
+	return c.set(context.Background(), key, value, cost, time.Time{}, false)
+}
+
+// SetNegative caches that the key has no value, e.g. that it wasn't found in
+// the backing store, for negTTL, which is usually shorter than the TTL of the
+// values to limit how long the negatives are stale. Get returns a nil value
+// and true for a negative, as it does for a nil value, and the callbacks are
+// passed a nil value for it. Its cost is 1, without calling the Cost function,
+// and it neither goes through WriteThrough nor counts for MaxSetsPerSecond,
+// since nothing is written.
+func (c *Cache) SetNegative(key string, negTTL time.Duration) bool {
+	return c.SetWithTTL(key, negativeValue{}, 1, negTTL)
+}
+
+// SetWithTTL works like SetWithCost but the key-value pair expires after ttl:
+// from then on Get treats it as missing and purges it, and ForEach skips it.
+// A ttl of zero or less means that the key-value pair never expires, as with
+// SetWithCost.
+func (c *Cache) SetWithTTL(key string, value any, cost int64, ttl time.Duration) bool {
 	if c == nil || c.isClosed.Load() {
 		return false
 	}
+	if ttl <= 0 {
+		return c.SetWithCost(key, value, cost)
+	}
+	c.hasTTL.Store(true)
+	return c.set(context.Background(), key, value, cost, c.clock.Now().Add(ttl), false)
+}
+
+// set adds the key-value pair to the cache, expiring at expiration unless it's
+// zero. Unless block is set, the set is dropped when the set buffer is full or,
+// unless BlockSetsOverLimit is set, when it goes over MaxSetsPerSecond.
+// Otherwise it waits for MaxSetsPerSecond and blocks until the item has been
+// sent to the policy, or until ctx is done.
+func (c *Cache) set(ctx context.Context, key string, value any, cost int64, expiration time.Time, block bool) bool {
+	if c == nil || c.isClosed.Load() {
+		return false
+	}
+
+	keyHash, conflictHash := c.keyToHash(key)
+	// A negative isn't a value to write, see SetNegative.
+	_, negative := value.(negativeValue)
+	if c.setLimiter != nil && !negative {
+		if c.blockSetsOverLimit || block {
+			if err := c.setLimiter.wait(ctx); err != nil {
+				return false
+			}
+		} else if !c.setLimiter.allow() {
+			c.Metrics.add(limitSets, keyHash, 1)
+			return false
+		}
+	}
+	if c.writeThrough != nil && !negative {
+		if err := c.writeThrough(key, value, cost); err != nil && !c.writeThroughFailOpen {
+			return false
+		}
+	}
+	return c.setItem(ctx, keyHash, conflictHash, value, cost, expiration, block)
+}
 
+// setInternal works like a blocking set for the writes the cache does
+// on its own, e.g. to restore a value: they are neither passed to WriteThrough
+// nor limited by MaxSetsPerSecond, and they wait for room in the set buffer
+// instead of being dropped.
+func (c *Cache) setInternal(key string, value any, cost int64, expiration time.Time) bool {
+	if c == nil || c.isClosed.Load() {
+		return false
+	}
 	keyHash, conflictHash := c.keyToHash(key)
+	return c.setItem(context.Background(), keyHash, conflictHash, value, cost, expiration, true)
+}
+
+// setItem stores the key-value pair and sends it to the policy, once set has
+// decided that it goes through.
+func (c *Cache) setItem(ctx context.Context, keyHash, conflictHash uint64, value any, cost int64, expiration time.Time, block bool) bool {
 	i := &Item{
-		flag:     itemNew,
-		Key:      keyHash,
-		Conflict: conflictHash,
-		Value:    value,
-		Cost:     cost,
+		flag:       itemNew,
+		Key:        keyHash,
+		Conflict:   conflictHash,
+		Value:      value,
+		Cost:       cost,
+		Expiration: expiration,
 	}
 	// cost is eventually updated. The expiration must also be immediately updated
 	// to prevent items from being prematurely removed from the map.
@@ -271,6 +921,15 @@ func (c *Cache) SetWithCost(key string, value any, cost int64) bool {
 		c.onExit(prev)
 		i.flag = itemUpdate
 	}
+	if block {
+		select {
+		case c.setBuf <- i:
+			return true
+		case <-ctx.Done():
+			// As below, the store has already been updated.
+			return i.flag == itemUpdate
+		}
+	}
 	// Attempt to send item to policy.
 	select {
 	case c.setBuf <- i:
@@ -287,12 +946,148 @@ func (c *Cache) SetWithCost(key string, value any, cost int64) bool {
 	}
 }
 
+// CompareAndSwap replaces the value of the key with newValue if its current value
+// is equal to oldValue, atomically, and returns whether it did. It fails if the
+// key is missing or expired. As with SetWithCost, a cost of 0 is evaluated by
+// the Cost function, and the new value never expires. Unlike Set, the swap isn't
+// subject to MaxSetsPerSecond and isn't passed to WriteThrough. As with
+// sync.Map.CompareAndSwap, oldValue must be of a comparable type.
+func (c *Cache) CompareAndSwap(key string, oldValue, newValue any, cost int64) bool {
+	return c.CompareAndSwapFunc(key, func(current any) bool {
+		return current == oldValue
+	}, newValue, cost)
+}
+
+// CompareAndSwapFunc works like CompareAndSwap, but the current value is
+// compared with the equal function, e.g. for values that aren't comparable.
+// The equal function is called with a shard of the store locked, so it must not
+// call the cache.
+func (c *Cache) CompareAndSwapFunc(key string, equal func(current any) bool, newValue any, cost int64) bool {
+	if c == nil || c.isClosed.Load() {
+		return false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	i := &Item{
+		flag:     itemUpdate,
+		Key:      keyHash,
+		Conflict: conflictHash,
+		Value:    newValue,
+		Cost:     cost,
+	}
+	prev, ok := c.store.CompareAndUpdate(i, func(current any) bool {
+		return equal(userValue(current))
+	})
+	if !ok {
+		return false
+	}
+	c.onExit(prev)
+	// Update the cost in the policy. As with the updates of set, the swap is
+	// done even if the set buffer is full.
+	select {
+	case c.setBuf <- i:
+	default:
+	}
+	return true
+}
+
+// Increment atomically adds delta to the int64 value of the key and returns the
+// new value, e.g. to count events. A missing key is added with delta as its
+// value and the given cost, which is evaluated by the Cost function if it's 0,
+// as with SetWithCost; the cost of an existing key doesn't change. It returns
+// false if the value of the key isn't an int64.
+//
+// Unlike with Set, a missing key is stored at once, so that the increments that
+// follow add up while the policy decides whether to admit it, and Increment
+// waits for room in the set buffer to pass it to the policy.
+func (c *Cache) Increment(key string, delta int64, cost int64) (int64, bool) {
+	if c == nil || c.isClosed.Load() {
+		return 0, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	value, prev, added, ok := c.store.Increment(keyHash, conflictHash, delta)
+	if !ok {
+		return 0, false
+	}
+	if added {
+		c.onExit(prev)
+		c.setBuf <- &Item{
+			flag:     itemNewStored,
+			Key:      keyHash,
+			Conflict: conflictHash,
+			Value:    value,
+			Cost:     cost,
+		}
+	}
+	return value, true
+}
+
+// SetIfAbsent adds the key-value pair with the given cost unless the key is
+// already in the cache, and returns whether it did, e.g. so that concurrent
+// fills of a cache-aside don't overwrite each other. The check and the
+// addition are atomic, and a present value is left untouched, along with the
+// metrics. As with Increment, the value is stored at once and then passed to
+// the policy, which may still reject it, waiting for room in the set buffer;
+// the cost is evaluated by the Cost function if it's 0.
+func (c *Cache) SetIfAbsent(key string, value any, cost int64) bool {
+	if c == nil || c.isClosed.Load() {
+		return false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	prev, ok := c.store.SetIfAbsent(&Item{
+		Key:      keyHash,
+		Conflict: conflictHash,
+		Value:    value,
+	})
+	if !ok {
+		return false
+	}
+	c.onExit(prev)
+	c.setBuf <- &Item{
+		flag:     itemNewStored,
+		Key:      keyHash,
+		Conflict: conflictHash,
+		Value:    value,
+		Cost:     cost,
+	}
+	return true
+}
+
+// UpdateCost updates the cost of a value in the cache without replacing it,
+// e.g. for a value that grew in place. CacheItemSize is added to the cost
+// unless IgnoreInternalCost is set, as with Set. It returns false if the key
+// isn't in the cache, or wasn't admitted yet. As with the updates done by Set,
+// a higher cost doesn't evict anything by itself: the values that no longer
+// fit are evicted when the next ones are added.
+func (c *Cache) UpdateCost(key string, newCost int64) bool {
+	if c == nil || c.isClosed.Load() {
+		return false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	if _, ok := c.store.Get(keyHash, conflictHash); !ok {
+		return false
+	}
+	if !c.ignoreInternalCost {
+		newCost += CacheItemSize
+	}
+	return c.policy.Update(keyHash, newCost)
+}
+
 // Delete deletes the key-value item from the cache if it exists.
 func (c *Cache) Delete(key string) {
 	if c == nil || c.isClosed.Load() {
 		return
 	}
-	keyHash, conflictHash := c.keyToHash(key)
+	if c.deleteThrough != nil {
+		if err := c.deleteThrough(key); err != nil && !c.writeThroughFailOpen {
+			return
+		}
+	}
+	c.del(c.keyToHash(key))
+}
+
+// del deletes the key-value item with the given hashes from the store and the
+// policy, without going through DeleteThrough.
+func (c *Cache) del(keyHash, conflictHash uint64) {
 	// Delete immediately.
 	_, prev := c.store.Del(keyHash, conflictHash)
 	c.onExit(prev)
@@ -307,6 +1102,257 @@ func (c *Cache) Delete(key string) {
 	}
 }
 
+// DeleteMulti works like Delete for many keys at once. The keys are deleted
+// from the policy in the background with a single operation, which waits for
+// room in the buffer of pending operations, as Delete does, so that the Sets of
+// the keys that are still pending are applied before it.
+func (c *Cache) DeleteMulti(keys []string) {
+	if c == nil || c.isClosed.Load() {
+		return
+	}
+	batch := make([]*Item, 0, len(keys))
+	for _, key := range keys {
+		if c.deleteThrough != nil {
+			if err := c.deleteThrough(key); err != nil && !c.writeThroughFailOpen {
+				continue
+			}
+		}
+		keyHash, conflictHash := c.keyToHash(key)
+		_, prev := c.store.Del(keyHash, conflictHash)
+		c.onExit(prev)
+		batch = append(batch, &Item{Key: keyHash, Conflict: conflictHash})
+	}
+	if len(batch) == 0 {
+		return
+	}
+	// Keep the policy in sync, see Delete.
+	c.setBuf <- &Item{flag: itemDeleteBatch, batch: batch}
+}
+
+// DeleteIf deletes all the key-value items whose value matches the predicate,
+// e.g. all the values of a tenant. It scans the whole store, so it's O(n) in
+// the number of cached items, and it isn't atomic: an item that is set while
+// it runs may or may not be deleted. The predicate is called with a shard of
+// the store locked, so it must not call the cache.
+func (c *Cache) DeleteIf(predicate func(value any) bool) {
+	if c == nil || c.isClosed.Load() {
+		return
+	}
+	deleted := c.store.DelIf(func(i *Item) bool {
+		return predicate(userValue(i.Value))
+	})
+	if len(deleted) == 0 {
+		return
+	}
+	for _, i := range deleted {
+		c.onExit(i.Value)
+	}
+	// Keep the policy in sync, see Delete.
+	c.setBuf <- &Item{flag: itemDeleteBatch, batch: deleted}
+}
+
+// DeleteHashRange deletes all the key-value items whose key hash is in [lo, hi]
+// and returns how many were deleted. This allows invalidating a whole range of
+// the hash space, e.g. when a shard is migrated, without tracking its keys.
+// It scans the whole store, so it's O(n) in the number of cached items.
+func (c *Cache) DeleteHashRange(lo, hi uint64) int {
+	if c == nil || c.isClosed.Load() {
+		return 0
+	}
+	deleted := c.store.DelIf(func(i *Item) bool {
+		return lo <= i.Key && i.Key <= hi
+	})
+	for _, i := range deleted {
+		c.onExit(i.Value)
+		// Keep the policy in sync, see Delete.
+		c.setBuf <- &Item{
+			flag:     itemDelete,
+			Key:      i.Key,
+			Conflict: i.Conflict,
+		}
+	}
+	return len(deleted)
+}
+
+// WithOverride stores temp under key with the given cost while fn runs, and then
+// restores the value the key had before the call with its original cost and
+// expiration, or deletes the key if it had no value or expired in the meantime. It
+// returns whether there was an original value to restore. The original value is
+// restored even if fn panics.
+//
+// The override only changes the cache: neither the temporary value nor the
+// restore are passed to WriteThrough or DeleteThrough, or limited by
+// MaxSetsPerSecond, and they wait for room in the set buffer instead of being
+// dropped. If the restore can't be applied, the key is deleted rather than left
+// with the temporary value.
+//
+// The override is not isolated from other goroutines: any concurrent access to key
+// while fn runs sees the temporary value. As with Set, the temporary value can still
+// be rejected by the policy.
+func (c *Cache) WithOverride(key string, temp any, cost int64, fn func()) (restored bool) {
+	if c == nil || c.isClosed.Load() {
+		fn()
+		return false
+	}
+
+	// Make sure pending sets for key have been applied, so that the value and the
+	// cost we save are the latest ones.
+	c.Wait()
+	keyHash, conflictHash := c.keyToHash(key)
+	prev, restored := c.store.Get(keyHash, conflictHash)
+	var prevCost int64
+	var prevExpiration time.Time
+	if restored {
+		prevExpiration, restored = c.store.Expiration(keyHash, conflictHash)
+	}
+	if restored {
+		prevCost = c.policy.Cost(keyHash)
+		if prevCost < 0 {
+			prevCost = 0
+		} else if !c.ignoreInternalCost {
+			// setItem adds the internal cost again.
+			prevCost -= CacheItemSize
+		}
+	}
+
+	defer func() {
+		// Keep the original expiration, unless it passed while fn ran.
+		if restored && (prevExpiration.IsZero() || c.clock.Now().Before(prevExpiration)) &&
+			c.setInternal(key, prev, prevCost, prevExpiration) {
+			return
+		}
+		if !c.isClosed.Load() {
+			c.del(keyHash, conflictHash)
+		}
+	}()
+
+	c.setInternal(key, temp, cost, time.Time{})
+	c.Wait()
+	fn()
+	return restored
+}
+
+// WarmUp adds to the cache the entries returned by next, until it returns false
+// or ctx is done, and returns how many entries were added. Unlike SetWithCost,
+// it waits for room in the set buffer and for MaxSetsPerSecond instead of
+// dropping entries, so it is meant to populate the cache on startup. As with
+// Set, the policy can still reject some of the entries.
+func (c *Cache) WarmUp(ctx context.Context, next func() (key string, value any, cost int64, ok bool)) (loaded int, err error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return loaded, err
+		}
+		if c == nil || c.isClosed.Load() {
+			return loaded, ErrCacheClosed
+		}
+		key, value, cost, ok := next()
+		if !ok {
+			return loaded, nil
+		}
+		if c.set(ctx, key, value, cost, time.Time{}, true) {
+			loaded++
+		}
+	}
+}
+
+// EvictionCandidates returns the entries the policy would evict to make room for
+// a new item of the given cost, without evicting anything, to help understand
+// the eviction decisions. The new item is assumed to be admitted. Since the
+// policy picks victims out of a random sample of the entries, consecutive calls
+// can return different candidates, but they are always among the least
+// frequently used entries of their sample.
+func (c *Cache) EvictionCandidates(cost int64) []Entry {
+	if c == nil || c.isClosed.Load() {
+		return nil
+	}
+	if !c.ignoreInternalCost {
+		// Add the cost of internally storing the object, as processItems does.
+		cost += CacheItemSize
+	}
+	candidates := c.policy.EvictionCandidates(cost)
+	for i := range candidates {
+		value, _ := c.store.Get(candidates[i].KeyHash, 0)
+		candidates[i].Value = userValue(value)
+	}
+	return candidates
+}
+
+// MergeHot adds the topN most frequently used entries of other to the cache,
+// hottest first and with their expiration, e.g. to seed a cache with a new
+// configuration from the one it replaces. The entries go through the admission
+// policy like Sets do, but not through WriteThrough and MaxSetsPerSecond, and
+// since the cache only keeps the hashes of the keys, both caches must use the
+// same KeyToHash. other is left untouched. MergeHot returns the number of
+// entries sent to the policy; call Wait to wait for them to be added.
+func (c *Cache) MergeHot(other *Cache, topN int) int {
+	if c == nil || c.isClosed.Load() || other == nil || other.isClosed.Load() || topN <= 0 {
+		return 0
+	}
+	merged := 0
+	for _, entry := range other.policy.Hottest(topN) {
+		conflict, value, ok := other.store.Lookup(entry.KeyHash)
+		if !ok {
+			// Evicted or deleted in the meantime.
+			continue
+		}
+		expiration, ok := other.store.Expiration(entry.KeyHash, conflict)
+		if !ok {
+			// Expired in the meantime.
+			continue
+		}
+		cost := entry.Cost
+		if !other.ignoreInternalCost {
+			// processItems adds the internal cost again.
+			cost -= CacheItemSize
+		}
+		i := &Item{
+			flag:       itemNew,
+			Key:        entry.KeyHash,
+			Conflict:   conflict,
+			Value:      value,
+			Cost:       cost,
+			Expiration: expiration,
+		}
+		if !expiration.IsZero() {
+			c.hasTTL.Store(true)
+		}
+		if prev, ok := c.store.Update(i); ok {
+			c.onExit(prev)
+			i.flag = itemUpdate
+		}
+		// Block instead of dropping the entry when the set buffer is full, as
+		// WarmUp does.
+		c.setBuf <- i
+		merged++
+	}
+	return merged
+}
+
+// SnapshotConsistent returns all the entries of the cache as of a single
+// point in time, with their cost as seen by the policy. Hits is not set.
+//
+// To do so, it waits for the pending sets to be processed, then pauses the
+// processing of sets while it copies the store, with all its shards locked.
+// This briefly stalls the cache: deletes and Wait can block until the copy is
+// done, and new sets are dropped once the set buffer is full, so it shouldn't
+// be called in a hot path.
+func (c *Cache) SnapshotConsistent() ([]Entry, error) {
+	if c == nil || c.isClosed.Load() {
+		return nil, ErrCacheClosed
+	}
+	c.Wait()
+	// Block until processItems goroutine is returned, as Clear does.
+	c.stop <- struct{}{}
+	entries := c.store.Snapshot()
+	// The policy doesn't change while processItems is stopped.
+	for i := range entries {
+		entries[i].Value = userValue(entries[i].Value)
+		entries[i].Cost = c.policy.Cost(entries[i].KeyHash)
+	}
+	go c.processItems()
+	return entries, nil
+}
+
 // Close stops all goroutines and closes all channels.
 func (c *Cache) Close() {
 	if c == nil {
@@ -317,10 +1363,30 @@ func (c *Cache) Close() {
 		return
 	}
 	c.Clear()
+	c.shutdown()
+}
 
+// CloseAndDrain works like Close, but first lets the pending operations be
+// processed, so that the last Sets aren't lost, e.g. before taking a final
+// Snapshot. The cache refuses the new operations as soon as it's called, as
+// it does once closed. If ctx is done before the pending operations are
+// processed, the cache is closed right away, as Close does, and the error of
+// ctx is returned. It returns ErrCacheClosed if the cache is already closed.
+func (c *Cache) CloseAndDrain(ctx context.Context) error {
+	if c == nil || c.isClosed.Swap(true) {
+		return ErrCacheClosed
+	}
+	defer c.shutdown()
+	return c.waitContext(ctx)
+}
+
+// shutdown stops all goroutines and closes all channels, once the cache is
+// marked as closed.
+func (c *Cache) shutdown() {
 	// Block until processItems goroutine is returned.
 	c.stop <- struct{}{}
 	close(c.stop)
+	c.releaseWaiters()
 	close(c.setBuf)
 	c.policy.Close()
 	c.isClosed.Store(true)
@@ -335,35 +1401,206 @@ func (c *Cache) Clear() {
 	}
 	// Block until processItems goroutine is returned.
 	c.stop <- struct{}{}
+	c.discardSetBuf()
+
+	// Clear value hashmap and policy data.
+	c.policy.Clear()
+	clear(c.admittedAt)
+	c.store.Clear(func(i *Item) {
+		i.Reason = EvictDeleted
+		c.onEvict(i)
+	})
+	// Only reset metrics if they're enabled.
+	if c.Metrics != nil {
+		c.Metrics.Clear()
+	}
+	// Restart processItems goroutine.
+	go c.processItems()
+	if c.onClear != nil {
+		c.onClear()
+	}
+}
+
+// Warm adds the given entries to the cache synchronously, e.g. to hydrate it
+// from a snapshot on startup. They go through the admission policy as with
+// Set, but not through the buffer of pending Sets, so none of them are
+// dropped. The cost of the values is computed by costFn, or by the Cost
+// function of the config if costFn is nil. It returns how many of the entries
+// are in the cache afterwards, since the ones that don't fit within the
+// capacity are rejected, or evicted by the next ones.
+//
+// The pending Sets aren't processed while Warm runs, so it's only meant to be
+// called before the cache is in use.
+func (c *Cache) Warm(entries map[string]any, costFn func(any) int64) int {
+	if c == nil || c.isClosed.Load() {
+		return 0
+	}
+	if costFn == nil {
+		costFn = c.cost
+	}
+	// Block until processItems goroutine is returned, as Clear does.
+	c.stop <- struct{}{}
+
+	warmed := make(map[uint64]struct{}, len(entries))
+	for key, value := range entries {
+		keyHash, conflictHash := c.keyToHash(key)
+		i := &Item{
+			flag:     itemNew,
+			Key:      keyHash,
+			Conflict: conflictHash,
+			Value:    value,
+		}
+		// Calculate the cost as processItems does.
+		if costFn != nil {
+			i.Cost = costFn(value)
+		}
+		if !c.ignoreInternalCost {
+			i.Cost += CacheItemSize
+		}
+		if c.policy.Has(i.Key) {
+			if prev, ok := c.store.Update(i); ok {
+				c.policy.Update(i.Key, i.Cost)
+				c.onExit(prev)
+				warmed[i.Key] = struct{}{}
+				if c.onAdmitUpdates {
+					c.onAdmit(i)
+				}
+			}
+			continue
+		}
+		victims, added := c.policy.Add(i.Key, i.Cost)
+		if added {
+			c.store.Set(i)
+			c.Metrics.add(keyAdd, i.Key, 1)
+			warmed[i.Key] = struct{}{}
+			c.onAdmit(i)
+		} else {
+			c.onReject(i)
+		}
+		for _, victim := range victims {
+			victim.Conflict, victim.Value = c.store.Del(victim.Key, 0)
+			delete(warmed, victim.Key)
+			c.onEvict(victim)
+		}
+	}
+	go c.processItems()
+	return len(warmed)
+}
+
+// ReplaceAll atomically replaces all the entries of the cache with the given
+// ones, e.g. to rebuild it from a snapshot of its source of truth. Readers see
+// either all the old entries or all the new ones, never a mix of both nor the
+// empty cache that Clear followed by Sets would expose in between.
+//
+// The entries are identified by their Key; KeyHash and Hits are ignored, and a
+// Cost of 0 is evaluated lazily by the Cost function, as with Set. If a key is
+// repeated, its last entry wins. The new entries go through the admission
+// policy, whose counters are reset, so the ones that don't fit in the cache are
+// rejected or evicted. The old entries are evicted, and the pending sets and
+// deletes are discarded, as in Clear.
+func (c *Cache) ReplaceAll(entries []Entry) error {
+	if c == nil || c.isClosed.Load() {
+		return ErrCacheClosed
+	}
+	// Block until processItems goroutine is returned, as Clear does.
+	c.stop <- struct{}{}
+	c.discardSetBuf()
+	c.policy.Clear()
+	clear(c.admittedAt)
+
+	last := make(map[uint64]int, len(entries))
+	for idx, entry := range entries {
+		keyHash, _ := c.keyToHash(entry.Key)
+		last[keyHash] = idx
+	}
+	admitted := make(map[uint64]*Item, len(last))
+	for idx, entry := range entries {
+		keyHash, conflictHash := c.keyToHash(entry.Key)
+		if last[keyHash] != idx {
+			continue
+		}
+		i := &Item{
+			flag:     itemNew,
+			Key:      keyHash,
+			Conflict: conflictHash,
+			Value:    entry.Value,
+			Cost:     entry.Cost,
+		}
+		// Calculate the cost as processItems does.
+		if i.Cost == 0 && c.cost != nil {
+			i.Cost = c.cost(i.Value)
+		}
+		if !c.ignoreInternalCost {
+			i.Cost += CacheItemSize
+		}
+		victims, added := c.policy.Add(i.Key, i.Cost)
+		if added {
+			admitted[i.Key] = i
+			c.Metrics.add(keyAdd, i.Key, 1)
+		} else {
+			c.onReject(i)
+		}
+		// The victims can only be new entries, since the policy was cleared.
+		for _, victim := range victims {
+			if evicted, ok := admitted[victim.Key]; ok {
+				delete(admitted, victim.Key)
+				c.onEvict(evicted)
+			}
+		}
+	}
+
+	items := make([]*Item, 0, len(admitted))
+	for _, i := range admitted {
+		items = append(items, i)
+	}
+	// The callbacks are only called once the store is unlocked.
+	for _, i := range c.store.Replace(items) {
+		i.Reason = EvictReplaced
+		c.onEvict(i)
+	}
+	for _, i := range items {
+		c.onAdmit(i)
+	}
+	go c.processItems()
+	return nil
+}
 
-	// Clear out the setBuf channel.
-loop:
+// discardSetBuf empties the setBuf channel while processItems is stopped,
+// releasing the callers of Wait and evicting the items that weren't added yet.
+func (c *Cache) discardSetBuf() {
 	for {
 		select {
 		case i := <-c.setBuf:
-			if i.wg != nil {
-				i.wg.Done()
+			if i.wait != nil {
+				close(i.wait)
 				continue
 			}
-			if i.flag != itemUpdate {
-				// In itemUpdate, the value is already set in the store.  So, no need to call
-				// onEvict here.
+			if i.flag != itemUpdate && i.flag != itemDeleteBatch && i.flag != itemNewStored {
+				// In itemUpdate and itemNewStored, the value is already set in the store.
+				// So, no need to call onEvict here. An itemDeleteBatch has no value at all.
+				i.Reason = EvictDeleted
 				c.onEvict(i)
 			}
 		default:
-			break loop
+			return
 		}
 	}
+}
 
-	// Clear value hashmap and policy data.
-	c.policy.Clear()
-	c.store.Clear(c.onEvict)
-	// Only reset metrics if they're enabled.
-	if c.Metrics != nil {
-		c.Metrics.Clear()
+// releaseWaiters releases the Wait and WaitWithContext calls whose items are
+// still in setBuf after processItems is stopped for good, and drops the other
+// items.
+func (c *Cache) releaseWaiters() {
+	for {
+		select {
+		case i := <-c.setBuf:
+			if i.wait != nil {
+				close(i.wait)
+			}
+		default:
+			return
+		}
 	}
-	// Restart processItems goroutine.
-	go c.processItems()
 }
 
 // Len returns the size of the cache (in entries)
@@ -374,6 +1611,40 @@ func (c *Cache) Len() int {
 	return c.store.Len()
 }
 
+// WindowedRatio returns the hit ratio of the Gets of the last window of time,
+// e.g. to notice that it dropped although the lifetime ratio of Metrics.Ratio
+// is still high. The window is rounded up to a whole number of RatioBucket,
+// and capped to the RatioWindow of the config. It returns 0 if there was no
+// Get in the window, or unless Metrics is set in the config.
+func (c *Cache) WindowedRatio(window time.Duration) float64 {
+	if c == nil || c.Metrics == nil || c.Metrics.window == nil {
+		return 0
+	}
+	return c.Metrics.window.ratio(window)
+}
+
+// LifespanHistogram returns how long the evicted keys were in the cache, as
+// Metrics.LifespanHistogram does, e.g. to tell whether the cache is too small
+// for the keys to stay long. It returns nil unless Metrics is set in the
+// config.
+func (c *Cache) LifespanHistogram() []Bucket {
+	if c == nil {
+		return nil
+	}
+	return c.Metrics.LifespanHistogram()
+}
+
+// ShardStats returns the number of entries in every shard of the store, and
+// how often the lock of every shard was contended, e.g. to tell whether the
+// keys are spread evenly. It returns nil unless Metrics is set in the config,
+// since counting the contention adds overhead to every lock.
+func (c *Cache) ShardStats() []ShardStat {
+	if c == nil || c.Metrics == nil {
+		return nil
+	}
+	return c.store.ShardStats()
+}
+
 // UsedCapacity returns the size of the cache (in bytes)
 func (c *Cache) UsedCapacity() int64 {
 	if c == nil {
@@ -390,6 +1661,39 @@ func (c *Cache) MaxCapacity() int64 {
 	return c.policy.MaxCost()
 }
 
+// FillRatio returns how full the cache is, as the ratio between its used and
+// max capacity. It can go over 1 while the cache shrinks after its capacity
+// was lowered, and is 0 if the cache has no capacity at all.
+func (c *Cache) FillRatio() float64 {
+	if c == nil {
+		return 0
+	}
+	maxCost := c.policy.MaxCost()
+	if maxCost <= 0 {
+		return 0
+	}
+	return float64(c.policy.Used()) / float64(maxCost)
+}
+
+// Headroom returns the capacity left in the cache, or 0 if the cache is full
+// or over its capacity.
+func (c *Cache) Headroom() int64 {
+	if c == nil {
+		return 0
+	}
+	return max(c.policy.MaxCost()-c.policy.Used(), 0)
+}
+
+// SetBufferPressure returns how full the buffer of pending Sets is, as a ratio
+// between 0 and 1. Sets are dropped while the buffer is full, so producers can
+// use it to slow down before that happens. It never blocks.
+func (c *Cache) SetBufferPressure() float64 {
+	if c == nil || c.isClosed.Load() {
+		return 0
+	}
+	return float64(len(c.setBuf)) / float64(cap(c.setBuf))
+}
+
 // SetCapacity updates the maxCost of an existing cache.
 func (c *Cache) SetCapacity(maxCost int64) {
 	if c == nil {
@@ -398,6 +1702,19 @@ func (c *Cache) SetCapacity(maxCost int64) {
 	c.policy.UpdateMaxCost(maxCost)
 }
 
+// ResizeCounters rebuilds the counters that estimate the access frequency of
+// the keys with the given number of counters, e.g. to follow a working set
+// that outgrew the NumCounters of the config. The entries of the cache are
+// kept, but their frequencies are reset, so the next admissions are decided
+// as if the keys had not been accessed yet. A number of counters that isn't
+// positive is ignored.
+func (c *Cache) ResizeCounters(numCounters int64) {
+	if c == nil || c.isClosed.Load() || numCounters <= 0 {
+		return
+	}
+	c.policy.UpdateNumCounters(numCounters)
+}
+
 // Evictions returns the number of evictions
 func (c *Cache) Evictions() int64 {
 	// TODO
@@ -429,30 +1746,109 @@ func (c *Cache) ForEach(forEach func(any) bool) {
 	if c == nil {
 		return
 	}
-	c.store.ForEach(forEach)
+	c.store.ForEach(func(value any) bool {
+		return forEach(userValue(value))
+	})
+}
+
+// ForEachKey works like ForEach, but also yields the key hash and the conflict
+// hash of every value, since the cache doesn't keep the keys. They are the
+// hashes of the keys, as computed by the KeyToHash function of the Config if
+// it's set.
+func (c *Cache) ForEachKey(forEach func(keyHash, conflictHash uint64, value any) bool) {
+	if c == nil {
+		return
+	}
+	c.store.ForEachKey(func(keyHash, conflictHash uint64, value any) bool {
+		return forEach(keyHash, conflictHash, userValue(value))
+	})
+}
+
+// HotKeys returns the most accessed keys, hottest first, up to the
+// TrackHotKeys of the config, or nil if it isn't set. The keys are tracked
+// from the Gets, including the misses, so they may not be in the cache. Their
+// hits are estimated, and decay over time as the other access frequencies do.
+func (c *Cache) HotKeys() []HotKey {
+	if c == nil || c.isClosed.Load() {
+		return nil
+	}
+	return c.policy.HotKeys()
+}
+
+// DebugDump writes a line for every value in the cache to w, with its key
+// hash, conflict hash, cost and remaining TTL, e.g. to inspect the cache while
+// debugging. The cost of a value that isn't admitted yet is -1. It walks the
+// whole store as ForEachKey does, so it's slow on large caches, and the values
+// set, deleted or expired during the walk may or may not be included. It
+// returns the first error of w.
+func (c *Cache) DebugDump(w io.Writer) error {
+	if c == nil {
+		return nil
+	}
+	type hashes struct {
+		keyHash, conflictHash uint64
+	}
+	var entries []hashes
+	c.store.ForEachKey(func(keyHash, conflictHash uint64, _ any) bool {
+		entries = append(entries, hashes{keyHash, conflictHash})
+		return true
+	})
+	// The costs and expirations are looked up once the store is unlocked.
+	for _, entry := range entries {
+		expiration, ok := c.store.Expiration(entry.keyHash, entry.conflictHash)
+		if !ok {
+			continue
+		}
+		ttl := "none"
+		if !expiration.IsZero() {
+			ttl = expiration.Sub(c.clock.Now()).String()
+		}
+		_, err := fmt.Fprintf(w, "key=%016x conflict=%016x cost=%d ttl=%s\n",
+			entry.keyHash, entry.conflictHash, c.policy.Cost(entry.keyHash), ttl)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeyHashes returns the key hashes of all the values in the cache, e.g. to
+// page through them with an index of the keys kept by the caller. It
+// allocates a slice as large as Len, and walks the store as ForEach does, so
+// the values set or deleted during the walk may or may not be included.
+func (c *Cache) KeyHashes() []uint64 {
+	if c == nil {
+		return nil
+	}
+	keyHashes := make([]uint64, 0, c.store.Len())
+	c.store.ForEachKey(func(keyHash, _ uint64, _ any) bool {
+		keyHashes = append(keyHashes, keyHash)
+		return true
+	})
+	return keyHashes
 }
 
 // processItems is ran by goroutines processing the Set buffer.
 func (c *Cache) processItems() {
-	startTs := make(map[uint64]time.Time)
-	numToKeep := 100000 // TODO: Make this configurable via options.
-
 	trackAdmission := func(key uint64) {
 		if c.Metrics == nil {
 			return
 		}
-		startTs[key] = time.Now()
-		if len(startTs) > numToKeep {
-			for k := range startTs {
-				if len(startTs) <= numToKeep {
+		c.admittedAt[key] = c.clock.Now()
+		if len(c.admittedAt) > c.admissionWindow {
+			for k := range c.admittedAt {
+				if len(c.admittedAt) <= c.admissionWindow {
 					break
 				}
-				delete(startTs, k)
+				delete(c.admittedAt, k)
 			}
 		}
 	}
 	onEvict := func(i *Item) {
-		delete(startTs, i.Key)
+		if start, ok := c.admittedAt[i.Key]; ok {
+			c.Metrics.observeLifespan(c.clock.Now().Sub(start))
+			delete(c.admittedAt, i.Key)
+		}
 		if c.onEvict != nil {
 			c.onEvict(i)
 		}
@@ -461,12 +1857,12 @@ func (c *Cache) processItems() {
 	for {
 		select {
 		case i := <-c.setBuf:
-			if i.wg != nil {
-				i.wg.Done()
+			if i.wait != nil {
+				close(i.wait)
 				continue
 			}
 			// Calculate item cost value if new or update.
-			if i.Cost == 0 && c.cost != nil && i.flag != itemDelete {
+			if i.Cost == 0 && c.cost != nil && i.flag != itemDelete && i.flag != itemDeleteBatch {
 				i.Cost = c.cost(i.Value)
 			}
 			if !c.ignoreInternalCost {
@@ -475,27 +1871,58 @@ func (c *Cache) processItems() {
 			}
 
 			switch i.flag {
-			case itemNew:
+			case itemNew, itemNewStored:
+				if !i.Expiration.IsZero() && c.clock.Now().After(i.Expiration) {
+					// The item expired before it could be admitted.
+					i.Reason = EvictExpired
+					onEvict(i)
+					break
+				}
+				if i.flag == itemNewStored && c.policy.Has(i.Key) {
+					// The value replaced an expired one that is still in the policy.
+					c.policy.Update(i.Key, i.Cost)
+					if c.onAdmitUpdates {
+						c.onAdmit(i)
+					}
+					break
+				}
 				victims, added := c.policy.Add(i.Key, i.Cost)
 				if added {
-					c.store.Set(i)
+					if i.flag == itemNew {
+						c.store.Set(i)
+					}
 					c.Metrics.add(keyAdd, i.Key, 1)
 					trackAdmission(i.Key)
+					c.onAdmit(i)
 				} else {
+					if i.flag == itemNewStored {
+						// The value was stored before being admitted, and may
+						// have been incremented since.
+						_, i.Value = c.store.Del(i.Key, i.Conflict)
+					}
 					c.onReject(i)
 				}
 				for _, victim := range victims {
 					victim.Conflict, victim.Value = c.store.Del(victim.Key, 0)
+					victim.Reason = EvictCapacity
 					onEvict(victim)
 				}
 
 			case itemUpdate:
-				c.policy.Update(i.Key, i.Cost)
+				if c.policy.Update(i.Key, i.Cost) && c.onAdmitUpdates {
+					c.onAdmit(i)
+				}
 
 			case itemDelete:
 				c.policy.Del(i.Key) // Deals with metrics updates.
 				_, val := c.store.Del(i.Key, i.Conflict)
 				c.onExit(val)
+			case itemDeleteBatch:
+				for _, d := range i.batch {
+					c.policy.Del(d.Key)
+					_, val := c.store.Del(d.Key, d.Conflict)
+					c.onExit(val)
+				}
 			}
 		case <-c.stop:
 			return
@@ -508,9 +1935,30 @@ func (c *Cache) processItems() {
 func (c *Cache) collectMetrics() {
 	c.Metrics = newMetrics()
 	c.policy.CollectMetrics(c.Metrics)
+	c.store.CollectMetrics(c.Metrics)
 }
 
-type metricType int
+// MetricType identifies one of the counters of Metrics.
+type MetricType int
+
+// The counters of Metrics, named after their getters, which can be reset
+// individually with ClearType.
+const (
+	MetricHits          MetricType = hit
+	MetricMisses        MetricType = miss
+	MetricKeysAdded     MetricType = keyAdd
+	MetricKeysUpdated   MetricType = keyUpdate
+	MetricKeysEvicted   MetricType = keyEvict
+	MetricCostAdded     MetricType = costAdd
+	MetricCostEvicted   MetricType = costEvict
+	MetricSetsDropped   MetricType = dropSets
+	MetricSetsRejected  MetricType = rejectSets
+	MetricSetsLimited   MetricType = limitSets
+	MetricGetsDropped   MetricType = dropGets
+	MetricGetsKept      MetricType = keepGets
+	MetricEvictsDropped MetricType = dropEvicts
+	MetricConflicts     MetricType = conflicts
+)
 
 const (
 	// The following 2 keep track of hits and misses.
@@ -526,15 +1974,23 @@ const (
 	// The following keep track of how many sets were dropped or rejected later.
 	dropSets
 	rejectSets
+	// The following keeps track of how many sets were dropped by MaxSetsPerSecond.
+	limitSets
 	// The following 2 keep track of how many gets were kept and dropped on the
 	// floor.
 	dropGets
 	keepGets
+	// The following keeps track of how many evictions were dropped because
+	// EvictChan was full.
+	dropEvicts
+	// The following keeps track of how many times a key hash was found in the
+	// store with another conflict hash.
+	conflicts
 	// This should be the final enum. Other enums should be set before this.
 	doNotUse
 )
 
-func stringFor(t metricType) string {
+func stringFor(t MetricType) string {
 	switch t {
 	case hit:
 		return "hit"
@@ -554,10 +2010,16 @@ func stringFor(t metricType) string {
 		return "sets-dropped"
 	case rejectSets:
 		return "sets-rejected" // by policy.
+	case limitSets:
+		return "sets-limited"
 	case dropGets:
 		return "gets-dropped"
 	case keepGets:
 		return "gets-kept"
+	case dropEvicts:
+		return "evict-dropped"
+	case conflicts:
+		return "conflicts"
 	default:
 		return "unidentified"
 	}
@@ -566,6 +2028,95 @@ func stringFor(t metricType) string {
 // Metrics is a snapshot of performance statistics for the lifetime of a cache instance.
 type Metrics struct {
 	all [doNotUse][]*uint64
+	// stripes are taken for reading by the updates of the counters, each by
+	// the updates of its stripe of the counters, and all of them for writing
+	// by Snapshot and the resets, so that they see and change all the
+	// counters at a single point in time.
+	stripes [metricsStripes]metricsStripe
+	// window counts the recent hits and misses, if the cache has metrics.
+	window *ratioWindow
+	// lifespans counts the evicted keys by lifespanBounds, and the last one
+	// those that lived longer.
+	lifespans [len(lifespanBounds) + 1]atomic.Uint64
+}
+
+// lifespanBounds are the upper bounds of the buckets of LifespanHistogram.
+var lifespanBounds = [...]time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+	24 * time.Hour,
+}
+
+// Bucket is a bucket of a histogram of durations.
+type Bucket struct {
+	// UpperBound is the longest duration counted in the bucket. It's
+	// math.MaxInt64 for the last bucket, which has no bound.
+	UpperBound time.Duration
+	// Count is the number of durations counted in the bucket, which doesn't
+	// include those of the previous buckets.
+	Count uint64
+}
+
+func (p *Metrics) observeLifespan(d time.Duration) {
+	if p == nil {
+		return
+	}
+	for i, bound := range lifespanBounds {
+		if d <= bound {
+			p.lifespans[i].Add(1)
+			return
+		}
+	}
+	p.lifespans[len(lifespanBounds)].Add(1)
+}
+
+// LifespanHistogram returns how long the evicted keys were in the cache, from
+// their admission to their eviction, by buckets from a millisecond to a day.
+// Only the keys whose admission time is still tracked, as bounded by
+// Config.AdmissionWindow, are counted.
+func (p *Metrics) LifespanHistogram() []Bucket {
+	if p == nil {
+		return nil
+	}
+	buckets := make([]Bucket, 0, len(p.lifespans))
+	for i := range p.lifespans {
+		bound := time.Duration(math.MaxInt64)
+		if i < len(lifespanBounds) {
+			bound = lifespanBounds[i]
+		}
+		buckets = append(buckets, Bucket{UpperBound: bound, Count: p.lifespans[i].Load()})
+	}
+	return buckets
+}
+
+// metricsStripes is the number of stripes of the counters, see add.
+const metricsStripes = 25
+
+// metricsStripe is the lock of a stripe of the counters, padded to 64 bytes
+// so that the locks of two stripes don't share a cache line.
+type metricsStripe struct {
+	sync.RWMutex
+	_ [64 - unsafe.Sizeof(sync.RWMutex{})]byte
+}
+
+// lockStripes waits for the pending updates of the counters and blocks the
+// new ones until unlockStripes is called.
+func (p *Metrics) lockStripes() {
+	for i := range p.stripes {
+		p.stripes[i].Lock()
+	}
+}
+
+func (p *Metrics) unlockStripes() {
+	for i := range p.stripes {
+		p.stripes[i].Unlock()
+	}
 }
 
 func newMetrics() *Metrics {
@@ -580,18 +2131,24 @@ func newMetrics() *Metrics {
 	return s
 }
 
-func (p *Metrics) add(t metricType, hash, delta uint64) {
+func (p *Metrics) add(t MetricType, hash, delta uint64) {
 	if p == nil {
 		return
 	}
 	valp := p.all[t]
 	// Avoid false sharing by padding at least 64 bytes of space between two
 	// atomic counters which would be incremented.
-	idx := (hash % 25) * 10
+	stripe := hash % metricsStripes
+	idx := stripe * 10
+	p.stripes[stripe].RLock()
 	atomic.AddUint64(valp[idx], delta)
+	p.stripes[stripe].RUnlock()
+	if p.window != nil && (t == hit || t == miss) {
+		p.window.add(t == hit, delta)
+	}
 }
 
-func (p *Metrics) get(t metricType) uint64 {
+func (p *Metrics) get(t MetricType) uint64 {
 	if p == nil {
 		return 0
 	}
@@ -649,6 +2206,12 @@ func (p *Metrics) SetsRejected() uint64 {
 	return p.get(rejectSets)
 }
 
+// SetsLimited is the number of Set calls dropped because they went over
+// MaxSetsPerSecond.
+func (p *Metrics) SetsLimited() uint64 {
+	return p.get(limitSets)
+}
+
 // GetsDropped is the number of Get counter increments that are dropped
 // internally.
 func (p *Metrics) GetsDropped() uint64 {
@@ -660,6 +2223,20 @@ func (p *Metrics) GetsKept() uint64 {
 	return p.get(keepGets)
 }
 
+// EvictsDropped is the number of evictions that weren't sent to EvictChan
+// because it was full.
+func (p *Metrics) EvictsDropped() uint64 {
+	return p.get(dropEvicts)
+}
+
+// Conflicts is the number of store operations that found a value under the
+// key hash of their key, but with another conflict hash, i.e. a value of
+// another key whose hash collides. A single Set can count twice, when its
+// update and then its addition are both refused.
+func (p *Metrics) Conflicts() uint64 {
+	return p.get(conflicts)
+}
+
 // Ratio is the number of Hits over all accesses (Hits + Misses). This is the
 // percentage of successful Get calls.
 func (p *Metrics) Ratio() float64 {
@@ -673,16 +2250,245 @@ func (p *Metrics) Ratio() float64 {
 	return float64(hits) / float64(hits+misses)
 }
 
+// GetsDropRatio is the number of GetsDropped over all the Get counter
+// increments (GetsDropped + GetsKept). The dropped increments are lost to the
+// admission policy, so a ratio that stays high suggests increasing
+// BufferItems.
+func (p *Metrics) GetsDropRatio() float64 {
+	if p == nil {
+		return 0.0
+	}
+	dropped, kept := p.get(dropGets), p.get(keepGets)
+	if dropped == 0 && kept == 0 {
+		return 0.0
+	}
+	return float64(dropped) / float64(dropped+kept)
+}
+
+// Stats is a copy of the counters of Metrics at a point in time, along with
+// the totals and ratios computed from them.
+type Stats struct {
+	Hits          uint64
+	Misses        uint64
+	KeysAdded     uint64
+	KeysUpdated   uint64
+	KeysEvicted   uint64
+	CostAdded     uint64
+	CostEvicted   uint64
+	SetsDropped   uint64
+	SetsRejected  uint64
+	SetsLimited   uint64
+	GetsDropped   uint64
+	GetsKept      uint64
+	EvictsDropped uint64
+	Conflicts     uint64
+	// GetsTotal is Hits + Misses.
+	GetsTotal uint64
+	// HitRatio is Hits over GetsTotal, or 0 if there was no Get.
+	HitRatio float64
+}
+
+// withTotals fills GetsTotal and HitRatio from the counters.
+func (s Stats) withTotals() Stats {
+	s.GetsTotal = s.Hits + s.Misses
+	s.HitRatio = 0
+	if s.GetsTotal > 0 {
+		s.HitRatio = float64(s.Hits) / float64(s.GetsTotal)
+	}
+	return s
+}
+
+// Snapshot returns the value of all the counters at once, e.g. to compute
+// their deltas between two scrapes with Rates. The updates of the counters
+// wait while the copy is made, so that it's taken at a single point in time
+// across all of them, and GetsTotal and HitRatio agree with Hits and Misses.
+// An operation that updates several counters, such as a Get counted in Hits
+// and in GetsKept, may still be in progress at that point, and then counted in
+// only some of them.
+func (p *Metrics) Snapshot() Stats {
+	if p == nil {
+		return Stats{}
+	}
+	p.lockStripes()
+	defer p.unlockStripes()
+	return Stats{
+		Hits:          p.get(hit),
+		Misses:        p.get(miss),
+		KeysAdded:     p.get(keyAdd),
+		KeysUpdated:   p.get(keyUpdate),
+		KeysEvicted:   p.get(keyEvict),
+		CostAdded:     p.get(costAdd),
+		CostEvicted:   p.get(costEvict),
+		SetsDropped:   p.get(dropSets),
+		SetsRejected:  p.get(rejectSets),
+		SetsLimited:   p.get(limitSets),
+		GetsDropped:   p.get(dropGets),
+		GetsKept:      p.get(keepGets),
+		EvictsDropped: p.get(dropEvicts),
+		Conflicts:     p.get(conflicts),
+	}.withTotals()
+}
+
+// Rates returns how much each counter has grown since the given Snapshot,
+// which callers divide by the time elapsed since they took it to get
+// per-second rates, along with the hit ratio of the Gets in between. It's a
+// simple subtraction that doesn't change the counters, so any number of
+// consumers can compute their own deltas by keeping their previous Snapshot.
+// The counters only go down when they are reset by Clear or ClearType: a
+// counter lower than in since is then returned as is, as its growth since the
+// reset.
+func (p *Metrics) Rates(since Stats) Stats {
+	now := p.Snapshot()
+	delta := func(now, since uint64) uint64 {
+		if now < since {
+			return now
+		}
+		return now - since
+	}
+	return Stats{
+		Hits:          delta(now.Hits, since.Hits),
+		Misses:        delta(now.Misses, since.Misses),
+		KeysAdded:     delta(now.KeysAdded, since.KeysAdded),
+		KeysUpdated:   delta(now.KeysUpdated, since.KeysUpdated),
+		KeysEvicted:   delta(now.KeysEvicted, since.KeysEvicted),
+		CostAdded:     delta(now.CostAdded, since.CostAdded),
+		CostEvicted:   delta(now.CostEvicted, since.CostEvicted),
+		SetsDropped:   delta(now.SetsDropped, since.SetsDropped),
+		SetsRejected:  delta(now.SetsRejected, since.SetsRejected),
+		SetsLimited:   delta(now.SetsLimited, since.SetsLimited),
+		GetsDropped:   delta(now.GetsDropped, since.GetsDropped),
+		GetsKept:      delta(now.GetsKept, since.GetsKept),
+		EvictsDropped: delta(now.EvictsDropped, since.EvictsDropped),
+		Conflicts:     delta(now.Conflicts, since.Conflicts),
+	}.withTotals()
+}
+
+// CounterNames returns the names of all the counters, as used by String and
+// Counter.
+func (p *Metrics) CounterNames() []string {
+	names := make([]string, 0, doNotUse)
+	for i := 0; i < doNotUse; i++ {
+		names = append(names, stringFor(MetricType(i)))
+	}
+	return names
+}
+
+// Counter returns the value of the counter with the given name, as returned by
+// CounterNames, and whether there is such a counter.
+func (p *Metrics) Counter(name string) (uint64, bool) {
+	for i := 0; i < doNotUse; i++ {
+		t := MetricType(i)
+		if stringFor(t) == name {
+			return p.get(t), true
+		}
+	}
+	return 0, false
+}
+
 // Clear resets all the metrics.
 func (p *Metrics) Clear() {
 	if p == nil {
 		return
 	}
+	p.lockStripes()
 	for i := 0; i < doNotUse; i++ {
-		for j := range p.all[i] {
-			atomic.StoreUint64(p.all[i][j], 0)
+		p.clearType(MetricType(i))
+	}
+	p.unlockStripes()
+	if p.window != nil {
+		p.window.clear()
+	}
+	for i := range p.lifespans {
+		p.lifespans[i].Store(0)
+	}
+}
+
+// ClearType resets a single counter, e.g. to reset the hits and misses at
+// every interval while the evictions keep adding up.
+func (p *Metrics) ClearType(t MetricType) {
+	if p == nil || t < 0 || t >= doNotUse {
+		return
+	}
+	p.lockStripes()
+	p.clearType(t)
+	p.unlockStripes()
+}
+
+func (p *Metrics) clearType(t MetricType) {
+	for _, valp := range p.all[t] {
+		atomic.StoreUint64(valp, 0)
+	}
+}
+
+// publishMu serializes PublishExpvar, so that the check for the names that are
+// already taken holds until they are published.
+var publishMu sync.Mutex
+
+// PublishExpvar publishes every counter as an expvar.Func named after the prefix
+// and the counter name, as returned by CounterNames, e.g. "plans.hit" for the
+// prefix "plans.". The values are read every time the variables are listed. It
+// returns an error without publishing anything if one of the names is already
+// taken.
+func (p *Metrics) PublishExpvar(prefix string) error {
+	if p == nil {
+		return errors.New("metrics are not collected")
+	}
+	publishMu.Lock()
+	defer publishMu.Unlock()
+	for _, name := range p.CounterNames() {
+		if expvar.Get(prefix+name) != nil {
+			return fmt.Errorf("expvar %s is already published", prefix+name)
 		}
 	}
+	for i := 0; i < doNotUse; i++ {
+		t := MetricType(i)
+		expvar.Publish(prefix+stringFor(t), expvar.Func(func() any {
+			return p.get(t)
+		}))
+	}
+	return nil
+}
+
+// MarshalJSON encodes the current value of all the counters as an object with
+// stable snake_case keys, along with the total number of gets and the hit
+// ratio.
+func (p *Metrics) MarshalJSON() ([]byte, error) {
+	stats := p.Snapshot()
+	return json.Marshal(struct {
+		Hits          uint64  `json:"hits"`
+		Misses        uint64  `json:"misses"`
+		KeysAdded     uint64  `json:"keys_added"`
+		KeysUpdated   uint64  `json:"keys_updated"`
+		KeysEvicted   uint64  `json:"keys_evicted"`
+		CostAdded     uint64  `json:"cost_added"`
+		CostEvicted   uint64  `json:"cost_evicted"`
+		SetsDropped   uint64  `json:"sets_dropped"`
+		SetsRejected  uint64  `json:"sets_rejected"`
+		SetsLimited   uint64  `json:"sets_limited"`
+		GetsDropped   uint64  `json:"gets_dropped"`
+		GetsKept      uint64  `json:"gets_kept"`
+		EvictsDropped uint64  `json:"evicts_dropped"`
+		Conflicts     uint64  `json:"conflicts"`
+		GetsTotal     uint64  `json:"gets_total"`
+		HitRatio      float64 `json:"hit_ratio"`
+	}{
+		Hits:          stats.Hits,
+		Misses:        stats.Misses,
+		KeysAdded:     stats.KeysAdded,
+		KeysUpdated:   stats.KeysUpdated,
+		KeysEvicted:   stats.KeysEvicted,
+		CostAdded:     stats.CostAdded,
+		CostEvicted:   stats.CostEvicted,
+		SetsDropped:   stats.SetsDropped,
+		SetsRejected:  stats.SetsRejected,
+		SetsLimited:   stats.SetsLimited,
+		GetsDropped:   stats.GetsDropped,
+		GetsKept:      stats.GetsKept,
+		EvictsDropped: stats.EvictsDropped,
+		Conflicts:     stats.Conflicts,
+		GetsTotal:     stats.GetsTotal,
+		HitRatio:      stats.HitRatio,
+	})
 }
 
 // String returns a string representation of the metrics.
@@ -692,7 +2498,7 @@ func (p *Metrics) String() string {
 	}
 	var buf bytes.Buffer
 	for i := 0; i < doNotUse; i++ {
-		t := metricType(i)
+		t := MetricType(i)
 		fmt.Fprintf(&buf, "%s: %d ", stringFor(t), p.get(t))
 	}
 	fmt.Fprintf(&buf, "gets-total: %d ", p.get(hit)+p.get(miss))
@@ -18,14 +18,22 @@
 package ristretto
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"math"
 	"math/rand"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"vitess.io/vitess/go/hack"
 	"vitess.io/vitess/go/vt/log"
 
 	"github.com/stretchr/testify/require"
@@ -152,6 +160,14 @@ func TestNewCache(t *testing.T) {
 	})
 	require.Error(t, err)
 
+	_, err = NewCache(&Config{
+		NumCounters:     100,
+		MaxCost:         10,
+		BufferItems:     64,
+		AdmissionWindow: -1,
+	})
+	require.Error(t, err)
+
 	c, err := NewCache(&Config{
 		NumCounters: 100,
 		MaxCost:     10,
@@ -160,6 +176,19 @@ func TestNewCache(t *testing.T) {
 	})
 	require.NoError(t, err)
 	require.NotNil(t, c)
+	require.Equal(t, defaultAdmissionWindow, c.admissionWindow)
+	c.Close()
+
+	c, err = NewCache(&Config{
+		NumCounters:     100,
+		MaxCost:         10,
+		BufferItems:     64,
+		Metrics:         true,
+		AdmissionWindow: 10,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 10, c.admissionWindow)
+	c.Close()
 }
 
 func TestNilCache(t *testing.T) {
@@ -169,6 +198,7 @@ func TestNilCache(t *testing.T) {
 	require.Nil(t, val)
 
 	require.False(t, c.SetWithCost("1", 1, 1))
+	require.False(t, c.SetWithTTL("1", 1, 1, time.Second))
 	c.Delete("1")
 	c.Clear()
 	c.Close()
@@ -463,194 +493,3007 @@ func TestCacheDel(t *testing.T) {
 	c.Delete("1")
 }
 
-func TestCacheClear(t *testing.T) {
+func TestCacheDeleteHashRange(t *testing.T) {
+	var exited []any
 	c, err := NewCache(&Config{
-		NumCounters:        100,
-		MaxCost:            10,
-		IgnoreInternalCost: true,
+		NumCounters:        1000,
+		MaxCost:            100,
 		BufferItems:        64,
-		Metrics:            true,
+		IgnoreInternalCost: true,
+		// spread the keys 0-99 evenly across the hash space
+		KeyToHash: func(key string) (uint64, uint64) {
+			n, err := strconv.ParseUint(key, 10, 64)
+			require.NoError(t, err)
+			return n * (math.MaxUint64 / 100), 0
+		},
+		OnExit: func(val any) {
+			exited = append(exited, val)
+		},
 	})
 	require.NoError(t, err)
 
-	for i := 0; i < 10; i++ {
-		c.SetWithCost(strconv.Itoa(i), i, 1)
+	for i := 0; i < 100; i++ {
+		require.True(t, c.SetWithCost(strconv.Itoa(i), i, 1))
+		c.Wait()
 	}
-	time.Sleep(wait)
-	require.Equal(t, uint64(10), c.Metrics.KeysAdded())
+	require.Equal(t, 100, c.Len())
 
-	c.Clear()
-	require.Equal(t, uint64(0), c.Metrics.KeysAdded())
+	lo, hi := uint64(20*(math.MaxUint64/100)), uint64(29*(math.MaxUint64/100))
+	require.Equal(t, 10, c.DeleteHashRange(lo, hi))
+	require.ElementsMatch(t, []any{20, 21, 22, 23, 24, 25, 26, 27, 28, 29}, exited)
+	c.Wait()
 
-	for i := 0; i < 10; i++ {
-		val, ok := c.Get(strconv.Itoa(i))
-		require.False(t, ok)
-		require.Nil(t, val)
+	for i := 0; i < 100; i++ {
+		_, ok := c.Get(strconv.Itoa(i))
+		require.Equal(t, i < 20 || i > 29, ok, "key %d", i)
 	}
+	require.Equal(t, 90, c.Len())
+	require.EqualValues(t, 90, c.UsedCapacity())
+
+	require.Zero(t, c.DeleteHashRange(lo, hi))
 }
 
-func TestCacheMetrics(t *testing.T) {
+func TestCacheWriteThrough(t *testing.T) {
+	backing := map[string]any{}
+	var failWrites bool
 	c, err := NewCache(&Config{
 		NumCounters:        100,
 		MaxCost:            10,
-		IgnoreInternalCost: true,
 		BufferItems:        64,
-		Metrics:            true,
+		IgnoreInternalCost: true,
+		WriteThrough: func(key string, value any, cost int64) error {
+			if failWrites {
+				return errors.New("backing store is down")
+			}
+			backing[key] = value
+			return nil
+		},
+		DeleteThrough: func(key string) error {
+			if failWrites {
+				return errors.New("backing store is down")
+			}
+			delete(backing, key)
+			return nil
+		},
 	})
 	require.NoError(t, err)
 
-	for i := 0; i < 10; i++ {
-		c.SetWithCost(strconv.Itoa(i), i, 1)
-	}
-	time.Sleep(wait)
-	m := c.Metrics
-	require.Equal(t, uint64(10), m.KeysAdded())
-}
+	require.True(t, c.SetWithCost("1", 1, 1))
+	c.Wait()
+	val, ok := c.Get("1")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.Equal(t, map[string]any{"1": 1}, backing)
 
-func TestMetrics(t *testing.T) {
-	newMetrics()
+	c.Delete("1")
+	c.Wait()
+	_, ok = c.Get("1")
+	require.False(t, ok)
+	require.Empty(t, backing)
+
+	// A failed write must not be cached, and a failed delete must not remove
+	// the cached item, so that the cache never has a value the backing store
+	// doesn't have.
+	require.True(t, c.SetWithCost("2", 2, 1))
+	c.Wait()
+	failWrites = true
+	require.False(t, c.SetWithCost("2", 20, 1))
+	require.False(t, c.SetWithCost("3", 3, 1))
+	c.Delete("2")
+	c.Wait()
+	val, ok = c.Get("2")
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+	_, ok = c.Get("3")
+	require.False(t, ok)
+	require.Equal(t, map[string]any{"2": 2}, backing)
 }
 
-func TestNilMetrics(t *testing.T) {
-	var m *Metrics
-	for _, f := range []func() uint64{
-		m.Hits,
-		m.Misses,
-		m.KeysAdded,
-		m.KeysEvicted,
-		m.CostEvicted,
-		m.SetsDropped,
-		m.SetsRejected,
-		m.GetsDropped,
-		m.GetsKept,
-	} {
-		require.Equal(t, uint64(0), f())
-	}
+func TestCacheWriteThroughFailOpen(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		WriteThrough: func(key string, value any, cost int64) error {
+			return errors.New("backing store is down")
+		},
+		DeleteThrough: func(key string) error {
+			return errors.New("backing store is down")
+		},
+		WriteThroughFailOpen: true,
+	})
+	require.NoError(t, err)
+
+	require.True(t, c.SetWithCost("1", 1, 1))
+	c.Wait()
+	val, ok := c.Get("1")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+
+	c.Delete("1")
+	c.Wait()
+	_, ok = c.Get("1")
+	require.False(t, ok)
 }
 
-func TestMetricsAddGet(t *testing.T) {
-	m := newMetrics()
-	m.add(hit, 1, 1)
-	m.add(hit, 2, 2)
-	m.add(hit, 3, 3)
-	require.Equal(t, uint64(6), m.Hits())
+func TestCacheMaxSetsPerSecond(t *testing.T) {
+	const perSecond = 1000
+	c, err := NewCache(&Config{
+		NumCounters:      100000,
+		MaxCost:          10000,
+		BufferItems:      64,
+		Metrics:          true,
+		MaxSetsPerSecond: perSecond,
+	})
+	require.NoError(t, err)
 
-	m = nil
-	m.add(hit, 1, 1)
-	require.Equal(t, uint64(0), m.Hits())
+	// Burst sets for a while: only the bucket (a tenth of a second worth of
+	// sets) plus the sets earned in the meantime must go through.
+	start := time.Now()
+	var allowed, total uint64
+	for time.Since(start) < 200*time.Millisecond {
+		if c.SetWithCost(strconv.FormatUint(total, 10), total, 1) {
+			allowed++
+		}
+		total++
+	}
+	elapsed := time.Since(start)
+	maxAllowed := perSecond/10 + uint64(elapsed.Seconds()*perSecond) + 1
+	require.Greater(t, total, maxAllowed)
+	require.LessOrEqual(t, allowed, maxAllowed)
+	require.GreaterOrEqual(t, allowed, uint64(0.2*perSecond))
+	require.Equal(t, total-allowed, c.Metrics.SetsLimited())
+
+	_, err = NewCache(&Config{
+		NumCounters:      100,
+		MaxCost:          10,
+		BufferItems:      64,
+		MaxSetsPerSecond: -1,
+	})
+	require.Error(t, err)
 }
 
-func TestMetricsRatio(t *testing.T) {
-	m := newMetrics()
-	require.Equal(t, float64(0), m.Ratio())
+func TestCacheMaxEntries(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            1000,
+		MaxEntries:         10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
 
-	m.add(hit, 1, 1)
-	m.add(hit, 2, 2)
-	m.add(miss, 1, 1)
-	m.add(miss, 2, 2)
-	require.Equal(t, 0.5, m.Ratio())
+	for i := 0; i < 100; i++ {
+		c.SetWithCost(strconv.Itoa(i), i, 1)
+		c.Wait()
+	}
+	// MaxCost is far from reached, but the number of entries is bounded.
+	require.Equal(t, 10, c.Len())
+	require.Equal(t, int64(10), c.UsedCapacity())
+	require.Equal(t, uint64(90), c.Metrics.KeysEvicted())
+	// Evicting one entry makes room for an item of any cost.
+	require.Len(t, c.EvictionCandidates(1), 1)
+	require.Len(t, c.EvictionCandidates(500), 1)
+
+	// The limit is kept across Clear.
+	c.Clear()
+	for i := 0; i < 20; i++ {
+		c.SetWithCost(strconv.Itoa(i), i, 1)
+		c.Wait()
+	}
+	require.Equal(t, 10, c.Len())
 
-	m = nil
-	require.Equal(t, float64(0), m.Ratio())
+	_, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		MaxEntries:  -1,
+	})
+	require.Error(t, err)
 }
 
-func TestMetricsString(t *testing.T) {
-	m := newMetrics()
-	m.add(hit, 1, 1)
-	m.add(miss, 1, 1)
-	m.add(keyAdd, 1, 1)
-	m.add(keyUpdate, 1, 1)
-	m.add(keyEvict, 1, 1)
-	m.add(costAdd, 1, 1)
-	m.add(costEvict, 1, 1)
-	m.add(dropSets, 1, 1)
-	m.add(rejectSets, 1, 1)
-	m.add(dropGets, 1, 1)
-	m.add(keepGets, 1, 1)
-	require.Equal(t, uint64(1), m.Hits())
-	require.Equal(t, uint64(1), m.Misses())
-	require.Equal(t, 0.5, m.Ratio())
-	require.Equal(t, uint64(1), m.KeysAdded())
-	require.Equal(t, uint64(1), m.KeysUpdated())
-	require.Equal(t, uint64(1), m.KeysEvicted())
-	require.Equal(t, uint64(1), m.CostAdded())
-	require.Equal(t, uint64(1), m.CostEvicted())
-	require.Equal(t, uint64(1), m.SetsDropped())
-	require.Equal(t, uint64(1), m.SetsRejected())
-	require.Equal(t, uint64(1), m.GetsDropped())
-	require.Equal(t, uint64(1), m.GetsKept())
+func TestCacheBlockSetsOverLimit(t *testing.T) {
+	const perSecond = 1000
+	c, err := NewCache(&Config{
+		NumCounters:        100000,
+		MaxCost:            10000,
+		BufferItems:        64,
+		Metrics:            true,
+		MaxSetsPerSecond:   perSecond,
+		BlockSetsOverLimit: true,
+	})
+	require.NoError(t, err)
 
-	require.NotEqual(t, 0, len(m.String()))
+	// The first 100 sets fill the bucket, the next 100 have to wait for a
+	// tenth of a second.
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		require.True(t, c.SetWithCost(strconv.Itoa(i), i, 1))
+	}
+	elapsed := time.Since(start)
+	require.GreaterOrEqual(t, elapsed, 90*time.Millisecond)
+	require.Zero(t, c.Metrics.SetsLimited())
+}
 
-	m = nil
-	require.Equal(t, 0, len(m.String()))
+func TestCacheWarmUp(t *testing.T) {
+	// Load more entries than the set buffer can hold, so that WarmUp has to
+	// wait for it to drain.
+	n := 2 * setBufSize
+	c, err := NewCache(&Config{
+		NumCounters:        int64(10 * n),
+		MaxCost:            int64(n),
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
 
-	require.Equal(t, "unidentified", stringFor(doNotUse))
+	i := 0
+	loaded, err := c.WarmUp(context.Background(), func() (string, any, int64, bool) {
+		if i == n {
+			return "", nil, 0, false
+		}
+		i++
+		return strconv.Itoa(i), i, 1, true
+	})
+	require.NoError(t, err)
+	require.Equal(t, n, loaded)
+	c.Wait()
+	require.Equal(t, n, c.Len())
+	require.Zero(t, c.Metrics.SetsDropped())
+
+	val, ok := c.Get(strconv.Itoa(n))
+	require.True(t, ok)
+	require.Equal(t, n, val)
 }
 
-func TestCacheMetricsClear(t *testing.T) {
+func TestCacheWarmUpCanceled(t *testing.T) {
 	c, err := NewCache(&Config{
 		NumCounters: 100,
 		MaxCost:     10,
 		BufferItems: 64,
-		Metrics:     true,
 	})
 	require.NoError(t, err)
 
-	c.SetWithCost("1", 1, 1)
-	stop := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-stop:
-				return
-			default:
-				c.Get("1")
-			}
+	ctx, cancel := context.WithCancel(context.Background())
+	i := 0
+	loaded, err := c.WarmUp(ctx, func() (string, any, int64, bool) {
+		i++
+		if i == 5 {
+			cancel()
 		}
-	}()
-	time.Sleep(wait)
-	c.Clear()
-	stop <- struct{}{}
-	c.Metrics = nil
-	c.Metrics.Clear()
-}
+		return strconv.Itoa(i), i, 1, true
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 5, i)
+	require.LessOrEqual(t, loaded, 5)
 
-// Regression test for bug https://github.com/dgraph-io/ristretto/issues/167
-func TestDropUpdates(t *testing.T) {
-	originalSetBugSize := setBufSize
-	defer func() { setBufSize = originalSetBugSize }()
+	c.Close()
+	loaded, err = c.WarmUp(context.Background(), func() (string, any, int64, bool) {
+		return "1", 1, 1, true
+	})
+	require.ErrorIs(t, err, ErrCacheClosed)
+	require.Zero(t, loaded)
+}
 
-	test := func() {
-		// dropppedMap stores the items dropped from the cache.
-		droppedMap := make(map[int]struct{})
-		lastEvictedSet := int64(-1)
+func TestCacheWarmUpCanceledWhileLimited(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:      100,
+		MaxCost:          10,
+		BufferItems:      64,
+		MaxSetsPerSecond: 1,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// The second entry has to wait for a second, which the deadline cuts
+	// short.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	i := 0
+	start := time.Now()
+	loaded, err := c.WarmUp(ctx, func() (string, any, int64, bool) {
+		i++
+		return strconv.Itoa(i), i, 1, true
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+	require.Equal(t, 1, loaded)
+	require.Equal(t, 2, i)
+}
 
-		var err error
-		handler := func(_ any, value any) {
-			v := value.(string)
-			lastEvictedSet, err = strconv.ParseInt(string(v), 10, 32)
-			require.NoError(t, err)
+func TestCacheEvictionCandidates(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		KeyToHash:          numericKeyHash,
+	})
+	require.NoError(t, err)
 
-			_, ok := droppedMap[int(lastEvictedSet)]
-			if ok {
-				panic(fmt.Sprintf("val = %+v was dropped but it got evicted. Dropped items: %+v\n",
-					lastEvictedSet, droppedMap))
-			}
+	for i := 0; i < 10; i++ {
+		require.True(t, c.SetWithCost(strconv.Itoa(i), i, 1))
+	}
+	c.Wait()
+	require.Empty(t, c.EvictionCandidates(0))
+
+	// Make keys 0 and 1 hot, so that every sample of the policy has colder
+	// entries than them. The admission counters are set directly, since the
+	// accesses recorded by Get can be dropped.
+	hot := make(map[uint64]bool)
+	p := c.policy.(*defaultPolicy)
+	p.Lock()
+	for _, key := range []string{"0", "1"} {
+		keyHash, _ := c.keyToHash(key)
+		hot[keyHash] = true
+		for i := 0; i < 10; i++ {
+			p.admit.Increment(keyHash)
 		}
+	}
+	p.Unlock()
+	c.Wait()
+
+	candidates := c.EvictionCandidates(2)
+	require.Len(t, candidates, 2)
+	for _, candidate := range candidates {
+		require.False(t, hot[candidate.KeyHash])
+		require.Equal(t, int64(1), candidate.Cost)
+		require.NotNil(t, candidate.Value)
+		val, ok := c.Get(strconv.Itoa(candidate.Value.(int)))
+		require.True(t, ok)
+		require.Equal(t, candidate.Value, val)
+	}
+	require.Empty(t, c.EvictionCandidates(11))
 
-		// This is important. The race condition shows up only when the setBuf
-		// is full and that's why we reduce the buf size here. The test will
-		// try to fill up the setbuf to it's capacity and then perform an
-		// update on a key.
-		setBufSize = 10
+	// Nothing was evicted.
+	require.Equal(t, 10, c.Len())
+	require.Equal(t, int64(10), c.UsedCapacity())
+	require.Zero(t, c.Metrics.KeysEvicted())
 
-		c, err := NewCache(&Config{
-			NumCounters: 100,
-			MaxCost:     10,
-			BufferItems: 64,
-			Metrics:     true,
-			OnEvict: func(item *Item) {
+	c.Close()
+	require.Nil(t, c.EvictionCandidates(2))
+}
+
+func TestCacheMergeHot(t *testing.T) {
+	old, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		KeyToHash:          numericKeyHash,
+	})
+	require.NoError(t, err)
+	defer old.Close()
+
+	for i := 0; i < 10; i++ {
+		require.True(t, old.SetWithCost(strconv.Itoa(i), i, 1))
+		old.Wait()
+	}
+	require.Equal(t, 10, old.Len())
+
+	// Make keys 7, 8 and 9 hot, 9 being the hottest. The accesses are recorded
+	// in the policy directly, since Get batches are dropped when it's busy.
+	p := old.policy.(*defaultPolicy)
+	p.Lock()
+	for i := 7; i < 10; i++ {
+		keyHash, _ := old.keyToHash(strconv.Itoa(i))
+		// The counters saturate at 15, so keep them below.
+		for n := 0; n < 3*(i-6); n++ {
+			p.admit.Increment(keyHash)
+		}
+	}
+	p.Unlock()
+	var hottest []uint64
+	for _, entry := range old.policy.Hottest(3) {
+		hottest = append(hottest, entry.KeyHash)
+	}
+	var want []uint64
+	for _, key := range []string{"9", "8", "7"} {
+		keyHash, _ := old.keyToHash(key)
+		want = append(want, keyHash)
+	}
+	require.Equal(t, want, hottest)
+	hits := old.Metrics.Hits()
+
+	c, err := NewCache(&Config{
+		NumCounters: 1000,
+		MaxCost:     3 * (1 + CacheItemSize),
+		BufferItems: 64,
+		Metrics:     true,
+		KeyToHash:   numericKeyHash,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Equal(t, 3, c.MergeHot(old, 3))
+	c.Wait()
+	require.Equal(t, 3, c.Len())
+	for i := 7; i < 10; i++ {
+		val, ok := c.Get(strconv.Itoa(i))
+		require.True(t, ok)
+		require.Equal(t, i, val)
+	}
+	// The internal cost of old isn't counted twice.
+	require.Equal(t, 3*(1+CacheItemSize), c.UsedCapacity())
+
+	// old is left untouched.
+	require.Equal(t, 10, old.Len())
+	require.Equal(t, int64(10), old.UsedCapacity())
+	require.Equal(t, hits, old.Metrics.Hits())
+	require.Zero(t, old.Metrics.KeysEvicted())
+
+	require.Zero(t, c.MergeHot(nil, 3))
+	require.Zero(t, c.MergeHot(old, 0))
+}
+
+func TestCacheSnapshotConsistent(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+
+	type value struct{ key, gen int }
+	const numKeys = 10
+	for key := 0; key < numKeys; key++ {
+		require.True(t, c.SetWithCost(strconv.Itoa(key), value{key, 0}, 1))
+	}
+	c.Wait()
+
+	// Update the keys in order, so that at any point in time the keys before
+	// some key are one generation ahead of the keys from it on.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for gen := 1; ; gen++ {
+			for key := 0; key < numKeys; key++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c.SetWithCost(strconv.Itoa(key), value{key, gen}, 1)
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		entries, err := c.SnapshotConsistent()
+		require.NoError(t, err)
+		require.Len(t, entries, numKeys)
+
+		gens := make([]int, numKeys)
+		for _, entry := range entries {
+			val := entry.Value.(value)
+			gens[val.key] = val.gen
+			require.Equal(t, int64(1), entry.Cost)
+		}
+		for key := 1; key < numKeys; key++ {
+			require.Contains(t, []int{gens[0], gens[0] - 1}, gens[key], "generations %v", gens)
+			require.LessOrEqual(t, gens[key], gens[key-1], "generations %v", gens)
+		}
+	}
+	close(stop)
+	<-done
+
+	c.Close()
+	_, err = c.SnapshotConsistent()
+	require.ErrorIs(t, err, ErrCacheClosed)
+}
+
+func TestCacheReplaceAll(t *testing.T) {
+	var exited atomic.Int64
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		OnExit: func(any) {
+			exited.Add(1)
+		},
+	})
+	require.NoError(t, err)
+
+	const numKeys = 10
+	generation := func(gen int) []Entry {
+		entries := make([]Entry, numKeys)
+		for key := range entries {
+			// Every generation has its own keys.
+			entries[key] = Entry{Key: fmt.Sprintf("%d-%d", gen, key), Value: gen, Cost: 1}
+		}
+		return entries
+	}
+	require.NoError(t, c.ReplaceAll(generation(0)))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// Readers see either all the old entries or all the new ones.
+			entries := c.store.Snapshot()
+			if len(entries) != numKeys {
+				t.Errorf("got %d entries, want %d", len(entries), numKeys)
+				return
+			}
+			for _, entry := range entries {
+				if entry.Value != entries[0].Value {
+					t.Errorf("got entries of generations %v and %v", entries[0].Value, entry.Value)
+					return
+				}
+			}
+		}
+	}()
+
+	const numGens = 50
+	for gen := 1; gen <= numGens; gen++ {
+		require.NoError(t, c.ReplaceAll(generation(gen)))
+	}
+	close(stop)
+	<-done
+
+	for key := 0; key < numKeys; key++ {
+		val, ok := c.Get(fmt.Sprintf("%d-%d", numGens, key))
+		require.True(t, ok)
+		require.Equal(t, numGens, val)
+		_, ok = c.Get(fmt.Sprintf("%d-%d", numGens-1, key))
+		require.False(t, ok)
+	}
+	require.Equal(t, int64(numKeys), c.UsedCapacity())
+	require.Equal(t, int64(numGens*numKeys), exited.Load())
+
+	// The last entry of a repeated key wins, and the entries that don't fit are
+	// rejected.
+	entries := []Entry{
+		{Key: "a", Value: 1, Cost: 1},
+		{Key: "a", Value: 2, Cost: 1},
+		{Key: "b", Value: 3, Cost: 101},
+	}
+	require.NoError(t, c.ReplaceAll(entries))
+	val, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+	_, ok = c.Get("b")
+	require.False(t, ok)
+	require.Equal(t, 1, c.Len())
+
+	c.Close()
+	require.ErrorIs(t, c.ReplaceAll(entries), ErrCacheClosed)
+}
+
+func TestCacheSetWithTTL(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL("expiring", 1, 1, 50*time.Millisecond))
+	require.True(t, c.SetWithTTL("zero", 2, 1, 0))
+	require.True(t, c.SetWithTTL("negative", 3, 1, -time.Second))
+	c.Wait()
+
+	val, ok := c.Get("expiring")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.Equal(t, 3, c.Len())
+
+	time.Sleep(100 * time.Millisecond)
+
+	// ForEach skips the expired item before it is purged.
+	var values []any
+	c.ForEach(func(value any) bool {
+		values = append(values, value)
+		return true
+	})
+	require.ElementsMatch(t, []any{2, 3}, values)
+	require.Equal(t, 3, c.Len())
+
+	// Get treats the expired item as a miss and purges it.
+	misses := c.Metrics.Misses()
+	_, ok = c.Get("expiring")
+	require.False(t, ok)
+	require.Equal(t, misses+1, c.Metrics.Misses())
+	require.Equal(t, 2, c.Len())
+	c.Wait()
+	require.Equal(t, int64(2), c.UsedCapacity())
+
+	// A ttl of zero or less never expires.
+	val, ok = c.Get("zero")
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+	val, ok = c.Get("negative")
+	require.True(t, ok)
+	require.Equal(t, 3, val)
+
+	// An item that expires before being admitted is not added.
+	require.True(t, c.SetWithTTL("expired", 4, 1, time.Nanosecond))
+	c.Wait()
+	_, ok = c.Get("expired")
+	require.False(t, ok)
+	require.Equal(t, 2, c.Len())
+}
+
+func TestCacheGetTTL(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL("expiring", 1, 1, time.Minute))
+	require.True(t, c.SetWithTTL("short", 2, 1, 50*time.Millisecond))
+	require.True(t, c.Set("forever", 3))
+	c.Wait()
+
+	hits, misses := c.Metrics.Hits(), c.Metrics.Misses()
+
+	ttl, ok := c.GetTTL("expiring")
+	require.True(t, ok)
+	require.Greater(t, ttl, time.Duration(0))
+	require.LessOrEqual(t, ttl, time.Minute)
+
+	// A key-value pair without expiration has a ttl of zero.
+	ttl, ok = c.GetTTL("forever")
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), ttl)
+
+	_, ok = c.GetTTL("missing")
+	require.False(t, ok)
+
+	time.Sleep(100 * time.Millisecond)
+	_, ok = c.GetTTL("short")
+	require.False(t, ok)
+
+	// GetTTL isn't counted as an access.
+	require.Equal(t, hits, c.Metrics.Hits())
+	require.Equal(t, misses, c.Metrics.Misses())
+}
+
+func TestCacheSetBufferPressure(t *testing.T) {
+	// The first value whose cost is computed blocks processItems, so that the
+	// following Sets pile up in the buffer.
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            int64(setBufSize),
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Cost: func(value any) int64 {
+			once.Do(func() {
+				close(blocked)
+				<-release
+			})
+			return 1
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, 0.0, c.SetBufferPressure())
+
+	c.Set("0", 0)
+	<-blocked
+	for i := 1; i <= setBufSize/2; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	require.Equal(t, 0.5, c.SetBufferPressure())
+
+	for i := setBufSize/2 + 1; i <= setBufSize+10; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	require.Equal(t, 1.0, c.SetBufferPressure())
+
+	close(release)
+	c.Wait()
+	require.Equal(t, 0.0, c.SetBufferPressure())
+}
+
+func TestCacheGetOrSet(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	const callers = 10
+	var computed atomic.Int64
+	release := make(chan struct{})
+	compute := func() (any, error) {
+		computed.Add(1)
+		<-release
+		return "value", nil
+	}
+
+	results := make(chan any, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := c.GetOrSet("key", 1, compute)
+			if err != nil {
+				t.Errorf("GetOrSet failed: %v", err)
+				return
+			}
+			results <- value
+		}()
+	}
+	// Let all the callers wait for the first computation.
+	time.Sleep(wait)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	require.Equal(t, int64(1), computed.Load())
+	for value := range results {
+		require.Equal(t, "value", value)
+	}
+	c.Wait()
+	value, ok := c.Get("key")
+	require.True(t, ok)
+	require.Equal(t, "value", value)
+
+	// A cached value isn't computed again.
+	value, err = c.GetOrSet("key", 1, func() (any, error) {
+		t.Error("compute called for a cached key")
+		return nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "value", value)
+}
+
+func TestCacheGetOrSetError(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	const callers = 10
+	computeErr := errors.New("compute failed")
+	var computed atomic.Int64
+	release := make(chan struct{})
+	compute := func() (any, error) {
+		computed.Add(1)
+		<-release
+		return nil, computeErr
+	}
+
+	errs := make(chan error, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.GetOrSet("key", 1, compute)
+			errs <- err
+		}()
+	}
+	time.Sleep(wait)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	require.Equal(t, int64(1), computed.Load())
+	for err := range errs {
+		require.ErrorIs(t, err, computeErr)
+	}
+
+	// The error isn't cached.
+	c.Wait()
+	_, ok := c.Get("key")
+	require.False(t, ok)
+	value, err := c.GetOrSet("key", 1, func() (any, error) {
+		return "value", nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "value", value)
+
+	c.Close()
+	_, err = c.GetOrSet("key", 1, compute)
+	require.ErrorIs(t, err, ErrCacheClosed)
+}
+
+func TestCacheGetMulti(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithCost("a", 1, 1))
+	require.True(t, c.SetWithCost("b", 2, 1))
+	require.True(t, c.SetWithCost("nil", nil, 1))
+	c.Wait()
+
+	values := c.GetMulti([]string{"a", "b", "nil", "missing", "a"})
+	require.Equal(t, map[string]any{"a": 1, "b": 2, "nil": nil}, values)
+	require.Equal(t, uint64(4), c.Metrics.Hits())
+	require.Equal(t, uint64(1), c.Metrics.Misses())
+
+	require.Empty(t, c.GetMulti(nil))
+
+	c.Close()
+	require.Nil(t, c.GetMulti([]string{"a"}))
+}
+
+func TestCachePeek(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        1,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithCost("a", 1, 1))
+	require.True(t, c.SetWithCost("nil", nil, 1))
+	c.Wait()
+	estimates := func() map[uint64]int64 {
+		hits := make(map[uint64]int64)
+		for _, entry := range c.policy.Hottest(10) {
+			hits[entry.KeyHash] = entry.Hits
+		}
+		return hits
+	}
+	hits := estimates()
+
+	value, ok := c.Peek("a")
+	require.True(t, ok)
+	require.Equal(t, 1, value)
+	value, ok = c.Peek("nil")
+	require.True(t, ok)
+	require.Nil(t, value)
+	_, ok = c.Peek("missing")
+	require.False(t, ok)
+
+	// With BufferItems == 1, every Get would be pushed to the policy at once.
+	time.Sleep(wait)
+	require.Equal(t, hits, estimates())
+	require.Equal(t, uint64(0), c.Metrics.Hits())
+	require.Equal(t, uint64(0), c.Metrics.Misses())
+
+	c.Close()
+	_, ok = c.Peek("a")
+	require.False(t, ok)
+}
+
+func TestCacheHas(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithCost("a", 1, 1))
+	require.True(t, c.SetWithCost("nil", nil, 1))
+	require.True(t, c.SetWithTTL("expiring", 2, 1, 50*time.Millisecond))
+	c.Wait()
+
+	require.True(t, c.Has("a"))
+	require.True(t, c.Has("nil"))
+	require.True(t, c.Has("expiring"))
+	require.False(t, c.Has("missing"))
+
+	time.Sleep(100 * time.Millisecond)
+	require.False(t, c.Has("expiring"))
+
+	require.Equal(t, uint64(0), c.Metrics.Hits())
+	require.Equal(t, uint64(0), c.Metrics.Misses())
+}
+
+func TestCacheSetBufferSize(t *testing.T) {
+	// burst returns how many of a burst of Sets are dropped while processItems
+	// is blocked computing the cost of the first one.
+	burst := func(bufferSize int) uint64 {
+		blocked := make(chan struct{})
+		release := make(chan struct{})
+		var once sync.Once
+		c, err := NewCache(&Config{
+			NumCounters:        1000,
+			MaxCost:            1000,
+			BufferItems:        64,
+			SetBufferSize:      bufferSize,
+			IgnoreInternalCost: true,
+			Metrics:            true,
+			Cost: func(value any) int64 {
+				once.Do(func() {
+					close(blocked)
+					<-release
+				})
+				return 1
+			},
+		})
+		require.NoError(t, err)
+		defer c.Close()
+
+		c.Set("0", 0)
+		<-blocked
+		for i := 1; i <= 100; i++ {
+			c.Set(strconv.Itoa(i), i)
+		}
+		close(release)
+		c.Wait()
+		return c.Metrics.SetsDropped()
+	}
+
+	require.Equal(t, uint64(90), burst(10))
+	require.Equal(t, uint64(0), burst(100))
+
+	_, err := NewCache(&Config{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		SetBufferSize: -1,
+	})
+	require.Error(t, err)
+}
+
+func TestCacheWaitWithContext(t *testing.T) {
+	// The first value whose cost is computed blocks processItems until it's
+	// released.
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		SetBufferSize:      2,
+		IgnoreInternalCost: true,
+		Cost: func(value any) int64 {
+			once.Do(func() {
+				close(blocked)
+				<-release
+			})
+			return 1
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.WaitWithContext(context.Background()))
+
+	c.Set("a", 1)
+	<-blocked
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	require.ErrorIs(t, c.WaitWithContext(ctx), context.DeadlineExceeded)
+
+	// The buffer is full, so the wait can't even start.
+	c.Set("b", 2)
+	ctx, cancel = context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	require.ErrorIs(t, c.WaitWithContext(ctx), context.DeadlineExceeded)
+
+	close(release)
+	require.NoError(t, c.WaitWithContext(context.Background()))
+	_, ok := c.Get("b")
+	require.True(t, ok)
+
+	c.Close()
+	require.ErrorIs(t, c.WaitWithContext(context.Background()), ErrCacheClosed)
+	var nilCache *Cache
+	require.ErrorIs(t, nilCache.WaitWithContext(context.Background()), ErrCacheClosed)
+}
+
+func TestCacheWaitErr(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+
+	require.True(t, c.SetWithCost("a", 1, 1))
+	require.NoError(t, c.WaitErr())
+	_, ok := c.Get("a")
+	require.True(t, ok)
+
+	c.Close()
+	require.ErrorIs(t, c.WaitErr(), ErrCacheClosed)
+
+	var nilCache *Cache
+	require.ErrorIs(t, nilCache.WaitErr(), ErrCacheClosed)
+}
+
+func TestCacheDeleteMulti(t *testing.T) {
+	var mu sync.Mutex
+	var exited []any
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		OnExit: func(val any) {
+			mu.Lock()
+			defer mu.Unlock()
+			exited = append(exited, val)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithCost("a", 1, 1))
+	require.True(t, c.SetWithCost("b", 2, 1))
+	require.True(t, c.SetWithCost("c", 3, 1))
+	c.Wait()
+
+	c.DeleteMulti([]string{"a", "b", "missing"})
+	// The keys are deleted from the store at once.
+	require.False(t, c.Has("a"))
+	require.False(t, c.Has("b"))
+	require.True(t, c.Has("c"))
+	c.Wait()
+	require.Equal(t, int64(1), c.UsedCapacity())
+	mu.Lock()
+	require.ElementsMatch(t, []any{1, 2}, exited)
+	mu.Unlock()
+}
+
+func TestCacheDeleteMultiFullBuffer(t *testing.T) {
+	// The first value whose cost is computed blocks processItems until it's
+	// released.
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		SetBufferSize:      1,
+		IgnoreInternalCost: true,
+		Cost: func(value any) int64 {
+			once.Do(func() {
+				close(blocked)
+				<-release
+			})
+			return 1
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithCost("a", 1, 1))
+	c.Wait()
+	c.Set("b", 2)
+	<-blocked
+	require.True(t, c.SetWithCost("c", 3, 1))
+
+	// The buffer is full, so DeleteMulti waits for room, as Delete does,
+	// rather than let the pending Set of c bring it back.
+	deleted := make(chan struct{})
+	go func() {
+		defer close(deleted)
+		c.DeleteMulti([]string{"a", "c"})
+	}()
+	select {
+	case <-deleted:
+		close(release)
+		t.Fatal("DeleteMulti didn't wait for room in the set buffer")
+	case <-time.After(wait):
+	}
+	require.False(t, c.Has("a"))
+
+	close(release)
+	<-deleted
+	c.Wait()
+	_, ok := c.Get("a")
+	require.False(t, ok)
+	_, ok = c.Get("c")
+	require.False(t, ok)
+	require.Equal(t, int64(1), c.UsedCapacity())
+}
+
+func TestCacheDeleteIf(t *testing.T) {
+	type tenantValue struct {
+		tenant string
+		value  int
+	}
+	var mu sync.Mutex
+	var exited []any
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		OnExit: func(val any) {
+			mu.Lock()
+			defer mu.Unlock()
+			exited = append(exited, val)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithCost("a1", tenantValue{"a", 1}, 1))
+	require.True(t, c.SetWithCost("a2", tenantValue{"a", 2}, 1))
+	require.True(t, c.SetWithCost("b1", tenantValue{"b", 1}, 1))
+	c.Wait()
+
+	c.DeleteIf(func(value any) bool {
+		return value.(tenantValue).tenant == "a"
+	})
+	require.False(t, c.Has("a1"))
+	require.False(t, c.Has("a2"))
+	require.True(t, c.Has("b1"))
+	c.Wait()
+	require.Equal(t, 1, c.Len())
+	require.Equal(t, int64(1), c.UsedCapacity())
+	mu.Lock()
+	require.ElementsMatch(t, []any{tenantValue{"a", 1}, tenantValue{"a", 2}}, exited)
+	mu.Unlock()
+
+	// Nothing matches.
+	c.DeleteIf(func(value any) bool { return false })
+	c.Wait()
+	require.Equal(t, 1, c.Len())
+}
+
+func TestCacheCompareAndSwap(t *testing.T) {
+	var mu sync.Mutex
+	var exited []any
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		OnExit: func(val any) {
+			mu.Lock()
+			defer mu.Unlock()
+			exited = append(exited, val)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.False(t, c.CompareAndSwap("config", nil, "v1", 1))
+	require.True(t, c.SetWithCost("config", "v1", 1))
+	c.Wait()
+
+	require.False(t, c.CompareAndSwap("config", "v0", "v2", 1))
+	require.True(t, c.CompareAndSwap("config", "v1", "v2", 3))
+	val, ok := c.Get("config")
+	require.True(t, ok)
+	require.Equal(t, "v2", val)
+	c.Wait()
+	require.Equal(t, int64(3), c.UsedCapacity())
+	mu.Lock()
+	require.Equal(t, []any{"v1"}, exited)
+	mu.Unlock()
+
+	// Only one of concurrent swaps from the same value succeeds.
+	var swapped atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if c.CompareAndSwap("config", "v2", fmt.Sprintf("v3-%d", i), 1) {
+				swapped.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, int64(1), swapped.Load())
+
+	// Values that aren't comparable need CompareAndSwapFunc.
+	require.True(t, c.SetWithCost("slice", []int{1}, 1))
+	c.Wait()
+	require.True(t, c.CompareAndSwapFunc("slice", func(current any) bool {
+		return slices.Equal(current.([]int), []int{1})
+	}, []int{2}, 1))
+	val, _ = c.Get("slice")
+	require.Equal(t, []int{2}, val)
+}
+
+func TestCacheIncrement(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Concurrent increments of a missing key don't get lost.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, ok := c.Increment("counter", 1, 2); !ok {
+					t.Error("Increment failed")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	val, ok := c.Get("counter")
+	require.True(t, ok)
+	require.Equal(t, int64(1000), val)
+	c.Wait()
+	require.Equal(t, 1, c.Len())
+	require.Equal(t, int64(2), c.UsedCapacity())
+
+	n, ok := c.Increment("counter", -10, 5)
+	require.True(t, ok)
+	require.Equal(t, int64(990), n)
+	c.Wait()
+	require.Equal(t, int64(2), c.UsedCapacity())
+
+	require.True(t, c.SetWithCost("string", "1", 1))
+	c.Wait()
+	_, ok = c.Increment("string", 1, 1)
+	require.False(t, ok)
+
+	// An expired counter starts over.
+	require.True(t, c.SetWithTTL("expiring", int64(5), 1, 50*time.Millisecond))
+	c.Wait()
+	time.Sleep(100 * time.Millisecond)
+	n, ok = c.Increment("expiring", 1, 1)
+	require.True(t, ok)
+	require.Equal(t, int64(1), n)
+	c.Wait()
+	require.Equal(t, 3, c.Len())
+	require.Equal(t, int64(4), c.UsedCapacity())
+}
+
+func TestCacheForEachKey(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	type hashes struct{ key, conflict uint64 }
+	expected := make(map[hashes]any)
+	for i, key := range []string{"a", "b", "c"} {
+		require.True(t, c.SetWithCost(key, i, 1))
+		keyHash, conflictHash := defaultStringHash(key)
+		expected[hashes{keyHash, conflictHash}] = i
+	}
+	c.Wait()
+
+	got := make(map[hashes]any)
+	c.ForEachKey(func(keyHash, conflictHash uint64, value any) bool {
+		got[hashes{keyHash, conflictHash}] = value
+		return true
+	})
+	require.Equal(t, expected, got)
+
+	// Returning false stops the iteration.
+	var calls int
+	c.ForEachKey(func(_, _ uint64, _ any) bool {
+		calls++
+		return false
+	})
+	require.Equal(t, 1, calls)
+}
+
+func TestCacheEvictChan(t *testing.T) {
+	evicted := make(chan *Item, 1)
+	var exited atomic.Int64
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            1,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		EvictChan:          evicted,
+		OnExit: func(val any) {
+			exited.Add(1)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Without any Get, every new item evicts the previous one.
+	for i, key := range []string{"a", "b", "c"} {
+		require.True(t, c.SetWithCost(key, i, 1))
+		c.Wait()
+	}
+
+	item := <-evicted
+	keyHash, _ := defaultStringHash("a")
+	require.Equal(t, keyHash, item.Key)
+	require.Equal(t, 0, item.Value)
+	// The eviction of b was dropped, since nobody was receiving.
+	require.Equal(t, uint64(2), c.Metrics.KeysEvicted())
+	require.Equal(t, uint64(1), c.Metrics.EvictsDropped())
+	require.Equal(t, int64(2), exited.Load())
+
+	_, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     1,
+		BufferItems: 64,
+		EvictChan:   evicted,
+		OnEvict:     func(item *Item) {},
+	})
+	require.Error(t, err)
+}
+
+func TestCacheEvictChanClear(t *testing.T) {
+	const n = 90
+	evicted := make(chan *Item, n)
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            n,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		EvictChan:          evicted,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	want := make(map[uint64]any, n)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%d", i)
+		require.True(t, c.SetWithCost(key, i, 1))
+		c.Wait()
+		keyHash, _ := defaultStringHash(key)
+		want[keyHash] = i
+	}
+	require.Len(t, c.KeyHashes(), n)
+
+	c.Clear()
+	got := make(map[uint64]any, n)
+	seen := make(map[*Item]bool, n)
+	for i := 0; i < n; i++ {
+		item := <-evicted
+		require.False(t, seen[item], "item %p received twice", item)
+		seen[item] = true
+		got[item.Key] = item.Value
+	}
+	require.Equal(t, want, got)
+}
+
+func TestCacheEvictReason(t *testing.T) {
+	var mu sync.Mutex
+	reasons := make(map[any]EvictReason)
+	record := func(item *Item) {
+		mu.Lock()
+		defer mu.Unlock()
+		reasons[item.Value] = item.Reason
+	}
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            2,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		OnEvict:            record,
+		OnReject:           record,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithCost("a", "capacity", 2))
+	c.Wait()
+	require.True(t, c.SetWithCost("b", "rejected", 3))
+	c.Wait()
+	require.True(t, c.SetWithCost("c", "replaced", 2))
+	c.Wait()
+	require.True(t, c.SetWithTTL("d", "expired", 0, 50*time.Millisecond))
+	c.Wait()
+	time.Sleep(100 * time.Millisecond)
+	_, ok := c.Get("d")
+	require.False(t, ok)
+	require.NoError(t, c.ReplaceAll([]Entry{{Key: "e", Value: "deleted", Cost: 1}}))
+	c.Clear()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, map[any]EvictReason{
+		"capacity": EvictCapacity,
+		"rejected": EvictRejected,
+		"replaced": EvictReplaced,
+		"expired":  EvictExpired,
+		"deleted":  EvictDeleted,
+	}, reasons)
+	require.Equal(t, "expired", EvictExpired.String())
+	require.Equal(t, "EvictReason(42)", EvictReason(42).String())
+}
+
+func TestCacheResizeCounters(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        10,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		require.True(t, c.SetWithCost(strconv.Itoa(i), i, 1))
+	}
+	c.Wait()
+
+	c.ResizeCounters(1000)
+	require.Equal(t, int64(1000), c.policy.(*defaultPolicy).numCounters)
+	// A number of counters that isn't positive is ignored.
+	c.ResizeCounters(0)
+	require.Equal(t, int64(1000), c.policy.(*defaultPolicy).numCounters)
+
+	for i := 0; i < 10; i++ {
+		val, ok := c.Get(strconv.Itoa(i))
+		require.True(t, ok)
+		require.Equal(t, i, val)
+	}
+	require.Equal(t, int64(10), c.UsedCapacity())
+
+	// New entries are still admitted after the resize.
+	for i := 10; i < 20; i++ {
+		require.True(t, c.SetWithCost(strconv.Itoa(i), i, 1))
+	}
+	c.Wait()
+	for i := 10; i < 20; i++ {
+		val, ok := c.Get(strconv.Itoa(i))
+		require.True(t, ok)
+		require.Equal(t, i, val)
+	}
+	require.Equal(t, int64(20), c.UsedCapacity())
+}
+
+func TestCacheFillRatio(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Equal(t, float64(0), c.FillRatio())
+	require.Equal(t, int64(10), c.Headroom())
+
+	require.True(t, c.SetWithCost("a", 1, 4))
+	c.Wait()
+	require.Equal(t, 0.4, c.FillRatio())
+	require.Equal(t, int64(6), c.Headroom())
+
+	// The cache is over its capacity until the next items are added.
+	c.SetCapacity(2)
+	require.Equal(t, float64(2), c.FillRatio())
+	require.Equal(t, int64(0), c.Headroom())
+
+	c.SetCapacity(0)
+	require.Equal(t, float64(0), c.FillRatio())
+	require.Equal(t, int64(0), c.Headroom())
+
+	var nilCache *Cache
+	require.Equal(t, float64(0), nilCache.FillRatio())
+	require.Equal(t, int64(0), nilCache.Headroom())
+}
+
+func TestCacheGetWithCost(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithCost("a", 1, 3))
+	c.Wait()
+
+	val, cost, ok := c.GetWithCost("a")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.Equal(t, int64(3), cost)
+
+	val, cost, ok = c.GetWithCost("missing")
+	require.False(t, ok)
+	require.Nil(t, val)
+	require.Equal(t, int64(0), cost)
+
+	require.Equal(t, uint64(1), c.Metrics.Hits())
+	require.Equal(t, uint64(1), c.Metrics.Misses())
+
+	// The cost of a value added by Increment is recorded once it's admitted.
+	_, ok = c.Increment("n", 1, 2)
+	require.True(t, ok)
+	c.Wait()
+	_, cost, ok = c.GetWithCost("n")
+	require.True(t, ok)
+	require.Equal(t, int64(2), cost)
+}
+
+func TestCacheUpdateCost(t *testing.T) {
+	for _, ignoreInternalCost := range []bool{true, false} {
+		c, err := NewCache(&Config{
+			NumCounters:        100,
+			MaxCost:            1000,
+			BufferItems:        64,
+			IgnoreInternalCost: ignoreInternalCost,
+		})
+		require.NoError(t, err)
+
+		var internalCost int64
+		if !ignoreInternalCost {
+			internalCost = CacheItemSize
+		}
+		require.True(t, c.SetWithCost("a", []int{1}, 1))
+		c.Wait()
+		require.Equal(t, 1+internalCost, c.UsedCapacity())
+
+		require.True(t, c.UpdateCost("a", 5))
+		require.Equal(t, 5+internalCost, c.UsedCapacity())
+		val, ok := c.Get("a")
+		require.True(t, ok)
+		require.Equal(t, []int{1}, val)
+
+		require.False(t, c.UpdateCost("missing", 5))
+		require.Equal(t, 5+internalCost, c.UsedCapacity())
+
+		c.Close()
+		require.False(t, c.UpdateCost("a", 1))
+	}
+}
+
+func TestCacheKeyHashes(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Empty(t, c.KeyHashes())
+
+	var want []uint64
+	for _, key := range []string{"a", "b", "c"} {
+		require.True(t, c.SetWithCost(key, key, 1))
+		keyHash, _ := defaultStringHash(key)
+		want = append(want, keyHash)
+	}
+	c.Wait()
+	require.ElementsMatch(t, want, c.KeyHashes())
+
+	c.Delete("b")
+	require.ElementsMatch(t, []uint64{want[0], want[2]}, c.KeyHashes())
+
+	var nilCache *Cache
+	require.Nil(t, nilCache.KeyHashes())
+}
+
+func TestCacheHotKeys(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        1,
+		IgnoreInternalCost: true,
+		TrackHotKeys:       2,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithCost("a", 1, 1))
+	c.Wait()
+	for key, gets := range map[string]int{"a": 5, "b": 3, "c": 1} {
+		for i := 0; i < gets; i++ {
+			c.Get(key)
+			// Leave time to the policy to process the Get, so it isn't dropped.
+			time.Sleep(time.Millisecond)
+		}
+	}
+	time.Sleep(wait)
+
+	// The key b isn't in the cache, but it's still hot.
+	aHash, _ := defaultStringHash("a")
+	bHash, _ := defaultStringHash("b")
+	require.Equal(t, []HotKey{{KeyHash: aHash, Hits: 5}, {KeyHash: bHash, Hits: 3}}, c.HotKeys())
+
+	c.Clear()
+	require.Empty(t, c.HotKeys())
+
+	c2, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c2.Close()
+	require.Nil(t, c2.HotKeys())
+
+	_, err = NewCache(&Config{
+		NumCounters:  100,
+		MaxCost:      10,
+		BufferItems:  64,
+		TrackHotKeys: -1,
+	})
+	require.Error(t, err)
+}
+
+func TestCacheHashSeeds(t *testing.T) {
+	seeds := [2]uint64{1, 2}
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		HashSeeds:          seeds,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	keyHash, conflictHash := c.keyToHash("a")
+	require.Equal(t, hack.RuntimeStrhash("a", seeds[0]), keyHash)
+	require.Equal(t, hack.RuntimeStrhash("a", seeds[1]), conflictHash)
+	other, _ := defaultStringHash("a")
+	require.NotEqual(t, other, keyHash)
+
+	require.True(t, c.SetWithCost("a", 1, 1))
+	c.Wait()
+	require.Equal(t, []uint64{keyHash}, c.KeyHashes())
+
+	// Two keys whose 64-bit hashes collide can't be found, so store a value
+	// under the key hash of b with another conflict hash, as such a key would
+	// be. The conflict hash of b tells it apart.
+	bKeyHash, bConflictHash := c.keyToHash("b")
+	c.store.Set(&Item{Key: bKeyHash, Conflict: bConflictHash + 1, Value: "collision"})
+	_, ok := c.Get("b")
+	require.False(t, ok)
+	val, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+
+	_, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		HashSeeds:   seeds,
+		KeyToHash:   defaultStringHash,
+	})
+	require.Error(t, err)
+}
+
+func TestCacheConflicts(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithCost("a", 1, 1))
+	c.Wait()
+	_, ok := c.Get("a")
+	require.True(t, ok)
+	_, ok = c.Get("missing")
+	require.False(t, ok)
+	require.Zero(t, c.Metrics.Conflicts())
+
+	// Store a value under the key hash of b, as a key colliding with it would.
+	keyHash, conflictHash := c.keyToHash("b")
+	c.store.Set(&Item{Key: keyHash, Conflict: conflictHash + 1, Value: "collision"})
+	_, ok = c.Get("b")
+	require.False(t, ok)
+	require.Equal(t, uint64(1), c.Metrics.Conflicts())
+	require.Contains(t, c.Metrics.String(), "conflicts: 1 ")
+}
+
+func TestCacheWarm(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        10000,
+		MaxCost:            1000,
+		BufferItems:        64,
+		SetBufferSize:      10,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Far more entries than the set buffer can hold are all added.
+	entries := make(map[string]any)
+	for i := 0; i < 500; i++ {
+		entries[strconv.Itoa(i)] = i
+	}
+	require.Equal(t, 500, c.Warm(entries, func(value any) int64 {
+		return 2
+	}))
+	require.Equal(t, 500, c.Len())
+	require.Equal(t, int64(1000), c.UsedCapacity())
+	require.Equal(t, uint64(500), c.Metrics.KeysAdded())
+	require.Zero(t, c.Metrics.SetsDropped())
+	for key, value := range entries {
+		val, ok := c.Get(key)
+		require.True(t, ok, key)
+		require.Equal(t, value, val)
+	}
+
+	// An entry that is already in the cache is updated.
+	require.Equal(t, 1, c.Warm(map[string]any{"0": "updated"}, nil))
+	val, ok := c.Get("0")
+	require.True(t, ok)
+	require.Equal(t, "updated", val)
+
+	// An entry over the capacity is rejected.
+	require.Equal(t, 0, c.Warm(map[string]any{"big": 1}, func(value any) int64 {
+		return 2000
+	}))
+	_, ok = c.Get("big")
+	require.False(t, ok)
+
+	// The cache works as usual afterwards.
+	require.True(t, c.SetWithCost("0", "set", 2))
+	c.Wait()
+	val, ok = c.Get("0")
+	require.True(t, ok)
+	require.Equal(t, "set", val)
+
+	c.Close()
+	require.Zero(t, c.Warm(entries, nil))
+}
+
+// fakeClock is a Clock that only moves forward when it's advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestCacheClock(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var expired []any
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Clock:              clock,
+		OnEvict: func(item *Item) {
+			if item.Reason == EvictExpired {
+				expired = append(expired, item.Value)
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL("a", 1, 1, 10*time.Second))
+	c.Wait()
+	ttl, ok := c.GetTTL("a")
+	require.True(t, ok)
+	require.Equal(t, 10*time.Second, ttl)
+
+	clock.Advance(9 * time.Second)
+	ttl, ok = c.GetTTL("a")
+	require.True(t, ok)
+	require.Equal(t, time.Second, ttl)
+
+	// The value expires right after its expiration time.
+	clock.Advance(time.Second)
+	val, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	clock.Advance(time.Nanosecond)
+	_, ok = c.Get("a")
+	require.False(t, ok)
+	require.Equal(t, []any{1}, expired)
+	require.Zero(t, c.Len())
+}
+
+func TestCacheShardStats(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        10000,
+		MaxCost:            1000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 500; i++ {
+		require.True(t, c.SetWithCost(strconv.Itoa(i), i, 1))
+		// Don't let the set buffer drop any set.
+		if i%100 == 0 {
+			c.Wait()
+		}
+	}
+	c.Wait()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c.Get(strconv.Itoa(i % 500))
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := c.ShardStats()
+	require.Len(t, stats, int(numShards))
+	entries := 0
+	for _, stat := range stats {
+		entries += stat.Entries
+	}
+	require.Equal(t, c.Len(), entries)
+
+	c2, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c2.Close()
+	require.Nil(t, c2.ShardStats())
+}
+
+func TestCacheSetIfAbsent(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Only one of the concurrent fills wins.
+	var wg sync.WaitGroup
+	var winners atomic.Int64
+	var winner atomic.Int64
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if c.SetIfAbsent("a", i, 1) {
+				winners.Add(1)
+				winner.Store(int64(i))
+			}
+		}(i)
+	}
+	wg.Wait()
+	c.Wait()
+	require.Equal(t, int64(1), winners.Load())
+	val, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, int(winner.Load()), val)
+	require.Equal(t, int64(1), c.UsedCapacity())
+	require.Equal(t, uint64(1), c.Metrics.KeysAdded())
+
+	require.True(t, c.SetWithCost("b", 1, 1))
+	c.Wait()
+	require.False(t, c.SetIfAbsent("b", 2, 5))
+	c.Wait()
+	val, _ = c.Get("b")
+	require.Equal(t, 1, val)
+	require.Equal(t, int64(2), c.UsedCapacity())
+	require.Zero(t, c.Metrics.KeysUpdated())
+
+	// A value that the policy rejects is removed.
+	require.True(t, c.SetIfAbsent("big", 1, 100))
+	c.Wait()
+	_, ok = c.Get("big")
+	require.False(t, ok)
+}
+
+func TestCacheRefreshAhead(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var loads atomic.Int64
+	loading := make(chan struct{}, 1)
+	release := make(chan error)
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Clock:              clock,
+		RefreshAhead:       2 * time.Second,
+		RefreshTTL:         5 * time.Second,
+		Loader: func(key uint64) (any, int64, error) {
+			n := loads.Add(1)
+			loading <- struct{}{}
+			if err := <-release; err != nil {
+				return nil, 0, err
+			}
+			return int(n), 1, nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL("a", 0, 1, 10*time.Second))
+	c.Wait()
+
+	// Out of the refresh window, nothing is loaded.
+	val, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 0, val)
+	time.Sleep(wait)
+	require.Zero(t, loads.Load())
+
+	// In the refresh window, the stale value is returned while it's reloaded,
+	// only once.
+	clock.Advance(9 * time.Second)
+	for i := 0; i < 3; i++ {
+		val, ok = c.Get("a")
+		require.True(t, ok)
+		require.Equal(t, 0, val)
+	}
+	<-loading
+	release <- nil
+	require.Eventually(t, func() bool {
+		val, _ := c.Get("a")
+		return val == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, int64(1), loads.Load())
+	ttl, ok := c.GetTTL("a")
+	require.True(t, ok)
+	require.Equal(t, 5*time.Second, ttl)
+
+	// A failed reload leaves the value until it expires.
+	clock.Advance(4 * time.Second)
+	val, ok = c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	<-loading
+	release <- errors.New("load failed")
+	require.Eventually(t, func() bool {
+		c.refreshMu.Lock()
+		defer c.refreshMu.Unlock()
+		return len(c.refreshing) == 0
+	}, time.Second, time.Millisecond)
+	clock.Advance(time.Second + time.Nanosecond)
+	_, ok = c.Get("a")
+	require.False(t, ok)
+
+	for _, config := range []*Config{
+		{RefreshAhead: -1},
+		{RefreshAhead: time.Second, RefreshTTL: time.Second},
+		{RefreshAhead: time.Second, Loader: func(uint64) (any, int64, error) { return nil, 0, nil }},
+	} {
+		config.NumCounters = 100
+		config.MaxCost = 10
+		config.BufferItems = 64
+		_, err := NewCache(config)
+		require.Error(t, err)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestCacheDebugDump(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	var buf strings.Builder
+	require.NoError(t, c.DebugDump(&buf))
+	require.Empty(t, buf.String())
+
+	require.True(t, c.SetWithCost("a", 1, 2))
+	require.True(t, c.SetWithTTL("b", 2, 3, 10*time.Second))
+	c.Wait()
+	clock.Advance(4 * time.Second)
+
+	aKey, aConflict := defaultStringHash("a")
+	bKey, bConflict := defaultStringHash("b")
+	require.NoError(t, c.DebugDump(&buf))
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.ElementsMatch(t, []string{
+		fmt.Sprintf("key=%016x conflict=%016x cost=2 ttl=none", aKey, aConflict),
+		fmt.Sprintf("key=%016x conflict=%016x cost=3 ttl=6s", bKey, bConflict),
+	}, lines)
+
+	require.Error(t, c.DebugDump(failingWriter{}))
+}
+
+func TestCacheCloseAndDrain(t *testing.T) {
+	newBlockedCache := func() (*Cache, chan struct{}, chan struct{}) {
+		// The first value whose cost is computed blocks processItems until
+		// it's released.
+		blocked := make(chan struct{})
+		release := make(chan struct{})
+		var once sync.Once
+		c, err := NewCache(&Config{
+			NumCounters:        100,
+			MaxCost:            10,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			Metrics:            true,
+			Cost: func(value any) int64 {
+				once.Do(func() {
+					close(blocked)
+					<-release
+				})
+				return 1
+			},
+		})
+		require.NoError(t, err)
+		return c, blocked, release
+	}
+
+	c, blocked, release := newBlockedCache()
+	c.Set("a", 1)
+	<-blocked
+	c.Set("b", 2)
+	drained := make(chan error)
+	go func() {
+		drained <- c.CloseAndDrain(context.Background())
+	}()
+	require.Eventually(t, c.isClosed.Load, time.Second, time.Millisecond)
+	require.False(t, c.Set("c", 3))
+	close(release)
+	require.NoError(t, <-drained)
+	// The pending Set was processed before closing.
+	require.Equal(t, uint64(2), c.Metrics.KeysAdded())
+	require.ErrorIs(t, c.CloseAndDrain(context.Background()), ErrCacheClosed)
+	c.Close()
+
+	// When ctx is done first, the cache is closed without waiting for the
+	// pending Sets.
+	c, blocked, release = newBlockedCache()
+	c.Set("a", 1)
+	<-blocked
+	c.Set("b", 2)
+	go func() {
+		// processItems can't be stopped before it's released.
+		time.Sleep(2 * wait)
+		close(release)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	require.ErrorIs(t, c.CloseAndDrain(ctx), context.DeadlineExceeded)
+	require.True(t, c.isClosed.Load())
+
+	var nilCache *Cache
+	require.ErrorIs(t, nilCache.CloseAndDrain(context.Background()), ErrCacheClosed)
+}
+
+func TestCacheSetNegative(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var exited []any
+	var evicted []any
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Clock:              clock,
+		Cost: func(value any) int64 {
+			require.IsType(t, 0, value)
+			return 1
+		},
+		OnExit: func(val any) {
+			exited = append(exited, val)
+		},
+		OnEvict: func(item *Item) {
+			evicted = append(evicted, item.Value)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetNegative("missing", time.Second))
+	require.True(t, c.Set("a", 1))
+	c.Wait()
+
+	val, ok := c.Get("missing")
+	require.True(t, ok)
+	require.Nil(t, val)
+	val, ok = c.Peek("missing")
+	require.True(t, ok)
+	require.Nil(t, val)
+	require.Equal(t, map[string]any{"missing": nil, "a": 1}, c.GetMulti([]string{"missing", "a", "absent"}))
+	_, ok = c.Get("absent")
+	require.False(t, ok)
+	var values []any
+	c.ForEach(func(value any) bool {
+		values = append(values, value)
+		return true
+	})
+	require.ElementsMatch(t, []any{nil, 1}, values)
+
+	// The negative expires after its own TTL.
+	clock.Advance(time.Second + time.Nanosecond)
+	_, ok = c.Get("missing")
+	require.False(t, ok)
+	val, ok = c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.Equal(t, []any{nil}, evicted)
+	require.Empty(t, exited)
+}
+
+func TestCacheSetNegativeHidden(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var written []any
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Clock:              clock,
+		MaxSetsPerSecond:   1,
+		WriteThrough: func(key string, value any, cost int64) error {
+			written = append(written, value)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// The negatives neither go through WriteThrough nor use up the only set
+	// allowed this second.
+	require.True(t, c.SetNegative("missing", time.Second))
+	require.True(t, c.SetNegative("other", time.Second))
+	require.True(t, c.Set("a", 1))
+	require.False(t, c.Set("b", 2))
+	c.Wait()
+	require.Equal(t, []any{1}, written)
+
+	// The callbacks see nil instead of the negative.
+	var compared []any
+	require.True(t, c.CompareAndSwapFunc("missing", func(current any) bool {
+		compared = append(compared, current)
+		return true
+	}, "found", 1))
+	require.Equal(t, []any{nil}, compared)
+	var deleted []any
+	c.DeleteIf(func(value any) bool {
+		deleted = append(deleted, value)
+		return value == nil
+	})
+	require.ElementsMatch(t, []any{nil, 1, "found"}, deleted)
+	c.Wait()
+	_, ok := c.Get("other")
+	require.False(t, ok)
+
+	// MergeHot keeps the TTL of the negatives.
+	require.True(t, c.SetNegative("merged", time.Second))
+	c.Wait()
+	dst, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer dst.Close()
+	require.Equal(t, 3, dst.MergeHot(c, 10))
+	dst.Wait()
+	ttl, ok := dst.GetTTL("merged")
+	require.True(t, ok)
+	require.Equal(t, time.Second, ttl)
+	val, ok := dst.Get("merged")
+	require.True(t, ok)
+	require.Nil(t, val)
+	clock.Advance(time.Second + time.Nanosecond)
+	_, ok = dst.Get("merged")
+	require.False(t, ok)
+	ttl, ok = dst.GetTTL("a")
+	require.True(t, ok)
+	require.Zero(t, ttl)
+}
+
+func TestCacheLifespanHistogram(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            1,
+		BufferItems:        64,
+		Metrics:            true,
+		IgnoreInternalCost: true,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Each key evicts the previous one, as none of them was ever read.
+	require.True(t, c.SetWithCost("a", 1, 1))
+	c.Wait()
+	clock.Advance(5 * time.Second)
+	require.True(t, c.SetWithCost("b", 2, 1))
+	c.Wait()
+	clock.Advance(2 * time.Hour)
+	require.True(t, c.SetWithCost("c", 3, 1))
+	c.Wait()
+
+	buckets := c.LifespanHistogram()
+	require.Len(t, buckets, len(lifespanBounds)+1)
+	counts := make(map[time.Duration]uint64)
+	for _, b := range buckets {
+		if b.Count > 0 {
+			counts[b.UpperBound] = b.Count
+		}
+	}
+	require.Equal(t, map[time.Duration]uint64{
+		10 * time.Second: 1,
+		24 * time.Hour:   1,
+	}, counts)
+	require.Equal(t, time.Duration(math.MaxInt64), buckets[len(buckets)-1].UpperBound)
+
+	// The admission times are kept when the processing of the sets restarts.
+	_, err = c.SnapshotConsistent()
+	require.NoError(t, err)
+	clock.Advance(time.Minute)
+	require.True(t, c.SetWithCost("d", 4, 1))
+	c.Wait()
+	buckets = c.LifespanHistogram()
+	require.Equal(t, time.Minute, buckets[5].UpperBound)
+	require.Equal(t, uint64(1), buckets[5].Count)
+
+	c.Metrics.Clear()
+	for _, b := range c.LifespanHistogram() {
+		require.Zero(t, b.Count)
+	}
+
+	var nilCache *Cache
+	require.Nil(t, nilCache.LifespanHistogram())
+	noMetrics, err := NewCache(&Config{NumCounters: 100, MaxCost: 10, BufferItems: 64})
+	require.NoError(t, err)
+	defer noMetrics.Close()
+	require.Nil(t, noMetrics.LifespanHistogram())
+}
+
+func TestCacheOnAdmit(t *testing.T) {
+	for _, updates := range []bool{false, true} {
+		t.Run(fmt.Sprintf("updates=%t", updates), func(t *testing.T) {
+			var mu sync.Mutex
+			admitted := make(map[uint64]int64)
+			var admits int
+			c, err := NewCache(&Config{
+				NumCounters:        100,
+				MaxCost:            1,
+				BufferItems:        64,
+				IgnoreInternalCost: true,
+				OnAdmit: func(item *Item) {
+					mu.Lock()
+					defer mu.Unlock()
+					admitted[item.Key] = item.Cost
+					admits++
+				},
+				OnAdmitUpdates: updates,
+				OnEvict: func(item *Item) {
+					mu.Lock()
+					defer mu.Unlock()
+					delete(admitted, item.Key)
+				},
+			})
+			require.NoError(t, err)
+			defer c.Close()
+
+			require.True(t, c.SetWithCost("a", 1, 1))
+			c.Wait()
+			require.True(t, c.SetWithCost("a", 2, 1))
+			c.Wait()
+			// b evicts a, as none of them was ever read.
+			require.True(t, c.SetWithCost("b", 3, 1))
+			c.Wait()
+
+			keyB, _ := c.keyToHash("b")
+			mu.Lock()
+			defer mu.Unlock()
+			require.Equal(t, map[uint64]int64{keyB: 1}, admitted)
+			if updates {
+				require.Equal(t, 3, admits)
+			} else {
+				require.Equal(t, 2, admits)
+			}
+		})
+	}
+}
+
+func TestCacheWithOverride(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+
+	c.SetWithCost("1", 1, 2)
+	c.Wait()
+
+	restored := c.WithOverride("1", 100, 3, func() {
+		val, ok := c.Get("1")
+		require.True(t, ok)
+		require.Equal(t, 100, val)
+		require.EqualValues(t, 3, c.UsedCapacity())
+	})
+	require.True(t, restored)
+	c.Wait()
+	val, ok := c.Get("1")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.EqualValues(t, 2, c.UsedCapacity())
+
+	restored = c.WithOverride("2", 200, 1, func() {
+		val, ok := c.Get("2")
+		require.True(t, ok)
+		require.Equal(t, 200, val)
+	})
+	require.False(t, restored)
+	c.Wait()
+	val, ok = c.Get("2")
+	require.False(t, ok)
+	require.Nil(t, val)
+	require.EqualValues(t, 2, c.UsedCapacity())
+}
+
+func TestCacheWithOverrideTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL("1", 1, 2, time.Minute))
+	c.Wait()
+
+	restored := c.WithOverride("1", 100, 3, func() {
+		ttl, ok := c.GetTTL("1")
+		require.True(t, ok)
+		require.Zero(t, ttl)
+		clock.Advance(10 * time.Second)
+	})
+	require.True(t, restored)
+	c.Wait()
+	val, ok := c.Get("1")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	ttl, ok := c.GetTTL("1")
+	require.True(t, ok)
+	require.Equal(t, 50*time.Second, ttl)
+
+	// A value that expires while fn runs isn't restored.
+	restored = c.WithOverride("1", 100, 3, func() {
+		clock.Advance(time.Minute)
+	})
+	require.True(t, restored)
+	c.Wait()
+	_, ok = c.Get("1")
+	require.False(t, ok)
+}
+
+func TestCacheWithOverrideWriteThrough(t *testing.T) {
+	backing := map[string]any{}
+	var failWrites bool
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		WriteThrough: func(key string, value any, cost int64) error {
+			if failWrites {
+				return errors.New("backing store is down")
+			}
+			backing[key] = value
+			return nil
+		},
+		DeleteThrough: func(key string) error {
+			if failWrites {
+				return errors.New("backing store is down")
+			}
+			delete(backing, key)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithCost("1", 1, 1))
+	c.Wait()
+
+	// Neither the temporary value nor the restore reach the backing store,
+	// even when it fails.
+	for _, fail := range []bool{false, true} {
+		failWrites = fail
+		restored := c.WithOverride("1", 100, 1, func() {
+			val, ok := c.Get("1")
+			require.True(t, ok)
+			require.Equal(t, 100, val)
+		})
+		require.True(t, restored)
+		c.Wait()
+		val, ok := c.Get("1")
+		require.True(t, ok)
+		require.Equal(t, 1, val)
+
+		require.False(t, c.WithOverride("2", 200, 1, func() {}))
+		c.Wait()
+		_, ok = c.Get("2")
+		require.False(t, ok)
+		require.Equal(t, map[string]any{"1": 1}, backing)
+	}
+}
+
+func TestCacheWithOverrideMaxSetsPerSecond(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		MaxSetsPerSecond:   1,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Use up the only set allowed this second.
+	require.True(t, c.SetWithCost("1", 1, 1))
+	require.False(t, c.SetWithCost("2", 2, 1))
+	c.Wait()
+
+	// Neither the temporary value nor the restore are limited.
+	restored := c.WithOverride("1", 100, 1, func() {
+		val, ok := c.Get("1")
+		require.True(t, ok)
+		require.Equal(t, 100, val)
+	})
+	require.True(t, restored)
+	c.Wait()
+	val, ok := c.Get("1")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.Equal(t, uint64(1), c.Metrics.SetsLimited())
+}
+
+func TestCacheWithOverridePanic(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+
+	c.SetWithCost("1", 1, 1)
+	c.Wait()
+
+	overrideAndPanic := func(key string) {
+		defer func() {
+			require.Equal(t, "boom", recover())
+		}()
+		c.WithOverride(key, 100, 1, func() {
+			panic("boom")
+		})
+	}
+
+	overrideAndPanic("1")
+	val, ok := c.Get("1")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+
+	overrideAndPanic("2")
+	val, ok = c.Get("2")
+	require.False(t, ok)
+	require.Nil(t, val)
+
+	c = nil
+	require.False(t, c.WithOverride("1", 1, 1, func() {}))
+}
+
+func TestCacheClear(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		c.SetWithCost(strconv.Itoa(i), i, 1)
+	}
+	time.Sleep(wait)
+	require.Equal(t, uint64(10), c.Metrics.KeysAdded())
+
+	c.Clear()
+	require.Equal(t, uint64(0), c.Metrics.KeysAdded())
+
+	for i := 0; i < 10; i++ {
+		val, ok := c.Get(strconv.Itoa(i))
+		require.False(t, ok)
+		require.Nil(t, val)
+	}
+}
+
+func TestCacheOnClear(t *testing.T) {
+	var (
+		c                  *Cache
+		exits, clears      atomic.Int64
+		exitsBeforeOnClear int64
+	)
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		OnExit: func(val any) {
+			exits.Add(1)
+		},
+		OnClear: func() {
+			clears.Add(1)
+			exitsBeforeOnClear = exits.Load()
+			// processItems is running again, or Wait would block.
+			c.Wait()
+		},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		c.SetWithCost(strconv.Itoa(i), i, 1)
+	}
+	c.Wait()
+	// These are probably still buffered.
+	for i := 5; i < 10; i++ {
+		c.SetWithCost(strconv.Itoa(i), i, 1)
+	}
+
+	c.Clear()
+	require.Equal(t, int64(1), clears.Load())
+	require.Equal(t, int64(10), exitsBeforeOnClear)
+	require.Equal(t, int64(10), exits.Load())
+	require.Zero(t, c.Len())
+
+	c.Clear()
+	require.Equal(t, int64(2), clears.Load())
+	require.Equal(t, int64(10), exits.Load())
+
+	c.Close()
+	c.Clear()
+	require.Equal(t, int64(2), clears.Load())
+}
+
+func TestCacheMetrics(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		c.SetWithCost(strconv.Itoa(i), i, 1)
+	}
+	time.Sleep(wait)
+	m := c.Metrics
+	require.Equal(t, uint64(10), m.KeysAdded())
+}
+
+func TestMetrics(t *testing.T) {
+	newMetrics()
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	for _, f := range []func() uint64{
+		m.Hits,
+		m.Misses,
+		m.KeysAdded,
+		m.KeysEvicted,
+		m.CostEvicted,
+		m.SetsDropped,
+		m.SetsRejected,
+		m.GetsDropped,
+		m.GetsKept,
+		m.EvictsDropped,
+		m.Conflicts,
+	} {
+		require.Equal(t, uint64(0), f())
+	}
+}
+
+func TestMetricsAddGet(t *testing.T) {
+	m := newMetrics()
+	m.add(hit, 1, 1)
+	m.add(hit, 2, 2)
+	m.add(hit, 3, 3)
+	require.Equal(t, uint64(6), m.Hits())
+
+	m = nil
+	m.add(hit, 1, 1)
+	require.Equal(t, uint64(0), m.Hits())
+}
+
+func TestMetricsRatio(t *testing.T) {
+	m := newMetrics()
+	require.Equal(t, float64(0), m.Ratio())
+
+	m.add(hit, 1, 1)
+	m.add(hit, 2, 2)
+	m.add(miss, 1, 1)
+	m.add(miss, 2, 2)
+	require.Equal(t, 0.5, m.Ratio())
+
+	m = nil
+	require.Equal(t, float64(0), m.Ratio())
+}
+
+func TestMetricsGetsDropRatio(t *testing.T) {
+	m := newMetrics()
+	require.Equal(t, float64(0), m.GetsDropRatio())
+
+	m.add(dropGets, 1, 1)
+	m.add(keepGets, 1, 2)
+	m.add(keepGets, 2, 1)
+	require.Equal(t, 0.25, m.GetsDropRatio())
+
+	m = nil
+	require.Equal(t, float64(0), m.GetsDropRatio())
+}
+
+func TestMetricsRates(t *testing.T) {
+	m := newMetrics()
+	m.add(hit, 1, 5)
+	m.add(miss, 2, 1)
+
+	// Two consumers taking snapshots at different times.
+	first := m.Snapshot()
+	m.add(hit, 3, 2)
+	m.add(keyEvict, 1, 1)
+	second := m.Snapshot()
+	m.add(hit, 4, 3)
+	m.add(miss, 1, 4)
+
+	require.Equal(t, Stats{Hits: 5, Misses: 4, KeysEvicted: 1, GetsTotal: 9, HitRatio: 5.0 / 9}, m.Rates(first))
+	require.Equal(t, Stats{Hits: 3, Misses: 4, GetsTotal: 7, HitRatio: 3.0 / 7}, m.Rates(second))
+	// Rates doesn't change the counters.
+	require.Equal(t, Stats{Hits: 10, Misses: 5, KeysEvicted: 1, GetsTotal: 15, HitRatio: 10.0 / 15}, m.Snapshot())
+
+	m.Clear()
+	m.add(hit, 1, 1)
+	require.Equal(t, Stats{Hits: 1, GetsTotal: 1, HitRatio: 1}, m.Rates(second))
+
+	m = nil
+	require.Equal(t, Stats{}, m.Rates(first))
+}
+
+func TestMetricsSnapshotConsistent(t *testing.T) {
+	m := newMetrics()
+
+	// Every writer counts a hit and then a miss, on all the stripes, so that
+	// at any point in time there are at least as many hits as misses, and at
+	// most one more per writer.
+	const writers = 4
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := uint64(0); ; hash++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				m.add(hit, hash, 1)
+				m.add(miss, hash+1, 1)
+			}
+		}()
+	}
+
+	for i := 0; i < 1000; i++ {
+		stats := m.Snapshot()
+		require.GreaterOrEqual(t, stats.Hits, stats.Misses)
+		require.LessOrEqual(t, stats.Hits, stats.Misses+writers)
+		require.Equal(t, stats.Hits+stats.Misses, stats.GetsTotal)
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestMetricsCounter(t *testing.T) {
+	m := newMetrics()
+	for i := 0; i < doNotUse; i++ {
+		m.add(MetricType(i), 1, uint64(i+1))
+	}
+
+	accessors := map[string]func() uint64{
+		"hit":           m.Hits,
+		"miss":          m.Misses,
+		"keys-added":    m.KeysAdded,
+		"keys-updated":  m.KeysUpdated,
+		"keys-evicted":  m.KeysEvicted,
+		"cost-added":    m.CostAdded,
+		"cost-evicted":  m.CostEvicted,
+		"sets-dropped":  m.SetsDropped,
+		"sets-rejected": m.SetsRejected,
+		"sets-limited":  m.SetsLimited,
+		"gets-dropped":  m.GetsDropped,
+		"gets-kept":     m.GetsKept,
+		"evict-dropped": m.EvictsDropped,
+		"conflicts":     m.Conflicts,
+	}
+	names := m.CounterNames()
+	require.Len(t, names, len(accessors))
+	for _, name := range names {
+		val, ok := m.Counter(name)
+		require.True(t, ok, name)
+		require.NotNil(t, accessors[name], name)
+		require.Equal(t, accessors[name](), val, name)
+	}
+
+	_, ok := m.Counter("unidentified")
+	require.False(t, ok)
+
+	m = nil
+	val, ok := m.Counter("hit")
+	require.True(t, ok)
+	require.Zero(t, val)
+}
+
+func TestMetricsClearType(t *testing.T) {
+	m := newMetrics()
+	for i := uint64(0); i < 256; i++ {
+		m.add(hit, i, 1)
+		m.add(miss, i, 2)
+		m.add(keyEvict, i, 3)
+	}
+
+	m.ClearType(MetricHits)
+	m.ClearType(MetricMisses)
+	require.Zero(t, m.Hits())
+	require.Zero(t, m.Misses())
+	require.Equal(t, uint64(3*256), m.KeysEvicted())
+
+	// Unknown types are ignored.
+	m.ClearType(MetricType(doNotUse))
+	m.ClearType(-1)
+	require.Equal(t, uint64(3*256), m.KeysEvicted())
+
+	m.Clear()
+	require.Zero(t, m.KeysEvicted())
+
+	m = nil
+	m.ClearType(MetricHits)
+}
+
+func TestMetricsMarshalJSON(t *testing.T) {
+	m := newMetrics()
+	for i := 0; i < doNotUse; i++ {
+		m.add(MetricType(i), 1, uint64(i+1))
+	}
+	out, err := json.Marshal(m)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"hits": 1,
+		"misses": 2,
+		"keys_added": 3,
+		"keys_updated": 4,
+		"keys_evicted": 5,
+		"cost_added": 6,
+		"cost_evicted": 7,
+		"sets_dropped": 8,
+		"sets_rejected": 9,
+		"sets_limited": 10,
+		"gets_dropped": 11,
+		"gets_kept": 12,
+		"evicts_dropped": 13,
+		"conflicts": 14,
+		"gets_total": 3,
+		"hit_ratio": 0.3333333333333333
+	}`, string(out))
+
+	m = nil
+	out, err = json.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, "null", string(out))
+}
+
+func TestMetricsPublishExpvar(t *testing.T) {
+	// expvar names can't be unpublished, so they must be unique to every run.
+	prefix := fmt.Sprintf("TestMetricsPublishExpvar%d.", time.Now().UnixNano())
+	m := newMetrics()
+	require.NoError(t, m.PublishExpvar(prefix))
+	for _, name := range m.CounterNames() {
+		require.Equal(t, "0", expvar.Get(prefix+name).String(), name)
+	}
+
+	// The values are read live.
+	m.add(hit, 1, 2)
+	m.add(keyEvict, 1, 3)
+	require.Equal(t, "2", expvar.Get(prefix+"hit").String())
+	require.Equal(t, "3", expvar.Get(prefix+"keys-evicted").String())
+
+	require.Error(t, newMetrics().PublishExpvar(prefix))
+
+	var disabled *Metrics
+	require.Error(t, disabled.PublishExpvar("disabled."+prefix))
+	require.Nil(t, expvar.Get("disabled."+prefix+"hit"))
+}
+
+func TestMetricsString(t *testing.T) {
+	m := newMetrics()
+	m.add(hit, 1, 1)
+	m.add(miss, 1, 1)
+	m.add(keyAdd, 1, 1)
+	m.add(keyUpdate, 1, 1)
+	m.add(keyEvict, 1, 1)
+	m.add(costAdd, 1, 1)
+	m.add(costEvict, 1, 1)
+	m.add(dropSets, 1, 1)
+	m.add(rejectSets, 1, 1)
+	m.add(limitSets, 1, 1)
+	m.add(dropGets, 1, 1)
+	m.add(keepGets, 1, 1)
+	m.add(dropEvicts, 1, 1)
+	m.add(conflicts, 1, 1)
+	require.Equal(t, uint64(1), m.Hits())
+	require.Equal(t, uint64(1), m.Misses())
+	require.Equal(t, 0.5, m.Ratio())
+	require.Equal(t, uint64(1), m.KeysAdded())
+	require.Equal(t, uint64(1), m.KeysUpdated())
+	require.Equal(t, uint64(1), m.KeysEvicted())
+	require.Equal(t, uint64(1), m.CostAdded())
+	require.Equal(t, uint64(1), m.CostEvicted())
+	require.Equal(t, uint64(1), m.SetsDropped())
+	require.Equal(t, uint64(1), m.SetsRejected())
+	require.Equal(t, uint64(1), m.SetsLimited())
+	require.Equal(t, uint64(1), m.GetsDropped())
+	require.Equal(t, uint64(1), m.GetsKept())
+	require.Equal(t, uint64(1), m.EvictsDropped())
+	require.Equal(t, uint64(1), m.Conflicts())
+
+	require.NotEqual(t, 0, len(m.String()))
+
+	m = nil
+	require.Equal(t, 0, len(m.String()))
+
+	require.Equal(t, "unidentified", stringFor(doNotUse))
+}
+
+func TestCacheMetricsClear(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	require.NoError(t, err)
+
+	c.SetWithCost("1", 1, 1)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.Get("1")
+			}
+		}
+	}()
+	time.Sleep(wait)
+	c.Clear()
+	stop <- struct{}{}
+	c.Metrics = nil
+	c.Metrics.Clear()
+}
+
+// Regression test for bug https://github.com/dgraph-io/ristretto/issues/167
+func TestDropUpdates(t *testing.T) {
+	originalSetBugSize := setBufSize
+	defer func() { setBufSize = originalSetBugSize }()
+
+	test := func() {
+		// dropppedMap stores the items dropped from the cache.
+		droppedMap := make(map[int]struct{})
+		lastEvictedSet := int64(-1)
+
+		var err error
+		handler := func(_ any, value any) {
+			v := value.(string)
+			lastEvictedSet, err = strconv.ParseInt(string(v), 10, 32)
+			require.NoError(t, err)
+
+			_, ok := droppedMap[int(lastEvictedSet)]
+			if ok {
+				panic(fmt.Sprintf("val = %+v was dropped but it got evicted. Dropped items: %+v\n",
+					lastEvictedSet, droppedMap))
+			}
+		}
+
+		// This is important. The race condition shows up only when the setBuf
+		// is full and that's why we reduce the buf size here. The test will
+		// try to fill up the setbuf to it's capacity and then perform an
+		// update on a key.
+		setBufSize = 10
+
+		c, err := NewCache(&Config{
+			NumCounters: 100,
+			MaxCost:     10,
+			BufferItems: 64,
+			Metrics:     true,
+			OnEvict: func(item *Item) {
 				if item.Value != nil {
 					handler(nil, item.Value)
 				}
@@ -680,6 +3523,14 @@ func TestDropUpdates(t *testing.T) {
 	}
 }
 
+// numericKeyHash hashes the numeric keys to consecutive values, so that they
+// never share counters in the sketch, as random hashes sometimes do since the
+// rows of the sketch are indexed by the same low bits of the hash.
+func numericKeyHash(key string) (uint64, uint64) {
+	n, _ := strconv.ParseUint(key, 10, 64)
+	return n + 1, 0
+}
+
 func newTestCache() (*Cache, error) {
 	return NewCache(&Config{
 		NumCounters: 100,
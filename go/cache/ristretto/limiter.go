@@ -0,0 +1,106 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ristretto
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// setLimiter is a token bucket limiting how many sets per second go through.
+//
+// Instead of counting tokens, it keeps the time at which the bucket will be
+// full again (the "theoretical arrival time" of GCRA), so taking a token is a
+// single compare-and-swap and the hot path never takes a lock.
+type setLimiter struct {
+	start time.Time
+	// interval is the time it takes to earn one token, in nanoseconds.
+	interval int64
+	// burst is the size of the bucket, in nanoseconds worth of tokens.
+	burst int64
+	// tat is the time the bucket will be full again, in nanoseconds since start.
+	tat atomic.Int64
+}
+
+// newSetLimiter returns a setLimiter allowing perSecond sets per second. The
+// bucket holds a tenth of a second of sets, so that bursts stay close to
+// the configured rate.
+func newSetLimiter(perSecond int) *setLimiter {
+	interval := int64(time.Second) / int64(perSecond)
+	burst := int64(time.Second) / 10
+	if burst < interval {
+		burst = interval
+	}
+	return &setLimiter{
+		start:    time.Now(),
+		interval: interval,
+		burst:    burst,
+	}
+}
+
+func (l *setLimiter) now() int64 {
+	return int64(time.Since(l.start))
+}
+
+// allow takes a token if there's one, and returns whether it did.
+func (l *setLimiter) allow() bool {
+	now := l.now()
+	for {
+		prev := l.tat.Load()
+		tat := prev
+		if tat < now {
+			tat = now
+		}
+		tat += l.interval
+		if tat-now > l.burst {
+			return false
+		}
+		if l.tat.CompareAndSwap(prev, tat) {
+			return true
+		}
+	}
+}
+
+// wait takes a token, blocking until there's one or ctx is done. In the latter
+// case, the token is given back and the error of ctx is returned.
+func (l *setLimiter) wait(ctx context.Context) error {
+	now := l.now()
+	for {
+		prev := l.tat.Load()
+		tat := prev
+		if tat < now {
+			tat = now
+		}
+		tat += l.interval
+		if l.tat.CompareAndSwap(prev, tat) {
+			delay := tat - now - l.burst
+			if delay <= 0 {
+				return nil
+			}
+			timer := time.NewTimer(time.Duration(delay))
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				return nil
+			case <-ctx.Done():
+				l.tat.Add(-l.interval)
+				return ctx.Err()
+			}
+		}
+	}
+}
@@ -18,7 +18,9 @@
 package ristretto
 
 import (
+	"cmp"
 	"math"
+	"slices"
 	"sync"
 	"sync/atomic"
 
@@ -50,8 +52,9 @@ type policy interface {
 	Used() int64
 	// Close stops all goroutines and closes all channels.
 	Close()
-	// Update updates the cost value for the key.
-	Update(uint64, int64)
+	// Update updates the cost value for the key. It returns false if the key
+	// isn't in the Policy.
+	Update(uint64, int64) bool
 	// Cost returns the cost value of a key or -1 if missing.
 	Cost(uint64) int64
 	// Optionally, set stats object to track how policy is performing.
@@ -62,6 +65,23 @@ type policy interface {
 	MaxCost() int64
 	// UpdateMaxCost updates the max cost of the cache policy.
 	UpdateMaxCost(int64)
+	// UpdateMaxEntries updates the max number of entries of the cache
+	// policy, zero meaning no limit.
+	UpdateMaxEntries(int64)
+	// UpdateNumCounters rebuilds the admission counters with the given size,
+	// resetting the access frequencies but keeping the admitted keys.
+	UpdateNumCounters(int64)
+	// TrackHotKeys starts tracking the given number of most accessed keys.
+	TrackHotKeys(int)
+	// HotKeys returns the tracked hot keys, hottest first, or nil if they
+	// aren't tracked.
+	HotKeys() []HotKey
+	// EvictionCandidates returns the entries that would be evicted to make
+	// room for an item of the given cost, without evicting them.
+	EvictionCandidates(int64) []Entry
+	// Hottest returns the entries with the highest access frequency, up to
+	// the given number, hottest first.
+	Hottest(int) []Entry
 }
 
 func newPolicy(numCounters, maxCost int64) policy {
@@ -78,6 +98,8 @@ type defaultPolicy struct {
 	metrics     *Metrics
 	numCounters int64
 	maxCost     int64
+	maxEntries  int64
+	hot         *hotKeys
 }
 
 func newDefaultPolicy(numCounters, maxCost int64) *defaultPolicy {
@@ -109,6 +131,9 @@ func (p *defaultPolicy) processItems() {
 		case items := <-p.itemsCh:
 			p.Lock()
 			p.admit.Push(items)
+			if p.hot != nil {
+				p.hot.push(items, p.admit)
+			}
 			p.Unlock()
 		case <-p.stop:
 			return
@@ -154,9 +179,8 @@ func (p *defaultPolicy) Add(key uint64, cost int64) ([]*Item, bool) {
 	}
 
 	// If the execution reaches this point, the key doesn't exist in the cache.
-	// Calculate the remaining room in the cache (usually bytes).
-	room := p.evict.roomLeft(cost)
-	if room >= 0 {
+	// Check the remaining room in the cache (usually bytes) and entries.
+	if p.evict.hasRoom(cost) {
 		// There's enough room in the cache to store the new item without
 		// overflowing. Do that now and stop here.
 		p.evict.add(key, cost)
@@ -176,7 +200,7 @@ func (p *defaultPolicy) Add(key uint64, cost int64) ([]*Item, bool) {
 
 	// Delete victims until there's enough space or a minKey is found that has
 	// more hits than incoming item.
-	for ; room < 0; room = p.evict.roomLeft(cost) {
+	for !p.evict.hasRoom(cost) {
 		// Fill up empty slots in sample.
 		sample = p.evict.fillSample(sample)
 
@@ -214,6 +238,83 @@ func (p *defaultPolicy) Add(key uint64, cost int64) ([]*Item, bool) {
 	return victims, true
 }
 
+// EvictionCandidates runs the victim selection of Add for an incoming item of
+// the given cost, assuming the item is admitted, and returns the victims
+// without changing the state of the policy. The selection samples the keys at
+// random, so consecutive calls can return different candidates.
+func (p *defaultPolicy) EvictionCandidates(cost int64) []Entry {
+	p.Lock()
+	defer p.Unlock()
+
+	if cost > p.evict.getMaxCost() {
+		return nil
+	}
+
+	var candidates []Entry
+	picked := make(map[uint64]struct{})
+	sample := make([]*policyPair, 0, lfuSample)
+	entries := int64(len(p.evict.keyCosts))
+	for room := p.evict.roomLeft(cost); room < 0 || !p.evict.entriesLeft(entries); {
+		// Fill up empty slots in sample, as fillSample does, but skipping the
+		// keys that were already picked since they are not deleted.
+		for key, keyCost := range p.evict.keyCosts {
+			if len(sample) >= lfuSample {
+				break
+			}
+			if _, ok := picked[key]; ok {
+				continue
+			}
+			picked[key] = struct{}{}
+			sample = append(sample, &policyPair{key, keyCost})
+		}
+		if len(sample) == 0 {
+			break
+		}
+
+		minHits, minID := int64(math.MaxInt64), 0
+		for i, pair := range sample {
+			if hits := p.admit.Estimate(pair.key); hits < minHits {
+				minHits, minID = hits, i
+			}
+		}
+		candidates = append(candidates, Entry{
+			KeyHash: sample[minID].key,
+			Cost:    sample[minID].cost,
+			Hits:    minHits,
+		})
+		room += sample[minID].cost
+		entries--
+
+		sample[minID] = sample[len(sample)-1]
+		sample = sample[:len(sample)-1]
+	}
+	return candidates
+}
+
+// Hottest sorts all the keys by their estimated access frequency, so it holds
+// the lock for a while on large caches. It doesn't change the state of the
+// policy.
+func (p *defaultPolicy) Hottest(n int) []Entry {
+	p.Lock()
+	defer p.Unlock()
+
+	entries := make([]Entry, 0, len(p.evict.keyCosts))
+	for key, cost := range p.evict.keyCosts {
+		entries = append(entries, Entry{
+			KeyHash: key,
+			Cost:    cost,
+			Hits:    p.admit.Estimate(key),
+		})
+	}
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return cmp.Compare(b.Hits, a.Hits)
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
 func (p *defaultPolicy) Has(key uint64) bool {
 	p.Lock()
 	_, exists := p.evict.keyCosts[key]
@@ -234,10 +335,11 @@ func (p *defaultPolicy) Used() int64 {
 	return used
 }
 
-func (p *defaultPolicy) Update(key uint64, cost int64) {
+func (p *defaultPolicy) Update(key uint64, cost int64) bool {
 	p.Lock()
-	p.evict.updateIfHas(key, cost)
+	updated := p.evict.updateIfHas(key, cost)
 	p.Unlock()
+	return updated
 }
 
 func (p *defaultPolicy) Cost(key uint64) int64 {
@@ -254,6 +356,10 @@ func (p *defaultPolicy) Clear() {
 	p.Lock()
 	p.admit = newTinyLFU(p.numCounters)
 	p.evict = newSampledLFU(p.maxCost)
+	p.evict.maxEntries = p.maxEntries
+	if p.hot != nil {
+		p.hot.clear()
+	}
 	p.Unlock()
 }
 
@@ -283,12 +389,57 @@ func (p *defaultPolicy) UpdateMaxCost(maxCost int64) {
 	p.evict.updateMaxCost(maxCost)
 }
 
+// UpdateMaxEntries doesn't evict anything by itself: as with UpdateMaxCost,
+// the extra entries are evicted when the next items are added.
+func (p *defaultPolicy) UpdateMaxEntries(maxEntries int64) {
+	if p == nil || p.evict == nil {
+		return
+	}
+	p.Lock()
+	p.maxEntries = maxEntries
+	p.evict.maxEntries = maxEntries
+	p.Unlock()
+}
+
+// UpdateNumCounters replaces the tinyLFU, so the keys start over with no
+// recorded accesses; the sampledLFU, and thus the cost of the keys in the
+// cache, is kept as is.
+func (p *defaultPolicy) UpdateNumCounters(numCounters int64) {
+	if p == nil || p.admit == nil {
+		return
+	}
+	p.Lock()
+	p.numCounters = numCounters
+	p.admit = newTinyLFU(numCounters)
+	if p.hot != nil {
+		p.hot.clear()
+	}
+	p.Unlock()
+}
+
+func (p *defaultPolicy) TrackHotKeys(n int) {
+	p.Lock()
+	p.hot = newHotKeys(n)
+	p.Unlock()
+}
+
+func (p *defaultPolicy) HotKeys() []HotKey {
+	p.Lock()
+	defer p.Unlock()
+	if p.hot == nil {
+		return nil
+	}
+	return p.hot.list()
+}
+
 // sampledLFU is an eviction helper storing key-cost pairs.
 type sampledLFU struct {
 	keyCosts map[uint64]int64
 	maxCost  int64
-	used     int64
-	metrics  *Metrics
+	// maxEntries bounds the number of keys, zero meaning no limit.
+	maxEntries int64
+	used       int64
+	metrics    *Metrics
 }
 
 func newSampledLFU(maxCost int64) *sampledLFU {
@@ -310,6 +461,18 @@ func (p *sampledLFU) roomLeft(cost int64) int64 {
 	return p.getMaxCost() - (p.used + cost)
 }
 
+// entriesLeft returns true if one more entry fits when there are already
+// the given number of entries.
+func (p *sampledLFU) entriesLeft(entries int64) bool {
+	return p.maxEntries == 0 || entries < p.maxEntries
+}
+
+// hasRoom returns true if a new entry of the given cost fits without going
+// over either the max cost or the max number of entries.
+func (p *sampledLFU) hasRoom(cost int64) bool {
+	return p.roomLeft(cost) >= 0 && p.entriesLeft(int64(len(p.keyCosts)))
+}
+
 func (p *sampledLFU) fillSample(in []*policyPair) []*policyPair {
 	if len(in) >= lfuSample {
 		return in
@@ -363,6 +526,98 @@ func (p *sampledLFU) clear() {
 	p.keyCosts = make(map[uint64]int64)
 }
 
+// HotKey is one of the most accessed keys of the cache.
+type HotKey struct {
+	// KeyHash is the hash of the key, since the cache doesn't keep the keys.
+	KeyHash uint64
+	// Hits is the access frequency estimated by the policy.
+	Hits int64
+}
+
+// hotKeys tracks the keys with the highest estimated access frequency among
+// the ones read from the Get buffers, whether they are in the cache or not.
+// hotKeys is NOT thread safe.
+type hotKeys struct {
+	n    int
+	hits map[uint64]int64
+	// minKey is the key with the lowest hits, which is the next one replaced
+	// once n keys are tracked.
+	minKey uint64
+	// incrs is the count of increments of the tinyLFU seen so far, to notice
+	// its resets.
+	incrs int64
+}
+
+func newHotKeys(n int) *hotKeys {
+	return &hotKeys{n: n, hits: make(map[uint64]int64, n)}
+}
+
+// push updates the hot keys with keys just pushed to the tinyLFU.
+func (h *hotKeys) push(keys []uint64, admit *tinyLFU) {
+	if admit.incrs < h.incrs+int64(len(keys)) {
+		// The tinyLFU halved its counters, so the estimates of the tracked
+		// keys are stale.
+		for key := range h.hits {
+			h.hits[key] = admit.Estimate(key)
+		}
+		h.updateMin()
+	}
+	h.incrs = admit.incrs
+	for _, key := range keys {
+		h.add(key, admit.Estimate(key))
+	}
+}
+
+func (h *hotKeys) add(key uint64, hits int64) {
+	if _, ok := h.hits[key]; ok {
+		h.hits[key] = hits
+		if key == h.minKey {
+			h.updateMin()
+		}
+		return
+	}
+	if len(h.hits) < h.n {
+		h.hits[key] = hits
+		if len(h.hits) == 1 || hits < h.hits[h.minKey] {
+			h.minKey = key
+		}
+		return
+	}
+	if hits <= h.hits[h.minKey] {
+		return
+	}
+	delete(h.hits, h.minKey)
+	h.hits[key] = hits
+	h.updateMin()
+}
+
+func (h *hotKeys) updateMin() {
+	first := true
+	for key, hits := range h.hits {
+		if first || hits < h.hits[h.minKey] {
+			h.minKey = key
+			first = false
+		}
+	}
+}
+
+// list returns the hot keys, hottest first.
+func (h *hotKeys) list() []HotKey {
+	keys := make([]HotKey, 0, len(h.hits))
+	for key, hits := range h.hits {
+		keys = append(keys, HotKey{KeyHash: key, Hits: hits})
+	}
+	slices.SortFunc(keys, func(a, b HotKey) int {
+		return cmp.Compare(b.Hits, a.Hits)
+	})
+	return keys
+}
+
+func (h *hotKeys) clear() {
+	h.hits = make(map[uint64]int64, h.n)
+	h.incrs = 0
+}
+
 // tinyLFU is an admission helper that keeps track of access frequency using
 // tiny (4-bit) counters in the form of a count-min sketch.
 // tinyLFU is NOT thread safe.
@@ -122,9 +122,12 @@ func TestPolicyCap(t *testing.T) {
 func TestPolicyUpdate(t *testing.T) {
 	p := newDefaultPolicy(100, 10)
 	p.Add(1, 1)
-	p.Update(1, 2)
+	require.True(t, p.Update(1, 2))
+	require.False(t, p.Update(2, 2))
 	p.Lock()
 	require.Equal(t, int64(2), p.evict.keyCosts[1])
+	_, ok := p.evict.keyCosts[2]
+	require.False(t, ok)
 	p.Unlock()
 }
 
@@ -274,3 +277,40 @@ func TestTinyLFUClear(t *testing.T) {
 	require.Equal(t, int64(0), a.incrs)
 	require.Equal(t, int64(0), a.Estimate(3))
 }
+
+func TestHotKeys(t *testing.T) {
+	a := newTinyLFU(100)
+	h := newHotKeys(2)
+	require.Empty(t, h.list())
+
+	keys := []uint64{1, 2, 2, 3, 3, 3}
+	a.Push(keys)
+	h.push(keys, a)
+	require.Equal(t, []HotKey{{KeyHash: 3, Hits: 3}, {KeyHash: 2, Hits: 2}}, h.list())
+
+	keys = []uint64{1, 1, 1, 1}
+	a.Push(keys)
+	h.push(keys, a)
+	require.Equal(t, []HotKey{{KeyHash: 1, Hits: 5}, {KeyHash: 3, Hits: 3}}, h.list())
+
+	h.clear()
+	require.Empty(t, h.list())
+}
+
+func TestHotKeysReset(t *testing.T) {
+	a := newTinyLFU(8)
+	h := newHotKeys(2)
+
+	keys := []uint64{1, 1, 1, 1, 2, 2}
+	a.Push(keys)
+	h.push(keys, a)
+	require.Equal(t, []HotKey{{KeyHash: 1, Hits: 4}, {KeyHash: 2, Hits: 2}}, h.list())
+
+	// The tinyLFU resets after 8 increments, which halves the estimates of the
+	// hot keys.
+	keys = []uint64{3, 3}
+	a.Push(keys)
+	h.push(keys, a)
+	require.Less(t, a.Estimate(1), int64(4))
+	require.Equal(t, []HotKey{{KeyHash: 1, Hits: a.Estimate(1)}, {KeyHash: 2, Hits: a.Estimate(2)}}, h.list())
+}
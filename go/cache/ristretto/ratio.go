@@ -0,0 +1,117 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ristretto
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultRatioWindow and defaultRatioBucket are used unless
+	// Config.RatioWindow and Config.RatioBucket are set.
+	defaultRatioWindow = time.Minute
+	defaultRatioBucket = time.Second
+)
+
+// ratioWindow counts the hits and misses of the last window of time, in a
+// ring of buckets of fixed duration, so that the hit ratio of any part of the
+// window can be computed.
+//
+// A bucket is reused once the ring wraps around, and the counts added while
+// another goroutine resets it are lost, so the ratios are approximate.
+type ratioWindow struct {
+	clock  Clock
+	bucket time.Duration
+	ring   []ratioBucket
+}
+
+type ratioBucket struct {
+	// epoch is the number of the bucket since the Unix epoch, i.e. its start
+	// time divided by the bucket duration, which is negative before 1970.
+	epoch  atomic.Int64
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func newRatioWindow(clock Clock, window, bucket time.Duration) *ratioWindow {
+	// The current bucket is only partially in the window, so keep one more.
+	return &ratioWindow{
+		clock:  clock,
+		bucket: bucket,
+		ring:   make([]ratioBucket, int((window+bucket-1)/bucket)+1),
+	}
+}
+
+func (w *ratioWindow) epoch() int64 {
+	// Round down, so that the buckets before 1970 don't overlap the first one.
+	now, bucket := w.clock.Now().UnixNano(), int64(w.bucket)
+	epoch := now / bucket
+	if now%bucket < 0 {
+		epoch--
+	}
+	return epoch
+}
+
+// slot returns the bucket of the ring used for the given epoch.
+func (w *ratioWindow) slot(epoch int64) *ratioBucket {
+	n := int64(len(w.ring))
+	return &w.ring[(epoch%n+n)%n]
+}
+
+// add counts hits or misses in the current bucket.
+func (w *ratioWindow) add(hit bool, delta uint64) {
+	epoch := w.epoch()
+	b := w.slot(epoch)
+	if prev := b.epoch.Load(); prev != epoch && b.epoch.CompareAndSwap(prev, epoch) {
+		b.hits.Store(0)
+		b.misses.Store(0)
+	}
+	if hit {
+		b.hits.Add(delta)
+	} else {
+		b.misses.Add(delta)
+	}
+}
+
+// ratio returns the ratio of hits over the buckets of the given window, up to
+// the whole ring, including the current one.
+func (w *ratioWindow) ratio(window time.Duration) float64 {
+	n := min(int64((window+w.bucket-1)/w.bucket), int64(len(w.ring))-1)
+	epoch := w.epoch()
+	var hits, misses uint64
+	for e := epoch - n; e <= epoch; e++ {
+		b := w.slot(e)
+		if b.epoch.Load() != e {
+			continue
+		}
+		hits += b.hits.Load()
+		misses += b.misses.Load()
+	}
+	if hits == 0 && misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+func (w *ratioWindow) clear() {
+	for i := range w.ring {
+		w.ring[i].epoch.Store(0)
+		w.ring[i].hits.Store(0)
+		w.ring[i].misses.Store(0)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRatioWindow(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	w := newRatioWindow(clock, 10*time.Second, time.Second)
+	require.Len(t, w.ring, 11)
+	require.Equal(t, float64(0), w.ratio(10*time.Second))
+
+	// 10 seconds of hits, then 5 seconds of misses.
+	for i := 0; i < 10; i++ {
+		w.add(true, 1)
+		clock.Advance(time.Second)
+	}
+	for i := 0; i < 5; i++ {
+		w.add(false, 1)
+		clock.Advance(time.Second)
+	}
+	w.add(false, 1)
+
+	// The last 5 seconds, plus the current one, only missed.
+	require.Equal(t, float64(0), w.ratio(5*time.Second))
+	require.Equal(t, float64(4)/float64(10), w.ratio(9*time.Second))
+	// The window is capped to the ring, whose oldest buckets were reused.
+	require.Equal(t, float64(5)/float64(11), w.ratio(time.Hour))
+
+	// The buckets of the hits are reused as time goes by.
+	clock.Advance(20 * time.Second)
+	w.add(true, 2)
+	require.Equal(t, float64(1), w.ratio(10*time.Second))
+
+	w.clear()
+	require.Equal(t, float64(0), w.ratio(10*time.Second))
+}
+
+func TestRatioWindowBefore1970(t *testing.T) {
+	// The window spans the Unix epoch, from before 1970 to after it.
+	clock := &fakeClock{now: time.Unix(0, 0).Add(-5500 * time.Millisecond)}
+	w := newRatioWindow(clock, 10*time.Second, time.Second)
+
+	for i := 0; i < 10; i++ {
+		w.add(i%2 == 0, 1)
+		clock.Advance(time.Second)
+	}
+	require.Equal(t, 0.5, w.ratio(10*time.Second))
+	require.Equal(t, float64(0), w.ratio(0))
+	clock.Advance(-time.Second)
+	require.Equal(t, float64(0), w.ratio(0))
+	clock.Advance(-5 * time.Second)
+	require.Equal(t, float64(1), w.ratio(0))
+}
+
+func TestCacheWindowedRatio(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		Clock:              clock,
+		RatioWindow:        time.Minute,
+		RatioBucket:        10 * time.Second,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithCost("a", 1, 1))
+	c.Wait()
+	for i := 0; i < 9; i++ {
+		c.Get("a")
+	}
+	c.Get("missing")
+	require.Equal(t, 0.9, c.WindowedRatio(time.Minute))
+
+	// After a while, only the misses are recent.
+	clock.Advance(2 * time.Minute)
+	c.GetMulti([]string{"missing", "other"})
+	require.Equal(t, float64(0), c.WindowedRatio(time.Minute))
+	require.Equal(t, 0.75, c.Metrics.Ratio())
+
+	c.Metrics.Clear()
+	require.Equal(t, float64(0), c.WindowedRatio(time.Minute))
+
+	c2, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c2.Close()
+	c2.Get("a")
+	require.Equal(t, float64(0), c2.WindowedRatio(time.Minute))
+
+	_, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		RatioBucket: time.Hour,
+	})
+	require.Error(t, err)
+	_, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		RatioWindow: -time.Second,
+	})
+	require.Error(t, err)
+}
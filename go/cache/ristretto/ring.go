@@ -90,3 +90,13 @@ func (b *ringBuffer) Push(item uint64) {
 	stripe.Push(item)
 	b.pool.Put(stripe)
 }
+
+// PushMany adds all the elements to the same internal stripe, draining it as
+// many times as it becomes full.
+func (b *ringBuffer) PushMany(items []uint64) {
+	stripe := b.pool.Get().(*ringStripe)
+	for _, item := range items {
+		stripe.Push(item)
+	}
+	b.pool.Put(stripe)
+}
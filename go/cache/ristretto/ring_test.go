@@ -85,3 +85,20 @@ func TestRingConsumer(t *testing.T) {
 	require.NotEqual(t, 0, l)
 	require.True(t, l <= 100)
 }
+
+func TestRingPushMany(t *testing.T) {
+	var drained []uint64
+	r := newRingBuffer(&testConsumer{
+		push: func(items []uint64) {
+			drained = append(drained, items...)
+		},
+		save: true,
+	}, 4)
+	items := make([]uint64, 10)
+	for i := range items {
+		items[i] = uint64(i)
+	}
+	r.PushMany(items)
+	// The last two items stay in the stripe until it's full again.
+	require.Equal(t, items[:8], drained)
+}
@@ -19,13 +19,21 @@ package ristretto
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // TODO: Do we need this to be a separate struct from Item?
 type storeItem struct {
-	key      uint64
-	conflict uint64
-	value    any
+	key        uint64
+	conflict   uint64
+	value      any
+	expiration time.Time
+}
+
+// expired returns whether the item has an expiration and it has passed.
+func (si *storeItem) expired(now time.Time) bool {
+	return !si.expiration.IsZero() && now.After(si.expiration)
 }
 
 // store is the interface fulfilled by all hash map implementations in this
@@ -35,8 +43,15 @@ type storeItem struct {
 //
 // Every store is safe for concurrent usage.
 type store interface {
-	// Get returns the value associated with the key parameter.
+	// Get returns the value associated with the key parameter. Expired items
+	// are treated as missing by Get, Lookup, ForEach and Snapshot.
 	Get(uint64, uint64) (any, bool)
+	// Lookup returns the conflict hash and the value associated with the key
+	// parameter, without checking the conflict hash.
+	Lookup(uint64) (uint64, any, bool)
+	// Expiration returns the expiration time of the key-value pair, which is
+	// zero if it never expires.
+	Expiration(uint64, uint64) (time.Time, bool)
 	// Set adds the key-value pair to the Map or updates the value if it's
 	// already present. The key-value pair is passed as a pointer to an
 	// item object.
@@ -46,12 +61,56 @@ type store interface {
 	// Update attempts to update the key with a new value and returns true if
 	// successful.
 	Update(*Item) (any, bool)
+	// CompareAndUpdate updates the key with a new value if its current value
+	// matches, and returns the replaced value and whether it did. Expired
+	// items never match.
+	CompareAndUpdate(*Item, func(any) bool) (any, bool)
+	// Increment adds delta to the int64 value of the key, and returns the new
+	// value. A missing or expired key is set to delta, in which case added is
+	// true and prev is the expired value, if any. ok is false if the value
+	// isn't an int64.
+	Increment(key, conflict uint64, delta int64) (value int64, prev any, added, ok bool)
+	// SetIfAbsent adds the key-value pair unless the key is already present,
+	// and returns whether it did, along with the expired value it replaced,
+	// if any.
+	SetIfAbsent(*Item) (any, bool)
+	// DelExpired deletes the key-value pair if it has expired, and returns
+	// its value.
+	DelExpired(uint64, uint64) (any, bool)
+	// DelIf deletes all the key-value pairs for which the predicate returns
+	// true, and returns them.
+	DelIf(func(*Item) bool) []*Item
 	// Clear clears all contents of the store.
 	Clear(onEvict itemCallback)
 	// ForEach yields all the values in the store
 	ForEach(forEach func(any) bool)
+	// ForEachKey yields all the key hashes, conflict hashes and values in the
+	// store
+	ForEachKey(forEach func(key, conflict uint64, value any) bool)
+	// Snapshot returns the key hash and value of all the key-value pairs
+	// at a single point in time.
+	Snapshot() []Entry
+	// Replace replaces all the key-value pairs with the given items at a
+	// single point in time, and returns the replaced ones.
+	Replace([]*Item) []*Item
 	// Len returns the number of entries in the store
 	Len() int
+	// CollectMetrics sets the metrics in which the store counts the key hash
+	// collisions.
+	CollectMetrics(*Metrics)
+	// SetClock sets the clock by which the items expire.
+	SetClock(Clock)
+	// ShardStats returns the statistics of every shard of the store.
+	ShardStats() []ShardStat
+}
+
+// ShardStat holds the statistics of one of the shards of the store.
+type ShardStat struct {
+	// Entries is the number of entries in the shard.
+	Entries int
+	// Contended is the number of times the lock of the shard was taken after
+	// waiting for another goroutine to release it.
+	Contended uint64
 }
 
 // newStore returns the default store implementation.
@@ -79,6 +138,14 @@ func (sm *shardedMap) Get(key, conflict uint64) (any, bool) {
 	return sm.shards[key%numShards].get(key, conflict)
 }
 
+func (sm *shardedMap) Lookup(key uint64) (uint64, any, bool) {
+	return sm.shards[key%numShards].lookup(key)
+}
+
+func (sm *shardedMap) Expiration(key, conflict uint64) (time.Time, bool) {
+	return sm.shards[key%numShards].expirationOf(key, conflict)
+}
+
 func (sm *shardedMap) Set(i *Item) {
 	if i == nil {
 		// If item is nil make this Set a no-op.
@@ -96,7 +163,37 @@ func (sm *shardedMap) Update(newItem *Item) (any, bool) {
 	return sm.shards[newItem.Key%numShards].Update(newItem)
 }
 
+func (sm *shardedMap) CompareAndUpdate(newItem *Item, match func(any) bool) (any, bool) {
+	return sm.shards[newItem.Key%numShards].CompareAndUpdate(newItem, match)
+}
+
+func (sm *shardedMap) Increment(key, conflict uint64, delta int64) (int64, any, bool, bool) {
+	return sm.shards[key%numShards].Increment(key, conflict, delta)
+}
+
+func (sm *shardedMap) SetIfAbsent(i *Item) (any, bool) {
+	return sm.shards[i.Key%numShards].SetIfAbsent(i)
+}
+
+func (sm *shardedMap) DelExpired(key, conflict uint64) (any, bool) {
+	return sm.shards[key%numShards].DelExpired(key, conflict)
+}
+
+func (sm *shardedMap) DelIf(pred func(*Item) bool) []*Item {
+	var deleted []*Item
+	for _, shard := range sm.shards {
+		deleted = shard.DelIf(pred, deleted)
+	}
+	return deleted
+}
+
 func (sm *shardedMap) ForEach(forEach func(any) bool) {
+	sm.ForEachKey(func(_, _ uint64, value any) bool {
+		return forEach(value)
+	})
+}
+
+func (sm *shardedMap) ForEachKey(forEach func(key, conflict uint64, value any) bool) {
 	for _, shard := range sm.shards {
 		if !shard.foreach(forEach) {
 			break
@@ -104,6 +201,63 @@ func (sm *shardedMap) ForEach(forEach func(any) bool) {
 	}
 }
 
+func (sm *shardedMap) Snapshot() []Entry {
+	// Lock all the shards at once so that no write lands in a shard that
+	// was already copied while the others are being copied.
+	for _, shard := range sm.shards {
+		shard.rlock()
+	}
+	defer func() {
+		for _, shard := range sm.shards {
+			shard.RUnlock()
+		}
+	}()
+
+	var entries []Entry
+	for _, shard := range sm.shards {
+		now := shard.clock.Now()
+		for _, si := range shard.data {
+			if si.expired(now) {
+				continue
+			}
+			entries = append(entries, Entry{KeyHash: si.key, Value: si.value})
+		}
+	}
+	return entries
+}
+
+func (sm *shardedMap) Replace(items []*Item) []*Item {
+	data := make([]map[uint64]storeItem, numShards)
+	for i := range data {
+		data[i] = make(map[uint64]storeItem)
+	}
+	for _, i := range items {
+		data[i.Key%numShards][i.Key] = storeItem{
+			key:        i.Key,
+			conflict:   i.Conflict,
+			value:      i.Value,
+			expiration: i.Expiration,
+		}
+	}
+
+	// As in Snapshot, lock all the shards at once so that no reader sees some
+	// shards replaced and others not.
+	for _, shard := range sm.shards {
+		shard.lock()
+	}
+	var replaced []*Item
+	for idx, shard := range sm.shards {
+		for _, si := range shard.data {
+			replaced = append(replaced, &Item{Key: si.key, Conflict: si.conflict, Value: si.value, Expiration: si.expiration})
+		}
+		shard.data = data[idx]
+	}
+	for _, shard := range sm.shards {
+		shard.Unlock()
+	}
+	return replaced
+}
+
 func (sm *shardedMap) Len() int {
 	l := 0
 	for _, shard := range sm.shards {
@@ -112,6 +266,33 @@ func (sm *shardedMap) Len() int {
 	return l
 }
 
+func (sm *shardedMap) CollectMetrics(metrics *Metrics) {
+	for _, shard := range sm.shards {
+		shard.Lock()
+		shard.metrics = metrics
+		shard.Unlock()
+	}
+}
+
+func (sm *shardedMap) SetClock(clock Clock) {
+	for _, shard := range sm.shards {
+		shard.Lock()
+		shard.clock = clock
+		shard.Unlock()
+	}
+}
+
+func (sm *shardedMap) ShardStats() []ShardStat {
+	stats := make([]ShardStat, len(sm.shards))
+	for i, shard := range sm.shards {
+		stats[i] = ShardStat{
+			Entries:   shard.Len(),
+			Contended: shard.contended.Load(),
+		}
+	}
+	return stats
+}
+
 func (sm *shardedMap) Clear(onEvict itemCallback) {
 	for i := uint64(0); i < numShards; i++ {
 		sm.shards[i].Clear(onEvict)
@@ -120,61 +301,127 @@ func (sm *shardedMap) Clear(onEvict itemCallback) {
 
 type lockedMap struct {
 	sync.RWMutex
-	data map[uint64]storeItem
+	data    map[uint64]storeItem
+	metrics *Metrics
+	clock   Clock
+	// contended counts the contended lock acquisitions, which is only done
+	// if metrics are collected.
+	contended atomic.Uint64
 }
 
 func newLockedMap() *lockedMap {
 	return &lockedMap{
-		data: make(map[uint64]storeItem),
+		data:  make(map[uint64]storeItem),
+		clock: wallClock{},
+	}
+}
+
+// lock locks the map for writing, and counts whether it had to wait for the
+// lock if metrics are collected.
+func (m *lockedMap) lock() {
+	if m.metrics == nil {
+		m.Lock()
+		return
+	}
+	if !m.TryLock() {
+		m.contended.Add(1)
+		m.Lock()
+	}
+}
+
+// rlock works like lock, for reading.
+func (m *lockedMap) rlock() {
+	if m.metrics == nil {
+		m.RLock()
+		return
+	}
+	if !m.TryRLock() {
+		m.contended.Add(1)
+		m.RLock()
+	}
+}
+
+// conflicts returns whether the stored item has another conflict hash than the
+// one looked up, i.e. whether its key hash collides with the key looked up,
+// and counts the collision in the metrics.
+func (m *lockedMap) conflicts(conflict uint64, item storeItem) bool {
+	if conflict == 0 || conflict == item.conflict {
+		return false
 	}
+	m.metrics.add(conflicts, item.key, 1)
+	return true
 }
 
 func (m *lockedMap) get(key, conflict uint64) (any, bool) {
-	m.RLock()
+	m.rlock()
 	item, ok := m.data[key]
 	m.RUnlock()
-	if !ok {
+	if !ok || item.expired(m.clock.Now()) {
 		return nil, false
 	}
-	if conflict != 0 && (conflict != item.conflict) {
+	if m.conflicts(conflict, item) {
 		return nil, false
 	}
 	return item.value, true
 }
 
+func (m *lockedMap) lookup(key uint64) (uint64, any, bool) {
+	m.rlock()
+	item, ok := m.data[key]
+	m.RUnlock()
+	if !ok || item.expired(m.clock.Now()) {
+		return 0, nil, false
+	}
+	return item.conflict, item.value, true
+}
+
+func (m *lockedMap) expirationOf(key, conflict uint64) (time.Time, bool) {
+	m.rlock()
+	item, ok := m.data[key]
+	m.RUnlock()
+	if !ok || item.expired(m.clock.Now()) {
+		return time.Time{}, false
+	}
+	if m.conflicts(conflict, item) {
+		return time.Time{}, false
+	}
+	return item.expiration, true
+}
+
 func (m *lockedMap) Set(i *Item) {
 	if i == nil {
 		// If the item is nil make this Set a no-op.
 		return
 	}
 
-	m.Lock()
+	m.lock()
 	defer m.Unlock()
 	item, ok := m.data[i.Key]
 
 	if ok {
 		// The item existed already. We need to check the conflict key and reject the
 		// update if they do not match. Only after that the expiration map is updated.
-		if i.Conflict != 0 && (i.Conflict != item.conflict) {
+		if m.conflicts(i.Conflict, item) {
 			return
 		}
 	}
 
 	m.data[i.Key] = storeItem{
-		key:      i.Key,
-		conflict: i.Conflict,
-		value:    i.Value,
+		key:        i.Key,
+		conflict:   i.Conflict,
+		value:      i.Value,
+		expiration: i.Expiration,
 	}
 }
 
 func (m *lockedMap) Del(key, conflict uint64) (uint64, any) {
-	m.Lock()
+	m.lock()
 	item, ok := m.data[key]
 	if !ok {
 		m.Unlock()
 		return 0, nil
 	}
-	if conflict != 0 && (conflict != item.conflict) {
+	if m.conflicts(conflict, item) {
 		m.Unlock()
 		return 0, nil
 	}
@@ -185,27 +432,124 @@ func (m *lockedMap) Del(key, conflict uint64) (uint64, any) {
 }
 
 func (m *lockedMap) Update(newItem *Item) (any, bool) {
-	m.Lock()
+	m.lock()
 	item, ok := m.data[newItem.Key]
 	if !ok {
 		m.Unlock()
 		return nil, false
 	}
-	if newItem.Conflict != 0 && (newItem.Conflict != item.conflict) {
+	if m.conflicts(newItem.Conflict, item) {
 		m.Unlock()
 		return nil, false
 	}
 
 	m.data[newItem.Key] = storeItem{
-		key:      newItem.Key,
-		conflict: newItem.Conflict,
-		value:    newItem.Value,
+		key:        newItem.Key,
+		conflict:   newItem.Conflict,
+		value:      newItem.Value,
+		expiration: newItem.Expiration,
 	}
 
 	m.Unlock()
 	return item.value, true
 }
 
+func (m *lockedMap) CompareAndUpdate(newItem *Item, match func(any) bool) (any, bool) {
+	m.lock()
+	defer m.Unlock()
+	item, ok := m.data[newItem.Key]
+	if !ok || item.expired(m.clock.Now()) {
+		return nil, false
+	}
+	if m.conflicts(newItem.Conflict, item) {
+		return nil, false
+	}
+	if !match(item.value) {
+		return nil, false
+	}
+	m.data[newItem.Key] = storeItem{
+		key:        newItem.Key,
+		conflict:   newItem.Conflict,
+		value:      newItem.Value,
+		expiration: newItem.Expiration,
+	}
+	return item.value, true
+}
+
+func (m *lockedMap) Increment(key, conflict uint64, delta int64) (int64, any, bool, bool) {
+	m.lock()
+	defer m.Unlock()
+	item, ok := m.data[key]
+	if ok && m.conflicts(conflict, item) {
+		return 0, nil, false, false
+	}
+	if !ok || item.expired(m.clock.Now()) {
+		m.data[key] = storeItem{
+			key:      key,
+			conflict: conflict,
+			value:    delta,
+		}
+		return delta, item.value, true, true
+	}
+	n, ok := item.value.(int64)
+	if !ok {
+		return 0, nil, false, false
+	}
+	item.value = n + delta
+	m.data[key] = item
+	return n + delta, nil, false, true
+}
+
+func (m *lockedMap) SetIfAbsent(i *Item) (any, bool) {
+	m.lock()
+	defer m.Unlock()
+	item, ok := m.data[i.Key]
+	if ok && !item.expired(m.clock.Now()) {
+		// The key hash may be taken by another key, which is kept as well.
+		m.conflicts(i.Conflict, item)
+		return nil, false
+	}
+	m.data[i.Key] = storeItem{
+		key:        i.Key,
+		conflict:   i.Conflict,
+		value:      i.Value,
+		expiration: i.Expiration,
+	}
+	return item.value, true
+}
+
+func (m *lockedMap) DelExpired(key, conflict uint64) (any, bool) {
+	m.lock()
+	defer m.Unlock()
+	item, ok := m.data[key]
+	if !ok || !item.expired(m.clock.Now()) {
+		return nil, false
+	}
+	if m.conflicts(conflict, item) {
+		return nil, false
+	}
+	delete(m.data, key)
+	return item.value, true
+}
+
+func (m *lockedMap) DelIf(pred func(*Item) bool, deleted []*Item) []*Item {
+	m.lock()
+	defer m.Unlock()
+	i := &Item{}
+	for key, si := range m.data {
+		i.Key = si.key
+		i.Conflict = si.conflict
+		i.Value = si.value
+		if !pred(i) {
+			continue
+		}
+		delete(m.data, key)
+		deleted = append(deleted, i)
+		i = &Item{}
+	}
+	return deleted
+}
+
 func (m *lockedMap) Len() int {
 	m.RLock()
 	l := len(m.data)
@@ -214,25 +558,32 @@ func (m *lockedMap) Len() int {
 }
 
 func (m *lockedMap) Clear(onEvict itemCallback) {
-	m.Lock()
-	i := &Item{}
+	m.lock()
 	if onEvict != nil {
 		for _, si := range m.data {
-			i.Key = si.key
-			i.Conflict = si.conflict
-			i.Value = si.value
-			onEvict(i)
+			// Every item gets its own Item, since onEvict may keep it, e.g. to
+			// send it on the EvictChan.
+			onEvict(&Item{
+				Key:        si.key,
+				Conflict:   si.conflict,
+				Value:      si.value,
+				Expiration: si.expiration,
+			})
 		}
 	}
 	m.data = make(map[uint64]storeItem)
 	m.Unlock()
 }
 
-func (m *lockedMap) foreach(forEach func(any) bool) bool {
-	m.RLock()
+func (m *lockedMap) foreach(forEach func(key, conflict uint64, value any) bool) bool {
+	m.rlock()
 	defer m.RUnlock()
+	now := m.clock.Now()
 	for _, si := range m.data {
-		if !forEach(si.value) {
+		if si.expired(now) {
+			continue
+		}
+		if !forEach(si.key, si.conflict, si.value) {
 			return false
 		}
 	}
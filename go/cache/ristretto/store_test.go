@@ -20,6 +20,7 @@ package ristretto
 import (
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -72,6 +73,32 @@ func TestStoreDel(t *testing.T) {
 	s.Del(2, 0)
 }
 
+func TestStoreDelIf(t *testing.T) {
+	s := newStore()
+	for i := 0; i < 1000; i++ {
+		key, conflict := defaultStringHash(strconv.Itoa(i))
+		it := Item{
+			Key:      key,
+			Conflict: conflict,
+			Value:    i,
+		}
+		s.Set(&it)
+	}
+	deleted := s.DelIf(func(i *Item) bool {
+		return i.Value.(int)%2 == 0
+	})
+	require.Len(t, deleted, 500)
+	for _, it := range deleted {
+		require.Zero(t, it.Value.(int)%2)
+	}
+	for i := 0; i < 1000; i++ {
+		key, conflict := defaultStringHash(strconv.Itoa(i))
+		_, ok := s.Get(key, conflict)
+		require.Equal(t, i%2 != 0, ok)
+	}
+	require.Equal(t, 500, s.Len())
+}
+
 func TestStoreClear(t *testing.T) {
 	s := newStore()
 	for i := 0; i < 1000; i++ {
@@ -134,6 +161,124 @@ func TestStoreUpdate(t *testing.T) {
 	require.Nil(t, val)
 }
 
+func TestStoreCompareAndUpdate(t *testing.T) {
+	s := newStore()
+	key, conflict := defaultStringHash("1")
+	s.Set(&Item{Key: key, Conflict: conflict, Value: 1})
+	is := func(v any) func(any) bool {
+		return func(current any) bool { return current == v }
+	}
+
+	prev, ok := s.CompareAndUpdate(&Item{Key: key, Conflict: conflict, Value: 2}, is(1))
+	require.True(t, ok)
+	require.Equal(t, 1, prev)
+	val, ok := s.Get(key, conflict)
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+
+	_, ok = s.CompareAndUpdate(&Item{Key: key, Conflict: conflict, Value: 3}, is(1))
+	require.False(t, ok)
+	val, _ = s.Get(key, conflict)
+	require.Equal(t, 2, val)
+
+	// A conflicting key doesn't match.
+	_, ok = s.CompareAndUpdate(&Item{Key: key, Conflict: conflict + 1, Value: 3}, is(2))
+	require.False(t, ok)
+
+	// Nor does a missing or expired key.
+	key, conflict = defaultStringHash("2")
+	_, ok = s.CompareAndUpdate(&Item{Key: key, Conflict: conflict, Value: 3}, is(nil))
+	require.False(t, ok)
+	s.Set(&Item{Key: key, Conflict: conflict, Value: 1, Expiration: time.Now().Add(-time.Second)})
+	_, ok = s.CompareAndUpdate(&Item{Key: key, Conflict: conflict, Value: 3}, is(1))
+	require.False(t, ok)
+}
+
+func TestStoreIncrement(t *testing.T) {
+	s := newStore()
+	key, conflict := defaultStringHash("1")
+
+	val, prev, added, ok := s.Increment(key, conflict, 2)
+	require.True(t, ok)
+	require.True(t, added)
+	require.Nil(t, prev)
+	require.Equal(t, int64(2), val)
+
+	val, _, added, ok = s.Increment(key, conflict, -5)
+	require.True(t, ok)
+	require.False(t, added)
+	require.Equal(t, int64(-3), val)
+	got, _ := s.Get(key, conflict)
+	require.Equal(t, int64(-3), got)
+
+	// A conflicting key isn't incremented.
+	_, _, _, ok = s.Increment(key, conflict+1, 1)
+	require.False(t, ok)
+
+	key, conflict = defaultStringHash("2")
+	s.Set(&Item{Key: key, Conflict: conflict, Value: 1})
+	_, _, _, ok = s.Increment(key, conflict, 1)
+	require.False(t, ok)
+
+	// An expired value is replaced.
+	s.Set(&Item{Key: key, Conflict: conflict, Value: int64(7), Expiration: time.Now().Add(-time.Second)})
+	val, prev, added, ok = s.Increment(key, conflict, 1)
+	require.True(t, ok)
+	require.True(t, added)
+	require.Equal(t, int64(7), prev)
+	require.Equal(t, int64(1), val)
+}
+
+func TestStoreSetIfAbsent(t *testing.T) {
+	s := newStore()
+	key, conflict := defaultStringHash("1")
+
+	prev, ok := s.SetIfAbsent(&Item{Key: key, Conflict: conflict, Value: 1})
+	require.True(t, ok)
+	require.Nil(t, prev)
+
+	_, ok = s.SetIfAbsent(&Item{Key: key, Conflict: conflict, Value: 2})
+	require.False(t, ok)
+	// A conflicting key doesn't replace the value either.
+	_, ok = s.SetIfAbsent(&Item{Key: key, Conflict: conflict + 1, Value: 3})
+	require.False(t, ok)
+	val, _ := s.Get(key, conflict)
+	require.Equal(t, 1, val)
+
+	// An expired value is replaced.
+	s.Set(&Item{Key: key, Conflict: conflict, Value: 4, Expiration: time.Now().Add(-time.Second)})
+	prev, ok = s.SetIfAbsent(&Item{Key: key, Conflict: conflict, Value: 5})
+	require.True(t, ok)
+	require.Equal(t, 4, prev)
+	val, _ = s.Get(key, conflict)
+	require.Equal(t, 5, val)
+}
+
+func TestStoreShardStats(t *testing.T) {
+	s := newShardedMap()
+	s.CollectMetrics(newMetrics())
+	s.Set(&Item{Key: 1, Conflict: 1, Value: 1})
+	s.Set(&Item{Key: 1 + numShards, Conflict: 1, Value: 2})
+	s.Set(&Item{Key: 2, Conflict: 1, Value: 3})
+
+	// Hold the lock of the shard of key 1, so that a Get has to wait for it.
+	shard := s.shards[1]
+	shard.Lock()
+	done := make(chan struct{})
+	go func() {
+		s.Get(1, 1)
+		close(done)
+	}()
+	time.Sleep(wait)
+	shard.Unlock()
+	<-done
+
+	stats := s.ShardStats()
+	require.Equal(t, ShardStat{Entries: 2, Contended: 1}, stats[1])
+	require.Equal(t, ShardStat{Entries: 1}, stats[2])
+	require.Equal(t, ShardStat{}, stats[3])
+}
+
 func TestStoreCollision(t *testing.T) {
 	s := newShardedMap()
 	s.shards[1].Lock()
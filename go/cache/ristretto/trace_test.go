@@ -0,0 +1,179 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ristretto
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/race"
+)
+
+// traceLength is the number of accesses replayed for every trace.
+const traceLength = 200_000
+
+// accessTrace generates a sequence of keys to be replayed through a Cache.
+type accessTrace struct {
+	name string
+	// keys returns the next key of the trace every time it's called.
+	keys func(r *rand.Rand) func() string
+	// minRatio is the minimum hit ratio the default policy must achieve on this
+	// trace for every tested capacity.
+	minRatio map[int64]float64
+	// maxRatio is the maximum hit ratio that can be achieved on this trace.
+	maxRatio float64
+}
+
+// zipfTrace returns keys following a Zipfian distribution over keySpace keys,
+// a good approximation of the skew found in most real workloads.
+func zipfTrace(keySpace uint64) func(r *rand.Rand) func() string {
+	return func(r *rand.Rand) func() string {
+		z := rand.NewZipf(r, 1.1, 1, keySpace-1)
+		return func() string {
+			return strconv.FormatUint(z.Uint64(), 10)
+		}
+	}
+}
+
+// loopTrace cycles over keySpace keys in order. A loop larger than the cache
+// capacity is the worst case for LRU and a good test for frequency-based
+// admission, which should keep a stable subset of the loop resident.
+func loopTrace(keySpace uint64) func(r *rand.Rand) func() string {
+	return func(_ *rand.Rand) func() string {
+		var i uint64
+		return func() string {
+			key := strconv.FormatUint(i%keySpace, 10)
+			i++
+			return key
+		}
+	}
+}
+
+// sequentialTrace never repeats a key, so no policy can get any hits. It's
+// used to make sure the cache does not report bogus hits.
+func sequentialTrace() func(r *rand.Rand) func() string {
+	return func(_ *rand.Rand) func() string {
+		var i uint64
+		return func() string {
+			key := strconv.FormatUint(i, 10)
+			i++
+			return key
+		}
+	}
+}
+
+var accessTraces = []accessTrace{
+	{
+		name:     "zipf",
+		keys:     zipfTrace(100_000),
+		minRatio: map[int64]float64{100: 0.40, 1_000: 0.65, 10_000: 0.80},
+		maxRatio: 1,
+	},
+	{
+		name: "loop",
+		keys: loopTrace(2_000),
+		// With every access counted, all the keys of a loop 20 times larger
+		// than the cache are equally frequent, so none of them stays.
+		minRatio: map[int64]float64{100: 0, 1_000: 0.18, 10_000: 0.98},
+		maxRatio: 1,
+	},
+	{
+		name:     "sequential",
+		keys:     sequentialTrace(),
+		minRatio: map[int64]float64{100: 0, 1_000: 0, 10_000: 0},
+		maxRatio: 0,
+	},
+}
+
+// replayTrace replays traceLength accesses of the given trace through a new
+// Cache with the given MaxCost, following the usual cache-aside pattern, and
+// returns the achieved hit ratio.
+//
+// The accesses are recorded in the policy synchronously, rather than through
+// Get, whose batches of accesses are dropped when the policy is busy, so that
+// the hit ratio doesn't depend on goroutine scheduling.
+func replayTrace(tb testing.TB, trace accessTrace, maxCost int64) float64 {
+	tb.Helper()
+
+	c, err := NewCache(&Config{
+		NumCounters:        maxCost * 10,
+		MaxCost:            maxCost,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(tb, err)
+	defer c.Close()
+	p := c.policy.(*defaultPolicy)
+
+	var hits int
+	next := trace.keys(rand.New(rand.NewSource(42)))
+	for i := 0; i < traceLength; i++ {
+		key := next()
+		keyHash, conflictHash := c.keyToHash(key)
+		p.Lock()
+		p.admit.Increment(keyHash)
+		p.Unlock()
+		if _, ok := c.store.Get(keyHash, conflictHash); ok {
+			hits++
+			continue
+		}
+		c.SetWithCost(key, key, 1)
+		// Sets are applied asynchronously; wait for them so the result
+		// depends on the policy and not on goroutine scheduling.
+		c.Wait()
+	}
+	return float64(hits) / traceLength
+}
+
+// TestHitRatio is a regression guard for the admission and eviction policies:
+// it fails whenever a change to the policy or the store makes the hit ratio on
+// any of the standard traces drop below its known minimum.
+func TestHitRatio(t *testing.T) {
+	if race.Enabled {
+		// The traces are replayed from a single goroutine, so the race
+		// detector only makes the test much slower.
+		t.Skip("skipping under the race detector")
+	}
+	for _, trace := range accessTraces {
+		for maxCost, minRatio := range trace.minRatio {
+			t.Run(fmt.Sprintf("%s/%d", trace.name, maxCost), func(t *testing.T) {
+				ratio := replayTrace(t, trace, maxCost)
+				t.Logf("hit ratio: %.4f", ratio)
+				require.GreaterOrEqual(t, ratio, minRatio)
+				require.LessOrEqual(t, ratio, trace.maxRatio)
+			})
+		}
+	}
+}
+
+func BenchmarkHitRatio(b *testing.B) {
+	for _, trace := range accessTraces {
+		for _, maxCost := range []int64{100, 1_000, 10_000} {
+			b.Run(fmt.Sprintf("%s/%d", trace.name, maxCost), func(b *testing.B) {
+				var ratio float64
+				for i := 0; i < b.N; i++ {
+					ratio = replayTrace(b, trace, maxCost)
+				}
+				b.ReportMetric(ratio, "hit-ratio")
+			})
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ristretto
+
+// TypedCache is a Cache whose values are all of type V. Get, Set and
+// SetWithCost take and return values of type V, so callers don't need type
+// assertions; the other methods, as well as the Metrics, are those of the
+// underlying Cache.
+type TypedCache[V any] struct {
+	*Cache
+}
+
+// NewTypedCache returns a new TypedCache instance and any configuration
+// errors, if any. The Cost and OnEvict callbacks of the config can be built
+// from functions of values of type V with TypedCost and TypedOnEvict.
+func NewTypedCache[V any](config *Config) (*TypedCache[V], error) {
+	cache, err := NewCache(config)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedCache[V]{Cache: cache}, nil
+}
+
+// Get returns the value (if any) and a boolean representing whether the
+// value was found or not. A value that isn't of type V, which can only have
+// been added through the underlying Cache, is treated as missing, and the
+// zero value of V is returned whenever the boolean is false.
+func (c *TypedCache[V]) Get(key string) (V, bool) {
+	value, ok := c.Cache.Get(key)
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	v, ok := value.(V)
+	return v, ok
+}
+
+// Set works like Cache.Set for a value of type V.
+func (c *TypedCache[V]) Set(key string, value V) bool {
+	return c.Cache.Set(key, value)
+}
+
+// SetWithCost works like Cache.SetWithCost for a value of type V.
+func (c *TypedCache[V]) SetWithCost(key string, value V, cost int64) bool {
+	return c.Cache.SetWithCost(key, value, cost)
+}
+
+// TypedCost adapts a cost function of values of type V to be used as the Cost
+// of a Config. Values that aren't of type V are passed as the zero value.
+func TypedCost[V any](cost func(value V) int64) func(value any) int64 {
+	return func(value any) int64 {
+		v, _ := value.(V)
+		return cost(v)
+	}
+}
+
+// TypedOnEvict adapts a callback taking the hashed key, the value of type V
+// and the cost of an evicted item to be used as the OnEvict of a Config.
+// Values that aren't of type V are passed as the zero value.
+func TypedOnEvict[V any](onEvict func(key uint64, value V, cost int64)) func(item *Item) {
+	return func(item *Item) {
+		v, _ := item.Value.(V)
+		onEvict(item.Key, v, item.Cost)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTypedCache(t *testing.T) {
+	c, err := NewTypedCache[string](&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+		Cost: TypedCost(func(value string) int64 {
+			return int64(len(value))
+		}),
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set("a", "abc"))
+	require.True(t, c.SetWithCost("b", "de", 1))
+	c.Wait()
+
+	val, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, "abc", val)
+	val, ok = c.Get("b")
+	require.True(t, ok)
+	require.Equal(t, "de", val)
+	require.Equal(t, int64(4), c.UsedCapacity())
+	require.Equal(t, uint64(2), c.Metrics.Hits())
+
+	val, ok = c.Get("missing")
+	require.False(t, ok)
+	require.Equal(t, "", val)
+
+	// A value of another type set through the underlying cache is missing.
+	require.True(t, c.Cache.SetWithCost("int", 1, 1))
+	c.Wait()
+	val, ok = c.Get("int")
+	require.False(t, ok)
+	require.Equal(t, "", val)
+
+	_, err = NewTypedCache[string](&Config{})
+	require.Error(t, err)
+}
+
+func TestTypedCallbacks(t *testing.T) {
+	cost := TypedCost(func(value []byte) int64 {
+		return int64(len(value))
+	})
+	require.Equal(t, int64(3), cost([]byte("abc")))
+	require.Equal(t, int64(0), cost("abc"))
+
+	var evicted []string
+	onEvict := TypedOnEvict(func(key uint64, value string, cost int64) {
+		require.Equal(t, uint64(1), key)
+		require.Equal(t, int64(2), cost)
+		evicted = append(evicted, value)
+	})
+	onEvict(&Item{Key: 1, Value: "abc", Cost: 2})
+	onEvict(&Item{Key: 1, Value: nil, Cost: 2})
+	require.Equal(t, []string{"abc", ""}, evicted)
+}
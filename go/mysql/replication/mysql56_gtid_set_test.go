@@ -465,6 +465,18 @@ func TestMysql56GTIDSetUnion(t *testing.T) {
 
 }
 
+func TestMysql56GTIDSetCount(t *testing.T) {
+	sid1 := SID{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	sid2 := SID{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 16}
+
+	assert.EqualValues(t, 0, Mysql56GTIDSet{}.Count())
+	assert.EqualValues(t, 1, Mysql56GTIDSet{sid1: []interval{{5, 5}}}.Count())
+	assert.EqualValues(t, 47, Mysql56GTIDSet{
+		sid1: []interval{{1, 30}, {35, 39}},
+		sid2: []interval{{20, 31}},
+	}.Count())
+}
+
 func TestMysql56GTIDSetDifference(t *testing.T) {
 	sid1 := SID{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
 	sid2 := SID{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 16}
@@ -17,7 +17,10 @@ limitations under the License.
 package utils
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"strings"
 	"testing"
 	"time"
@@ -340,3 +343,28 @@ func TimeoutAction(t *testing.T, timeout time.Duration, errMsg string, action fu
 		}
 	}
 }
+
+// GetPlanCache returns the entries of the plan cache of the vtgate listening on the given host:port,
+// as listed by its /debug/query_plans endpoint. The Key of each entry is the normalized query.
+func GetPlanCache(vtgateHostPort string) ([]map[string]any, error) {
+	var results []map[string]any
+	client := http.Client{
+		Timeout: 10 * time.Second,
+	}
+	resp, err := client.Get(fmt.Sprintf("http://%s/debug/query_plans", vtgateHostPort))
+	if err != nil {
+		return results, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return results, err
+	}
+
+	err = json.Unmarshal(body, &results)
+	if err != nil {
+		return results, err
+	}
+
+	return results, nil
+}
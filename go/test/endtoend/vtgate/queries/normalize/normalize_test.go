@@ -18,12 +18,8 @@ package normalize
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
 	"testing"
-	"time"
 
 	"vitess.io/vitess/go/test/endtoend/utils"
 
@@ -46,7 +42,7 @@ func TestNormalizeAllFields(t *testing.T) {
 	assert.Equal(t, 1, len(qr.Rows), "wrong number of table rows, expected 1 but had %d. Results: %v", len(qr.Rows), qr.Rows)
 
 	// Now need to figure out the best way to check the normalized query in the planner cache...
-	results, err := getPlanCache(fmt.Sprintf("%s:%d", vtParams.Host, clusterInstance.VtgateProcess.Port))
+	results, err := utils.GetPlanCache(fmt.Sprintf("%s:%d", vtParams.Host, clusterInstance.VtgateProcess.Port))
 	require.Nil(t, err)
 	found := false
 	for _, record := range results {
@@ -58,26 +54,3 @@ func TestNormalizeAllFields(t *testing.T) {
 	}
 	assert.Truef(t, found, "correctly normalized record not found in planner cache %v", results)
 }
-
-func getPlanCache(vtgateHostPort string) ([]map[string]any, error) {
-	var results []map[string]any
-	client := http.Client{
-		Timeout: 10 * time.Second,
-	}
-	resp, err := client.Get(fmt.Sprintf("http://%s/debug/query_plans", vtgateHostPort))
-	if err != nil {
-		return results, err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return results, err
-	}
-
-	err = json.Unmarshal(body, &results)
-	if err != nil {
-		return results, err
-	}
-
-	return results, nil
-}
@@ -0,0 +1,371 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package random
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"vitess.io/vitess/go/vt/sqlparser"
+)
+
+// this file contains the structs and functions to generate random DDL statements
+
+type (
+	// ddlGenerator generates a CREATE TABLE statement and ALTER TABLE statements for a single table
+	// it keeps track of the columns and indexes of the table, so that the ALTER TABLE statements
+	// only reference columns and indexes that exist
+	ddlGenerator struct {
+		r     *rand.Rand
+		table sqlparser.TableName
+		// cols are the columns of the table other than the primary key (id)
+		cols []*sqlparser.ColumnDefinition
+		// indexes are the columns of the secondary indexes of the table, by index name
+		indexes map[string][]sqlparser.IdentifierCI
+		// colCount and indexCount are used to generate unique column and index names
+		colCount, indexCount int
+	}
+
+	// ddlType is a column type the generator can use
+	ddlType struct {
+		typ string
+		// newColumnType returns a random instance of the type, e.g. varchar(20)
+		newColumnType func(r *rand.Rand) *sqlparser.ColumnType
+		// defaultValue returns a random literal to use as default value, or nil if the type can't have one
+		defaultValue func(r *rand.Rand) sqlparser.Expr
+		// indexPrefix is true if the type can only be indexed on a prefix of its values
+		indexPrefix bool
+	}
+)
+
+var ddlTypes = []ddlType{
+	{
+		typ:           "bigint",
+		newColumnType: func(*rand.Rand) *sqlparser.ColumnType { return &sqlparser.ColumnType{Type: "bigint"} },
+		defaultValue:  func(r *rand.Rand) sqlparser.Expr { return sqlparser.NewIntLiteral(strconv.Itoa(r.Intn(200) - 100)) },
+	},
+	{
+		typ:           "int unsigned",
+		newColumnType: func(*rand.Rand) *sqlparser.ColumnType { return &sqlparser.ColumnType{Type: "int", Unsigned: true} },
+		defaultValue:  func(r *rand.Rand) sqlparser.Expr { return sqlparser.NewIntLiteral(strconv.Itoa(r.Intn(100))) },
+	},
+	{
+		typ: "decimal",
+		newColumnType: func(r *rand.Rand) *sqlparser.ColumnType {
+			length := r.Intn(10) + 5
+			return &sqlparser.ColumnType{
+				Type:   "decimal",
+				Length: sqlparser.NewIntLiteral(strconv.Itoa(length)),
+				Scale:  sqlparser.NewIntLiteral(strconv.Itoa(r.Intn(4))),
+			}
+		},
+		defaultValue: func(r *rand.Rand) sqlparser.Expr {
+			return sqlparser.NewDecimalLiteral(fmt.Sprintf("%d.%d", r.Intn(100), r.Intn(100)))
+		},
+	},
+	{
+		typ:           "double",
+		newColumnType: func(*rand.Rand) *sqlparser.ColumnType { return &sqlparser.ColumnType{Type: "double"} },
+		defaultValue: func(r *rand.Rand) sqlparser.Expr {
+			return sqlparser.NewDecimalLiteral(fmt.Sprintf("%d.5", r.Intn(100)))
+		},
+	},
+	{
+		typ: "varchar",
+		newColumnType: func(r *rand.Rand) *sqlparser.ColumnType {
+			ct := &sqlparser.ColumnType{Type: "varchar", Length: sqlparser.NewIntLiteral(strconv.Itoa(r.Intn(64) + 1))}
+			if r.Intn(4) < 1 {
+				ct.Charset = sqlparser.ColumnCharset{Name: "utf8mb4"}
+				ct.Options = &sqlparser.ColumnTypeOptions{Collate: randomEl(r, []string{"utf8mb4_bin", "utf8mb4_general_ci", "utf8mb4_0900_ai_ci"})}
+			}
+			return ct
+		},
+		defaultValue: func(r *rand.Rand) sqlparser.Expr {
+			return sqlparser.NewStrLiteral(randomEl(r, []string{"", "a", "abc"}))
+		},
+	},
+	{
+		typ: "char",
+		newColumnType: func(r *rand.Rand) *sqlparser.ColumnType {
+			return &sqlparser.ColumnType{Type: "char", Length: sqlparser.NewIntLiteral(strconv.Itoa(r.Intn(16) + 1))}
+		},
+		defaultValue: func(r *rand.Rand) sqlparser.Expr { return sqlparser.NewStrLiteral(randomEl(r, []string{"", "a"})) },
+	},
+	{
+		typ:           "date",
+		newColumnType: func(*rand.Rand) *sqlparser.ColumnType { return &sqlparser.ColumnType{Type: "date"} },
+		defaultValue: func(r *rand.Rand) sqlparser.Expr {
+			return sqlparser.NewStrLiteral(fmt.Sprintf("20%02d-%02d-%02d", r.Intn(30), r.Intn(12)+1, r.Intn(28)+1))
+		},
+	},
+	{
+		typ:           "datetime",
+		newColumnType: func(*rand.Rand) *sqlparser.ColumnType { return &sqlparser.ColumnType{Type: "datetime"} },
+		defaultValue: func(r *rand.Rand) sqlparser.Expr {
+			return sqlparser.NewStrLiteral(fmt.Sprintf("20%02d-%02d-%02d %02d:00:00", r.Intn(30), r.Intn(12)+1, r.Intn(28)+1, r.Intn(24)))
+		},
+	},
+	{
+		typ: "enum",
+		newColumnType: func(*rand.Rand) *sqlparser.ColumnType {
+			return &sqlparser.ColumnType{Type: "enum", EnumValues: []string{"'red'", "'green'", "'blue'"}}
+		},
+		defaultValue: func(r *rand.Rand) sqlparser.Expr {
+			return sqlparser.NewStrLiteral(randomEl(r, []string{"red", "green", "blue"}))
+		},
+	},
+	{
+		typ:           "text",
+		newColumnType: func(*rand.Rand) *sqlparser.ColumnType { return &sqlparser.ColumnType{Type: "text"} },
+		// text columns can only have an expression as default value
+		defaultValue: func(*rand.Rand) sqlparser.Expr { return nil },
+		indexPrefix:  true,
+	},
+}
+
+func newDDLGenerator(r *rand.Rand, table string) *ddlGenerator {
+	return &ddlGenerator{
+		r:       r,
+		table:   sqlparser.NewTableName(table),
+		indexes: make(map[string][]sqlparser.IdentifierCI),
+	}
+}
+
+// randomCreateTable returns a CREATE TABLE statement with an auto_increment primary key (id),
+// 1-5 columns of random types and 0-2 secondary indexes
+func (dg *ddlGenerator) randomCreateTable() *sqlparser.CreateTable {
+	notNull := false
+	spec := &sqlparser.TableSpec{
+		Columns: []*sqlparser.ColumnDefinition{{
+			Name: sqlparser.NewIdentifierCI("id"),
+			Type: &sqlparser.ColumnType{Type: "bigint", Options: &sqlparser.ColumnTypeOptions{Null: &notNull, Autoincrement: true}},
+		}},
+		Indexes: []*sqlparser.IndexDefinition{{
+			Info:    &sqlparser.IndexInfo{Type: sqlparser.PrimaryKeyTypeStr, Primary: true, Unique: true},
+			Columns: []*sqlparser.IndexColumn{{Column: sqlparser.NewIdentifierCI("id")}},
+		}},
+	}
+
+	numCols := dg.r.Intn(5) + 1
+	for i := 0; i < numCols; i++ {
+		col := dg.randomColumn()
+		dg.cols = append(dg.cols, col)
+		spec.Columns = append(spec.Columns, col)
+	}
+
+	numIndexes := dg.r.Intn(3)
+	for i := 0; i < numIndexes; i++ {
+		spec.Indexes = append(spec.Indexes, dg.randomIndex())
+	}
+
+	return &sqlparser.CreateTable{Table: dg.table, TableSpec: spec}
+}
+
+// randomAlterTable returns an ALTER TABLE statement with 1-3 random changes to the table created by randomCreateTable:
+// adding, dropping or modifying a column, or adding or dropping an index
+// the columns and indexes added by the statement are not dropped or modified by the same statement,
+// and neither are the columns of the added indexes, since mysql doesn't allow it
+func (dg *ddlGenerator) randomAlterTable() *sqlparser.AlterTable {
+	alter := &sqlparser.AlterTable{Table: dg.table}
+	var added []*sqlparser.ColumnDefinition
+	var addedIndexes []string
+	existing := func() (cols []*sqlparser.ColumnDefinition) {
+		for _, col := range dg.cols {
+			if slices.Contains(added, col) {
+				continue
+			}
+			if slices.ContainsFunc(addedIndexes, func(name string) bool { return slices.ContainsFunc(dg.indexes[name], col.Name.Equal) }) {
+				continue
+			}
+			cols = append(cols, col)
+		}
+		return
+	}
+
+	numChanges := dg.r.Intn(3) + 1
+	for i := 0; i < numChanges; i++ {
+		switch dg.r.Intn(5) {
+		case 0:
+			col := dg.randomColumn()
+			addCols := &sqlparser.AddColumns{Columns: []*sqlparser.ColumnDefinition{col}}
+			if dg.r.Intn(4) < 1 {
+				addCols.After = sqlparser.NewColName("id")
+			}
+			dg.cols = append(dg.cols, col)
+			added = append(added, col)
+			alter.AlterOptions = append(alter.AlterOptions, addCols)
+		case 1:
+			// always keep a column other than the primary key
+			cols := existing()
+			if len(cols) == 0 || len(dg.cols) < 2 {
+				continue
+			}
+			col := randomEl(dg.r, cols)
+			dg.dropColumn(col)
+			alter.AlterOptions = append(alter.AlterOptions, &sqlparser.DropColumn{Name: sqlparser.NewColName(col.Name.String())})
+		case 2:
+			// changing the type of an indexed column could require an index prefix
+			var cols []*sqlparser.ColumnDefinition
+			for _, col := range existing() {
+				if !dg.isIndexed(col) {
+					cols = append(cols, col)
+				}
+			}
+			if len(cols) == 0 {
+				continue
+			}
+			col := randomEl(dg.r, cols)
+			newCol := dg.randomColumnType(col.Name)
+			dg.cols[slices.Index(dg.cols, col)] = newCol
+			// the column is now in its modified form, so it can't be modified again
+			added = append(added, newCol)
+			alter.AlterOptions = append(alter.AlterOptions, &sqlparser.ModifyColumn{NewColDefinition: newCol})
+		case 3:
+			idx := dg.randomIndex()
+			addedIndexes = append(addedIndexes, idx.Info.Name.String())
+			alter.AlterOptions = append(alter.AlterOptions, &sqlparser.AddIndexDefinition{IndexDefinition: idx})
+		default:
+			var names []string
+			for name := range dg.indexes {
+				if !slices.Contains(addedIndexes, name) {
+					names = append(names, name)
+				}
+			}
+			if len(names) == 0 {
+				continue
+			}
+			slices.Sort(names)
+			name := randomEl(dg.r, names)
+			delete(dg.indexes, name)
+			alter.AlterOptions = append(alter.AlterOptions, &sqlparser.DropKey{Type: sqlparser.NormalKeyType, Name: sqlparser.NewIdentifierCI(name)})
+		}
+	}
+
+	// nothing could be changed, e.g. when asked to drop the only column
+	if len(alter.AlterOptions) == 0 {
+		col := dg.randomColumn()
+		dg.cols = append(dg.cols, col)
+		alter.AlterOptions = append(alter.AlterOptions, &sqlparser.AddColumns{Columns: []*sqlparser.ColumnDefinition{col}})
+	}
+
+	return alter
+}
+
+// randomColumn returns a column with a new name and a random type
+func (dg *ddlGenerator) randomColumn() *sqlparser.ColumnDefinition {
+	name := sqlparser.NewIdentifierCI(fmt.Sprintf("c%d", dg.colCount))
+	dg.colCount++
+	return dg.randomColumnType(name)
+}
+
+// randomColumnType returns a column named name with a random type, nullability, default value and comment
+func (dg *ddlGenerator) randomColumnType(name sqlparser.IdentifierCI) *sqlparser.ColumnDefinition {
+	typ := randomEl(dg.r, ddlTypes)
+	ct := typ.newColumnType(dg.r)
+	if ct.Options == nil {
+		ct.Options = &sqlparser.ColumnTypeOptions{}
+	}
+	if dg.r.Intn(2) < 1 {
+		null := dg.r.Intn(2) < 1
+		ct.Options.Null = &null
+	}
+	if dg.r.Intn(2) < 1 {
+		if def := typ.defaultValue(dg.r); def != nil {
+			ct.Options.Default = def
+			ct.Options.DefaultLiteral = true
+		}
+	}
+	if dg.r.Intn(4) < 1 {
+		ct.Options.Comment = sqlparser.NewStrLiteral(fmt.Sprintf("column %s", name.String()))
+	}
+
+	return &sqlparser.ColumnDefinition{Name: name, Type: ct}
+}
+
+// randomIndex returns a new secondary index on 1-2 random columns, which is unique a quarter of the time
+func (dg *ddlGenerator) randomIndex() *sqlparser.IndexDefinition {
+	name := fmt.Sprintf("idx%d", dg.indexCount)
+	dg.indexCount++
+	info := &sqlparser.IndexInfo{Type: sqlparser.NormalKeyTypeStr, Name: sqlparser.NewIdentifierCI(name)}
+	if dg.r.Intn(4) < 1 {
+		info.Type = "unique key"
+		info.Unique = true
+	}
+
+	idx := &sqlparser.IndexDefinition{Info: info}
+	perm := dg.r.Perm(len(dg.cols))
+	for _, i := range perm[:min(len(perm), dg.r.Intn(2)+1)] {
+		col := dg.cols[i]
+		idxCol := &sqlparser.IndexColumn{Column: col.Name}
+		if dg.needsIndexPrefix(col) {
+			idxCol.Length = sqlparser.NewIntLiteral("10")
+		}
+		idx.Columns = append(idx.Columns, idxCol)
+		dg.indexes[name] = append(dg.indexes[name], col.Name)
+	}
+
+	return idx
+}
+
+// dropColumn removes col from the columns and from the indexes of the table
+// mysql drops the indexes that are left without columns
+func (dg *ddlGenerator) dropColumn(col *sqlparser.ColumnDefinition) {
+	dg.cols = slices.DeleteFunc(dg.cols, func(c *sqlparser.ColumnDefinition) bool { return c == col })
+	for name, cols := range dg.indexes {
+		cols = slices.DeleteFunc(cols, col.Name.Equal)
+		if len(cols) == 0 {
+			delete(dg.indexes, name)
+		} else {
+			dg.indexes[name] = cols
+		}
+	}
+}
+
+func (dg *ddlGenerator) isIndexed(col *sqlparser.ColumnDefinition) bool {
+	for _, cols := range dg.indexes {
+		if slices.ContainsFunc(cols, col.Name.Equal) {
+			return true
+		}
+	}
+	return false
+}
+
+func (dg *ddlGenerator) needsIndexPrefix(col *sqlparser.ColumnDefinition) bool {
+	for _, typ := range ddlTypes {
+		if typ.indexPrefix && typ.typ == col.Type.Type {
+			return true
+		}
+	}
+	return false
+}
+
+var autoIncrementOption = regexp.MustCompile(` AUTO_INCREMENT=\d+`)
+
+// normalizeCreateTable normalizes the output of SHOW CREATE TABLE so that it can be compared between vitess and mysql:
+// the AUTO_INCREMENT table option depends on the rows inserted so far and is removed,
+// and the statement is formatted by sqlparser to ignore whitespace and quoting differences
+func normalizeCreateTable(createTable string) string {
+	createTable = autoIncrementOption.ReplaceAllString(createTable, "")
+	stmt, err := sqlparser.Parse(createTable)
+	if err != nil {
+		return createTable
+	}
+	return sqlparser.String(stmt)
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2026 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package random
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"vitess.io/vitess/go/vt/sqlparser"
+)
+
+// TestNormalizeCreateTable makes sure that the SHOW CREATE TABLE outputs of vitess and mysql
+// only compare equal when they differ in formatting or in the AUTO_INCREMENT table option
+func TestNormalizeCreateTable(t *testing.T) {
+	mysqlCreate := "CREATE TABLE `ddl_random` (\n" +
+		"  `id` bigint NOT NULL AUTO_INCREMENT,\n" +
+		"  `c0` varchar(64) DEFAULT NULL,\n" +
+		"  PRIMARY KEY (`id`),\n" +
+		"  KEY `idx0` (`c0`)\n" +
+		") ENGINE=InnoDB AUTO_INCREMENT=15 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci"
+	vtCreate := "CREATE TABLE ddl_random (id bigint NOT NULL AUTO_INCREMENT, c0 varchar(64) DEFAULT NULL, " +
+		"PRIMARY KEY (id), KEY idx0 (c0)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci"
+	assert.Equal(t, normalizeCreateTable(mysqlCreate), normalizeCreateTable(vtCreate))
+
+	// a different column type is still a mismatch
+	otherCreate := "CREATE TABLE ddl_random (id bigint NOT NULL AUTO_INCREMENT, c0 varchar(32) DEFAULT NULL, " +
+		"PRIMARY KEY (id), KEY idx0 (c0)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci"
+	assert.NotEqual(t, normalizeCreateTable(mysqlCreate), normalizeCreateTable(otherCreate))
+
+	// an output that doesn't parse is compared as is
+	assert.Equal(t, "not a create table", normalizeCreateTable("not a create table"))
+}
+
+// TestNormalizeCreateTableGenerated makes sure that the generated CREATE TABLE statements
+// survive the normalization, so that TestRandomDDL compares them instead of the raw outputs
+func TestNormalizeCreateTableGenerated(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		dg := newDDLGenerator(rand.New(rand.NewSource(int64(i))), "ddl_random")
+		query := sqlparser.String(dg.randomCreateTable())
+		normalized := normalizeCreateTable(query)
+		_, err := sqlparser.Parse(normalized)
+		assert.NoError(t, err, query)
+		assert.Equal(t, normalized, normalizeCreateTable(normalized), query)
+	}
+}
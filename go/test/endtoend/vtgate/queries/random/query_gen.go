@@ -20,10 +20,14 @@ import (
 	"fmt"
 	"math/rand"
 	"slices"
+	"strconv"
 
 	"vitess.io/vitess/go/slice"
+	"vitess.io/vitess/go/sqltypes"
 	"vitess.io/vitess/go/vt/log"
 	"vitess.io/vitess/go/vt/sqlparser"
+
+	querypb "vitess.io/vitess/go/vt/proto/query"
 )
 
 // this file contains the structs and functions to generate random queries
@@ -43,12 +47,54 @@ type (
 		maxGBs       int
 		schemaTables []tableT
 		sel          *sqlparser.Select
+		// shardKeyPredicates counts the predicates on a sharding key generated so far;
+		// they let the planner route to one or a few shards instead of scattering
+		shardKeyPredicates int
+		// if true then every select repeats a grouping expression and has an ORDER BY and a LIMIT
+		repeatedGroupBy bool
+		// if true then every select has at least one aggregation, all aggregations are aliased,
+		// and they are ordered by their alias, e.g. select count(*) as caggr0 ... order by caggr0
+		aggregateAliases bool
+		// if true then every select groups by at least one column, and either by the sharding key (deptno)
+		// or by columns that are not the sharding key, nudging the planner between pushing the aggregation
+		// down to the shards and aggregating in vtgate, either ordered or hashed
+		vindexGrouping bool
+		// if greater than 0 then every select filters on a sharding key with an IN list of 1 to inListSize values,
+		// stressing how vtgate routes, merges and caches the plans of queries with large IN lists
+		inListSize int
+		// if true then every select is a select distinct over an inner join with at least one aggregation
+		// and is ordered by all its select expressions, so that its results can be compared with mysql
+		distinctAggregation bool
+		// if true then every select joins the same table with itself at least once,
+		// and filters on a column referencing another one of the other alias, e.g. tbl0.mgr = tbl1.empno
+		selfJoins bool
+		// if greater than 0 then every select reads from derivedTableDepth levels of nested derived tables,
+		// e.g. select ... from (select ... from (select ... from emp) as tbl0) as tbl0 for a depth of 2
+		// it is bounded by maxDerivedTableDepth
+		derivedTableDepth int
+		// derivedTableLevel is the number of derived tables the current select is nested in
+		derivedTableLevel int
+		// if true then every select is grouped and has window functions over the groups,
+		// e.g. select tbl0.deptno, count(*), rank() over (order by count(*) desc) ... group by tbl0.deptno
+		// vitess only partially supports window functions, so this is off by default
+		windowFunctions bool
+		// if true then joins and filters compare nullable columns with the NULL-safe equality operator,
+		// e.g. tbl0.mgr <=> tbl1.comm or tbl0.comm <=> null, which unlike = is true when both sides are NULL
+		nullSafeEquality bool
+		// if true then every select can aggregate and is ordered, and most of its grouping and ordering expressions
+		// that are also select expressions are replaced by their 1-based position in the select list,
+		// e.g. select tbl0.loc, count(*) ... group by 1 order by 2 desc
+		positionalReferences bool
 	}
 
 	// queryGenerator generates queries, which can either be unions or select statements
 	queryGenerator struct {
 		stmt   sqlparser.SelectStatement
 		selGen *selectGenerator
+		// if true then every query is a union ordered by all its columns and limited,
+		// e.g. (select ...) union (select ...) order by 1 asc, 2 desc limit 3
+		// the ordering is total, so that the limited results can be compared with mysql
+		unionOrderBy bool
 	}
 
 	column struct {
@@ -56,6 +102,8 @@ type (
 		// TODO: perhaps remove tableName and always pass columns through a tableT
 		tableName string
 		typ       string
+		// nullable is true if the column can be NULL
+		nullable bool
 	}
 
 	tableT struct {
@@ -69,6 +117,20 @@ type (
 	}
 )
 
+// maxDerivedTableDepth bounds selectGenerator.derivedTableDepth, deeper nesting only makes pathological queries
+const maxDerivedTableDepth = 4
+
+// vindexFunctionColumns are the columns of a vindex function, i.e. of a select from a vindex of the vschema
+// as if it were a table, e.g. select keyspace_id, shard from hash where id = 10
+var vindexFunctionColumns = []string{"id", "keyspace_id", "range_start", "range_end", "hex_keyspace_id", "shard"}
+
+// foreignKeys lists the pairs of columns of the schema where the first column references the second one,
+// e.g. the mgr of an employee is the empno of another employee
+var foreignKeys = [][2]string{
+	{"mgr", "empno"},
+	{"deptno", "deptno"},
+}
+
 var _ sqlparser.ExprGenerator = (*tableT)(nil)
 var _ sqlparser.ExprGenerator = (*column)(nil)
 var _ sqlparser.QueryGenerator = (*selectGenerator)(nil)
@@ -197,7 +259,9 @@ func (sg *selectGenerator) IsQueryGenerator() {}
 func (qg *queryGenerator) IsQueryGenerator()  {}
 
 func (qg *queryGenerator) randomQuery() {
-	if qg.selGen.r.Intn(10) < 1 && testFailingQueries {
+	if qg.unionOrderBy {
+		qg.createOrderedUnion()
+	} else if qg.selGen.r.Intn(10) < 1 && testFailingQueries {
 		qg.createUnion()
 	} else {
 		qg.selGen.randomSelect()
@@ -224,6 +288,21 @@ func (qg *queryGenerator) createUnion() {
 	qg.stmt = union
 }
 
+// createOrderedUnion creates a UNION or UNION ALL of two selects with a top-level ORDER BY on
+// the positions of all its columns and a LIMIT, which apply to the combined result
+func (qg *queryGenerator) createOrderedUnion() {
+	// the arms are plain selects
+	qg.unionOrderBy = false
+	defer func() { qg.unionOrderBy = true }()
+	qg.createUnion()
+
+	union := qg.stmt.(*sqlparser.Union)
+	for i := 1; i <= qg.selGen.genConfig.NumCols; i++ {
+		union.OrderBy = append(union.OrderBy, sqlparser.NewOrder(sqlparser.NewIntLiteral(strconv.Itoa(i)), getRandomOrderDirection(qg.selGen.r)))
+	}
+	union.Limit = qg.selGen.randomLimit()
+}
+
 func (sg *selectGenerator) randomSelect() {
 	// make sure the random expressions can generally not contain aggregates; change appropriately
 	sg.genConfig = sg.genConfig.CannotAggregateConfig()
@@ -232,7 +311,8 @@ func (sg *selectGenerator) randomSelect() {
 	sg.sel.SetComments(sqlparser.Comments{"/*vt+ PLANNER=Gen4 */"})
 
 	// select distinct (fails with group by bigint)
-	isDistinct := sg.r.Intn(2) < 1
+	isDistinct := sg.r.Intn(2) < 1 && !sg.repeatedGroupBy && !sg.aggregateAliases && !sg.vindexGrouping && !sg.windowFunctions
+	isDistinct = isDistinct || sg.distinctAggregation
 	if isDistinct {
 		sg.sel.MakeDistinct()
 	}
@@ -242,7 +322,8 @@ func (sg *selectGenerator) randomSelect() {
 
 	// canAggregate determines if the query will have
 	// aggregate columns, group by, and having
-	canAggregate := sg.r.Intn(4) < 3
+	canAggregate := sg.r.Intn(4) < 3 || sg.repeatedGroupBy || sg.aggregateAliases || sg.vindexGrouping || sg.distinctAggregation || sg.windowFunctions
+	canAggregate = canAggregate || sg.positionalReferences
 
 	var (
 		grouping, aggregates []column
@@ -250,11 +331,18 @@ func (sg *selectGenerator) randomSelect() {
 	)
 	// TODO: distinct makes vitess think there is grouping on aggregation columns
 	if canAggregate {
-		if testFailingQueries || !isDistinct {
+		if testFailingQueries || !isDistinct || sg.distinctAggregation {
 			// group by
-			if !sg.genConfig.SingleRow {
+			if sg.vindexGrouping && !sg.genConfig.SingleRow {
+				grouping = sg.createVindexGroupBy(tables, sg.r.Intn(2) < 1)
+			} else if !sg.genConfig.SingleRow {
 				grouping = sg.createGroupBy(tables)
 			}
+
+			// group by the same expression twice, e.g. group by tbl0.dname, tbl0.loc, tbl0.dname
+			if sg.repeatedGroupBy || sg.r.Intn(10) < 1 {
+				sg.repeatGroupBy(tables)
+			}
 		}
 
 		// having
@@ -270,9 +358,29 @@ func (sg *selectGenerator) randomSelect() {
 		// aggregation columns
 		aggregates = sg.createAggregations(tables)
 
+		// conditional aggregation columns
+		if sg.r.Intn(4) < 1 {
+			aggregates = append(aggregates, sg.createConditionalAggregations(tables)...)
+		}
+
+		// aggregation columns over expressions referencing two tables
+		if len(tables) > 1 && sg.r.Intn(4) < 1 {
+			aggregates = append(aggregates, sg.createCrossTableAggregations(tables)...)
+		}
+
+		// having on the alias of an aggregation, e.g. having caggr0 > 0
+		if sg.aggregateAliases || sg.r.Intn(10) < 1 {
+			sg.createAliasHavingPredicate()
+		}
+
 		// add the grouping and aggregation to newTable
 		newTable.addColumns(grouping...)
 		newTable.addColumns(aggregates...)
+
+		// window functions over the groups, e.g. rank() over (partition by tbl0.loc order by count(*) desc)
+		if sg.windowFunctions {
+			newTable.addColumns(sg.createWindowFunctions()...)
+		}
 	}
 
 	// where
@@ -326,6 +434,7 @@ func (sg *selectGenerator) randomSelect() {
 	// can add both aggregate and grouping columns to order by
 	// TODO: order fails with distinct and outer joins
 	isOrdered := sg.r.Intn(2) < 1 && (!isDistinct || testFailingQueries) && (!isJoin || testFailingQueries)
+	isOrdered = isOrdered || sg.repeatedGroupBy || sg.aggregateAliases || sg.distinctAggregation || sg.windowFunctions || sg.positionalReferences
 	if isOrdered || (!canAggregate && sg.genConfig.SingleRow) /* TODO: might be redundant */ {
 		sg.createOrderBy()
 	}
@@ -333,6 +442,7 @@ func (sg *selectGenerator) randomSelect() {
 	// only add a limit if there is an ordering
 	// TODO: limit fails a lot
 	isLimit := sg.r.Intn(2) < 1 && len(sg.sel.OrderBy) > 0 && testFailingQueries
+	isLimit = isLimit || sg.repeatedGroupBy
 	if isLimit || (!canAggregate && sg.genConfig.SingleRow) /* TODO: might be redundant */ {
 		sg.createLimit()
 	}
@@ -340,27 +450,212 @@ func (sg *selectGenerator) randomSelect() {
 	// this makes sure the query generated has the correct number of columns (sg.selGen.genConfig.numCols)
 	newTable = sg.matchNumCols(tables, newTable, canAggregate)
 
+	// reference grouping and ordering expressions by their position in the select list, e.g. group by 1 order by 2 desc
+	// this must happen after matchNumCols, which can still add and remove select expressions
+	if sg.positionalReferences {
+		sg.usePositionalReferences()
+	}
+
 	// add new table to schemaTables
 	newTable.tableExpr = sqlparser.NewDerivedTable(false, sg.sel)
 	sg.schemaTables = append(sg.schemaTables, newTable)
 
 	// derived tables (partially unsupported)
-	if sg.r.Intn(10) < 1 {
+	if sg.derivedTableLevel < min(sg.derivedTableDepth, maxDerivedTableDepth) {
+		// select from the select that was just generated
+		sg.derivedTableLevel++
 		sg.randomSelect()
+	} else if sg.derivedTableDepth == 0 && sg.r.Intn(10) < 1 {
+		sg.randomSelect()
+	}
+}
+
+// randomSingleShardSelect returns a select on one of the emp/dept tables with an equality on its sharding key,
+// so that vitess routes it to a single shard, and without an ORDER BY
+// since vitess only forwards the query to that shard, it should return the rows in the same order as mysql
+func (sg *selectGenerator) randomSingleShardSelect() *sqlparser.Select {
+	sg.genConfig = sg.genConfig.CannotAggregateConfig()
+
+	sg.sel = &sqlparser.Select{}
+	sg.sel.SetComments(sqlparser.Comments{"/*vt+ PLANNER=Gen4 */"})
+
+	tbl := *sg.schemaTables[sg.r.Intn(2)].clone()
+	tbl.setAlias("tbl0")
+	sg.sel.From = append(sg.sel.From, newAliasedTable(tbl, "tbl0"))
+
+	// select some of the columns in a random order
+	cols := slices.Clone(tbl.cols)
+	sg.r.Shuffle(len(cols), func(i, j int) { cols[i], cols[j] = cols[j], cols[i] })
+	for _, col := range cols[:sg.r.Intn(len(cols))+1] {
+		sg.sel.SelectExprs = append(sg.sel.SelectExprs, newAliasedColumn(col, ""))
+	}
+
+	predicates := sg.createRandomExprs(0, 2, &tbl)
+	// the seeded departments are 10-40, 50 should not match any row
+	deptno := column{name: "deptno", tableName: tbl.getName(), typ: "bigint"}
+	predicates = append(predicates, sqlparser.NewComparisonExpr(sqlparser.EqualOp,
+		deptno.getASTExpr(), sqlparser.NewIntLiteral(fmt.Sprintf("%d", (sg.r.Intn(5)+1)*10)), nil))
+	sg.sel.AddWhere(sqlparser.AndExpressions(predicates...))
+
+	// a limit without an ordering still returns the first rows of the shard
+	if sg.r.Intn(2) < 1 {
+		sg.createLimit()
+	}
+
+	return sg.sel
+}
+
+// randomConstantSelect returns a select of 1-4 expressions that don't depend on the routing or the aggregation,
+// so that they are only evaluated by the evalengine and mysql
+// half of the time the expressions are only made of constants and the select is from dual,
+// e.g. select 1 + 2 * 3, 'a' = 'a' from dual, which vitess evaluates without going to a shard
+// the rest of the time they mix constants and the columns of a single table
+// the expression generator doesn't generate non-deterministic functions like now() or rand(),
+// so the results of both can be compared
+func (sg *selectGenerator) randomConstantSelect() *sqlparser.Select {
+	sg.genConfig = sg.genConfig.CannotAggregateConfig()
+
+	sg.sel = &sqlparser.Select{}
+	sg.sel.SetComments(sqlparser.Comments{"/*vt+ PLANNER=Gen4 */"})
+
+	var generators []sqlparser.ExprGenerator
+	if sg.r.Intn(2) < 1 {
+		sg.sel.From = append(sg.sel.From, sqlparser.NewAliasedTableExpr(sqlparser.NewTableName("dual"), ""))
+	} else {
+		tbl := *sg.schemaTables[sg.r.Intn(2)].clone()
+		tbl.setAlias("tbl0")
+		sg.sel.From = append(sg.sel.From, newAliasedTable(tbl, "tbl0"))
+		generators = append(generators, &tbl)
+	}
+
+	numExprs := sg.r.Intn(4) + 1
+	for i := 0; i < numExprs; i++ {
+		sg.randomlyAlias(sg.getRandomExpr(generators...), fmt.Sprintf("cconst%d", i))
+	}
+
+	return sg.sel
+}
+
+// randomVindexFunctionSelect returns a select of some of the vindexFunctionColumns, in a random order and possibly
+// repeated, from the hash vindex of the sharding key, with an equality or an IN list on id
+// e.g. select shard, keyspace_id as cvindex1 from hash where id in (20, 10, 20)
+// vindex functions only exist in vitess, so there is no mysql query to compare their results with
+func (sg *selectGenerator) randomVindexFunctionSelect() *sqlparser.Select {
+	sg.sel = &sqlparser.Select{}
+	sg.sel.SetComments(sqlparser.Comments{"/*vt+ PLANNER=Gen4 */"})
+	sg.sel.From = append(sg.sel.From, sqlparser.NewAliasedTableExpr(sqlparser.NewTableName("hash"), ""))
+
+	numCols := sg.r.Intn(len(vindexFunctionColumns)) + 1
+	for i := 0; i < numCols; i++ {
+		sg.randomlyAlias(sqlparser.NewColName(randomEl(sg.r, vindexFunctionColumns)), fmt.Sprintf("cvindex%d", i))
+	}
+
+	// vindex functions can only be filtered with an equality or an IN list on id
+	id := sqlparser.NewColName("id")
+	if sg.inListSize > 0 && sg.r.Intn(2) < 1 {
+		sg.sel.AddWhere(sqlparser.NewComparisonExpr(sqlparser.InOp, id, sg.createInList(), nil))
+	} else {
+		sg.sel.AddWhere(sqlparser.NewComparisonExpr(sqlparser.EqualOp, id, sqlparser.NewIntLiteral(fmt.Sprintf("%d", (sg.r.Intn(5)+1)*10)), nil))
+	}
+
+	return sg.sel
+}
+
+// randomInsertSelect returns an INSERT INTO target SELECT ... statement
+// the select has one expression for each column of target with the same type,
+// so that the statement doesn't fail because of a column count or type mismatch
+func (sg *selectGenerator) randomInsertSelect(target tableT) *sqlparser.Insert {
+	sg.genConfig = sg.genConfig.CannotAggregateConfig()
+
+	sg.sel = &sqlparser.Select{}
+	sg.sel.SetComments(sqlparser.Comments{"/*vt+ PLANNER=Gen4 */"})
+	if sg.r.Intn(2) < 1 {
+		sg.sel.MakeDistinct()
+	}
+
+	tables, _ := sg.createTablesAndJoin()
+	sg.createWherePredicates(tables)
+
+	var columns sqlparser.Columns
+	for _, col := range target.cols {
+		columns = append(columns, sqlparser.NewIdentifierCI(col.name))
+		sg.sel.SelectExprs = append(sg.sel.SelectExprs, sqlparser.NewAliasedExpr(sg.insertValue(tables, col), ""))
+	}
+
+	// order by and limit change which rows are inserted, not only their order
+	if sg.r.Intn(4) < 1 {
+		for _, selExpr := range sg.sel.SelectExprs {
+			sg.sel.OrderBy = append(sg.sel.OrderBy, sqlparser.NewOrder(selExpr.(*sqlparser.AliasedExpr).Expr, getRandomOrderDirection(sg.r)))
+		}
+		sg.sel.Limit = sqlparser.NewLimitWithoutOffset(sg.r.Intn(10) + 1)
+	}
+
+	return &sqlparser.Insert{
+		Table:   sqlparser.NewAliasedTableExpr(target.tableExpr, ""),
+		Columns: columns,
+		Rows:    sg.sel,
 	}
 }
 
+// insertValue returns a column of tables with the same type as col, or NULL if there is none
+// the sharding key (deptno) is always taken from the sharding key of one of tables,
+// since vitess can't route a row with a NULL sharding key
+func (sg *selectGenerator) insertValue(tables []tableT, col column) sqlparser.Expr {
+	if col.name == "deptno" {
+		var shardKeys []column
+		for _, tbl := range tables {
+			for _, tblCol := range tbl.cols {
+				if tblCol.name == "deptno" {
+					shardKeys = append(shardKeys, tblCol)
+				}
+			}
+		}
+		if len(shardKeys) == 0 {
+			return sqlparser.NewIntLiteral(fmt.Sprintf("%d", (sg.r.Intn(4)+1)*10))
+		}
+		shardKey := randomEl(sg.r, shardKeys)
+		return shardKey.getASTExpr()
+	}
+
+	typedConfig := sg.genConfig
+	typedConfig.Type = col.typ
+	tbl := randomEl(sg.r, tables)
+	if expr := tbl.Generate(sg.r, typedConfig); expr != nil {
+		return expr
+	}
+	return &sqlparser.NullVal{}
+}
+
 func (sg *selectGenerator) createTablesAndJoin() ([]tableT, bool) {
 	var tables []tableT
-	// add at least one of original emp/dept tables
-	tables = append(tables, sg.schemaTables[sg.r.Intn(2)])
+	// add at least one of original emp/dept tables, or the derived table of the previous level if nesting
+	// the tables are cloned so that aliasing them doesn't alias the columns of the schema tables,
+	// which would make every use of a table refer to its last alias
+	first := sg.r.Intn(2)
+	if sg.derivedTableLevel > 0 {
+		// the last schema table is the derived table to nest
+		first = len(sg.schemaTables) - 1
+	}
+	tables = append(tables, *sg.schemaTables[first].clone())
 
 	tables[0].setAlias("tbl0")
 	sg.sel.From = append(sg.sel.From, newAliasedTable(tables[0], "tbl0"))
 
+	// randomTable returns the table to join with, which is always the first table for self joins
+	randomTable := func() tableT {
+		if sg.selfJoins {
+			return *sg.schemaTables[first].clone()
+		}
+		tbl := randomEl(sg.r, sg.schemaTables)
+		return *tbl.clone()
+	}
+
 	numTables := sg.r.Intn(sg.maxTables)
+	if sg.selfJoins {
+		numTables = max(numTables, 1)
+	}
 	for i := 0; i < numTables; i++ {
-		tables = append(tables, randomEl(sg.r, sg.schemaTables))
+		tables = append(tables, randomTable())
 		alias := fmt.Sprintf("tbl%d", i+1)
 		sg.sel.From = append(sg.sel.From, newAliasedTable(tables[i+1], alias))
 		tables[i+1].setAlias(alias)
@@ -368,9 +663,10 @@ func (sg *selectGenerator) createTablesAndJoin() ([]tableT, bool) {
 
 	// TODO: outer joins produce results mismatched
 	isJoin := sg.r.Intn(2) < 1 && testFailingQueries
+	isJoin = isJoin || sg.distinctAggregation
 	if isJoin {
 		// TODO: do nested joins
-		newTable := randomEl(sg.r, sg.schemaTables)
+		newTable := randomTable()
 		alias := fmt.Sprintf("tbl%d", numTables+1)
 		newTable.setAlias(alias)
 		tables = append(tables, newTable)
@@ -392,7 +688,12 @@ func (sg *selectGenerator) createJoin(tables []tableT) {
 	joinPredicate := sqlparser.AndExpressions(sg.createJoinPredicates(tables)...)
 	joinCondition := sqlparser.NewJoinCondition(joinPredicate, nil)
 	newTable := newAliasedTable(tables[n], fmt.Sprintf("tbl%d", n))
-	sg.sel.From[n-1] = sqlparser.NewJoinTableExpr(sg.sel.From[n-1], getRandomJoinType(sg.r), newTable, joinCondition)
+	joinType := getRandomJoinType(sg.r)
+	// TODO: outer joins produce results mismatched
+	if sg.distinctAggregation && !testFailingQueries {
+		joinType = randomEl(sg.r, []sqlparser.JoinType{sqlparser.NormalJoinType, sqlparser.StraightJoinType})
+	}
+	sg.sel.From[n-1] = sqlparser.NewJoinTableExpr(sg.sel.From[n-1], joinType, newTable, joinCondition)
 }
 
 // returns 1-3 random expressions based on the last two elements of tables
@@ -409,7 +710,128 @@ func (sg *selectGenerator) createJoinPredicates(tables []tableT) sqlparser.Exprs
 		exprGenerators = append(exprGenerators, sg)
 	}
 
-	return sg.createRandomExprs(1, 3, exprGenerators...)
+	predicates := sg.createRandomExprs(1, 3, exprGenerators...)
+	if sg.selfJoins {
+		predicates = append(predicates, sg.createSelfJoinPredicates(tables[len(tables)-2:])...)
+	}
+	if sg.nullSafeEquality {
+		predicates = append(predicates, sg.createNullSafeJoinPredicates(tables[len(tables)-2], tables[len(tables)-1])...)
+	}
+
+	return predicates
+}
+
+// createNullSafeJoinPredicates returns 1-2 predicates comparing a nullable column of left
+// to a column of the same type of right with <=>, e.g. tbl0.mgr <=> tbl1.comm
+// returns nothing if the tables have no such columns
+func (sg *selectGenerator) createNullSafeJoinPredicates(left, right tableT) (predicates sqlparser.Exprs) {
+	leftCols := nullableColumns(left)
+	if len(leftCols) == 0 {
+		return
+	}
+
+	numPredicates := sg.r.Intn(2) + 1
+	for i := 0; i < numPredicates; i++ {
+		leftCol := randomEl(sg.r, leftCols)
+		var rightCols []column
+		for _, col := range right.cols {
+			if col.typ == leftCol.typ {
+				rightCols = append(rightCols, col)
+			}
+		}
+		if len(rightCols) == 0 {
+			continue
+		}
+		rightCol := randomEl(sg.r, rightCols)
+		predicates = append(predicates, sqlparser.NewComparisonExpr(sqlparser.NullSafeEqualOp, leftCol.getASTExpr(), rightCol.getASTExpr(), nil))
+	}
+
+	return
+}
+
+// createNullSafeFilter returns a predicate comparing a nullable column of a random table of tables with <=>,
+// either to NULL or to another column of the same type, e.g. tbl0.comm <=> null or tbl0.comm <=> tbl1.sal
+// returns nil if tables have no nullable columns
+func (sg *selectGenerator) createNullSafeFilter(tables []tableT) sqlparser.Expr {
+	var cols []column
+	for _, tbl := range tables {
+		cols = append(cols, nullableColumns(tbl)...)
+	}
+	if len(cols) == 0 {
+		return nil
+	}
+
+	col := randomEl(sg.r, cols)
+	var others []column
+	for _, tbl := range tables {
+		for _, otherCol := range tbl.cols {
+			if otherCol.typ == col.typ && otherCol != col {
+				others = append(others, otherCol)
+			}
+		}
+	}
+
+	var other sqlparser.Expr = &sqlparser.NullVal{}
+	if len(others) > 0 && sg.r.Intn(2) < 1 {
+		otherCol := randomEl(sg.r, others)
+		other = otherCol.getASTExpr()
+	}
+
+	return sqlparser.NewComparisonExpr(sqlparser.NullSafeEqualOp, col.getASTExpr(), other, nil)
+}
+
+// nullableColumns returns the columns of tbl that can be NULL
+// the columns of a derived table are expressions that can evaluate to NULL, so all of them are considered nullable
+func nullableColumns(tbl tableT) (cols []column) {
+	_, isDerived := tbl.tableExpr.(*sqlparser.DerivedTable)
+	for _, col := range tbl.cols {
+		if col.nullable || isDerived {
+			cols = append(cols, col)
+		}
+	}
+
+	return
+}
+
+// createSelfJoinPredicates returns a predicate for every two aliases of the same table in tables,
+// comparing a column of one of them to the column it references in the other one (see foreignKeys)
+// returns nothing if tables doesn't use the same table twice
+func (sg *selectGenerator) createSelfJoinPredicates(tables []tableT) (predicates sqlparser.Exprs) {
+	hasColumn := func(tbl tableT, name string) bool {
+		return slices.ContainsFunc(tbl.cols, func(col column) bool { return col.name == name })
+	}
+
+	for i := range tables {
+		for j := i + 1; j < len(tables); j++ {
+			tblA, okA := tables[i].tableExpr.(sqlparser.TableName)
+			tblB, okB := tables[j].tableExpr.(sqlparser.TableName)
+			if !okA || !okB || tblA.Name != tblB.Name {
+				continue
+			}
+
+			var keys [][2]string
+			for _, key := range foreignKeys {
+				if hasColumn(tables[i], key[0]) && hasColumn(tables[i], key[1]) {
+					keys = append(keys, key)
+				}
+			}
+			if len(keys) == 0 {
+				continue
+			}
+
+			key := randomEl(sg.r, keys)
+			// either alias can reference the other one
+			referencing, referenced := tables[i], tables[j]
+			if sg.r.Intn(2) < 1 {
+				referencing, referenced = referenced, referencing
+			}
+			predicates = append(predicates, sqlparser.NewComparisonExpr(sqlparser.EqualOp,
+				sqlparser.NewColNameWithQualifier(key[0], sqlparser.NewTableName(referencing.getName())),
+				sqlparser.NewColNameWithQualifier(key[1], sqlparser.NewTableName(referenced.getName())), nil))
+		}
+	}
+
+	return
 }
 
 // returns the grouping columns as []column
@@ -437,6 +859,114 @@ func (sg *selectGenerator) createGroupBy(tables []tableT) (grouping []column) {
 	return
 }
 
+// createWindowFunctions adds 1-2 window functions over the groups of the select to its SelectExprs,
+// partitioned by some of the grouping expressions and ordered by some of the grouping and aggregation expressions
+// only the ranking functions that give the same result to rows with equal ordering values are used,
+// so that the results are deterministic, e.g. rank() but not row_number()
+func (sg *selectGenerator) createWindowFunctions() (windows []column) {
+	var aggrExprs sqlparser.Exprs
+	for _, selExpr := range sg.sel.SelectExprs {
+		if aliasedExpr, ok := selExpr.(*sqlparser.AliasedExpr); ok && sqlparser.ContainsAggregation(aliasedExpr.Expr) {
+			aggrExprs = append(aggrExprs, aliasedExpr.Expr)
+		}
+	}
+	// some of the given expressions, possibly none
+	someOf := func(exprs sqlparser.Exprs) (some sqlparser.Exprs) {
+		for _, expr := range exprs {
+			if sg.r.Intn(2) < 1 {
+				some = append(some, sqlparser.CloneExpr(expr))
+			}
+		}
+		return
+	}
+
+	numWindows := sg.r.Intn(2) + 1
+	for i := 0; i < numWindows; i++ {
+		spec := &sqlparser.WindowSpecification{PartitionClause: someOf(sqlparser.Exprs(sg.sel.GroupBy))}
+		for _, expr := range append(someOf(sqlparser.Exprs(sg.sel.GroupBy)), someOf(aggrExprs)...) {
+			spec.OrderClause = append(spec.OrderClause, sqlparser.NewOrder(expr, getRandomOrderDirection(sg.r)))
+		}
+		window := &sqlparser.ArgumentLessWindowExpr{
+			Type:       randomEl(sg.r, []sqlparser.ArgumentLessWindowExprType{sqlparser.RankExprType, sqlparser.DenseRankExprType, sqlparser.PercentRankExprType, sqlparser.CumeDistExprType}),
+			OverClause: &sqlparser.OverClause{WindowSpec: spec},
+		}
+
+		alias := fmt.Sprintf("cwindow%d", i)
+		sg.sel.SelectExprs = append(sg.sel.SelectExprs, sqlparser.NewAliasedExpr(window, alias))
+		windows = append(windows, column{name: alias})
+	}
+
+	return
+}
+
+// createVindexGroupBy groups by at least one column and returns the grouping columns that are selected
+// if onVindex is true, it groups by the sharding key of a table in tables and possibly other columns,
+// otherwise it only groups by columns that are not a sharding key
+// if only one kind of column is available, it groups by that kind
+func (sg *selectGenerator) createVindexGroupBy(tables []tableT, onVindex bool) (grouping []column) {
+	var shardKeys, others []column
+	for _, tbl := range tables {
+		_, isTable := tbl.tableExpr.(sqlparser.TableName)
+		for _, col := range tbl.cols {
+			switch {
+			case col.name == "deptno" && isTable:
+				shardKeys = append(shardKeys, col)
+			// a deptno column of a derived table can still be the sharding key
+			case col.name == "deptno":
+			// TODO: grouping by a date column sometimes errors
+			case col.typ == "date" && !testFailingQueries:
+			default:
+				others = append(others, col)
+			}
+		}
+	}
+
+	var cols []column
+	if onVindex && len(shardKeys) > 0 {
+		cols = append(cols, randomEl(sg.r, shardKeys))
+	}
+	if len(others) > 0 {
+		numOthers := sg.r.Intn(max(sg.maxGBs, 1)) + 1 - len(cols)
+		for i := 0; i < numOthers; i++ {
+			cols = append(cols, randomEl(sg.r, others))
+		}
+	}
+	if len(cols) == 0 && len(shardKeys) > 0 {
+		cols = append(cols, randomEl(sg.r, shardKeys))
+	}
+	// the grouping columns are in a random order, so that the sharding key is not always first
+	sg.r.Shuffle(len(cols), func(i, j int) { cols[i], cols[j] = cols[j], cols[i] })
+
+	for _, col := range cols {
+		sg.sel.GroupBy = append(sg.sel.GroupBy, col.getASTExpr())
+
+		// add to select
+		if sg.r.Intn(2) < 1 {
+			sg.sel.SelectExprs = append(sg.sel.SelectExprs, newAliasedColumn(col, ""))
+			grouping = append(grouping, col)
+		}
+	}
+
+	return
+}
+
+// repeatGroupBy adds one of the grouping expressions to the group by again, at a random position
+// if there is no grouping yet, it groups by a random column first
+func (sg *selectGenerator) repeatGroupBy(tables []tableT) {
+	for len(sg.sel.GroupBy) == 0 {
+		col := randomEl(sg.r, randomEl(sg.r, tables).cols)
+		// TODO: grouping by a date column sometimes errors
+		if col.typ == "date" && !testFailingQueries {
+			continue
+		}
+		sg.sel.GroupBy = append(sg.sel.GroupBy, col.getASTExpr())
+	}
+
+	expr := sqlparser.CloneExpr(randomEl(sg.r, sg.sel.GroupBy))
+	idx := sg.r.Intn(len(sg.sel.GroupBy) + 1)
+	sg.sel.GroupBy = slices.Insert(sg.sel.GroupBy, idx, expr)
+}
+
 // aliasGroupingColumns randomly aliases the grouping columns in the SelectExprs
 func (sg *selectGenerator) aliasGroupingColumns(grouping []column) []column {
 	if len(grouping) != len(sg.sel.SelectExprs) {
@@ -465,12 +995,125 @@ func (sg *selectGenerator) createAggregations(tables []tableT) (aggregates []col
 		exprGenerators = append(exprGenerators, sg)
 	}
 
+	minAggrs := 0
+	if sg.aggregateAliases || sg.distinctAggregation {
+		minAggrs = min(1, sg.maxAggrs)
+	}
+
 	sg.genConfig = sg.genConfig.IsAggregateConfig()
-	aggrExprs := sg.createRandomExprs(0, sg.maxAggrs, exprGenerators...)
+	aggrExprs := sg.createRandomExprs(minAggrs, sg.maxAggrs, exprGenerators...)
 	sg.genConfig = sg.genConfig.CannotAggregateConfig()
 
 	for i, expr := range aggrExprs {
-		col := sg.randomlyAlias(expr, fmt.Sprintf("caggr%d", i))
+		alias := fmt.Sprintf("caggr%d", i)
+		if sg.aggregateAliases {
+			sg.sel.SelectExprs = append(sg.sel.SelectExprs, sqlparser.NewAliasedExpr(expr, alias))
+			aggregates = append(aggregates, column{name: alias})
+			continue
+		}
+		col := sg.randomlyAlias(expr, alias)
+		aggregates = append(aggregates, col)
+	}
+
+	return
+}
+
+// returns 1-2 conditional aggregation columns, e.g. sum(case when ... then 1 else 0 end)
+// the branches of each case expression have the same type, so that vitess and mysql
+// have to agree on both the result type and on how the NULLs of the skipped rows are aggregated
+func (sg *selectGenerator) createConditionalAggregations(tables []tableT) (aggregates []column) {
+	exprGenerators := slice.Map(tables, func(t tableT) sqlparser.ExprGenerator { return &t })
+
+	numAggrs := sg.r.Intn(2) + 1
+	for i := 0; i < numAggrs; i++ {
+		predicate := sg.getRandomExpr(exprGenerators...)
+		expr := sg.conditionalAggregate(tables, predicate)
+		col := sg.randomlyAlias(expr, fmt.Sprintf("ccaggr%d", i))
+		aggregates = append(aggregates, col)
+	}
+
+	return
+}
+
+// returns a random aggregate over a case expression conditioned on predicate
+func (sg *selectGenerator) conditionalAggregate(tables []tableT, predicate sqlparser.Expr) sqlparser.Expr {
+	tbl := randomEl(sg.r, tables)
+	intConfig, anyConfig := sg.genConfig, sg.genConfig
+	intConfig.Type, anyConfig.Type = "bigint", ""
+	intCol := tbl.Generate(sg.r, intConfig)
+	anyCol := tbl.Generate(sg.r, anyConfig)
+
+	whenThen := func(val, elseVal sqlparser.Expr) *sqlparser.CaseExpr {
+		return &sqlparser.CaseExpr{
+			Whens: []*sqlparser.When{{Cond: predicate, Val: val}},
+			Else:  elseVal,
+		}
+	}
+
+	// derived tables don't keep the type of their columns, so there may not be a bigint column
+	if intCol == nil {
+		// sum(case when predicate then 1 else 0 end)
+		return &sqlparser.Sum{Arg: whenThen(sqlparser.NewIntLiteral("1"), sqlparser.NewIntLiteral("0"))}
+	}
+
+	switch sg.r.Intn(5) {
+	case 0:
+		// sum(case when predicate then 1 else 0 end)
+		return &sqlparser.Sum{Arg: whenThen(sqlparser.NewIntLiteral("1"), sqlparser.NewIntLiteral("0"))}
+	case 1:
+		// count(case when predicate then col end)
+		return &sqlparser.Count{Args: sqlparser.Exprs{whenThen(anyCol, nil)}}
+	case 2:
+		// sum(case when predicate then col else 0 end)
+		return &sqlparser.Sum{Arg: whenThen(intCol, sqlparser.NewIntLiteral("0"))}
+	case 3:
+		// max(case when predicate then col end)
+		return &sqlparser.Max{Arg: whenThen(intCol, nil)}
+	default:
+		// min(case when predicate then col else null end)
+		return &sqlparser.Min{Arg: whenThen(intCol, &sqlparser.NullVal{})}
+	}
+}
+
+// returns 0-2 aggregation columns over an arithmetic expression on columns of two different tables,
+// e.g. sum(tbl0.sal + tbl1.comm) or count(tbl0.empno * tbl1.deptno)
+// only bigint columns are used so that the expression has a consistent type, and
+// a nullable operand is randomly wrapped in ifnull so that both the NULL and non-NULL paths are covered
+func (sg *selectGenerator) createCrossTableAggregations(tables []tableT) (aggregates []column) {
+	intConfig := sg.genConfig
+	intConfig.Type = "bigint"
+
+	numAggrs := sg.r.Intn(2) + 1
+	for i := 0; i < numAggrs; i++ {
+		idx := sg.r.Perm(len(tables))
+		// derived tables don't keep the type of their columns, so there may not be a bigint column
+		left := tables[idx[0]].Generate(sg.r, intConfig)
+		right := tables[idx[1]].Generate(sg.r, intConfig)
+		if left == nil || right == nil {
+			continue
+		}
+		if sg.r.Intn(2) < 1 {
+			right = &sqlparser.FuncExpr{
+				Name:  sqlparser.NewIdentifierCI("ifnull"),
+				Exprs: sqlparser.SelectExprs{sqlparser.NewAliasedExpr(right, ""), sqlparser.NewAliasedExpr(sqlparser.NewIntLiteral("0"), "")},
+			}
+		}
+
+		op := randomEl(sg.r, []sqlparser.BinaryExprOperator{sqlparser.PlusOp, sqlparser.MinusOp, sqlparser.MultOp})
+		arg := &sqlparser.BinaryExpr{Operator: op, Left: left, Right: right}
+
+		var expr sqlparser.Expr
+		switch sg.r.Intn(4) {
+		case 0:
+			expr = &sqlparser.Sum{Arg: arg}
+		case 1:
+			expr = &sqlparser.Count{Args: sqlparser.Exprs{arg}}
+		case 2:
+			expr = &sqlparser.Max{Arg: arg}
+		default:
+			expr = &sqlparser.Min{Arg: arg}
+		}
+		col := sg.randomlyAlias(expr, fmt.Sprintf("cxaggr%d", i))
 		aggregates = append(aggregates, col)
 	}
 
@@ -479,6 +1122,12 @@ func (sg *selectGenerator) createAggregations(tables []tableT) (aggregates []col
 
 // orders on all grouping expressions and on random SelectExprs
 func (sg *selectGenerator) createOrderBy() {
+	// with distinct, mysql can only order on the select expressions
+	if sg.distinctAggregation {
+		sg.createDistinctOrderBy()
+		return
+	}
+
 	// always order on grouping expressions
 	for _, expr := range sg.sel.GroupBy {
 		sg.sel.OrderBy = append(sg.sel.OrderBy, sqlparser.NewOrder(expr, getRandomOrderDirection(sg.r)))
@@ -486,7 +1135,16 @@ func (sg *selectGenerator) createOrderBy() {
 
 	// randomly order on SelectExprs
 	for _, selExpr := range sg.sel.SelectExprs {
-		if aliasedExpr, ok := selExpr.(*sqlparser.AliasedExpr); ok && sg.r.Intn(2) < 1 {
+		aliasedExpr, ok := selExpr.(*sqlparser.AliasedExpr)
+		if !ok {
+			continue
+		}
+		// order on an aggregation by its alias instead of by the aggregation itself
+		if sg.isAliasedAggregate(aliasedExpr) && (sg.aggregateAliases || sg.r.Intn(4) < 1) {
+			sg.sel.OrderBy = append(sg.sel.OrderBy, sqlparser.NewOrder(sqlparser.NewColName(aliasedExpr.As.String()), getRandomOrderDirection(sg.r)))
+			continue
+		}
+		if sg.r.Intn(2) < 1 {
 			literal, ok := aliasedExpr.Expr.(*sqlparser.Literal)
 			isIntLiteral := ok && literal.Type == sqlparser.IntVal
 			if isIntLiteral {
@@ -497,6 +1155,87 @@ func (sg *selectGenerator) createOrderBy() {
 	}
 }
 
+// createDistinctOrderBy orders on every select expression, by its alias if it has one,
+// so that the rows of a select distinct are in a deterministic order
+func (sg *selectGenerator) createDistinctOrderBy() {
+	for _, selExpr := range sg.sel.SelectExprs {
+		aliasedExpr, ok := selExpr.(*sqlparser.AliasedExpr)
+		if !ok {
+			continue
+		}
+		var expr sqlparser.Expr = sqlparser.CloneExpr(aliasedExpr.Expr)
+		if !aliasedExpr.As.IsEmpty() {
+			expr = sqlparser.NewColName(aliasedExpr.As.String())
+		}
+		sg.sel.OrderBy = append(sg.sel.OrderBy, sqlparser.NewOrder(expr, getRandomOrderDirection(sg.r)))
+	}
+}
+
+// usePositionalReferences replaces, with a probability of 3/4 each, the grouping and ordering expressions
+// that are also select expressions by their 1-based position in the select list
+// an ordering expression can also match a select expression through its alias
+// mysql does not allow grouping by the position of an aggregation, but grouping expressions never contain one
+func (sg *selectGenerator) usePositionalReferences() {
+	position := func(expr sqlparser.Expr) (int, bool) {
+		for i, selExpr := range sg.sel.SelectExprs {
+			aliasedExpr, ok := selExpr.(*sqlparser.AliasedExpr)
+			if !ok {
+				continue
+			}
+			if sqlparser.Equals.Expr(aliasedExpr.Expr, expr) {
+				return i + 1, true
+			}
+			colName, ok := expr.(*sqlparser.ColName)
+			if ok && colName.Qualifier.IsEmpty() && !aliasedExpr.As.IsEmpty() && colName.Name.Equal(aliasedExpr.As) {
+				return i + 1, true
+			}
+		}
+		return 0, false
+	}
+
+	for i, expr := range sg.sel.GroupBy {
+		if pos, ok := position(expr); ok && sg.r.Intn(4) < 3 {
+			sg.sel.GroupBy[i] = sqlparser.NewIntLiteral(strconv.Itoa(pos))
+		}
+	}
+	for _, order := range sg.sel.OrderBy {
+		if pos, ok := position(order.Expr); ok && sg.r.Intn(4) < 3 {
+			order.Expr = sqlparser.NewIntLiteral(strconv.Itoa(pos))
+		}
+	}
+}
+
+// isAliasedAggregate returns true if aliasedExpr is an aggregation with an alias that can be referenced
+// matchNumCols may remove select expressions after they are referenced, so aliases
+// are only referenced when the number of columns is not fixed
+func (sg *selectGenerator) isAliasedAggregate(aliasedExpr *sqlparser.AliasedExpr) bool {
+	return !aliasedExpr.As.IsEmpty() && sqlparser.ContainsAggregation(aliasedExpr.Expr) && sg.genConfig.NumCols == 0
+}
+
+// createAliasHavingPredicate adds a predicate on the alias of a random aggregation to the having clause,
+// comparing it to an int literal or to NULL
+func (sg *selectGenerator) createAliasHavingPredicate() {
+	var aliases []string
+	for _, selExpr := range sg.sel.SelectExprs {
+		if aliasedExpr, ok := selExpr.(*sqlparser.AliasedExpr); ok && sg.isAliasedAggregate(aliasedExpr) {
+			aliases = append(aliases, aliasedExpr.As.String())
+		}
+	}
+	if len(aliases) == 0 {
+		return
+	}
+
+	alias := sqlparser.NewColName(randomEl(sg.r, aliases))
+	var predicate sqlparser.Expr
+	if sg.r.Intn(4) < 1 {
+		predicate = &sqlparser.IsExpr{Left: alias, Right: randomEl(sg.r, []sqlparser.IsExprOperator{sqlparser.IsNullOp, sqlparser.IsNotNullOp})}
+	} else {
+		op := randomEl(sg.r, []sqlparser.ComparisonExprOperator{sqlparser.EqualOp, sqlparser.NotEqualOp, sqlparser.LessThanOp, sqlparser.GreaterThanOp, sqlparser.LessEqualOp, sqlparser.GreaterEqualOp})
+		predicate = sqlparser.NewComparisonExpr(op, alias, sqlparser.NewIntLiteral(fmt.Sprintf("%d", sg.r.Intn(10))), nil)
+	}
+	sg.sel.AddHaving(predicate)
+}
+
 // returns 0-2 random expressions based on tables
 func (sg *selectGenerator) createWherePredicates(tables []tableT) {
 	exprGenerators := slice.Map(tables, func(t tableT) sqlparser.ExprGenerator { return &t })
@@ -507,9 +1246,81 @@ func (sg *selectGenerator) createWherePredicates(tables []tableT) {
 	}
 
 	predicates := sg.createRandomExprs(0, 2, exprGenerators...)
+
+	// correlate the aliases of the same table, e.g. tbl0.mgr = tbl1.empno
+	if sg.selfJoins || sg.r.Intn(4) < 1 {
+		predicates = append(predicates, sg.createSelfJoinPredicates(tables)...)
+	}
+
+	if sg.nullSafeEquality {
+		if predicate := sg.createNullSafeFilter(tables); predicate != nil {
+			predicates = append(predicates, predicate)
+		}
+	}
+
+	// filter on a sharding key so that the query is not always a scatter
+	// the vindex grouping queries must stay scatters for the planner to choose how to aggregate
+	if (sg.r.Intn(2) < 1 || sg.inListSize > 0) && !sg.vindexGrouping {
+		if predicate := sg.createShardKeyPredicate(tables); predicate != nil {
+			predicates = append(predicates, predicate)
+		}
+	}
+
 	sg.sel.AddWhere(sqlparser.AndExpressions(predicates...))
 }
 
+// returns a predicate on the sharding key (deptno) of a random emp/dept table in tables,
+// either shardKey = N (single shard) or shardKey IN (...) (multiple shards)
+// returns nil if tables only has derived tables
+func (sg *selectGenerator) createShardKeyPredicate(tables []tableT) sqlparser.Expr {
+	var shardKeys []column
+	for _, tbl := range tables {
+		if _, ok := tbl.tableExpr.(sqlparser.TableName); !ok {
+			continue
+		}
+		for _, col := range tbl.cols {
+			if col.name == "deptno" {
+				shardKeys = append(shardKeys, col)
+			}
+		}
+	}
+	if len(shardKeys) == 0 {
+		return nil
+	}
+
+	shardKey := randomEl(sg.r, shardKeys)
+	// the seeded departments are 10-40, 50 should not match any row
+	randomDeptno := func() sqlparser.Expr {
+		return sqlparser.NewIntLiteral(fmt.Sprintf("%d", (sg.r.Intn(5)+1)*10))
+	}
+
+	sg.shardKeyPredicates++
+	if sg.inListSize > 0 {
+		return sqlparser.NewComparisonExpr(sqlparser.InOp, shardKey.getASTExpr(), sg.createInList(), nil)
+	}
+	if sg.r.Intn(2) < 1 {
+		return sqlparser.NewComparisonExpr(sqlparser.EqualOp, shardKey.getASTExpr(), randomDeptno(), nil)
+	}
+
+	var values sqlparser.ValTuple
+	numValues := sg.r.Intn(3) + 1
+	for i := 0; i < numValues; i++ {
+		values = append(values, randomDeptno())
+	}
+	return sqlparser.NewComparisonExpr(sqlparser.InOp, shardKey.getASTExpr(), values, nil)
+}
+
+// returns a list of 1 to sg.inListSize department numbers, possibly with duplicates
+// most of them match no row, but they are spread over all the shards
+func (sg *selectGenerator) createInList() (values sqlparser.ValTuple) {
+	numValues := sg.r.Intn(sg.inListSize) + 1
+	for i := 0; i < numValues; i++ {
+		values = append(values, sqlparser.NewIntLiteral(fmt.Sprintf("%d", (sg.r.Intn(numValues)+1)*10)))
+	}
+
+	return
+}
+
 // creates predicates for the having clause comparing a column to a random expression
 func (sg *selectGenerator) createHavingPredicates(grouping []column) {
 	exprGenerators := slice.Map(grouping, func(c column) sqlparser.ExprGenerator { return &c })
@@ -560,19 +1371,24 @@ func (sg *selectGenerator) createLimit() {
 		return
 	}
 
+	sg.sel.Limit = sg.randomLimit()
+}
+
+// randomLimit returns a limit of 0-9 rows, with an offset of 0-9 rows half of the time
+func (sg *selectGenerator) randomLimit() *sqlparser.Limit {
 	limitNum := sg.r.Intn(10)
 	if sg.r.Intn(2) < 1 {
 		offset := sg.r.Intn(10)
-		sg.sel.Limit = sqlparser.NewLimit(offset, limitNum)
-	} else {
-		sg.sel.Limit = sqlparser.NewLimitWithoutOffset(limitNum)
+		return sqlparser.NewLimit(offset, limitNum)
 	}
+	return sqlparser.NewLimitWithoutOffset(limitNum)
 }
 
 // randomlyAlias randomly aliases expr with alias alias, adds it to sel.SelectExprs, and returns the column created
 func (sg *selectGenerator) randomlyAlias(expr sqlparser.Expr, alias string) column {
 	var col column
-	if sg.r.Intn(2) < 1 {
+	// the columns of nested derived tables are always aliased, so that the outer selects can reference them
+	if sg.r.Intn(2) < 1 && sg.derivedTableDepth == 0 {
 		alias = ""
 		col.name = sqlparser.String(expr)
 	} else {
@@ -616,6 +1432,90 @@ func (sg *selectGenerator) matchNumCols(tables []tableT, newTable tableT, canAgg
 	return newTable
 }
 
+// literalTwin returns a query that only differs from the given one in the values of its literals, e.g.
+// select tbl0.ename from emp as tbl0 where tbl0.sal > 1000 limit 2 and select tbl0.ename from emp as tbl0 where tbl0.sal > 47 limit 9
+// only the literals that vtgate turns into bind variables are changed, each to a new value of the same type, so both
+// queries have the same normalized form and should share a plan in the plan cache
+// literals that vtgate deduplicates into a single bind variable get the same new value and the others get distinct ones,
+// and lists that become a single list argument get a new number of values
+// it returns false if the query cannot be normalized or has a literal of a type it doesn't know how to regenerate
+func literalTwin(r *rand.Rand, query string) (string, bool) {
+	// normalize a parsed copy of the query, like vtgate does, to know which literals are bind variables
+	stmt, err := sqlparser.Parse(query)
+	if err != nil {
+		return "", false
+	}
+	bindVars := make(map[string]*querypb.BindVariable)
+	if err := sqlparser.Normalize(stmt, sqlparser.NewReservedVars("vtg", sqlparser.GetBindvars(stmt)), bindVars); err != nil {
+		return "", false
+	}
+
+	used := make(map[string]bool)
+	newLiteral := func(typ sqltypes.Type) *sqlparser.Literal {
+		var val string
+		switch typ {
+		case sqltypes.Int64:
+			val = strconv.Itoa(r.Intn(100))
+		case sqltypes.Decimal:
+			val = fmt.Sprintf("%d.%d", r.Intn(100), r.Intn(100))
+		case sqltypes.VarChar:
+			val = randomEl(r, []string{"SMITH", "CLERK", "SALESMAN", "MANAGER", "ACCOUNTING", "DALLAS", "ox", "ant", "ape"})
+		default:
+			return nil
+		}
+		// the values of different bind variables must stay different, or vtgate would deduplicate them
+		for i := 1; used[typ.String()+val]; i++ {
+			val += strconv.Itoa(i)
+		}
+		used[typ.String()+val] = true
+
+		switch typ {
+		case sqltypes.Int64:
+			return sqlparser.NewIntLiteral(val)
+		case sqltypes.Decimal:
+			return sqlparser.NewDecimalLiteral(val)
+		default:
+			return sqlparser.NewStrLiteral(val)
+		}
+	}
+
+	ok := true
+	newValues := make(map[string]*sqlparser.Literal)
+	twin := sqlparser.Rewrite(stmt, nil, func(cursor *sqlparser.Cursor) bool {
+		switch node := cursor.Node().(type) {
+		case *sqlparser.Argument:
+			lit, found := newValues[node.Name]
+			if !found {
+				lit = newLiteral(node.Type)
+				newValues[node.Name] = lit
+			}
+			if lit == nil {
+				ok = false
+				return false
+			}
+			cursor.Replace(sqlparser.CloneRefOfLiteral(lit))
+		case sqlparser.ListArg:
+			oldValues := bindVars[string(node)].Values
+			var values sqlparser.ValTuple
+			numValues := r.Intn(len(oldValues)+1) + 1
+			for i := 0; i < numValues; i++ {
+				lit := newLiteral(oldValues[i%len(oldValues)].Type)
+				if lit == nil {
+					ok = false
+					return false
+				}
+				values = append(values, lit)
+			}
+			cursor.Replace(values)
+		}
+		return true
+	})
+	if !ok {
+		return "", false
+	}
+	return sqlparser.String(twin), true
+}
+
 func getRandomOrderDirection(r *rand.Rand) sqlparser.OrderDirection {
 	// asc, desc
 	return randomEl(r, []sqlparser.OrderDirection{0, 1})
@@ -17,14 +17,24 @@ limitations under the License.
 package random
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/rand"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"vitess.io/vitess/go/mysql/sqlerror"
+	"vitess.io/vitess/go/slice"
+	"vitess.io/vitess/go/sqltypes"
+	"vitess.io/vitess/go/vt/key"
 	"vitess.io/vitess/go/vt/sqlparser"
+	"vitess.io/vitess/go/vt/vtgate/vindexes"
+
+	topodatapb "vitess.io/vitess/go/vt/proto/topodata"
 
 	"github.com/stretchr/testify/require"
 
@@ -37,6 +47,46 @@ import (
 // if true then execution will always stop on a "must fix" error: a results mismatched or EOF
 const stopOnMustFixError = false
 
+// if true then runFuzzLoop runs every query with random session settings, on both vitess and mysql
+const randomizeSessionSettings = false
+
+// sessionSettings are the session settings a query is run with
+type sessionSettings struct {
+	sqlMode, collation, isolation, workload string
+}
+
+// randomSessionSettings returns random values for a subset of the session settings
+// that can change the result of a query without changing the schema or the data
+// every sql_mode keeps ONLY_FULL_GROUP_BY, since the generator can produce queries
+// that group by a subset of the selected columns, and vitess and mysql pick different
+// values for the other columns when it is disabled
+func randomSessionSettings(r *rand.Rand) sessionSettings {
+	return sessionSettings{
+		sqlMode: randomEl(r, []string{
+			"ONLY_FULL_GROUP_BY,STRICT_TRANS_TABLES,NO_ZERO_IN_DATE,NO_ZERO_DATE,ERROR_FOR_DIVISION_BY_ZERO,NO_ENGINE_SUBSTITUTION",
+			"ONLY_FULL_GROUP_BY,STRICT_TRANS_TABLES",
+			"ONLY_FULL_GROUP_BY,ERROR_FOR_DIVISION_BY_ZERO",
+			"ONLY_FULL_GROUP_BY",
+		}),
+		collation: randomEl(r, []string{"utf8mb4_0900_ai_ci", "utf8mb4_general_ci", "utf8mb4_bin"}),
+		isolation: randomEl(r, []string{"REPEATABLE-READ", "READ-COMMITTED", "READ-UNCOMMITTED", "SERIALIZABLE"}),
+		workload:  randomEl(r, []string{"oltp", "olap"}),
+	}
+}
+
+// apply sets all the settings of s, so that the vitess and mysql sessions always match
+// no matter which settings were previously applied
+// workload only exists in vitess, so it is only set on the vitess connection
+func (s sessionSettings) apply(t *testing.T, mcmp utils.MySQLCompare) {
+	t.Helper()
+	mcmp.Exec(fmt.Sprintf("set sql_mode = '%s', collation_connection = '%s', transaction_isolation = '%s'", s.sqlMode, s.collation, s.isolation))
+	utils.Exec(t, mcmp.VtConn, "set workload = "+s.workload)
+}
+
+func (s sessionSettings) String() string {
+	return fmt.Sprintf("sql_mode = '%s', collation_connection = '%s', transaction_isolation = '%s', workload = %s", s.sqlMode, s.collation, s.isolation, s.workload)
+}
+
 func start(t *testing.T) (utils.MySQLCompare, func()) {
 	mcmp, err := utils.NewMySQLCompare(t, vtParams, mysqlParams)
 	require.NoError(t, err)
@@ -44,7 +94,7 @@ func start(t *testing.T) (utils.MySQLCompare, func()) {
 	deleteAll := func() {
 		_, _ = utils.ExecAllowError(t, mcmp.VtConn, "set workload = oltp")
 
-		tables := []string{"emp", "dept"}
+		tables := []string{"emp", "dept", "emp_copy", "dept_copy"}
 		for _, table := range tables {
 			_, _ = mcmp.ExecAndIgnore("delete from " + table)
 		}
@@ -66,6 +116,42 @@ func start(t *testing.T) (utils.MySQLCompare, func()) {
 	}
 }
 
+// getSchemaTables returns the schema that is defined in schema.sql
+func getSchemaTables() []tableT {
+	schemaTables := []tableT{
+		{tableExpr: sqlparser.NewTableName("emp")},
+		{tableExpr: sqlparser.NewTableName("dept")},
+	}
+	schemaTables[0].addColumns([]column{
+		{name: "empno", typ: "bigint"},
+		{name: "ename", typ: "varchar", nullable: true},
+		{name: "job", typ: "varchar", nullable: true},
+		{name: "mgr", typ: "bigint", nullable: true},
+		{name: "hiredate", typ: "date", nullable: true},
+		{name: "sal", typ: "bigint", nullable: true},
+		{name: "comm", typ: "bigint", nullable: true},
+		{name: "deptno", typ: "bigint", nullable: true},
+	}...)
+	schemaTables[1].addColumns([]column{
+		{name: "deptno", typ: "bigint"},
+		{name: "dname", typ: "varchar", nullable: true},
+		{name: "loc", typ: "varchar", nullable: true},
+	}...)
+
+	return schemaTables
+}
+
+// getInsertTargets returns the tables INSERT ... SELECT statements insert into;
+// they have the same columns as the tables of getSchemaTables, but no primary key
+func getInsertTargets() []tableT {
+	targets := getSchemaTables()
+	for i := range targets {
+		targets[i].tableExpr = sqlparser.NewTableName(targets[i].getName() + "_copy")
+	}
+
+	return targets
+}
+
 func helperTest(t *testing.T, query string) {
 	t.Helper()
 	t.Run(query, func(t *testing.T) {
@@ -261,35 +347,33 @@ func TestKnownFailures(t *testing.T) {
 	helperTest(t, "select /*vt+ PLANNER=Gen4 */ exists (select 1) as crandom0 from dept as tbl0 group by exists (select 1)")
 }
 
-func TestRandom(t *testing.T) {
-	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+// failedQueryError is returned by the check of runFuzzLoop when the statement that failed is not the generated query,
+// so that it is the one that is reported and simplified
+type failedQueryError struct {
+	query string
+	err   error
+}
 
-	mcmp, closer := start(t)
-	defer closer()
+func (e *failedQueryError) Error() string {
+	return fmt.Sprintf("%s\n%v", e.query, e.err)
+}
 
-	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
-	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+func (e *failedQueryError) Unwrap() error {
+	return e.err
+}
 
-	// specify the schema (that is defined in schema.sql)
-	schemaTables := []tableT{
-		{tableExpr: sqlparser.NewTableName("emp")},
-		{tableExpr: sqlparser.NewTableName("dept")},
-	}
-	schemaTables[0].addColumns([]column{
-		{name: "empno", typ: "bigint"},
-		{name: "ename", typ: "varchar"},
-		{name: "job", typ: "varchar"},
-		{name: "mgr", typ: "bigint"},
-		{name: "hiredate", typ: "date"},
-		{name: "sal", typ: "bigint"},
-		{name: "comm", typ: "bigint"},
-		{name: "deptno", typ: "bigint"},
-	}...)
-	schemaTables[1].addColumns([]column{
-		{name: "deptno", typ: "bigint"},
-		{name: "dname", typ: "varchar"},
-		{name: "loc", typ: "varchar"},
-	}...)
+// runFuzzLoop runs the queries returned by gen for a second, each one generated from a new seed, and reports
+// the ones that fail check, which runs a query on mcmp and returns why it failed
+// gen returns an empty query to skip a seed
+// if randomizeSessionSettings is true then each query is run with random session settings
+// results mismatched errors of selects are simplified before being reported
+// the mysql and vitess connections are restarted after a failure
+func runFuzzLoop(t *testing.T, gen func(r *rand.Rand) string, check func(mcmp *utils.MySQLCompare, query string) error) {
+	t.Helper()
+
+	mcmp, closer := start(t)
+	// closer changes every time the connections are restarted
+	defer func() { closer() }()
 
 	endBy := time.Now().Add(1 * time.Second)
 
@@ -297,30 +381,47 @@ func TestRandom(t *testing.T) {
 	// continue testing after an error if and only if testFailingQueries is true
 	for time.Now().Before(endBy) && (!t.Failed() || !testFailingQueries) {
 		seed := time.Now().UnixNano()
-		genConfig := sqlparser.NewExprGeneratorConfig(sqlparser.CannotAggregate, "", 0, false)
-		qg := newQueryGenerator(rand.New(rand.NewSource(seed)), genConfig, 2, 2, 2, schemaTables)
-		qg.randomQuery()
-		query := sqlparser.String(qg.stmt)
-		_, vtErr := mcmp.ExecAllowAndCompareError(query)
+		query := gen(rand.New(rand.NewSource(seed)))
+		if query == "" {
+			continue
+		}
+		var settings sessionSettings
+		if randomizeSessionSettings {
+			settings = randomSessionSettings(rand.New(rand.NewSource(seed)))
+			settings.apply(t, mcmp)
+		}
+		vtErr := check(&mcmp, query)
 
 		// this assumes all queries are valid mysql queries
 		if vtErr != nil {
 			fmt.Printf("seed: %d\n", seed)
+			if randomizeSessionSettings {
+				fmt.Printf("session settings: %s\n", settings)
+			}
 			fmt.Println(query)
 			fmt.Println(vtErr)
 
-			if stopOnMustFixError {
-				// results mismatched
-				if strings.Contains(vtErr.Error(), "results mismatched") {
-					simplified := simplifyResultsMismatchedQuery(t, query)
+			failedQuery := query
+			var fqErr *failedQueryError
+			if errors.As(vtErr, &fqErr) {
+				failedQuery = fqErr.query
+			}
+
+			// results mismatched
+			if strings.Contains(vtErr.Error(), "results mismatched") {
+				if isSelect(failedQuery) {
+					simplified := simplifyResultsMismatchedQuery(t, failedQuery)
 					fmt.Printf("final simplified query: %s\n", simplified)
-					break
 				}
-				// EOF
-				if sqlError, ok := vtErr.(*sqlerror.SQLError); ok && strings.Contains(sqlError.Message, "EOF") {
+				if stopOnMustFixError {
 					break
 				}
 			}
+			// EOF
+			var sqlError *sqlerror.SQLError
+			if errors.As(vtErr, &sqlError) && strings.Contains(sqlError.Message, "EOF") && stopOnMustFixError {
+				break
+			}
 
 			// restart the mysql and vitess connections in case something bad happened
 			closer()
@@ -335,6 +436,503 @@ func TestRandom(t *testing.T) {
 	fmt.Printf("Queries failed: %d\n", queryFailCount)
 }
 
+// isSelect returns true if query is a select or a union, the only statements the simplifier can simplify
+func isSelect(query string) bool {
+	stmt, err := sqlparser.Parse(query)
+	if err != nil {
+		return false
+	}
+	_, ok := stmt.(sqlparser.SelectStatement)
+	return ok
+}
+
+// compareResults is the check of runFuzzLoop for queries whose results must be the same in vitess and mysql
+func compareResults(mcmp *utils.MySQLCompare, query string) error {
+	_, err := mcmp.ExecAllowAndCompareError(query)
+	return err
+}
+
+// randomQueries returns a gen for runFuzzLoop, generating random queries over the schema tables
+// with the options that configure sets on the generator
+func randomQueries(configure func(r *rand.Rand, qg *queryGenerator)) func(r *rand.Rand) string {
+	schemaTables := getSchemaTables()
+	return func(r *rand.Rand) string {
+		genConfig := sqlparser.NewExprGeneratorConfig(sqlparser.CannotAggregate, "", 0, false)
+		qg := newQueryGenerator(r, genConfig, 2, 2, 2, schemaTables)
+		configure(r, qg)
+		qg.randomQuery()
+		return sqlparser.String(qg.stmt)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+
+	schemaTables := getSchemaTables()
+
+	var shardKeyQueryCount int
+	runFuzzLoop(t, func(r *rand.Rand) string {
+		genConfig := sqlparser.NewExprGeneratorConfig(sqlparser.CannotAggregate, "", 0, false)
+		qg := newQueryGenerator(r, genConfig, 2, 2, 2, schemaTables)
+		qg.randomQuery()
+		if qg.selGen.shardKeyPredicates > 0 {
+			shardKeyQueryCount++
+		}
+		return sqlparser.String(qg.stmt)
+	}, compareResults)
+	fmt.Printf("Queries filtering on a sharding key: %d\n", shardKeyQueryCount)
+}
+
+// TestRepeatedGroupBy only generates queries grouping by the same expression more than once,
+// with an ORDER BY and a LIMIT, e.g.
+// select tbl0.dname from dept as tbl0 group by tbl0.dname, tbl0.dname order by tbl0.dname limit 3
+// results mismatched errors are simplified before being reported
+func TestRepeatedGroupBy(t *testing.T) {
+	t.Skip("Skip CI; limit generates too many failures")
+
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+
+	runFuzzLoop(t, randomQueries(func(_ *rand.Rand, qg *queryGenerator) {
+		qg.selGen.repeatedGroupBy = true
+	}), compareResults)
+}
+
+// TestAggregateAliases only generates queries with aliased aggregations that are referenced
+// by their alias in the ORDER BY, and sometimes in the HAVING, e.g.
+// select tbl0.dname, count(*) as caggr0 from dept as tbl0 group by tbl0.dname having caggr0 > 0 order by tbl0.dname, caggr0
+// the grouping expressions are always ordered on, so the ordering is total
+// results mismatched errors are simplified before being reported
+func TestAggregateAliases(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+
+	runFuzzLoop(t, randomQueries(func(_ *rand.Rand, qg *queryGenerator) {
+		qg.selGen.aggregateAliases = true
+	}), compareResults)
+}
+
+// TestVindexGrouping only generates grouped queries, grouping either by the sharding key (deptno) or by other columns, e.g.
+// select tbl0.deptno, count(*) from emp as tbl0 group by tbl0.deptno and select tbl0.job, count(*) from emp as tbl0 group by tbl0.job
+// the aggregation is pushed down to the shards in the first case and done in vtgate in the second
+func TestVindexGrouping(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+
+	runFuzzLoop(t, randomQueries(func(_ *rand.Rand, qg *queryGenerator) {
+		qg.selGen.vindexGrouping = true
+	}), compareResults)
+}
+
+// TestLargeInList generates queries filtering on a sharding key with an IN list of up to 5, 50 or 500 values,
+// e.g. select tbl0.ename from emp as tbl0 where tbl0.deptno in (10, 20, 30, ...)
+// the values are spread over all the shards, exercising how vtgate routes and merges the results of large IN lists
+func TestLargeInList(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+
+	runFuzzLoop(t, randomQueries(func(r *rand.Rand, qg *queryGenerator) {
+		// vary the size of the IN lists from a few values to hundreds
+		qg.selGen.inListSize = randomEl(r, []int{5, 50, 500})
+	}), compareResults)
+}
+
+// TestDistinctAggregation generates select distinct queries over an inner join with at least one aggregation, e.g.
+// select distinct tbl0.dname, count(tbl1.sal) from dept as tbl0 join emp as tbl1 on tbl0.deptno = tbl1.deptno group by tbl0.dname order by tbl0.dname, count(tbl1.sal)
+// they are ordered by all their select expressions, so that the distinct rows can be compared with mysql
+func TestDistinctAggregation(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+
+	runFuzzLoop(t, randomQueries(func(_ *rand.Rand, qg *queryGenerator) {
+		qg.selGen.distinctAggregation = true
+	}), compareResults)
+}
+
+// TestSelfJoins generates queries joining a table with itself, filtering on a column that references another one
+// of the other alias, e.g. select tbl1.ename from emp as tbl0, emp as tbl1 where tbl0.mgr = tbl1.empno
+func TestSelfJoins(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+
+	runFuzzLoop(t, randomQueries(func(_ *rand.Rand, qg *queryGenerator) {
+		qg.selGen.selfJoins = true
+	}), compareResults)
+}
+
+// TestNestedDerivedTables generates queries reading from 2 to 4 levels of nested derived tables, e.g.
+// select tbl0.ename from (select tbl0.ename from (select tbl0.ename from emp as tbl0) as tbl0) as tbl0
+func TestNestedDerivedTables(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+
+	runFuzzLoop(t, randomQueries(func(r *rand.Rand, qg *queryGenerator) {
+		// nest 2-4 levels of derived tables
+		qg.selGen.derivedTableDepth = r.Intn(maxDerivedTableDepth-1) + 2
+	}), compareResults)
+}
+
+// TestWindowFunctions generates grouped queries with window functions over the groups, e.g.
+// select tbl0.deptno, count(*), rank() over (order by count(*) desc) from emp as tbl0 group by tbl0.deptno
+func TestWindowFunctions(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+
+	runFuzzLoop(t, randomQueries(func(_ *rand.Rand, qg *queryGenerator) {
+		qg.selGen.windowFunctions = true
+	}), compareResults)
+}
+
+// TestNullSafeEquality generates queries whose joins and filters compare nullable columns with <=>, e.g.
+// select tbl0.ename from emp as tbl0 join emp as tbl1 on tbl0.mgr <=> tbl1.comm
+// unlike =, <=> is true when both sides are NULL, so the rows with NULL columns are not filtered out
+func TestNullSafeEquality(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+
+	runFuzzLoop(t, randomQueries(func(_ *rand.Rand, qg *queryGenerator) {
+		qg.selGen.nullSafeEquality = true
+	}), compareResults)
+}
+
+// TestUnionOrderBy generates unions ordered by all their columns and limited, e.g.
+// (select tbl0.dname from dept as tbl0) union (select tbl0.ename from emp as tbl0) order by 1 asc limit 3
+func TestUnionOrderBy(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+
+	runFuzzLoop(t, randomQueries(func(_ *rand.Rand, qg *queryGenerator) {
+		qg.unionOrderBy = true
+	}), compareResults)
+}
+
+// TestPositionalReferences generates selects that group and order by the position of a select expression,
+// e.g. select tbl0.loc, count(*) from dept as tbl0 group by 1 order by 2 desc
+// the planner resolves positions through a different path than the names of columns and aliases
+func TestPositionalReferences(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+
+	runFuzzLoop(t, randomQueries(func(_ *rand.Rand, qg *queryGenerator) {
+		qg.selGen.positionalReferences = true
+	}), compareResults)
+}
+
+// TestInsertSelect generates INSERT INTO target SELECT ... statements, e.g.
+// insert into dept_copy(deptno, dname, loc) select tbl0.deptno, tbl1.ename, tbl0.loc from dept as tbl0, emp as tbl1
+// and compares the contents of the target table after each one
+// every statement is run in a transaction that is rolled back, so the target tables are always empty at first
+func TestInsertSelect(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	for _, table := range []string{"emp", "dept", "emp_copy", "dept_copy"} {
+		require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, table, clusterInstance.VtgateProcess.ReadVSchema))
+	}
+
+	schemaTables := getSchemaTables()
+	targets := getInsertTargets()
+
+	// target is the table the last generated statement inserts into
+	var target tableT
+	runFuzzLoop(t, func(r *rand.Rand) string {
+		genConfig := sqlparser.NewExprGeneratorConfig(sqlparser.CannotAggregate, "", 0, false)
+		sg := newSelectGenerator(r, genConfig, 2, 2, 2, schemaTables)
+		target = randomEl(r, targets)
+		return sqlparser.String(sg.randomInsertSelect(target))
+	}, func(mcmp *utils.MySQLCompare, query string) error {
+		mcmp.Exec("begin")
+		defer func() { _, _ = mcmp.ExecAndIgnore("rollback") }()
+
+		if _, err := mcmp.ExecAllowAndCompareError(query); err != nil {
+			return err
+		}
+		colNames := slice.Map(target.cols, func(c column) string { return c.name })
+		_, err := mcmp.ExecAllowAndCompareError(fmt.Sprintf("select %s from %s", strings.Join(colNames, ", "), sqlparser.String(target.tableExpr)))
+		return err
+	})
+}
+
+// TestSingleShardOrder generates selects routed to a single shard without an ORDER BY
+// and checks that vitess returns their rows in the same order as mysql
+func TestSingleShardOrder(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+
+	schemaTables := getSchemaTables()
+	runFuzzLoop(t, func(r *rand.Rand) string {
+		genConfig := sqlparser.NewExprGeneratorConfig(sqlparser.CannotAggregate, "", 0, false)
+		sg := newSelectGenerator(r, genConfig, 2, 2, 2, schemaTables)
+		return sqlparser.String(sg.randomSingleShardSelect())
+	}, func(mcmp *utils.MySQLCompare, query string) error {
+		if _, err := mcmp.ExecAllowAndCompareError(query); err != nil {
+			return err
+		}
+
+		// the rows match, now check that they are in the same order
+		mysqlQr, vtQr := mcmp.ExecNoCompare(query)
+		if !sqltypes.ResultsEqual([]sqltypes.Result{*vtQr}, []sqltypes.Result{*mysqlQr}) {
+			return fmt.Errorf("rows in a different order\nVitess Results:\n%v\nMySQL Results:\n%v", vtQr.Rows, mysqlQr.Rows)
+		}
+		return nil
+	})
+}
+
+// TestVindexFunctions generates selects from the hash vindex of the sharding key as if it were a table,
+// e.g. select keyspace_id, shard from hash where id in (10, 20)
+// mysql has no equivalent, so instead of comparing with mysql, the rows are checked against
+// the keyspace ids computed with the hash vindex and the shards of the keyspace
+func TestVindexFunctions(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	schemaTables := getSchemaTables()
+
+	// sel is the last generated select, whose rows are checked
+	var sel *sqlparser.Select
+	runFuzzLoop(t, func(r *rand.Rand) string {
+		genConfig := sqlparser.NewExprGeneratorConfig(sqlparser.CannotAggregate, "", 0, false)
+		sg := newSelectGenerator(r, genConfig, 2, 2, 2, schemaTables)
+		sg.inListSize = 5
+		sel = sg.randomVindexFunctionSelect()
+		return sqlparser.String(sel)
+	}, func(mcmp *utils.MySQLCompare, query string) error {
+		vtQr, err := utils.ExecAllowError(t, mcmp.VtConn, query)
+		if err != nil {
+			return err
+		}
+		return checkVindexFunctionResult(sel, vtQr)
+	})
+}
+
+// checkVindexFunctionResult checks the rows of a select generated by randomVindexFunctionSelect:
+// there must be one row per id, in the order of the ids, with the keyspace id computed by the hash vindex
+// and the key range of the shard (-80 or 80-) the keyspace id belongs to
+func checkVindexFunctionResult(sel *sqlparser.Select, qr *sqltypes.Result) error {
+	var ids sqlparser.ValTuple
+	switch right := sel.Where.Expr.(*sqlparser.ComparisonExpr).Right.(type) {
+	case sqlparser.ValTuple:
+		ids = right
+	default:
+		ids = sqlparser.ValTuple{right}
+	}
+	if len(qr.Rows) != len(ids) {
+		return fmt.Errorf("got %d rows for %d ids: %v", len(qr.Rows), len(ids), qr.Rows)
+	}
+
+	vindex, err := vindexes.CreateVindex("hash", "hash", nil)
+	if err != nil {
+		return err
+	}
+	shards, err := key.ParseShardingSpec("-80-")
+	if err != nil {
+		return err
+	}
+	for i, idExpr := range ids {
+		id := idExpr.(*sqlparser.Literal).Val
+		idVal, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return err
+		}
+		ksid, err := vindex.(vindexes.Hashing).Hash(sqltypes.NewInt64(idVal))
+		if err != nil {
+			return err
+		}
+		var shard *topodatapb.KeyRange
+		for _, kr := range shards {
+			if key.KeyRangeContains(kr, ksid) {
+				shard = kr
+			}
+		}
+
+		expected := map[string]string{
+			"id":              id,
+			"keyspace_id":     string(ksid),
+			"range_start":     string(shard.Start),
+			"range_end":       string(shard.End),
+			"hex_keyspace_id": hex.EncodeToString(ksid),
+			"shard":           key.KeyRangeString(shard),
+		}
+		for j, selExpr := range sel.SelectExprs {
+			col := selExpr.(*sqlparser.AliasedExpr).Expr.(*sqlparser.ColName).Name.String()
+			if got := qr.Rows[i][j].ToString(); got != expected[col] {
+				return fmt.Errorf("row %d: got %s = %q, want %q", i, col, got, expected[col])
+			}
+		}
+	}
+	return nil
+}
+
+// TestConstantFolding generates selects whose expressions only depend on constants and on the columns of a single table,
+// e.g. select 1 + 2 * 3, 'a' = 'a' from dual, to compare the scalar evaluation of the evalengine with mysql
+func TestConstantFolding(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+
+	schemaTables := getSchemaTables()
+	runFuzzLoop(t, func(r *rand.Rand) string {
+		genConfig := sqlparser.NewExprGeneratorConfig(sqlparser.CannotAggregate, "", 0, false)
+		sg := newSelectGenerator(r, genConfig, 2, 2, 2, schemaTables)
+		return sqlparser.String(sg.randomConstantSelect())
+	}, compareResults)
+}
+
+// TestPlanCacheNormalization generates pairs of queries that only differ in the values of their literals, e.g.
+// select tbl0.ename from emp as tbl0 where tbl0.sal > 1000 limit 2 and select tbl0.ename from emp as tbl0 where tbl0.sal > 47 limit 9
+// both queries must be executed with the same plan from the vtgate plan cache, and both must return the same results as mysql
+func TestPlanCacheNormalization(t *testing.T) {
+	t.Skip("Skip CI; random expressions generate too many failures to properly limit")
+
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
+	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
+
+	vtgateHostPort := fmt.Sprintf("%s:%d", vtParams.Host, clusterInstance.VtgateProcess.Port)
+	schemaTables := getSchemaTables()
+
+	// twin is the twin of the last generated query
+	var twin string
+	runFuzzLoop(t, func(r *rand.Rand) string {
+		genConfig := sqlparser.NewExprGeneratorConfig(sqlparser.CannotAggregate, "", 0, false)
+		qg := newQueryGenerator(r, genConfig, 2, 2, 2, schemaTables)
+		qg.randomQuery()
+		query := sqlparser.String(qg.stmt)
+		var ok bool
+		if twin, ok = literalTwin(r, query); !ok {
+			return ""
+		}
+		return query
+	}, func(mcmp *utils.MySQLCompare, query string) error {
+		execCounts, err := planExecCounts(vtgateHostPort)
+		require.NoError(t, err)
+		var plans [][]string
+		for _, q := range []string{query, twin} {
+			if _, err := mcmp.ExecAllowAndCompareError(q); err != nil {
+				return &failedQueryError{query: q, err: err}
+			}
+			newExecCounts, err := planExecCounts(vtgateHostPort)
+			require.NoError(t, err)
+			plans = append(plans, executedPlans(execCounts, newExecCounts))
+			execCounts = newExecCounts
+		}
+		// a plan that is not in the cache yet cannot be compared
+		if len(plans[0]) > 0 && len(plans[1]) > 0 && !slices.Equal(plans[0], plans[1]) {
+			return &failedQueryError{
+				query: twin,
+				err:   fmt.Errorf("queries that only differ in their literals were executed with different plans: %v and %v", plans[0], plans[1]),
+			}
+		}
+		return nil
+	})
+}
+
+// planExecCounts returns the number of times each plan in the vtgate plan cache was executed, by normalized query
+func planExecCounts(vtgateHostPort string) (map[string]float64, error) {
+	entries, err := utils.GetPlanCache(vtgateHostPort)
+	if err != nil {
+		return nil, err
+	}
+	execCounts := make(map[string]float64, len(entries))
+	for _, entry := range entries {
+		key, _ := entry["Key"].(string)
+		plan, _ := entry["Value"].(map[string]any)
+		// ExecCount is omitted while it is 0
+		execCounts[key], _ = plan["ExecCount"].(float64)
+	}
+	return execCounts, nil
+}
+
+// executedPlans returns the sorted normalized queries of the plans that were executed between two calls to planExecCounts
+func executedPlans(before, after map[string]float64) (plans []string) {
+	for key, count := range after {
+		if count > before[key] {
+			plans = append(plans, key)
+		}
+	}
+	slices.Sort(plans)
+	return
+}
+
+// TestRandomDDL creates a table with a random schema and alters it a few times, both through vitess and in mysql,
+// and compares the normalized output of SHOW CREATE TABLE after each statement
+func TestRandomDDL(t *testing.T) {
+	t.Skip("Skip CI; random DDL generates too many failures to properly limit")
+
+	mcmp, closer := start(t)
+	defer closer()
+
+	const table = "ddl_random"
+	endBy := time.Now().Add(1 * time.Second)
+
+	var stmtCount, stmtFailCount int
+	for time.Now().Before(endBy) {
+		seed := time.Now().UnixNano()
+		dg := newDDLGenerator(rand.New(rand.NewSource(seed)), table)
+		_, _ = mcmp.ExecAndIgnore("drop table if exists " + table)
+
+		stmts := []sqlparser.Statement{dg.randomCreateTable()}
+		numAlters := dg.r.Intn(5) + 1
+		for i := 0; i < numAlters; i++ {
+			stmts = append(stmts, dg.randomAlterTable())
+		}
+
+		for _, stmt := range stmts {
+			query := sqlparser.String(stmt)
+			_, vtErr := mcmp.ExecAllowAndCompareError(query)
+			if vtErr == nil {
+				mysqlQr, vtQr := mcmp.ExecNoCompare("show create table " + table)
+				mysqlCreate := normalizeCreateTable(mysqlQr.Rows[0][1].ToString())
+				vtCreate := normalizeCreateTable(vtQr.Rows[0][1].ToString())
+				if mysqlCreate != vtCreate {
+					vtErr = fmt.Errorf("schemas mismatched\nVitess:\n%s\nMySQL:\n%s", vtCreate, mysqlCreate)
+				}
+			}
+			stmtCount++
+
+			if vtErr != nil {
+				fmt.Printf("seed: %d\n", seed)
+				fmt.Println(query)
+				fmt.Println(vtErr)
+
+				// restart the mysql and vitess connections in case something bad happened
+				closer()
+				mcmp, closer = start(t)
+
+				fmt.Printf("\n\n\n")
+				stmtFailCount++
+				break
+			}
+		}
+	}
+	_, _ = mcmp.ExecAndIgnore("drop table if exists " + table)
+	fmt.Printf("Statements successfully executed: %d\n", stmtCount-stmtFailCount)
+	fmt.Printf("Statements failed: %d\n", stmtFailCount)
+}
+
 // these queries were previously failing and have now been fixed
 func TestBuggyQueries(t *testing.T) {
 	mcmp, closer := start(t)
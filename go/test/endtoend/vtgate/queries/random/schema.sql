@@ -16,5 +16,24 @@ CREATE TABLE dept (
  DNAME VARCHAR(14),
  LOC VARCHAR(13),
  PRIMARY KEY (DEPTNO)
+) Engine = InnoDB
+  COLLATE = utf8mb4_general_ci;
+
+CREATE TABLE emp_copy (
+ EMPNO bigint,
+ ENAME VARCHAR(10),
+ JOB VARCHAR(9),
+ MGR bigint,
+ HIREDATE DATE,
+ SAL bigint,
+ COMM bigint,
+ DEPTNO bigint
+) Engine = InnoDB
+  COLLATE = utf8mb4_general_ci;
+
+CREATE TABLE dept_copy (
+ DEPTNO bigint,
+ DNAME VARCHAR(14),
+ LOC VARCHAR(13)
 ) Engine = InnoDB
   COLLATE = utf8mb4_general_ci;
\ No newline at end of file
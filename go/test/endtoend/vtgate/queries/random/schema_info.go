@@ -0,0 +1,117 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package random
+
+import (
+	"fmt"
+	"strings"
+
+	"vitess.io/vitess/go/json2"
+	"vitess.io/vitess/go/mysql/collations"
+	"vitess.io/vitess/go/sqltypes"
+	"vitess.io/vitess/go/vt/key"
+	"vitess.io/vitess/go/vt/sqlparser"
+	"vitess.io/vitess/go/vt/vtgate/semantics"
+	"vitess.io/vitess/go/vt/vtgate/vindexes"
+
+	topodatapb "vitess.io/vitess/go/vt/proto/topodata"
+	vschemapb "vitess.io/vitess/go/vt/proto/vschema"
+)
+
+// schemaCollation is the collation of the text columns in schema.sql
+const schemaCollation = "utf8mb4_general_ci"
+
+// schemaInfo implements semantics.SchemaInformation for the tables the generator uses,
+// so that the simplifier sees the same column types, collations and vindexes as vtgate
+// every table is routed to a replica with no destination, like the queries of the tests
+type schemaInfo struct {
+	keyspace string
+	tables   map[string]*vindexes.Table
+}
+
+var _ semantics.SchemaInformation = (*schemaInfo)(nil)
+
+// newSchemaInfo builds the schemaInfo of schemaTables using the vindexes of vschema,
+// the JSON keyspace vschema the cluster is started with
+func newSchemaInfo(keyspace, vschema string, schemaTables []tableT) (*schemaInfo, error) {
+	formal := &vschemapb.Keyspace{}
+	if err := json2.Unmarshal([]byte(vschema), formal); err != nil {
+		return nil, err
+	}
+	ksSchema, err := vindexes.BuildKeyspaceSchema(formal, keyspace)
+	if err != nil {
+		return nil, err
+	}
+
+	si := &schemaInfo{
+		keyspace: keyspace,
+		tables:   make(map[string]*vindexes.Table, len(schemaTables)),
+	}
+	for _, tbl := range schemaTables {
+		name := tbl.getName()
+		vtbl, ok := ksSchema.Tables[name]
+		if !ok {
+			return nil, fmt.Errorf("table %s is not in the vschema of %s", name, keyspace)
+		}
+		vtbl.Columns = nil
+		for _, col := range tbl.cols {
+			vcol, err := col.vindexesColumn()
+			if err != nil {
+				return nil, err
+			}
+			vtbl.Columns = append(vtbl.Columns, vcol)
+		}
+		vtbl.ColumnListAuthoritative = true
+		si.tables[name] = vtbl
+	}
+	return si, nil
+}
+
+// vindexesColumn returns the vindexes.Column of c, mapping the generator's type to a sqltypes type
+func (c *column) vindexesColumn() (vindexes.Column, error) {
+	vcol := vindexes.Column{Name: sqlparser.NewIdentifierCI(c.name)}
+	switch c.typ {
+	case "bigint":
+		vcol.Type = sqltypes.Int64
+	case "varchar":
+		vcol.Type = sqltypes.VarChar
+		vcol.CollationName = schemaCollation
+	case "date":
+		vcol.Type = sqltypes.Date
+	default:
+		return vindexes.Column{}, fmt.Errorf("unsupported type %s for column %s", c.typ, c.name)
+	}
+	return vcol, nil
+}
+
+// FindTableOrVindex implements the SchemaInformation interface
+func (si *schemaInfo) FindTableOrVindex(tablename sqlparser.TableName) (*vindexes.Table, vindexes.Vindex, string, topodatapb.TabletType, key.Destination, error) {
+	if !tablename.Qualifier.IsEmpty() && tablename.Qualifier.String() != si.keyspace {
+		return nil, nil, "", topodatapb.TabletType_UNKNOWN, nil, vindexes.NotFoundError{TableName: sqlparser.String(tablename)}
+	}
+	name := strings.ToLower(tablename.Name.String())
+	vtbl, ok := si.tables[name]
+	if !ok {
+		return nil, nil, "", topodatapb.TabletType_UNKNOWN, nil, vindexes.NotFoundError{TableName: tablename.Name.String()}
+	}
+	return vtbl, nil, si.keyspace, topodatapb.TabletType_REPLICA, nil, nil
+}
+
+// ConnCollation implements the SchemaInformation interface
+func (si *schemaInfo) ConnCollation() collations.ID {
+	return collations.Default()
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package random
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/sqltypes"
+	"vitess.io/vitess/go/vt/sqlparser"
+	"vitess.io/vitess/go/vt/vtgate/vindexes"
+
+	topodatapb "vitess.io/vitess/go/vt/proto/topodata"
+)
+
+// TestSchemaInfo makes sure that FindTableOrVindex returns the columns of the seeded schema with their types
+func TestSchemaInfo(t *testing.T) {
+	si, err := newSchemaInfo(keyspaceName, vschema, getSchemaTables())
+	require.NoError(t, err)
+
+	tbl, vindex, ks, tabletType, dest, err := si.FindTableOrVindex(sqlparser.NewTableName("emp"))
+	require.NoError(t, err)
+	assert.Nil(t, vindex)
+	assert.Equal(t, keyspaceName, ks)
+	assert.Equal(t, topodatapb.TabletType_REPLICA, tabletType)
+	assert.Nil(t, dest)
+	assert.True(t, tbl.ColumnListAuthoritative)
+	assert.True(t, tbl.Keyspace.Sharded)
+	require.Len(t, tbl.ColumnVindexes, 1)
+	assert.Equal(t, "deptno", tbl.ColumnVindexes[0].Columns[0].String())
+
+	expected := []vindexes.Column{
+		{Name: sqlparser.NewIdentifierCI("empno"), Type: sqltypes.Int64},
+		{Name: sqlparser.NewIdentifierCI("ename"), Type: sqltypes.VarChar, CollationName: schemaCollation},
+		{Name: sqlparser.NewIdentifierCI("job"), Type: sqltypes.VarChar, CollationName: schemaCollation},
+		{Name: sqlparser.NewIdentifierCI("mgr"), Type: sqltypes.Int64},
+		{Name: sqlparser.NewIdentifierCI("hiredate"), Type: sqltypes.Date},
+		{Name: sqlparser.NewIdentifierCI("sal"), Type: sqltypes.Int64},
+		{Name: sqlparser.NewIdentifierCI("comm"), Type: sqltypes.Int64},
+		{Name: sqlparser.NewIdentifierCI("deptno"), Type: sqltypes.Int64},
+	}
+	assert.Equal(t, expected, tbl.Columns)
+
+	tbl, _, _, tabletType, dest, err = si.FindTableOrVindex(sqlparser.NewTableName("DEPT"))
+	require.NoError(t, err)
+	assert.Equal(t, topodatapb.TabletType_REPLICA, tabletType)
+	assert.Nil(t, dest)
+	require.Len(t, tbl.Columns, 3)
+	assert.Equal(t, sqltypes.VarChar, tbl.Columns[1].Type)
+
+	_, _, _, _, _, err = si.FindTableOrVindex(sqlparser.NewTableName("bonus"))
+	assert.ErrorContains(t, err, "table bonus not found")
+}
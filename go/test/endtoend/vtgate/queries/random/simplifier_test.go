@@ -21,15 +21,11 @@ import (
 	"strings"
 	"testing"
 
-	"vitess.io/vitess/go/test/vschemawrapper"
-
 	"github.com/stretchr/testify/require"
 
 	"vitess.io/vitess/go/test/endtoend/utils"
 	"vitess.io/vitess/go/vt/sqlparser"
-	"vitess.io/vitess/go/vt/vtgate/planbuilder"
 	"vitess.io/vitess/go/vt/vtgate/simplifier"
-	"vitess.io/vitess/go/vt/vtgate/vindexes"
 )
 
 func TestSimplifyResultsMismatchedQuery(t *testing.T) {
@@ -86,21 +82,16 @@ func simplifyResultsMismatchedQuery(t *testing.T, query string) string {
 	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "emp", clusterInstance.VtgateProcess.ReadVSchema))
 	require.NoError(t, utils.WaitForAuthoritative(t, keyspaceName, "dept", clusterInstance.VtgateProcess.ReadVSchema))
 
-	formal, err := vindexes.LoadFormal("svschema.json")
+	si, err := newSchemaInfo(keyspaceName, vschema, getSchemaTables())
 	require.NoError(t, err)
-	vSchema := vindexes.BuildVSchema(formal)
-	vSchemaWrapper := &vschemawrapper.VSchemaWrapper{
-		V:       vSchema,
-		Version: planbuilder.Gen4,
-	}
 
 	stmt, err := sqlparser.Parse(query)
 	require.NoError(t, err)
 
 	simplified := simplifier.SimplifyStatement(
 		stmt.(sqlparser.SelectStatement),
-		vSchemaWrapper.CurrentDb(),
-		vSchemaWrapper,
+		keyspaceName,
+		si,
 		func(statement sqlparser.SelectStatement) bool {
 			q := sqlparser.String(statement)
 			_, newErr := mcmp.ExecAllowAndCompareError(q)
@@ -115,6 +115,23 @@ func TestSchemaChange(t *testing.T) {
 	testWithAutoSchemaFromChangeDir(t)
 }
 
+// TestKnownDDLFailures holds the reproducers of the DDL divergences that TestRandomDDL
+// (go/test/endtoend/vtgate/queries/random) finds between vitess and mysql
+// each reproducer is the sequence of statements after which the normalized SHOW CREATE TABLE
+// outputs differ, with both outputs in a comment above it
+// no divergence is known yet
+func TestKnownDDLFailures(t *testing.T) {
+	t.Skip("Skip CI")
+	defer cluster.PanicHandler(t)
+
+	var reproducers [][]string
+	for _, stmts := range reproducers {
+		err := clusterInstance.VtctlclientProcess.ApplySchema(keyspaceName, strings.Join(stmts, ";"))
+		require.NoError(t, err)
+		matchSchema(t, clusterInstance.Keyspaces[0].Shards[0].Vttablets[0].VttabletProcess.TabletPath, clusterInstance.Keyspaces[0].Shards[1].Vttablets[0].VttabletProcess.TabletPath)
+	}
+}
+
 func testWithInitialSchema(t *testing.T) {
 	// Create 4 tables
 	var sqlQuery = "" // nolint
@@ -405,6 +405,14 @@ func (dbcfgs *DBConfigs) SetDbParams(dbaParams, appParams, filteredParams mysql.
 	dbcfgs.filteredParams = filteredParams
 }
 
+// SetDbaCredentials replaces the user and password of the dba params.
+func (dbcfgs *DBConfigs) SetDbaCredentials(user, password string) {
+	dbcfgs.Dba.User = user
+	dbcfgs.Dba.Password = password
+	dbcfgs.dbaParams.Uname = user
+	dbcfgs.dbaParams.Pass = password
+}
+
 // NewTestDBConfigs returns a DBConfigs meant for testing.
 func NewTestDBConfigs(genParams, appDebugParams mysql.ConnParams, dbname string) *DBConfigs {
 	return &DBConfigs{
@@ -56,9 +56,12 @@ type ConnectionPool struct {
 	maxLifetime         time.Duration
 	resolutionFrequency time.Duration
 
-	// info is set at Open() time
+	// info is set at Open() time, and replaced by RefreshConnections.
 	info dbconfigs.Connector
-	name string
+	// generation is bumped by RefreshConnections. Connections opened
+	// with an older generation are stale and get reopened.
+	generation int64
+	name       string
 }
 
 // NewConnectionPool creates a new ConnectionPool. The name is used
@@ -113,7 +116,8 @@ func (cp *ConnectionPool) Open(info dbconfigs.Connector) {
 
 // connect is used by the resource pool to create a new Resource.
 func (cp *ConnectionPool) connect(ctx context.Context) (pools.Resource, error) {
-	c, err := NewDBConnection(ctx, cp.info)
+	info, generation := cp.connector()
+	c, err := NewDBConnection(ctx, info)
 	if err != nil {
 		return nil, err
 	}
@@ -121,9 +125,36 @@ func (cp *ConnectionPool) connect(ctx context.Context) (pools.Resource, error) {
 		DBConnection: c,
 		timeCreated:  time.Now(),
 		pool:         cp,
+		generation:   generation,
 	}, nil
 }
 
+// connector returns the connection parameters used to open new
+// connections, and their generation.
+func (cp *ConnectionPool) connector() (dbconfigs.Connector, int64) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.info, cp.generation
+}
+
+// RefreshConnections replaces the connection parameters used to open new
+// connections, and marks all the existing connections as stale. Stale
+// connections are reopened with the new parameters when they are next
+// fetched from the pool, or closed when they are recycled, so the pool
+// converges to the new parameters without waiting for in-use connections.
+func (cp *ConnectionPool) RefreshConnections(info dbconfigs.Connector) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.info = info
+	cp.generation++
+}
+
+func (cp *ConnectionPool) isStale(conn *PooledDBConnection) bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return conn.generation != cp.generation
+}
+
 // Close will close the pool and wait for connections to be returned before
 // exiting.
 func (cp *ConnectionPool) Close() {
@@ -151,7 +182,14 @@ func (cp *ConnectionPool) Get(ctx context.Context) (*PooledDBConnection, error)
 		return nil, err
 	}
 
-	return r.(*PooledDBConnection), nil
+	conn := r.(*PooledDBConnection)
+	if cp.isStale(conn) {
+		if err := conn.Reconnect(ctx); err != nil {
+			conn.Recycle()
+			return nil, err
+		}
+	}
+	return conn, nil
 }
 
 // Put puts a connection into the pool.
@@ -0,0 +1,103 @@
+/*
+Copyright 2026 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dbconnpool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/mysql"
+	"vitess.io/vitess/go/mysql/fakesqldb"
+	"vitess.io/vitess/go/vt/dbconfigs"
+)
+
+func TestConnectionPoolRefreshConnections(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	cp := NewConnectionPool("", 2, time.Minute, 0, 0)
+	cp.Open(db.ConnParamsWithUname("user1"))
+	defer cp.Close()
+	ctx := context.Background()
+
+	inUse, err := cp.Get(ctx)
+	require.NoError(t, err)
+	idle, err := cp.Get(ctx)
+	require.NoError(t, err)
+	idleID := idle.ID()
+	idle.Recycle()
+	assert.EqualValues(t, 0, inUse.generation)
+
+	cp.RefreshConnections(db.ConnParamsWithUname("user2"))
+	info, generation := cp.connector()
+	assert.EqualValues(t, 1, generation)
+	params, err := info.MysqlParams()
+	require.NoError(t, err)
+	assert.Equal(t, "user2", params.Uname)
+
+	// The idle connection is stale, so it's reopened when it's fetched.
+	conn, err := cp.Get(ctx)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, conn.generation)
+	assert.NotEqual(t, idleID, conn.ID())
+	conn.Recycle()
+
+	// The connection that was in use is closed when it's recycled, and
+	// its replacement is opened with the new generation.
+	inUse.Recycle()
+	assert.True(t, inUse.IsClosed())
+	assert.EqualValues(t, 0, cp.InUse())
+	for i := 0; i < 2; i++ {
+		conn, err := cp.Get(ctx)
+		require.NoError(t, err)
+		defer conn.Recycle()
+		assert.EqualValues(t, 1, conn.generation)
+	}
+}
+
+func TestConnectionPoolRefreshConnectionsReconnectError(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	cp := NewConnectionPool("", 1, time.Minute, 0, 0)
+	cp.Open(db.ConnParams())
+	defer cp.Close()
+	ctx := context.Background()
+
+	conn, err := cp.Get(ctx)
+	require.NoError(t, err)
+	conn.Recycle()
+
+	cp.RefreshConnections(dbconfigs.New(&mysql.ConnParams{
+		UnixSocket: t.TempDir() + "/nonexistent.sock",
+	}))
+
+	// The stale connection can't be reopened. It's given back to the
+	// pool instead of leaking its slot.
+	_, err = cp.Get(ctx)
+	require.Error(t, err)
+	assert.EqualValues(t, 0, cp.InUse())
+	assert.EqualValues(t, 1, cp.Available())
+
+	cp.RefreshConnections(db.ConnParams())
+	conn, err = cp.Get(ctx)
+	require.NoError(t, err)
+	defer conn.Recycle()
+	assert.EqualValues(t, 2, conn.generation)
+}
@@ -28,6 +28,9 @@ type PooledDBConnection struct {
 	*DBConnection
 	timeCreated time.Time
 	pool        *ConnectionPool
+	// generation is the generation of the pool's connection
+	// parameters this connection was opened with.
+	generation int64
 }
 
 func (pc *PooledDBConnection) Expired(lifetimeTimeout time.Duration) bool {
@@ -54,6 +57,10 @@ func (pc *PooledDBConnection) ResetSetting(context.Context) error {
 
 // Recycle should be called to return the PooledDBConnection to the pool.
 func (pc *PooledDBConnection) Recycle() {
+	if !pc.IsClosed() && pc.pool.isStale(pc) {
+		// The pool was refreshed while this connection was in use.
+		pc.Close()
+	}
 	if pc.IsClosed() {
 		pc.pool.Put(nil)
 	} else {
@@ -65,10 +72,12 @@ func (pc *PooledDBConnection) Recycle() {
 // if possible. Recycle should still be called afterwards.
 func (pc *PooledDBConnection) Reconnect(ctx context.Context) error {
 	pc.DBConnection.Close()
-	newConn, err := NewDBConnection(ctx, pc.pool.info)
+	info, generation := pc.pool.connector()
+	newConn, err := NewDBConnection(ctx, info)
 	if err != nil {
 		return err
 	}
 	pc.DBConnection = newConn
+	pc.generation = generation
 	return nil
 }
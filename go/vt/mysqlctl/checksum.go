@@ -0,0 +1,65 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"vitess.io/vitess/go/mysql/sqlerror"
+	"vitess.io/vitess/go/sqlescape"
+)
+
+// ErrTableNotFound is returned by TableChecksum for a table that doesn't exist.
+var ErrTableNotFound = errors.New("table not found")
+
+// TableChecksum returns the live checksum of a table, as computed by
+// CHECKSUM TABLE. The table name can be qualified with a database name,
+// e.g. "db.t". The checksum depends on the row format, so it is only
+// comparable between tables with the same definition on the same version
+// of MySQL.
+func (mysqld *Mysqld) TableChecksum(ctx context.Context, table string) (uint64, error) {
+	query := "CHECKSUM TABLE " + escapeTableName(table)
+	qr, err := mysqld.FetchSuperQuery(ctx, query)
+	if err != nil {
+		if sqlErr, ok := sqlerror.NewSQLErrorFromError(err).(*sqlerror.SQLError); ok && sqlErr.Number() == sqlerror.ERNoSuchTable {
+			return 0, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+		}
+		return 0, fmt.Errorf("cannot checksum table %s: %w", table, err)
+	}
+	if len(qr.Rows) != 1 || len(qr.Rows[0]) != 2 {
+		return 0, fmt.Errorf("unexpected result for %v: %#v", query, qr)
+	}
+	// MySQL returns a NULL checksum with a warning for missing tables.
+	checksum := qr.Rows[0][1]
+	if checksum.IsNull() {
+		return 0, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	return checksum.ToUint64()
+}
+
+// escapeTableName escapes a table name that may be qualified with a
+// database name.
+func escapeTableName(table string) string {
+	parts := strings.Split(table, ".")
+	for i, part := range parts {
+		parts[i] = sqlescape.EscapeID(sqlescape.UnescapeID(part))
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/mysql/fakesqldb"
+	"vitess.io/vitess/go/mysql/sqlerror"
+	"vitess.io/vitess/go/sqltypes"
+)
+
+var checksumFields = sqltypes.MakeTestFields("Table|Checksum", "varchar|uint64")
+
+func TestTableChecksum(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+	ctx := context.Background()
+
+	db.AddQuery("CHECKSUM TABLE `t1`", sqltypes.MakeTestResult(checksumFields, "vt_test.t1|3893895441"))
+	checksum, err := mysqld.TableChecksum(ctx, "t1")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3893895441), checksum)
+
+	db.AddQuery("CHECKSUM TABLE `vt_test`.`t2`", sqltypes.MakeTestResult(checksumFields, "vt_test.t2|0"))
+	checksum, err = mysqld.TableChecksum(ctx, "vt_test.`t2`")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), checksum)
+}
+
+func TestTableChecksumTableNotFound(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+	ctx := context.Background()
+
+	db.AddQuery("CHECKSUM TABLE `missing`", sqltypes.MakeTestResult(checksumFields, "vt_test.missing|null"))
+	_, err := mysqld.TableChecksum(ctx, "missing")
+	require.ErrorIs(t, err, ErrTableNotFound)
+	assert.EqualError(t, err, "table not found: missing")
+
+	db.AddRejectedQuery("CHECKSUM TABLE `dropped`", sqlerror.NewSQLError(sqlerror.ERNoSuchTable, sqlerror.SSUnknownTable, "Table 'vt_test.dropped' doesn't exist"))
+	_, err = mysqld.TableChecksum(ctx, "dropped")
+	require.ErrorIs(t, err, ErrTableNotFound)
+}
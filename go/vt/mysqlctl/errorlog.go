@@ -0,0 +1,108 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"vitess.io/vitess/go/mysql/sqlerror"
+)
+
+const errorLogQuery = "SELECT LOGGED, THREAD_ID, PRIO, ERROR_CODE, SUBSYSTEM, DATA FROM performance_schema.error_log ORDER BY LOGGED DESC, THREAD_ID DESC LIMIT %d"
+
+// TailErrorLog returns the last lines of the MySQL error log, oldest first.
+// On MySQL 8.0.22+ they are read from performance_schema.error_log and
+// formatted like the lines of the error log file. Older versions and MariaDB
+// don't have that table, so the file named by log_error is read instead,
+// which only works when mysqld runs on this host.
+func (mysqld *Mysqld) TailErrorLog(ctx context.Context, lines int) ([]string, error) {
+	if lines <= 0 {
+		return nil, nil
+	}
+	tail, err := mysqld.tailErrorLogTable(ctx, lines)
+	if err == nil {
+		return tail, nil
+	}
+	if sqlErr, ok := sqlerror.NewSQLErrorFromError(err).(*sqlerror.SQLError); !ok || sqlErr.Number() != sqlerror.ERNoSuchTable {
+		return nil, err
+	}
+	return mysqld.tailErrorLogFile(ctx, lines)
+}
+
+func (mysqld *Mysqld) tailErrorLogTable(ctx context.Context, lines int) ([]string, error) {
+	qr, err := mysqld.FetchSuperQuery(ctx, fmt.Sprintf(errorLogQuery, lines))
+	if err != nil {
+		return nil, err
+	}
+	// The rows are newest first.
+	tail := make([]string, len(qr.Rows))
+	for i, row := range qr.Rows {
+		tail[len(qr.Rows)-1-i] = fmt.Sprintf("%s %s [%s] [%s] [%s] %s",
+			row[0].ToString(), row[1].ToString(), row[2].ToString(), row[3].ToString(), row[4].ToString(), row[5].ToString())
+	}
+	return tail, nil
+}
+
+func (mysqld *Mysqld) tailErrorLogFile(ctx context.Context, lines int) ([]string, error) {
+	vars, err := mysqld.fetchVariables(ctx, "log_error")
+	if err != nil {
+		return nil, err
+	}
+	path := vars["log_error"]
+	switch path {
+	case "":
+		return nil, fmt.Errorf("log_error is not set")
+	case "stderr":
+		return nil, fmt.Errorf("error log is written to stderr")
+	}
+	if !filepath.IsAbs(path) {
+		// A relative log_error is relative to the data directory.
+		vars, err := mysqld.fetchVariables(ctx, "datadir")
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(vars["datadir"], path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Keep the last lines in a ring buffer, so that reading a large error
+	// log doesn't hold all of it in memory.
+	ring := make([]string, lines)
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ring[n%lines] = scanner.Text()
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if n < lines {
+		return ring[:n], nil
+	}
+	start := n % lines
+	return append(ring[start:], ring[:start]...), nil
+}
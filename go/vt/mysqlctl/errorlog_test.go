@@ -0,0 +1,80 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/mysql/fakesqldb"
+	"vitess.io/vitess/go/mysql/sqlerror"
+	"vitess.io/vitess/go/sqltypes"
+)
+
+func TestTailErrorLogTable(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	db.AddQuery(fmt.Sprintf(errorLogQuery, 2), sqltypes.MakeTestResult(
+		sqltypes.MakeTestFields("LOGGED|THREAD_ID|PRIO|ERROR_CODE|SUBSYSTEM|DATA", "timestamp|int64|varchar|varchar|varchar|varchar"),
+		"2023-07-20 10:00:02.000000|0|System|MY-010931|Server|/usr/sbin/mysqld: ready for connections.",
+		"2023-07-20 10:00:01.000000|1|Warning|MY-010068|Server|CA certificate ca.pem is self signed.",
+	))
+
+	tail, err := mysqld.TailErrorLog(context.Background(), 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"2023-07-20 10:00:01.000000 1 [Warning] [MY-010068] [Server] CA certificate ca.pem is self signed.",
+		"2023-07-20 10:00:02.000000 0 [System] [MY-010931] [Server] /usr/sbin/mysqld: ready for connections.",
+	}, tail)
+}
+
+func TestTailErrorLogFile(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "error.log"), []byte("line 1\nline 2\nline 3\nline 4\n"), 0o644)
+	require.NoError(t, err)
+
+	db.AddRejectedQuery(fmt.Sprintf(errorLogQuery, 3), sqlerror.NewSQLError(sqlerror.ERNoSuchTable, sqlerror.SSUnknownTable, "Table 'performance_schema.error_log' doesn't exist"))
+	db.AddRejectedQuery(fmt.Sprintf(errorLogQuery, 10), sqlerror.NewSQLError(sqlerror.ERNoSuchTable, sqlerror.SSUnknownTable, "Table 'performance_schema.error_log' doesn't exist"))
+	fields := sqltypes.MakeTestFields("Variable_name|Value", "varchar|varchar")
+	db.AddQuery("SHOW VARIABLES LIKE 'log_error'", sqltypes.MakeTestResult(fields, "log_error|./error.log"))
+	db.AddQuery("SHOW VARIABLES LIKE 'datadir'", sqltypes.MakeTestResult(fields, "datadir|"+dir+"/"))
+
+	tail, err := mysqld.TailErrorLog(context.Background(), 3)
+	require.NoError(t, err)
+	require.Equal(t, []string{"line 2", "line 3", "line 4"}, tail)
+
+	tail, err = mysqld.TailErrorLog(context.Background(), 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"line 1", "line 2", "line 3", "line 4"}, tail)
+
+	db.AddQuery("SHOW VARIABLES LIKE 'log_error'", sqltypes.MakeTestResult(fields, "log_error|stderr"))
+	_, err = mysqld.TailErrorLog(context.Background(), 3)
+	require.EqualError(t, err, "error log is written to stderr")
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ExplainPlan is the query plan MySQL reports with EXPLAIN FORMAT=JSON.
+type ExplainPlan struct {
+	// Root is the "query_block" of the query.
+	Root *ExplainNode
+}
+
+// ExplainNode is a node of an ExplainPlan tree.
+type ExplainNode struct {
+	// Operation is the name of the node in the EXPLAIN output, e.g.
+	// "query_block", "nested_loop", "table" or "ordering_operation".
+	Operation string
+	// SelectID and Cost are only set for "query_block" nodes.
+	SelectID int64
+	Cost     float64
+	// Message explains why there are no tables to read, e.g. "No tables used".
+	Message string
+	// Table is only set for "table" nodes.
+	Table *ExplainTable
+	// Extra lists the flags reported for the node, e.g. "using_filesort".
+	Extra    []string
+	Children []*ExplainNode
+}
+
+// ExplainTable is how a table is accessed in an ExplainPlan.
+type ExplainTable struct {
+	Name         string
+	AccessType   string
+	PossibleKeys []string
+	Key          string
+	// Rows is the estimated number of rows read each time the table is
+	// accessed.
+	Rows      int64
+	Filtered  float64
+	Condition string
+	// Extra lists the flags reported for the table, e.g. "using_index" or
+	// "using_join_buffer (hash join)".
+	Extra []string
+}
+
+// Tables returns the tables of the plan, in the order they are read.
+func (plan *ExplainPlan) Tables() []*ExplainTable {
+	var tables []*ExplainTable
+	var visit func(node *ExplainNode)
+	visit = func(node *ExplainNode) {
+		if node.Table != nil {
+			tables = append(tables, node.Table)
+		}
+		for _, child := range node.Children {
+			visit(child)
+		}
+	}
+	visit(plan.Root)
+	return tables
+}
+
+// ExplainQuery returns the plan MySQL chooses for the given query.
+func (mysqld *Mysqld) ExplainQuery(ctx context.Context, query string) (*ExplainPlan, error) {
+	qr, err := mysqld.FetchSuperQuery(ctx, "EXPLAIN FORMAT=JSON "+query)
+	if err != nil {
+		return nil, err
+	}
+	if len(qr.Rows) != 1 || len(qr.Rows[0]) != 1 {
+		return nil, fmt.Errorf("unexpected EXPLAIN result for query %q: %v", query, qr.Rows)
+	}
+	return parseExplainPlan(qr.Rows[0][0].ToString())
+}
+
+// parseExplainPlan parses the output of EXPLAIN FORMAT=JSON. Only the fields
+// that mean the same in MySQL 5.7 and 8.0 are kept, and unknown fields are
+// ignored, so that the extra details newer versions add don't break parsing.
+func parseExplainPlan(explain string) (*ExplainPlan, error) {
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(explain), &doc); err != nil {
+		return nil, fmt.Errorf("cannot parse EXPLAIN output: %v", err)
+	}
+	queryBlock, ok := doc["query_block"].(map[string]any)
+	if !ok {
+		// e.g. explain_json_format_version=2 in MySQL 8.3+
+		return nil, fmt.Errorf("unsupported EXPLAIN format: no query_block")
+	}
+	return &ExplainPlan{Root: parseExplainNode("query_block", queryBlock)}, nil
+}
+
+// explainSubqueries are the fields holding a list of subqueries, each one
+// with its own query_block.
+var explainSubqueries = map[string]bool{
+	"attached_subqueries":       true,
+	"optimized_away_subqueries": true,
+	"select_list_subqueries":    true,
+	"order_by_subqueries":       true,
+	"group_by_subqueries":       true,
+	"having_subqueries":         true,
+	"query_specifications":      true,
+}
+
+func parseExplainNode(operation string, obj map[string]any) *ExplainNode {
+	node := &ExplainNode{Operation: operation}
+	if operation == "table" {
+		node.Table = parseExplainTable(obj)
+	}
+
+	for _, key := range sortedKeys(obj) {
+		value := obj[key]
+		switch {
+		case key == "select_id":
+			node.SelectID = int64(explainNumber(value))
+		case key == "cost_info":
+			if costInfo, ok := value.(map[string]any); ok && operation == "query_block" {
+				node.Cost = explainNumber(costInfo["query_cost"])
+			}
+		case key == "message":
+			node.Message, _ = value.(string)
+		case key == "nested_loop":
+			loop := &ExplainNode{Operation: key}
+			for _, elem := range explainList(value) {
+				loop.Children = append(loop.Children, parseExplainChildren(elem)...)
+			}
+			node.Children = append(node.Children, loop)
+		case explainSubqueries[key]:
+			for _, elem := range explainList(value) {
+				node.Children = append(node.Children, parseExplainChildren(elem)...)
+			}
+		default:
+			if child, ok := value.(map[string]any); ok {
+				node.Children = append(node.Children, parseExplainNode(key, child))
+			} else if node.Table == nil {
+				if flag := explainFlag(key, value); flag != "" {
+					node.Extra = append(node.Extra, flag)
+				}
+			}
+		}
+	}
+	return node
+}
+
+// parseExplainChildren parses the nodes of an object like {"table": {...}}
+// or {"dependent": false, "query_block": {...}}.
+func parseExplainChildren(obj map[string]any) []*ExplainNode {
+	var children []*ExplainNode
+	for _, key := range sortedKeys(obj) {
+		if child, ok := obj[key].(map[string]any); ok {
+			children = append(children, parseExplainNode(key, child))
+		}
+	}
+	return children
+}
+
+func parseExplainTable(obj map[string]any) *ExplainTable {
+	table := &ExplainTable{}
+	for _, key := range sortedKeys(obj) {
+		value := obj[key]
+		switch key {
+		case "table_name":
+			table.Name, _ = value.(string)
+		case "access_type":
+			table.AccessType, _ = value.(string)
+		case "possible_keys":
+			list, _ := value.([]any)
+			for _, k := range list {
+				if k, ok := k.(string); ok {
+					table.PossibleKeys = append(table.PossibleKeys, k)
+				}
+			}
+		case "key":
+			table.Key, _ = value.(string)
+		case "rows_examined_per_scan", "rows":
+			// "rows" is what MySQL 5.6 used to report.
+			table.Rows = int64(explainNumber(value))
+		case "filtered":
+			table.Filtered = explainNumber(value)
+		case "attached_condition":
+			table.Condition, _ = value.(string)
+		default:
+			if flag := explainFlag(key, value); flag != "" {
+				table.Extra = append(table.Extra, flag)
+			}
+		}
+	}
+	return table
+}
+
+// explainFlag returns the description of a "using_*" flag, or an empty
+// string if key is not a flag or the flag is off.
+func explainFlag(key string, value any) string {
+	if !strings.HasPrefix(key, "using_") {
+		return ""
+	}
+	switch value := value.(type) {
+	case bool:
+		if value {
+			return key
+		}
+	case string:
+		// e.g. "using_join_buffer": "Block Nested Loop" in 5.7, or "hash join" in 8.0
+		return fmt.Sprintf("%s (%s)", key, value)
+	}
+	return ""
+}
+
+// explainNumber returns value as a number. Depending on the field and the
+// version, EXPLAIN reports numbers either as JSON numbers or as strings.
+func explainNumber(value any) float64 {
+	switch value := value.(type) {
+	case float64:
+		return value
+	case string:
+		n, _ := strconv.ParseFloat(value, 64)
+		return n
+	}
+	return 0
+}
+
+func explainList(value any) []map[string]any {
+	list, _ := value.([]any)
+	objs := make([]map[string]any, 0, len(list))
+	for _, elem := range list {
+		if obj, ok := elem.(map[string]any); ok {
+			objs = append(objs, obj)
+		}
+	}
+	return objs
+}
+
+func sortedKeys(obj map[string]any) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
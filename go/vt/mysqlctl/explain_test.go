@@ -0,0 +1,270 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/mysql/fakesqldb"
+	"vitess.io/vitess/go/sqltypes"
+)
+
+// explain57 is the output of MySQL 5.7 for
+// select * from emp e join dept d on e.deptno = d.deptno order by e.ename
+const explain57 = `{
+  "query_block": {
+    "select_id": 1,
+    "cost_info": {
+      "query_cost": "12.40"
+    },
+    "ordering_operation": {
+      "using_temporary_table": true,
+      "using_filesort": true,
+      "cost_info": {
+        "sort_cost": "14.00"
+      },
+      "nested_loop": [
+        {
+          "table": {
+            "table_name": "d",
+            "access_type": "ALL",
+            "possible_keys": [
+              "PRIMARY"
+            ],
+            "rows_examined_per_scan": 4,
+            "rows_produced_per_join": 4,
+            "filtered": "100.00",
+            "cost_info": {
+              "read_cost": "1.00",
+              "eval_cost": "0.80",
+              "prefix_cost": "1.80",
+              "data_read_per_join": "1K"
+            },
+            "used_columns": [
+              "deptno",
+              "dname",
+              "loc"
+            ]
+          }
+        },
+        {
+          "table": {
+            "table_name": "e",
+            "access_type": "ALL",
+            "rows_examined_per_scan": 14,
+            "rows_produced_per_join": 5,
+            "filtered": "10.00",
+            "using_join_buffer": "Block Nested Loop",
+            "cost_info": {
+              "read_cost": "9.48",
+              "eval_cost": "1.12",
+              "prefix_cost": "12.40",
+              "data_read_per_join": "4K"
+            },
+            "used_columns": [
+              "empno",
+              "ename",
+              "deptno"
+            ],
+            "attached_condition": "(` + "`ks`.`e`.`deptno` = `ks`.`d`.`deptno`" + `)"
+          }
+        }
+      ]
+    }
+  }
+}`
+
+// explain80 is the output of MySQL 8.0 for
+// select deptno, count(*) from (select deptno from emp where sal > 1000) t group by deptno
+const explain80 = `{
+  "query_block": {
+    "select_id": 1,
+    "cost_info": {
+      "query_cost": "3.70"
+    },
+    "grouping_operation": {
+      "using_temporary_table": true,
+      "using_filesort": false,
+      "table": {
+        "table_name": "t",
+        "access_type": "ALL",
+        "rows_examined_per_scan": 4,
+        "rows_produced_per_join": 4,
+        "filtered": "100.00",
+        "cost_info": {
+          "read_cost": "2.53",
+          "eval_cost": "0.47",
+          "prefix_cost": "3.00",
+          "data_read_per_join": "75"
+        },
+        "used_columns": [
+          "deptno"
+        ],
+        "materialized_from_subquery": {
+          "using_temporary_table": true,
+          "dependent": false,
+          "cacheable": true,
+          "query_block": {
+            "select_id": 2,
+            "cost_info": {
+              "query_cost": "1.65"
+            },
+            "table": {
+              "table_name": "emp",
+              "access_type": "range",
+              "possible_keys": [
+                "sal_idx"
+              ],
+              "key": "sal_idx",
+              "used_key_parts": [
+                "sal"
+              ],
+              "key_length": "9",
+              "rows_examined_per_scan": 4,
+              "rows_produced_per_join": 4,
+              "filtered": "100.00",
+              "using_index_condition": true,
+              "cost_info": {
+                "read_cost": "1.25",
+                "eval_cost": "0.40",
+                "prefix_cost": "1.65",
+                "data_read_per_join": "3K"
+              },
+              "used_columns": [
+                "sal",
+                "deptno"
+              ]
+            }
+          }
+        }
+      }
+    }
+  }
+}`
+
+func TestParseExplainPlan(t *testing.T) {
+	plan, err := parseExplainPlan(explain57)
+	require.NoError(t, err)
+	require.Equal(t, &ExplainPlan{Root: &ExplainNode{
+		Operation: "query_block",
+		SelectID:  1,
+		Cost:      12.4,
+		Children: []*ExplainNode{{
+			Operation: "ordering_operation",
+			Extra:     []string{"using_filesort", "using_temporary_table"},
+			Children: []*ExplainNode{{
+				Operation: "nested_loop",
+				Children: []*ExplainNode{{
+					Operation: "table",
+					Table: &ExplainTable{
+						Name:         "d",
+						AccessType:   "ALL",
+						PossibleKeys: []string{"PRIMARY"},
+						Rows:         4,
+						Filtered:     100,
+					},
+				}, {
+					Operation: "table",
+					Table: &ExplainTable{
+						Name:       "e",
+						AccessType: "ALL",
+						Rows:       14,
+						Filtered:   10,
+						Condition:  "(`ks`.`e`.`deptno` = `ks`.`d`.`deptno`)",
+						Extra:      []string{"using_join_buffer (Block Nested Loop)"},
+					},
+				}},
+			}},
+		}},
+	}}, plan)
+
+	plan, err = parseExplainPlan(explain80)
+	require.NoError(t, err)
+	require.Equal(t, &ExplainPlan{Root: &ExplainNode{
+		Operation: "query_block",
+		SelectID:  1,
+		Cost:      3.7,
+		Children: []*ExplainNode{{
+			Operation: "grouping_operation",
+			Extra:     []string{"using_temporary_table"},
+			Children: []*ExplainNode{{
+				Operation: "table",
+				Table: &ExplainTable{
+					Name:       "t",
+					AccessType: "ALL",
+					Rows:       4,
+					Filtered:   100,
+				},
+				Children: []*ExplainNode{{
+					Operation: "materialized_from_subquery",
+					Extra:     []string{"using_temporary_table"},
+					Children: []*ExplainNode{{
+						Operation: "query_block",
+						SelectID:  2,
+						Cost:      1.65,
+						Children: []*ExplainNode{{
+							Operation: "table",
+							Table: &ExplainTable{
+								Name:         "emp",
+								AccessType:   "range",
+								PossibleKeys: []string{"sal_idx"},
+								Key:          "sal_idx",
+								Rows:         4,
+								Filtered:     100,
+								Extra:        []string{"using_index_condition"},
+							},
+						}},
+					}},
+				}},
+			}},
+		}},
+	}}, plan)
+
+	plan, err = parseExplainPlan(`{"query_block": {"select_id": 1, "message": "No tables used"}}`)
+	require.NoError(t, err)
+	require.Equal(t, &ExplainNode{Operation: "query_block", SelectID: 1, Message: "No tables used"}, plan.Root)
+	require.Empty(t, plan.Tables())
+
+	_, err = parseExplainPlan(`{"query": "/* select#1 */ select 1", "operation": "Rows fetched before execution"}`)
+	require.EqualError(t, err, "unsupported EXPLAIN format: no query_block")
+
+	_, err = parseExplainPlan(`not json`)
+	require.ErrorContains(t, err, "cannot parse EXPLAIN output")
+}
+
+func TestExplainQuery(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	query := "select * from emp e join dept d on e.deptno = d.deptno order by e.ename"
+	db.AddQuery("EXPLAIN FORMAT=JSON "+query, sqltypes.MakeTestResult(
+		sqltypes.MakeTestFields("EXPLAIN", "json"),
+		explain57,
+	))
+
+	plan, err := mysqld.ExplainQuery(context.Background(), query)
+	require.NoError(t, err)
+	tables := plan.Tables()
+	require.Len(t, tables, 2)
+	require.Equal(t, "d", tables[0].Name)
+	require.Equal(t, "e", tables[1].Name)
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerMetrics is a snapshot of the status and variables of the server that
+// are commonly used for monitoring.
+type ServerMetrics struct {
+	// CapturedAt is when the snapshot was taken.
+	CapturedAt time.Time
+
+	Uptime time.Duration
+
+	// Connections is the total number of connection attempts since startup.
+	Connections      int64
+	ThreadsConnected int64
+	ThreadsRunning   int64
+	MaxConnections   int64
+
+	BufferPoolSize       int64
+	BufferPoolPagesTotal int64
+	BufferPoolPagesData  int64
+	BufferPoolPagesFree  int64
+
+	ReadOnly      bool
+	SuperReadOnly bool
+	GTIDExecuted  string
+}
+
+var (
+	metricsStatuses = []string{
+		"uptime",
+		"connections",
+		"threads_connected",
+		"threads_running",
+		"innodb_buffer_pool_pages_total",
+		"innodb_buffer_pool_pages_data",
+		"innodb_buffer_pool_pages_free",
+	}
+	metricsVariables = []string{
+		"max_connections",
+		"innodb_buffer_pool_size",
+		"read_only",
+		"super_read_only",
+		"gtid_executed",
+	}
+	metricsSnapshotQuery = fmt.Sprintf("SELECT LOWER(VARIABLE_NAME), VARIABLE_VALUE FROM performance_schema.global_status WHERE LOWER(VARIABLE_NAME) IN (%s) "+
+		"UNION ALL SELECT LOWER(VARIABLE_NAME), VARIABLE_VALUE FROM performance_schema.global_variables WHERE LOWER(VARIABLE_NAME) IN (%s)",
+		quotedList(metricsStatuses), quotedList(metricsVariables))
+)
+
+func quotedList(names []string) string {
+	return "'" + strings.Join(names, "', '") + "'"
+}
+
+// MetricsSnapshot returns the ServerMetrics of the server. Everything is read
+// with a single query, so the values are as consistent as performance_schema
+// allows, as opposed to fetching them with separate SHOW VARIABLES and SHOW
+// STATUS calls.
+func (mysqld *Mysqld) MetricsSnapshot(ctx context.Context) (*ServerMetrics, error) {
+	capturedAt := time.Now()
+	qr, err := mysqld.FetchSuperQuery(ctx, metricsSnapshotQuery)
+	if err != nil {
+		return nil, err
+	}
+	if len(qr.Fields) != 2 {
+		return nil, fmt.Errorf("query %#v returned %d columns, expected 2", metricsSnapshotQuery, len(qr.Fields))
+	}
+	values := make(map[string]string, len(qr.Rows))
+	for _, row := range qr.Rows {
+		values[row[0].ToString()] = row[1].ToString()
+	}
+
+	p := metricsParser{values: values}
+	metrics := &ServerMetrics{
+		CapturedAt:           capturedAt,
+		Uptime:               time.Duration(p.int64("uptime")) * time.Second,
+		Connections:          p.int64("connections"),
+		ThreadsConnected:     p.int64("threads_connected"),
+		ThreadsRunning:       p.int64("threads_running"),
+		MaxConnections:       p.int64("max_connections"),
+		BufferPoolSize:       p.int64("innodb_buffer_pool_size"),
+		BufferPoolPagesTotal: p.int64("innodb_buffer_pool_pages_total"),
+		BufferPoolPagesData:  p.int64("innodb_buffer_pool_pages_data"),
+		BufferPoolPagesFree:  p.int64("innodb_buffer_pool_pages_free"),
+		ReadOnly:             p.bool("read_only"),
+		SuperReadOnly:        p.bool("super_read_only"),
+		GTIDExecuted:         p.string("gtid_executed"),
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return metrics, nil
+}
+
+// metricsParser parses the values returned by metricsSnapshotQuery, keeping
+// the first error it finds.
+type metricsParser struct {
+	values map[string]string
+	err    error
+}
+
+func (p *metricsParser) string(name string) string {
+	value, ok := p.values[name]
+	if !ok && p.err == nil {
+		p.err = fmt.Errorf("%s not found", name)
+	}
+	return value
+}
+
+func (p *metricsParser) int64(name string) int64 {
+	value := p.string(name)
+	if p.err != nil {
+		return 0
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		p.err = fmt.Errorf("invalid value for %s: %q", name, value)
+	}
+	return n
+}
+
+func (p *metricsParser) bool(name string) bool {
+	value := p.string(name)
+	return value == "ON" || value == "1"
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/mysql/fakesqldb"
+	"vitess.io/vitess/go/sqltypes"
+)
+
+func TestMetricsSnapshot(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	fields := sqltypes.MakeTestFields("name|value", "varchar|varchar")
+	db.AddQuery(metricsSnapshotQuery, sqltypes.MakeTestResult(fields,
+		"uptime|3600",
+		"connections|1234",
+		"threads_connected|12",
+		"threads_running|3",
+		"innodb_buffer_pool_pages_total|8192",
+		"innodb_buffer_pool_pages_data|6000",
+		"innodb_buffer_pool_pages_free|2000",
+		"max_connections|500",
+		"innodb_buffer_pool_size|134217728",
+		"read_only|ON",
+		"super_read_only|OFF",
+		"gtid_executed|00010203-0405-0607-0809-0a0b0c0d0e0f:1-100",
+	))
+
+	before := time.Now()
+	metrics, err := mysqld.MetricsSnapshot(context.Background())
+	require.NoError(t, err)
+	require.WithinRange(t, metrics.CapturedAt, before, time.Now())
+	metrics.CapturedAt = time.Time{}
+	require.Equal(t, &ServerMetrics{
+		Uptime:               time.Hour,
+		Connections:          1234,
+		ThreadsConnected:     12,
+		ThreadsRunning:       3,
+		MaxConnections:       500,
+		BufferPoolSize:       134217728,
+		BufferPoolPagesTotal: 8192,
+		BufferPoolPagesData:  6000,
+		BufferPoolPagesFree:  2000,
+		ReadOnly:             true,
+		SuperReadOnly:        false,
+		GTIDExecuted:         "00010203-0405-0607-0809-0a0b0c0d0e0f:1-100",
+	}, metrics)
+	require.Equal(t, 1, db.GetQueryCalledNum(metricsSnapshotQuery))
+
+	// A missing value is an error rather than a silent zero.
+	db.AddQuery(metricsSnapshotQuery, sqltypes.MakeTestResult(fields, "uptime|3600"))
+	_, err = mysqld.MetricsSnapshot(context.Background())
+	require.EqualError(t, err, "connections not found")
+}
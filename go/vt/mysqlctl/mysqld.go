@@ -74,8 +74,11 @@ var (
 	dbaPoolSize = 20
 	// DbaIdleTimeout is how often we will refresh the DBA connpool connections
 	DbaIdleTimeout = time.Minute
-	appPoolSize    = 40
-	appIdleTimeout = time.Minute
+	// dbaPoolAcquireTimeout bounds how long to wait for a DBA connpool connection,
+	// separately from the deadline of the query it is used for
+	dbaPoolAcquireTimeout time.Duration
+	appPoolSize           = 40
+	appIdleTimeout        = time.Minute
 
 	// PoolDynamicHostnameResolution is whether we should retry DNS resolution of hostname targets
 	// and reconnect if necessary
@@ -92,12 +95,22 @@ var (
 	binlogEntryTimestampGTIDRegexp     = regexp.MustCompile(`^#(.+) server id.*\bGTID\b`)
 )
 
+// updateDBACredentialsTimeout bounds how long UpdateDBACredentials waits
+// for the connection that checks the new credentials.
+const updateDBACredentialsTimeout = 30 * time.Second
+
 // How many bytes from MySQL error log to sample for error messages
 const maxLogFileSampleSize = 4096
 
 // Mysqld is the object that represents a mysqld daemon running on this server.
 type Mysqld struct {
-	dbcfgs  *dbconfigs.DBConfigs
+	// dbcfgsMu protects dbcfgs. UpdateDBACredentials replaces dbcfgs
+	// instead of changing it in place, so it must be read with dbConfigs.
+	dbcfgsMu sync.RWMutex
+	dbcfgs   *dbconfigs.DBConfigs
+	// credentialsMu serializes UpdateDBACredentials.
+	credentialsMu sync.Mutex
+
 	dbaPool *dbconnpool.ConnectionPool
 	appPool *dbconnpool.ConnectionPool
 
@@ -107,6 +120,13 @@ type Mysqld struct {
 	mutex         sync.Mutex
 	onTermFuncs   []func()
 	cancelWaitCmd chan struct{}
+
+	// quiesceMu protects readOnlyBeforeQuiesce. It's separate from mutex so
+	// that Quiesce doesn't block Shutdown and the OnTerm callbacks.
+	quiesceMu sync.Mutex
+	// readOnlyBeforeQuiesce is the read_only state before Quiesce, or nil
+	// if not quiesced.
+	readOnlyBeforeQuiesce *bool
 }
 
 func init() {
@@ -135,6 +155,7 @@ func registerReparentFlags(fs *pflag.FlagSet) {
 func registerPoolFlags(fs *pflag.FlagSet) {
 	fs.IntVar(&dbaPoolSize, "dba_pool_size", dbaPoolSize, "Size of the connection pool for dba connections")
 	fs.DurationVar(&DbaIdleTimeout, "dba_idle_timeout", DbaIdleTimeout, "Idle timeout for dba connections")
+	fs.DurationVar(&dbaPoolAcquireTimeout, "dba_pool_acquire_timeout", dbaPoolAcquireTimeout, "Timeout for getting a connection from the dba connection pool, on top of the deadline of the query (0 means no extra timeout)")
 	fs.DurationVar(&appIdleTimeout, "app_idle_timeout", appIdleTimeout, "Idle timeout for app connections")
 	fs.IntVar(&appPoolSize, "app_pool_size", appPoolSize, "Size of the connection pool for app connections")
 }
@@ -263,7 +284,7 @@ func (mysqld *Mysqld) RunMysqlUpgrade(ctx context.Context) error {
 	// privileges' right in the middle, and then subsequent
 	// commands fail if we don't use valid credentials. So let's
 	// use dba credentials.
-	params, err := mysqld.dbcfgs.DbaConnector().MysqlParams()
+	params, err := mysqld.dbConfigs().DbaConnector().MysqlParams()
 	if err != nil {
 		return err
 	}
@@ -430,7 +451,7 @@ func (mysqld *Mysqld) startNoWait(ctx context.Context, cnf *Mycnf, mysqldArgs ..
 // will use the dba credentials to try to connect. Use wait() with
 // different credentials if needed.
 func (mysqld *Mysqld) Wait(ctx context.Context, cnf *Mycnf) error {
-	params, err := mysqld.dbcfgs.DbaConnector().MysqlParams()
+	params, err := mysqld.dbConfigs().DbaConnector().MysqlParams()
 	if err != nil {
 		return err
 	}
@@ -520,7 +541,7 @@ func (mysqld *Mysqld) Shutdown(ctx context.Context, cnf *Mycnf, waitForMysqld bo
 		if err != nil {
 			return err
 		}
-		params, err := mysqld.dbcfgs.DbaConnector().MysqlParams()
+		params, err := mysqld.dbConfigs().DbaConnector().MysqlParams()
 		if err != nil {
 			return err
 		}
@@ -1092,12 +1113,55 @@ func (mysqld *Mysqld) GetAppConnection(ctx context.Context) (*dbconnpool.PooledD
 
 // GetDbaConnection creates a new DBConnection.
 func (mysqld *Mysqld) GetDbaConnection(ctx context.Context) (*dbconnpool.DBConnection, error) {
-	return dbconnpool.NewDBConnection(ctx, mysqld.dbcfgs.DbaConnector())
+	return dbconnpool.NewDBConnection(ctx, mysqld.dbConfigs().DbaConnector())
+}
+
+// UpdateDBACredentials rotates the credentials used for dba connections.
+// The new credentials are checked with a fresh connection first, so a
+// mistyped password leaves the current ones in place. Pooled dba connections
+// are then refreshed so they reconnect with the new credentials.
+//
+// It takes a ctx, like the other Mysqld methods that connect to MySQL, so
+// that the caller can cancel the check of the new credentials. The check is
+// bounded by updateDBACredentialsTimeout either way.
+func (mysqld *Mysqld) UpdateDBACredentials(ctx context.Context, user, password string) error {
+	if user == "" {
+		return errors.New("cannot update dba credentials: user is empty")
+	}
+
+	mysqld.credentialsMu.Lock()
+	defer mysqld.credentialsMu.Unlock()
+
+	dbcfgs := mysqld.dbConfigs().Clone()
+	dbcfgs.SetDbaCredentials(user, password)
+	ctx, cancel := context.WithTimeout(ctx, updateDBACredentialsTimeout)
+	defer cancel()
+	conn, err := dbconnpool.NewDBConnection(ctx, dbcfgs.DbaConnector())
+	if err != nil {
+		return vterrors.Wrapf(err, "cannot connect with the new dba credentials for user %v", user)
+	}
+	conn.Close()
+
+	mysqld.dbcfgsMu.Lock()
+	mysqld.dbcfgs = dbcfgs
+	mysqld.dbcfgsMu.Unlock()
+	if mysqld.dbaPool != nil {
+		mysqld.dbaPool.RefreshConnections(dbcfgs.DbaWithDB())
+	}
+	log.Infof("Updated dba credentials: %+v", dbcfgs.Redacted().Dba)
+	return nil
+}
+
+// dbConfigs returns the current DBConfigs. It must not be modified.
+func (mysqld *Mysqld) dbConfigs() *dbconfigs.DBConfigs {
+	mysqld.dbcfgsMu.RLock()
+	defer mysqld.dbcfgsMu.RUnlock()
+	return mysqld.dbcfgs
 }
 
 // GetAllPrivsConnection creates a new DBConnection.
 func (mysqld *Mysqld) GetAllPrivsConnection(ctx context.Context) (*dbconnpool.DBConnection, error) {
-	return dbconnpool.NewDBConnection(ctx, mysqld.dbcfgs.AllPrivsWithDB())
+	return dbconnpool.NewDBConnection(ctx, mysqld.dbConfigs().AllPrivsWithDB())
 }
 
 // Close will close this instance of Mysqld. It will wait for all dba
@@ -1221,7 +1285,7 @@ func (mysqld *Mysqld) ApplyBinlogFile(ctx context.Context, req *mysqlctlpb.Apply
 		if err != nil {
 			return err
 		}
-		params, err := mysqld.dbcfgs.DbaConnector().MysqlParams()
+		params, err := mysqld.dbConfigs().DbaConnector().MysqlParams()
 		if err != nil {
 			return err
 		}
@@ -17,11 +17,17 @@ limitations under the License.
 package mysqlctl
 
 import (
+	"context"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/mysql"
+	"vitess.io/vitess/go/mysql/fakesqldb"
+	"vitess.io/vitess/go/sqltypes"
 )
 
 type testcase struct {
@@ -178,3 +184,79 @@ func TestParseBinlogEntryTimestamp(t *testing.T) {
 		})
 	}
 }
+
+// userRecordingHandler records the user of the connection every query
+// was run on, and passes the query to the fakesqldb.DB.
+type userRecordingHandler struct {
+	*fakesqldb.DB
+	mu    sync.Mutex
+	users map[string]int
+}
+
+func (h *userRecordingHandler) HandleQuery(c *mysql.Conn, query string, callback func(*sqltypes.Result) error) error {
+	h.mu.Lock()
+	h.users[c.User]++
+	h.mu.Unlock()
+	return h.DB.HandleQuery(c, query, callback)
+}
+
+func (h *userRecordingHandler) reset() map[string]int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	users := h.users
+	h.users = map[string]int{}
+	return users
+}
+
+func TestUpdateDBACredentials(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	handler := &userRecordingHandler{DB: db, users: map[string]int{}}
+	db.Handler = handler
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+	db.AddQuery("select 1 from dual", &sqltypes.Result{})
+	ctx := context.Background()
+
+	_, err := mysqld.FetchSuperQuery(ctx, "select 1 from dual")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user1"}, mapKeys(handler.reset()))
+
+	// Hold a connection while the credentials are rotated.
+	inUse, err := mysqld.dbaPool.Get(ctx)
+	require.NoError(t, err)
+	handler.reset()
+
+	require.NoError(t, mysqld.UpdateDBACredentials(ctx, "user2", "password2"))
+	assert.Equal(t, "user2", mysqld.dbConfigs().Dba.User)
+	params, err := mysqld.dbConfigs().DbaConnector().MysqlParams()
+	require.NoError(t, err)
+	assert.Equal(t, "user2", params.Uname)
+	assert.Equal(t, "password2", params.Pass)
+
+	// The idle connection is reopened with the new credentials.
+	_, err = mysqld.FetchSuperQuery(ctx, "select 1 from dual")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user2"}, mapKeys(handler.reset()))
+
+	// The connection that was in use is closed when it is recycled.
+	inUse.Recycle()
+	assert.True(t, inUse.IsClosed())
+	for i := 0; i < 2; i++ {
+		_, err = mysqld.FetchSuperQuery(ctx, "select 1 from dual")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"user2"}, mapKeys(handler.reset()))
+
+	err = mysqld.UpdateDBACredentials(ctx, "", "password3")
+	require.Error(t, err)
+	assert.Equal(t, "user2", mysqld.dbConfigs().Dba.User)
+}
+
+func mapKeys(m map[string]int) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"vitess.io/vitess/go/sqltypes"
+	"vitess.io/vitess/go/vt/log"
+)
+
+// ConnInfo describes a server-side connection, as reported by
+// information_schema.processlist.
+type ConnInfo struct {
+	ID      int64
+	User    string
+	Host    string
+	DB      string
+	Command string
+	Time    time.Duration
+	State   string
+}
+
+const sleepingConnectionsQuery = "SELECT ID, USER, HOST, DB, COMMAND, TIME, STATE FROM information_schema.processlist WHERE COMMAND = 'Sleep' AND ID != CONNECTION_ID()"
+
+// FindOrphanedConnections returns the connections opened by the DBA user that
+// have been sleeping for at least olderThan. Connections are matched on the
+// user only: HOST is the client address of each connection, which includes
+// the ephemeral port for TCP connections, so it can't identify this instance.
+//
+// When a query times out, executeFetchContext kills the server-side thread and
+// closes the connection, but a kill racing with the query completion can leave
+// the thread behind. This lets operators find such leaked connections.
+func (mysqld *Mysqld) FindOrphanedConnections(ctx context.Context, olderThan time.Duration) ([]ConnInfo, error) {
+	params, err := mysqld.dbConfigs().DbaConnector().MysqlParams()
+	if err != nil {
+		return nil, err
+	}
+	qr, err := mysqld.FetchSuperQuery(ctx, sleepingConnectionsQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphaned []ConnInfo
+	for _, row := range qr.Named().Rows {
+		conn := parseConnInfo(row)
+		if conn.User != params.Uname || conn.Time < olderThan {
+			continue
+		}
+		orphaned = append(orphaned, conn)
+	}
+	return orphaned, nil
+}
+
+const activeQueriesQuery = "SELECT ID, USER, HOST, DB, COMMAND, TIME, STATE FROM information_schema.processlist WHERE COMMAND NOT IN ('Sleep', 'Daemon', 'Binlog Dump', 'Binlog Dump GTID') AND USER NOT IN ('system user', 'event_scheduler') AND ID != CONNECTION_ID()"
+
+// quiescePollInterval is how often Quiesce checks for active queries.
+var quiescePollInterval = 500 * time.Millisecond
+
+// QuiesceTimeoutError is returned by Quiesce when queries are still running
+// after maxWait.
+type QuiesceTimeoutError struct {
+	Running int
+}
+
+// Error is part of the error interface.
+func (e *QuiesceTimeoutError) Error() string {
+	return fmt.Sprintf("%d queries still running after quiesce timeout", e.Running)
+}
+
+// Quiesce prepares mysqld for a shutdown: it sets it read-only, so that no
+// new writes are accepted, then waits until the queries of the users drain,
+// ignoring idle connections and the threads of mysqld and replication. It
+// returns a *QuiesceTimeoutError if queries are still running after maxWait.
+//
+// The read_only state before the first Quiesce is recorded, so that
+// Unquiesce can restore it, e.g. if the maintenance is called off.
+func (mysqld *Mysqld) Quiesce(ctx context.Context, maxWait time.Duration) error {
+	if err := mysqld.setReadOnlyForQuiesce(); err != nil {
+		return err
+	}
+
+	timeout := time.NewTimer(maxWait)
+	defer timeout.Stop()
+	ticker := time.NewTicker(quiescePollInterval)
+	defer ticker.Stop()
+	for {
+		qr, err := mysqld.FetchSuperQuery(ctx, activeQueriesQuery)
+		if err != nil {
+			return err
+		}
+		if len(qr.Rows) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return &QuiesceTimeoutError{Running: len(qr.Rows)}
+		case <-ticker.C:
+		}
+	}
+}
+
+// setReadOnlyForQuiesce sets mysqld read-only and records its previous
+// read_only state, unless it's already quiesced.
+func (mysqld *Mysqld) setReadOnlyForQuiesce() error {
+	mysqld.quiesceMu.Lock()
+	defer mysqld.quiesceMu.Unlock()
+
+	if mysqld.readOnlyBeforeQuiesce != nil {
+		return nil
+	}
+	readOnly, err := mysqld.IsReadOnly()
+	if err != nil {
+		return err
+	}
+	if !readOnly {
+		if err := mysqld.SetReadOnly(true); err != nil {
+			return err
+		}
+	}
+	mysqld.readOnlyBeforeQuiesce = &readOnly
+	return nil
+}
+
+// Unquiesce restores the read_only state recorded by Quiesce. It does
+// nothing if mysqld isn't quiesced.
+func (mysqld *Mysqld) Unquiesce() error {
+	mysqld.quiesceMu.Lock()
+	defer mysqld.quiesceMu.Unlock()
+
+	if mysqld.readOnlyBeforeQuiesce == nil {
+		return nil
+	}
+	if !*mysqld.readOnlyBeforeQuiesce {
+		if err := mysqld.SetReadOnly(false); err != nil {
+			return err
+		}
+	}
+	mysqld.readOnlyBeforeQuiesce = nil
+	return nil
+}
+
+// TxnInfo describes an open InnoDB transaction, as reported by
+// information_schema.innodb_trx, and its connection.
+type TxnInfo struct {
+	ID     string
+	ConnID int64
+	User   string
+	Host   string
+	DB     string
+	// Idle is how long the connection has been sleeping, i.e. how long the
+	// transaction has been idle.
+	Idle         time.Duration
+	RowsLocked   int64
+	RowsModified int64
+}
+
+const idleTransactionsQuery = "SELECT trx.trx_id, trx.trx_mysql_thread_id, trx.trx_rows_locked, trx.trx_rows_modified, p.USER, p.HOST, p.DB, p.TIME FROM information_schema.innodb_trx AS trx JOIN information_schema.processlist AS p ON p.ID = trx.trx_mysql_thread_id WHERE p.COMMAND = 'Sleep' AND p.ID != CONNECTION_ID()"
+
+// FindIdleTransactions returns the open transactions whose connection has
+// been sleeping for at least idleFor, i.e. that were left open between two
+// statements. Such transactions keep their locks, and the undo log can't be
+// purged past their snapshot.
+func (mysqld *Mysqld) FindIdleTransactions(ctx context.Context, idleFor time.Duration) ([]TxnInfo, error) {
+	qr, err := mysqld.FetchSuperQuery(ctx, idleTransactionsQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var idle []TxnInfo
+	for _, row := range qr.Named().Rows {
+		txn := TxnInfo{
+			ID:           row.AsString("trx_id", ""),
+			ConnID:       row.AsInt64("trx_mysql_thread_id", 0),
+			User:         row.AsString("USER", ""),
+			Host:         row.AsString("HOST", ""),
+			DB:           row.AsString("DB", ""),
+			Idle:         time.Duration(row.AsInt64("TIME", 0)) * time.Second,
+			RowsLocked:   row.AsInt64("trx_rows_locked", 0),
+			RowsModified: row.AsInt64("trx_rows_modified", 0),
+		}
+		if txn.Idle < idleFor {
+			continue
+		}
+		idle = append(idle, txn)
+	}
+	return idle, nil
+}
+
+// KillIdleTransactions kills the connections of the transactions returned by
+// FindIdleTransactions, which rolls them back. It returns the transactions
+// whose connection was killed, and tries to kill all of them even if some
+// kills fail.
+func (mysqld *Mysqld) KillIdleTransactions(ctx context.Context, idleFor time.Duration) ([]TxnInfo, error) {
+	idle, err := mysqld.FindIdleTransactions(ctx, idleFor)
+	if err != nil {
+		return nil, err
+	}
+
+	var killed []TxnInfo
+	var errs []error
+	for _, txn := range idle {
+		log.Infof("Mysqld.KillIdleTransactions(): killing connID %v of transaction %v, idle for %v", txn.ConnID, txn.ID, txn.Idle)
+		if err := mysqld.killConnection(txn.ConnID); err != nil {
+			errs = append(errs, fmt.Errorf("cannot kill connID %v of transaction %v: %w", txn.ConnID, txn.ID, err))
+			continue
+		}
+		killed = append(killed, txn)
+	}
+	return killed, errors.Join(errs...)
+}
+
+func parseConnInfo(row sqltypes.RowNamedValues) ConnInfo {
+	return ConnInfo{
+		ID:      row.AsInt64("ID", 0),
+		User:    row.AsString("USER", ""),
+		Host:    row.AsString("HOST", ""),
+		DB:      row.AsString("DB", ""),
+		Command: row.AsString("COMMAND", ""),
+		Time:    time.Duration(row.AsInt64("TIME", 0)) * time.Second,
+		State:   row.AsString("STATE", ""),
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/mysql/fakesqldb"
+	"vitess.io/vitess/go/mysql/sqlerror"
+	"vitess.io/vitess/go/sqltypes"
+)
+
+func TestFindOrphanedConnections(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	db.AddQuery(sleepingConnectionsQuery, sqltypes.MakeTestResult(
+		sqltypes.MakeTestFields("ID|USER|HOST|DB|COMMAND|TIME|STATE", "int64|varchar|varchar|varchar|varchar|int64|varchar"),
+		"1|user1|localhost:1234|vt_ks|Sleep|600|",
+		"2|user1|localhost:1235|vt_ks|Sleep|10|",
+		"3|vt_app|localhost:1236|vt_ks|Sleep|600|",
+		"4|user1|localhost:1237|null|Sleep|300|",
+	))
+
+	ctx := context.Background()
+	conns, err := mysqld.FindOrphanedConnections(ctx, 5*time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []ConnInfo{{
+		ID:      1,
+		User:    "user1",
+		Host:    "localhost:1234",
+		DB:      "vt_ks",
+		Command: "Sleep",
+		Time:    10 * time.Minute,
+	}, {
+		ID:      4,
+		User:    "user1",
+		Host:    "localhost:1237",
+		DB:      "",
+		Command: "Sleep",
+		Time:    5 * time.Minute,
+	}}, conns)
+
+	conns, err = mysqld.FindOrphanedConnections(ctx, time.Hour)
+	require.NoError(t, err)
+	require.Empty(t, conns)
+}
+
+func TestQuiesce(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	defer func(interval time.Duration) { quiescePollInterval = interval }(quiescePollInterval)
+	quiescePollInterval = time.Millisecond
+
+	db.AddQuery("SHOW VARIABLES LIKE 'read_only'", sqltypes.MakeTestResult(sqltypes.MakeTestFields("Variable_name|Value", "varchar|varchar"), "read_only|OFF"))
+	db.AddQuery("SET GLOBAL read_only = ON", &sqltypes.Result{})
+	db.AddQuery("SET GLOBAL read_only = OFF", &sqltypes.Result{})
+	// One query finishes on every poll after the first one.
+	processlist := db.AddQuery(activeQueriesQuery, sqltypes.MakeTestResult(
+		sqltypes.MakeTestFields("ID|USER|HOST|DB|COMMAND|TIME|STATE", "int64|varchar|varchar|varchar|varchar|int64|varchar"),
+		"1|vt_app|localhost:1234|vt_ks|Query|1|executing",
+		"2|vt_app|localhost:1235|vt_ks|Query|2|executing",
+		"3|vt_app|localhost:1236|vt_ks|Execute|0|updating",
+	))
+	polls := 0
+	db.SetBeforeFunc(activeQueriesQuery, func() {
+		polls++
+		if polls > 1 {
+			processlist.Rows = processlist.Rows[1:]
+		}
+	})
+
+	ctx := context.Background()
+	require.NoError(t, mysqld.Quiesce(ctx, time.Minute))
+	require.Equal(t, 4, polls)
+	require.Equal(t, 1, db.GetQueryCalledNum("SET GLOBAL read_only = ON"))
+
+	require.NoError(t, mysqld.Unquiesce())
+	require.Equal(t, 1, db.GetQueryCalledNum("SET GLOBAL read_only = OFF"))
+	// Not quiesced anymore.
+	require.NoError(t, mysqld.Unquiesce())
+	require.Equal(t, 1, db.GetQueryCalledNum("SET GLOBAL read_only = OFF"))
+}
+
+func TestQuiesceTimeout(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	defer func(interval time.Duration) { quiescePollInterval = interval }(quiescePollInterval)
+	quiescePollInterval = time.Millisecond
+
+	db.AddQuery("SHOW VARIABLES LIKE 'read_only'", sqltypes.MakeTestResult(sqltypes.MakeTestFields("Variable_name|Value", "varchar|varchar"), "read_only|ON"))
+	db.AddQuery(activeQueriesQuery, sqltypes.MakeTestResult(
+		sqltypes.MakeTestFields("ID|USER|HOST|DB|COMMAND|TIME|STATE", "int64|varchar|varchar|varchar|varchar|int64|varchar"),
+		"1|vt_app|localhost:1234|vt_ks|Query|600|executing",
+		"2|vt_app|localhost:1235|vt_ks|Query|600|executing",
+	))
+
+	err := mysqld.Quiesce(context.Background(), 50*time.Millisecond)
+	var timeoutErr *QuiesceTimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	require.Equal(t, 2, timeoutErr.Running)
+	require.EqualError(t, err, "2 queries still running after quiesce timeout")
+
+	// mysqld was already read-only, so Unquiesce leaves it read-only.
+	require.NoError(t, mysqld.Unquiesce())
+	require.Zero(t, db.GetQueryCalledNum("SET GLOBAL read_only = OFF"))
+}
+
+var idleTransactionsResult = sqltypes.MakeTestResult(
+	sqltypes.MakeTestFields("trx_id|trx_mysql_thread_id|trx_rows_locked|trx_rows_modified|USER|HOST|DB|TIME", "varchar|int64|int64|int64|varchar|varchar|varchar|int64"),
+	"1301|7|3|1|vt_app|localhost:1234|vt_ks|600",
+	"1302|8|0|0|vt_app|localhost:1235|vt_ks|5",
+	"1303|9|12|12|vt_dba|localhost:1236|null|120",
+)
+
+func TestFindIdleTransactions(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	db.AddQuery(idleTransactionsQuery, idleTransactionsResult)
+
+	ctx := context.Background()
+	txns, err := mysqld.FindIdleTransactions(ctx, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []TxnInfo{{
+		ID:           "1301",
+		ConnID:       7,
+		User:         "vt_app",
+		Host:         "localhost:1234",
+		DB:           "vt_ks",
+		Idle:         10 * time.Minute,
+		RowsLocked:   3,
+		RowsModified: 1,
+	}, {
+		ID:           "1303",
+		ConnID:       9,
+		User:         "vt_dba",
+		Host:         "localhost:1236",
+		DB:           "",
+		Idle:         2 * time.Minute,
+		RowsLocked:   12,
+		RowsModified: 12,
+	}}, txns)
+
+	txns, err = mysqld.FindIdleTransactions(ctx, time.Hour)
+	require.NoError(t, err)
+	require.Empty(t, txns)
+}
+
+func TestKillIdleTransactions(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	db.AddQuery(idleTransactionsQuery, idleTransactionsResult)
+	db.AddQuery("kill 7", &sqltypes.Result{})
+	db.AddRejectedQuery("kill 9", sqlerror.NewSQLError(sqlerror.ERNoSuchThread, sqlerror.SSUnknownSQLState, "Unknown thread id: 9"))
+
+	killed, err := mysqld.KillIdleTransactions(context.Background(), time.Minute)
+	require.ErrorContains(t, err, "cannot kill connID 9 of transaction 1303")
+	require.Len(t, killed, 1)
+	require.Equal(t, int64(7), killed[0].ConnID)
+	require.Equal(t, 1, db.GetQueryCalledNum("kill 7"))
+	require.Equal(t, 1, db.GetQueryCalledNum("kill 9"))
+	require.Zero(t, db.GetQueryCalledNum("kill 8"))
+}
@@ -18,28 +18,57 @@ package mysqlctl
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
 	"vitess.io/vitess/go/mysql/sqlerror"
+	"vitess.io/vitess/go/pools"
 	"vitess.io/vitess/go/sqltypes"
 	"vitess.io/vitess/go/vt/dbconnpool"
 	"vitess.io/vitess/go/vt/log"
 )
 
+// defaultSuperQueryMaxRows is the maximum number of rows of the queries run
+// by FetchSuperQuery and ExecuteSuperQueryList.
+const defaultSuperQueryMaxRows = 10000
+
+var (
+	// ErrPoolAcquireTimeout is returned when no connection could be gotten
+	// from the pool in time, as opposed to ErrQueryTimeout.
+	ErrPoolAcquireTimeout = errors.New("timed out waiting for a connection from the pool")
+
+	// ErrQueryTimeout is returned when a query didn't complete in time, as
+	// opposed to ErrPoolAcquireTimeout.
+	ErrQueryTimeout = errors.New("query timed out")
+)
+
 // getPoolReconnect gets a connection from a pool, tests it, and reconnects if
-// the connection is lost.
+// the connection is lost. Getting the connection is bounded by
+// --dba_pool_acquire_timeout as well as by ctx, and timing out returns
+// ErrPoolAcquireTimeout.
 func getPoolReconnect(ctx context.Context, pool *dbconnpool.ConnectionPool) (*dbconnpool.PooledDBConnection, error) {
-	conn, err := pool.Get(ctx)
+	acquireCtx := ctx
+	if dbaPoolAcquireTimeout > 0 {
+		var cancel context.CancelFunc
+		acquireCtx, cancel = context.WithTimeout(ctx, dbaPoolAcquireTimeout)
+		defer cancel()
+	}
+	conn, err := pool.Get(acquireCtx)
 	if err != nil {
+		if errors.Is(err, pools.ErrTimeout) || errors.Is(err, pools.ErrCtxTimeout) || errors.Is(acquireCtx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w: %v", ErrPoolAcquireTimeout, err)
+		}
 		return conn, err
 	}
 	// Run a test query to see if this connection is still good.
 	if _, err := conn.ExecuteFetch("SELECT 1", 1, false); err != nil {
 		// If we get a connection error, try to reconnect.
 		if sqlErr, ok := err.(*sqlerror.SQLError); ok && (sqlErr.Number() == sqlerror.CRServerGone || sqlErr.Number() == sqlerror.CRServerLost) {
-			if err := conn.Reconnect(ctx); err != nil {
+			if err := conn.Reconnect(acquireCtx); err != nil {
 				conn.Recycle()
 				return nil, err
 			}
@@ -56,17 +85,116 @@ func (mysqld *Mysqld) ExecuteSuperQuery(ctx context.Context, query string) error
 	return mysqld.ExecuteSuperQueryList(ctx, []string{query})
 }
 
+// ExecuteSuperQueryRows executes a query as a super user, like
+// ExecuteSuperQuery, and returns the number of rows it affected, e.g. to
+// check how many rows an UPDATE or a DELETE changed.
+func (mysqld *Mysqld) ExecuteSuperQueryRows(ctx context.Context, query string) (uint64, error) {
+	conn, err := getPoolReconnect(ctx, mysqld.dbaPool)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Recycle()
+
+	log.Infof("exec %s", limitString(redactPassword(query), logQueryLengthLimit))
+	qr, err := mysqld.executeFetchContext(ctx, conn, query, defaultSuperQueryMaxRows, false)
+	if err != nil {
+		log.Errorf("ExecuteFetch(%v) failed: %v", redactPassword(query), redactPassword(err.Error()))
+		return 0, executeFetchError(query, err)
+	}
+	return qr.RowsAffected, nil
+}
+
 // ExecuteSuperQueryList alows the user to execute queries as a super user.
 func (mysqld *Mysqld) ExecuteSuperQueryList(ctx context.Context, queryList []string) error {
+	return mysqld.ExecuteSuperQueryListWithLimit(ctx, queryList, defaultSuperQueryMaxRows)
+}
+
+// ExecuteSuperQueryListWithLimit is like ExecuteSuperQueryList, but fails
+// any query that returns more than maxrows rows instead of more than
+// 10000. The rows are read in memory before being discarded, so a very large
+// limit risks running out of memory.
+func (mysqld *Mysqld) ExecuteSuperQueryListWithLimit(ctx context.Context, queryList []string, maxrows int) error {
 	conn, err := getPoolReconnect(ctx, mysqld.dbaPool)
 	if err != nil {
 		return err
 	}
 	defer conn.Recycle()
 
-	return mysqld.executeSuperQueryListConn(ctx, conn, queryList)
+	return mysqld.executeSuperQueryListConnWithLimit(ctx, conn, queryList, maxrows)
 }
 
+// ExecuteSuperQueryListInTransaction executes queries as a super user in a
+// single transaction, which is rolled back if any of them fails. Statements
+// that cause an implicit commit, such as DDLs, commit the queries before them
+// and can't be rolled back, so the list isn't atomic if it contains any.
+func (mysqld *Mysqld) ExecuteSuperQueryListInTransaction(ctx context.Context, queryList []string) error {
+	conn, err := getPoolReconnect(ctx, mysqld.dbaPool)
+	if err != nil {
+		return err
+	}
+	defer conn.Recycle()
+
+	queries := make([]string, 0, len(queryList)+2)
+	queries = append(queries, "BEGIN")
+	queries = append(queries, queryList...)
+	queries = append(queries, "COMMIT")
+	if err := mysqld.executeSuperQueryListConn(ctx, conn, queries); err != nil {
+		// Use another context, since ctx may be why the queries failed.
+		rollbackCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if rollbackErr := mysqld.executeSuperQueryListConn(rollbackCtx, conn, []string{"ROLLBACK"}); rollbackErr != nil {
+			// The connection may have been closed, which rolls back anyway.
+			log.Warningf("ExecuteSuperQueryListInTransaction failed to roll back: %v", rollbackErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// SuperQueryRetryableErrors are the MySQL error numbers on which
+// ExecuteSuperQueryListWithRetry retries the queries. They are transient
+// errors a query usually doesn't fail with when it's run again.
+var SuperQueryRetryableErrors = []sqlerror.ErrorCode{
+	sqlerror.ERLockDeadlock,
+	sqlerror.ERLockWaitTimeout,
+}
+
+// ExecuteSuperQueryListWithRetry is like ExecuteSuperQueryList, but runs the
+// queries again, up to maxRetries more times, as long as one of them fails
+// with one of SuperQueryRetryableErrors, waiting for backoff in between.
+// The whole list is run again from its first query, including the queries
+// that succeeded in the failed attempt, so they must be safe to run twice.
+// It stops retrying once ctx is done, and returns the error of the last
+// attempt.
+func (mysqld *Mysqld) ExecuteSuperQueryListWithRetry(ctx context.Context, queryList []string, maxRetries int, backoff time.Duration) error {
+	for attempt := 0; ; attempt++ {
+		err := mysqld.ExecuteSuperQueryList(ctx, queryList)
+		if err == nil || attempt >= maxRetries || !isRetryableSuperQueryError(err) {
+			return err
+		}
+		log.Warningf("ExecuteSuperQueryList failed on attempt %d of %d, retrying in %v: %v", attempt+1, maxRetries+1, backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// isRetryableSuperQueryError returns whether err, which may have been
+// formatted into another error, has one of the SuperQueryRetryableErrors.
+func isRetryableSuperQueryError(err error) bool {
+	sqlErr, ok := sqlerror.NewSQLErrorFromError(err).(*sqlerror.SQLError)
+	if !ok {
+		return false
+	}
+	return slices.Contains(SuperQueryRetryableErrors, sqlErr.Number())
+}
+
+// logQueryLengthLimit is the length the super queries are truncated to when
+// they are logged.
+const logQueryLengthLimit = 200
+
 func limitString(s string, limit int) string {
 	if len(s) > limit {
 		return s[:limit]
@@ -75,85 +203,153 @@ func limitString(s string, limit int) string {
 }
 
 func (mysqld *Mysqld) executeSuperQueryListConn(ctx context.Context, conn *dbconnpool.PooledDBConnection, queryList []string) error {
-	const LogQueryLengthLimit = 200
+	return mysqld.executeSuperQueryListConnWithLimit(ctx, conn, queryList, defaultSuperQueryMaxRows)
+}
+
+func (mysqld *Mysqld) executeSuperQueryListConnWithLimit(ctx context.Context, conn *dbconnpool.PooledDBConnection, queryList []string, maxrows int) error {
 	for _, query := range queryList {
-		log.Infof("exec %s", limitString(redactPassword(query), LogQueryLengthLimit))
-		if _, err := mysqld.executeFetchContext(ctx, conn, query, 10000, false); err != nil {
+		log.Infof("exec %s", limitString(redactPassword(query), logQueryLengthLimit))
+		if _, err := mysqld.executeFetchContext(ctx, conn, query, maxrows, false); err != nil {
 			log.Errorf("ExecuteFetch(%v) failed: %v", redactPassword(query), redactPassword(err.Error()))
-			return fmt.Errorf("ExecuteFetch(%v) failed: %v", redactPassword(query), redactPassword(err.Error()))
+			return executeFetchError(query, err)
 		}
 	}
 	return nil
 }
 
+// executeFetchError returns the error of running query, with the secrets of
+// both redacted. The timeouts and cancellations are wrapped instead, since
+// their messages don't contain the query, so that errors.Is still matches
+// ErrQueryTimeout, ErrPoolAcquireTimeout and the errors of the context.
+func executeFetchError(query string, err error) error {
+	if errors.Is(err, ErrQueryTimeout) || errors.Is(err, ErrPoolAcquireTimeout) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("ExecuteFetch(%v) failed: %w", redactPassword(query), err)
+	}
+	return fmt.Errorf("ExecuteFetch(%v) failed: %v", redactPassword(query), redactPassword(err.Error()))
+}
+
 // FetchSuperQuery returns the results of executing a query as a super user.
 func (mysqld *Mysqld) FetchSuperQuery(ctx context.Context, query string) (*sqltypes.Result, error) {
+	return mysqld.FetchSuperQueryWithLimit(ctx, query, defaultSuperQueryMaxRows)
+}
+
+// FetchSuperQueryWithLimit is like FetchSuperQuery, but fails if the query
+// returns more than maxrows rows instead of more than 10000. All the rows are
+// held in memory, so a very large limit risks running out of memory; use
+// StreamSuperQuery for large results instead.
+func (mysqld *Mysqld) FetchSuperQueryWithLimit(ctx context.Context, query string, maxrows int) (*sqltypes.Result, error) {
 	conn, connErr := getPoolReconnect(ctx, mysqld.dbaPool)
 	if connErr != nil {
 		return nil, connErr
 	}
 	defer conn.Recycle()
-	qr, err := mysqld.executeFetchContext(ctx, conn, query, 10000, true)
+	qr, err := mysqld.executeFetchContext(ctx, conn, query, maxrows, true)
 	if err != nil {
 		return nil, err
 	}
 	return qr, nil
 }
 
+// streamBufferSize is the number of bytes of rows StreamSuperQuery gathers
+// before passing them to its callback.
+const streamBufferSize = 32 * 1024
+
+// StreamSuperQuery executes a query as a super user and passes its results to
+// callback as they are read, instead of buffering them like FetchSuperQuery:
+// first a result with only the fields, then results with chunks of rows. If
+// callback returns an error, the query is stopped and the error returned.
+func (mysqld *Mysqld) StreamSuperQuery(ctx context.Context, query string, callback func(*sqltypes.Result) error) error {
+	conn, err := getPoolReconnect(ctx, mysqld.dbaPool)
+	if err != nil {
+		return err
+	}
+	defer conn.Recycle()
+	return mysqld.executeContext(ctx, conn, query, func() error {
+		return conn.ExecuteStreamFetch(query, callback, func() *sqltypes.Result {
+			return &sqltypes.Result{}
+		}, streamBufferSize)
+	})
+}
+
 // executeFetchContext calls ExecuteFetch() on the given connection,
 // while respecting Context deadline and cancellation.
 func (mysqld *Mysqld) executeFetchContext(ctx context.Context, conn *dbconnpool.PooledDBConnection, query string, maxrows int, wantfields bool) (*sqltypes.Result, error) {
+	var qr *sqltypes.Result
+	err := mysqld.executeContext(ctx, conn, query, func() (err error) {
+		qr, err = conn.ExecuteFetch(query, maxrows, wantfields)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return qr, nil
+}
+
+// executeContext calls execute, which runs query on the given connection,
+// while respecting Context deadline and cancellation: if ctx is done first,
+// the connection is killed to interrupt the query, and closed.
+func (mysqld *Mysqld) executeContext(ctx context.Context, conn *dbconnpool.PooledDBConnection, query string, execute func() error) error {
 	// Fast fail if context is done.
 	select {
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		return queryContextError(ctx)
 	default:
 	}
 
 	// Execute asynchronously so we can select on both it and the context.
-	var qr *sqltypes.Result
 	var executeErr error
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
 
-		qr, executeErr = conn.ExecuteFetch(query, maxrows, wantfields)
+		executeErr = execute()
 	}()
 
 	// Wait for either the query or the context to be done.
 	select {
 	case <-done:
-		return qr, executeErr
+		return executeErr
 	case <-ctx.Done():
 		// If both are done already, we may end up here anyway because select
 		// chooses among multiple ready channels pseudorandomly.
 		// Check the done channel and prefer that one if it's ready.
 		select {
 		case <-done:
-			return qr, executeErr
+			return executeErr
 		default:
 		}
 
 		// The context expired or was canceled.
-		// Try to kill the connection to effectively cancel the ExecuteFetch().
+		// Try to kill the connection to effectively cancel the query.
 		connID := conn.ID()
-		log.Infof("Mysqld.executeFetchContext(): killing connID %v due to timeout of query: %v", connID, query)
+		log.Infof("Mysqld.executeContext(): killing connID %v due to timeout of query: %v", connID, redactPassword(query))
 		if killErr := mysqld.killConnection(connID); killErr != nil {
 			// Log it, but go ahead and wait for the query anyway.
-			log.Warningf("Mysqld.executeFetchContext(): failed to kill connID %v: %v", connID, killErr)
+			log.Warningf("Mysqld.executeContext(): failed to kill connID %v: %v", connID, killErr)
 		}
-		// Wait for the conn.ExecuteFetch() call to return.
+		// Wait for the query to return.
 		<-done
 		// Close the connection. Upon Recycle() it will be thrown out.
 		conn.Close()
-		// ExecuteFetch() may have succeeded before we tried to kill it.
-		// If ExecuteFetch() had returned because we canceled it,
+		// The query may have succeeded before we tried to kill it.
+		// If it had returned because we canceled it,
 		// then executeErr would be an error like "MySQL has gone away".
 		if executeErr == nil {
-			return qr, executeErr
+			return nil
 		}
-		return nil, ctx.Err()
+		return queryContextError(ctx)
+	}
+}
+
+// queryContextError returns the error of ctx, which is done, wrapped in
+// ErrQueryTimeout if its deadline was exceeded.
+func queryContextError(ctx context.Context) error {
+	err := ctx.Err()
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("%w: %w", ErrQueryTimeout, err)
 	}
+	return err
 }
 
 // killConnection issues a MySQL KILL command for the given connection ID.
@@ -193,7 +389,16 @@ func (mysqld *Mysqld) killConnection(connID int64) error {
 // fetchVariables returns a map from MySQL variable names to variable value
 // for variables that match the given pattern.
 func (mysqld *Mysqld) fetchVariables(ctx context.Context, pattern string) (map[string]string, error) {
-	query := fmt.Sprintf("SHOW VARIABLES LIKE '%s'", pattern)
+	return mysqld.fetchVariablesQuery(ctx, fmt.Sprintf("SHOW VARIABLES LIKE '%s'", pattern))
+}
+
+// fetchGlobalVariables is like fetchVariables, but returns the global
+// values instead of the session ones.
+func (mysqld *Mysqld) fetchGlobalVariables(ctx context.Context, pattern string) (map[string]string, error) {
+	return mysqld.fetchVariablesQuery(ctx, fmt.Sprintf("SHOW GLOBAL VARIABLES LIKE '%s'", pattern))
+}
+
+func (mysqld *Mysqld) fetchVariablesQuery(ctx context.Context, query string) (map[string]string, error) {
 	qr, err := mysqld.FetchSuperQuery(ctx, query)
 	if err != nil {
 		return nil, err
@@ -226,31 +431,69 @@ func (mysqld *Mysqld) fetchStatuses(ctx context.Context, pattern string) (map[st
 	return varMap, nil
 }
 
-const (
-	masterPasswordStart = "  MASTER_PASSWORD = '"
-	masterPasswordEnd   = "',\n"
-	passwordStart       = " PASSWORD = '"
-	passwordEnd         = "'"
-)
+// passwordRegexp matches either what precedes a secret in a statement, up to
+// the quote that starts the secret, or the quote that starts any other string
+// literal or quoted identifier. What precedes a secret, in any letter case,
+// is a PASSWORD, MASTER_PASSWORD or SOURCE_PASSWORD option, SET PASSWORD, the
+// IDENTIFIED BY or IDENTIFIED WITH clause of CREATE USER and ALTER USER, or
+// the SET GLOBAL or SET PERSIST of a variable whose name contains PASSWORD or
+// SECRET, as SetGlobalVariable does.
+var passwordRegexp = regexp.MustCompile("(?i)" +
+	`(\b(?:(?:MASTER_|SOURCE_)?PASSWORD(?:\s+FOR\s+\S+)?\s*=\s*|IDENTIFIED\s+(?:WITH\s+\S+\s+)?(?:BY|AS)\s+|` +
+	`SET\s+(?:GLOBAL|PERSIST|PERSIST_ONLY)\s+[\w.]*(?:PASSWORD|SECRET)[\w.]*\s*=\s*))?` +
+	"(['\"`])")
 
+// redactPassword replaces every secret of a statement with '****', so that it
+// can be logged, and keeps the rest of the statement as is. The keywords are
+// only looked for outside of string literals and quoted identifiers, and only
+// as whole words. A secret whose closing quote is missing is left as is, along
+// with the rest of the statement.
 func redactPassword(input string) string {
-	i := strings.Index(input, masterPasswordStart)
-	// We have primary password in the query, try to redact it
-	if i != -1 {
-		j := strings.Index(input[i+len(masterPasswordStart):], masterPasswordEnd)
-		if j == -1 {
-			return input
+	var redacted strings.Builder
+	rest := input
+	for {
+		loc := passwordRegexp.FindStringSubmatchIndex(rest)
+		if loc == nil {
+			break
 		}
-		input = input[:i+len(masterPasswordStart)] + strings.Repeat("*", 4) + input[i+len(masterPasswordStart)+j:]
-	}
-	// We also check if we have any password keyword in the query
-	i = strings.Index(input, passwordStart)
-	if i == -1 {
-		return input
+		end := quotedStringEnd(rest[loc[1]:], rest[loc[4]])
+		if end == -1 {
+			break
+		}
+		// Keep everything up to the end of the literal, but the secret.
+		end += loc[1] + 1
+		if loc[2] == -1 {
+			redacted.WriteString(rest[:end])
+		} else {
+			redacted.WriteString(rest[:loc[1]])
+			redacted.WriteString(strings.Repeat("*", 4))
+			redacted.WriteByte(rest[loc[4]])
+		}
+		rest = rest[end:]
 	}
-	j := strings.Index(input[i+len(passwordStart):], passwordEnd)
-	if j == -1 {
-		return input
+	redacted.WriteString(rest)
+	return redacted.String()
+}
+
+// quotedStringEnd returns the index in s of the quote ending the string
+// literal or quoted identifier s is the inside of, or -1 if there is none.
+// Doubled quotes are skipped. So are quotes escaped with a backslash, but
+// only in string literals: a backslash is a plain character in a quoted
+// identifier.
+func quotedStringEnd(s string, quote byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			if i+1 < len(s) && s[i+1] == quote {
+				i++
+				continue
+			}
+			return i
+		}
 	}
-	return input[:i+len(passwordStart)] + strings.Repeat("*", 4) + input[i+len(passwordStart)+j:]
+	return -1
 }
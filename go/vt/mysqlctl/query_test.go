@@ -0,0 +1,336 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/mysql"
+	"vitess.io/vitess/go/mysql/fakesqldb"
+	"vitess.io/vitess/go/mysql/sqlerror"
+	"vitess.io/vitess/go/sqltypes"
+	"vitess.io/vitess/go/vt/dbconfigs"
+	"vitess.io/vitess/go/vt/dbconnpool"
+
+	querypb "vitess.io/vitess/go/vt/proto/query"
+)
+
+// newTestMysqld returns a Mysqld whose DBA pool is connected to db. It's
+// built by hand rather than with NewMysqld to skip flavor detection.
+func newTestMysqld(db *fakesqldb.DB) *Mysqld {
+	params, _ := db.ConnParams().MysqlParams()
+	mysqld := &Mysqld{
+		dbcfgs: dbconfigs.NewTestDBConfigs(*params, *params, "fakesqldb"),
+	}
+	mysqld.dbaPool = dbconnpool.NewConnectionPool("DbaConnPool", 2, DbaIdleTimeout, 0, 0)
+	mysqld.dbaPool.Open(mysqld.dbcfgs.DbaWithDB())
+	// getPoolReconnect checks every connection before using it.
+	db.AddQuery("SELECT 1", &sqltypes.Result{})
+	return mysqld
+}
+
+// killableHandler blocks slowQuery until it is killed, like mysqld does with
+// a KILL statement, and passes every other query to the fakesqldb.DB.
+type killableHandler struct {
+	*fakesqldb.DB
+	slowQuery string
+	killed    chan struct{}
+}
+
+func (h *killableHandler) HandleQuery(c *mysql.Conn, query string, callback func(*sqltypes.Result) error) error {
+	switch {
+	case query == h.slowQuery:
+		<-h.killed
+		return sqlerror.NewSQLError(sqlerror.ERQueryInterrupted, sqlerror.SSUnknownSQLState, "Query execution was interrupted")
+	case strings.HasPrefix(query, "kill "):
+		close(h.killed)
+		return callback(&sqltypes.Result{})
+	}
+	return h.DB.HandleQuery(c, query, callback)
+}
+
+func TestFetchSuperQueryPoolAcquireTimeout(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+	db.AddQuery("select 1 from dual", &sqltypes.Result{})
+
+	// Use up the whole pool.
+	for i := 0; i < 2; i++ {
+		conn, err := mysqld.dbaPool.Get(context.Background())
+		require.NoError(t, err)
+		defer conn.Recycle()
+	}
+
+	defer func(timeout time.Duration) { dbaPoolAcquireTimeout = timeout }(dbaPoolAcquireTimeout)
+	dbaPoolAcquireTimeout = 10 * time.Millisecond
+
+	// The acquisition times out long before the query deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := mysqld.FetchSuperQuery(ctx, "select 1 from dual")
+	require.ErrorIs(t, err, ErrPoolAcquireTimeout)
+	require.NotErrorIs(t, err, ErrQueryTimeout)
+
+	// Without --dba_pool_acquire_timeout the deadline of the query applies.
+	dbaPoolAcquireTimeout = 0
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = mysqld.FetchSuperQuery(ctx, "select 1 from dual")
+	require.ErrorIs(t, err, ErrPoolAcquireTimeout)
+}
+
+func TestFetchSuperQueryQueryTimeout(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	db.Handler = &killableHandler{DB: db, slowQuery: "select sleep(60) from dual", killed: make(chan struct{})}
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	defer func(timeout time.Duration) { dbaPoolAcquireTimeout = timeout }(dbaPoolAcquireTimeout)
+	dbaPoolAcquireTimeout = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := mysqld.FetchSuperQuery(ctx, "select sleep(60) from dual")
+	require.ErrorIs(t, err, ErrQueryTimeout)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NotErrorIs(t, err, ErrPoolAcquireTimeout)
+}
+
+func TestExecuteSuperQueryQueryTimeout(t *testing.T) {
+	execs := map[string]func(ctx context.Context, mysqld *Mysqld, query string) error{
+		"ExecuteSuperQuery": func(ctx context.Context, mysqld *Mysqld, query string) error {
+			return mysqld.ExecuteSuperQuery(ctx, query)
+		},
+		"ExecuteSuperQueryRows": func(ctx context.Context, mysqld *Mysqld, query string) error {
+			_, err := mysqld.ExecuteSuperQueryRows(ctx, query)
+			return err
+		},
+	}
+	for name, exec := range execs {
+		t.Run(name, func(t *testing.T) {
+			db := fakesqldb.New(t)
+			defer db.Close()
+			db.Handler = &killableHandler{DB: db, slowQuery: "select sleep(60) from dual", killed: make(chan struct{})}
+			mysqld := newTestMysqld(db)
+			defer mysqld.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			err := exec(ctx, mysqld, "select sleep(60) from dual")
+			require.ErrorIs(t, err, ErrQueryTimeout)
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+			require.NotErrorIs(t, err, ErrPoolAcquireTimeout)
+			require.ErrorContains(t, err, "ExecuteFetch(select sleep(60) from dual) failed")
+		})
+	}
+}
+
+func TestStreamSuperQuery(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	const query = "select id from t"
+	want := sqltypes.MakeTestResult(sqltypes.MakeTestFields("id", "int64"), "1", "2", "3")
+	db.AddQuery(query, want)
+
+	var fields []*querypb.Field
+	var rows [][]sqltypes.Value
+	err := mysqld.StreamSuperQuery(context.Background(), query, func(qr *sqltypes.Result) error {
+		if qr.Fields != nil {
+			fields = qr.Fields
+		}
+		rows = append(rows, qr.Rows...)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, fields, 1)
+	require.Equal(t, "id", fields[0].Name)
+	require.Equal(t, want.Rows, rows)
+
+	// An error of the callback stops the query.
+	errStop := errors.New("stop")
+	err = mysqld.StreamSuperQuery(context.Background(), query, func(qr *sqltypes.Result) error {
+		return errStop
+	})
+	require.ErrorContains(t, err, errStop.Error())
+}
+
+func TestStreamSuperQueryQueryTimeout(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	db.Handler = &killableHandler{DB: db, slowQuery: "select sleep(60) from dual", killed: make(chan struct{})}
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := mysqld.StreamSuperQuery(ctx, "select sleep(60) from dual", func(*sqltypes.Result) error {
+		return nil
+	})
+	require.ErrorIs(t, err, ErrQueryTimeout)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// flakyHandler fails the first failures runs of failingQuery with err, and
+// passes every other query to the fakesqldb.DB.
+type flakyHandler struct {
+	*fakesqldb.DB
+	failingQuery string
+	failures     int
+	err          error
+	runs         atomic.Int64
+}
+
+func (h *flakyHandler) HandleQuery(c *mysql.Conn, query string, callback func(*sqltypes.Result) error) error {
+	if query == h.failingQuery && h.runs.Add(1) <= int64(h.failures) {
+		return h.err
+	}
+	return h.DB.HandleQuery(c, query, callback)
+}
+
+func TestExecuteSuperQueryListWithRetry(t *testing.T) {
+	deadlock := sqlerror.NewSQLError(sqlerror.ERLockDeadlock, sqlerror.SSLockDeadlock, "Deadlock found when trying to get lock")
+	tcases := []struct {
+		name     string
+		failures int
+		err      error
+		runs     int64
+		wantErr  bool
+	}{
+		{name: "no failure", failures: 0, err: deadlock, runs: 1},
+		{name: "deadlocks", failures: 2, err: deadlock, runs: 3},
+		{name: "lock wait timeout", failures: 1, err: sqlerror.NewSQLError(sqlerror.ERLockWaitTimeout, sqlerror.SSUnknownSQLState, "Lock wait timeout exceeded"), runs: 2},
+		{name: "too many failures", failures: 5, err: deadlock, runs: 3, wantErr: true},
+		{name: "not retryable", failures: 1, err: sqlerror.NewSQLError(sqlerror.ERNoSuchTable, sqlerror.SSUnknownTable, "Table 'missing' doesn't exist"), runs: 1, wantErr: true},
+	}
+	for _, tcase := range tcases {
+		t.Run(tcase.name, func(t *testing.T) {
+			db := fakesqldb.New(t)
+			defer db.Close()
+			handler := &flakyHandler{DB: db, failingQuery: "update t set a = 1", failures: tcase.failures, err: tcase.err}
+			db.Handler = handler
+			mysqld := newTestMysqld(db)
+			defer mysqld.Close()
+			db.AddQuery("begin", &sqltypes.Result{})
+			db.AddQuery("update t set a = 1", &sqltypes.Result{})
+			db.AddQuery("commit", &sqltypes.Result{})
+
+			err := mysqld.ExecuteSuperQueryListWithRetry(context.Background(), []string{"begin", "update t set a = 1", "commit"}, 2, time.Millisecond)
+			if tcase.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tcase.runs, handler.runs.Load())
+		})
+	}
+}
+
+func TestExecuteSuperQueryListWithRetryContext(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	handler := &flakyHandler{
+		DB:           db,
+		failingQuery: "update t set a = 1",
+		failures:     100,
+		err:          sqlerror.NewSQLError(sqlerror.ERLockDeadlock, sqlerror.SSLockDeadlock, "Deadlock found when trying to get lock"),
+	}
+	db.Handler = handler
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	// The deadline expires during the first backoff.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := mysqld.ExecuteSuperQueryListWithRetry(ctx, []string{"update t set a = 1"}, 100, time.Minute)
+	require.ErrorContains(t, err, "Deadlock")
+	require.Equal(t, int64(1), handler.runs.Load())
+}
+
+func TestSuperQueryWithLimit(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	const query = "select id from t"
+	db.AddQuery(query, sqltypes.MakeTestResult(sqltypes.MakeTestFields("id", "int64"), "1", "2", "3"))
+
+	qr, err := mysqld.FetchSuperQueryWithLimit(context.Background(), query, 3)
+	require.NoError(t, err)
+	require.Len(t, qr.Rows, 3)
+	_, err = mysqld.FetchSuperQueryWithLimit(context.Background(), query, 2)
+	require.ErrorContains(t, err, "Row count exceeded")
+
+	require.NoError(t, mysqld.ExecuteSuperQueryListWithLimit(context.Background(), []string{query}, 3))
+	require.ErrorContains(t, mysqld.ExecuteSuperQueryListWithLimit(context.Background(), []string{query}, 2), "Row count exceeded")
+}
+
+func TestExecuteSuperQueryRows(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	db.AddQuery("update t set a = 1 where b = 2", &sqltypes.Result{RowsAffected: 3})
+	rows, err := mysqld.ExecuteSuperQueryRows(context.Background(), "update t set a = 1 where b = 2")
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), rows)
+
+	db.AddRejectedQuery("delete from missing", sqlerror.NewSQLError(sqlerror.ERNoSuchTable, sqlerror.SSUnknownTable, "Table 'missing' doesn't exist"))
+	_, err = mysqld.ExecuteSuperQueryRows(context.Background(), "delete from missing")
+	require.ErrorContains(t, err, "doesn't exist")
+}
+
+func TestExecuteSuperQueryListInTransaction(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+	db.AddQuery("BEGIN", &sqltypes.Result{})
+	db.AddQuery("COMMIT", &sqltypes.Result{})
+	db.AddQuery("ROLLBACK", &sqltypes.Result{})
+	db.AddQuery("update t set a = 1", &sqltypes.Result{})
+	db.AddQuery("update u set b = 2", &sqltypes.Result{})
+	db.AddRejectedQuery("update missing set c = 3", sqlerror.NewSQLError(sqlerror.ERNoSuchTable, sqlerror.SSUnknownTable, "Table 'missing' doesn't exist"))
+
+	err := mysqld.ExecuteSuperQueryListInTransaction(context.Background(), []string{"update t set a = 1", "update u set b = 2"})
+	require.NoError(t, err)
+	require.Equal(t, 1, db.GetQueryCalledNum("BEGIN"))
+	require.Equal(t, 1, db.GetQueryCalledNum("COMMIT"))
+	require.Equal(t, 0, db.GetQueryCalledNum("ROLLBACK"))
+
+	// The failed query stops the list, and the transaction is rolled back.
+	err = mysqld.ExecuteSuperQueryListInTransaction(context.Background(), []string{"update t set a = 1", "update missing set c = 3", "update u set b = 2"})
+	require.ErrorContains(t, err, "doesn't exist")
+	require.Equal(t, 2, db.GetQueryCalledNum("BEGIN"))
+	require.Equal(t, 1, db.GetQueryCalledNum("COMMIT"))
+	require.Equal(t, 1, db.GetQueryCalledNum("ROLLBACK"))
+	require.Equal(t, 1, db.GetQueryCalledNum("update u set b = 2"))
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"vitess.io/vitess/go/vt/sqlparser"
+)
+
+// ErrNotReadOnly is returned by BenchmarkQuery for a query that could modify
+// data.
+var ErrNotReadOnly = errors.New("query is not read-only")
+
+// LatencyStats summarizes the latencies of the successful runs of a query.
+// The percentiles use the nearest-rank method, so they are always one of the
+// measured latencies.
+type LatencyStats struct {
+	// Samples is the number of successful runs the latencies are computed
+	// from.
+	Samples int
+	// Errors is the number of runs that failed.
+	Errors int
+
+	Min time.Duration
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// BenchmarkQuery runs a read-only query the given number of times through
+// FetchSuperQuery, one run after the other, and returns the statistics of
+// their latencies. The runs that fail are counted but don't stop the
+// benchmark. If ctx is done before the last run, BenchmarkQuery returns the
+// statistics of the runs so far along with the error of ctx.
+func (mysqld *Mysqld) BenchmarkQuery(ctx context.Context, query string, iterations int) (*LatencyStats, error) {
+	if iterations <= 0 {
+		return nil, fmt.Errorf("iterations must be positive, got %d", iterations)
+	}
+	if !isReadOnlyQuery(query) {
+		return nil, fmt.Errorf("%w: %s", ErrNotReadOnly, query)
+	}
+
+	var (
+		latencies []time.Duration
+		errCount  int
+	)
+	for i := 0; i < iterations; i++ {
+		if err := ctx.Err(); err != nil {
+			return newLatencyStats(latencies, errCount), err
+		}
+		start := time.Now()
+		_, err := mysqld.FetchSuperQuery(ctx, query)
+		latency := time.Since(start)
+		if err != nil {
+			if ctx.Err() != nil {
+				// The run was interrupted, so it doesn't count.
+				return newLatencyStats(latencies, errCount), ctx.Err()
+			}
+			errCount++
+			continue
+		}
+		latencies = append(latencies, latency)
+	}
+	return newLatencyStats(latencies, errCount), nil
+}
+
+func newLatencyStats(latencies []time.Duration, errCount int) *LatencyStats {
+	stats := &LatencyStats{Samples: len(latencies), Errors: errCount}
+	if len(latencies) == 0 {
+		return stats
+	}
+	slices.Sort(latencies)
+	percentile := func(p int) time.Duration {
+		// The nearest rank is ceil(p/100 * n), counting from 1.
+		rank := (p*len(latencies) + 99) / 100
+		return latencies[max(rank, 1)-1]
+	}
+	stats.Min = latencies[0]
+	stats.P50 = percentile(50)
+	stats.P90 = percentile(90)
+	stats.P99 = percentile(99)
+	stats.Max = latencies[len(latencies)-1]
+	return stats
+}
+
+// isReadOnlyQuery returns whether a query only reads data: a SELECT that
+// neither locks rows nor writes to a file, a SHOW, or an EXPLAIN of such a
+// SELECT. Queries that can't be parsed are not read-only.
+func isReadOnlyQuery(query string) bool {
+	stmt, err := sqlparser.Parse(query)
+	if err != nil {
+		return false
+	}
+	return isReadOnlyStatement(stmt)
+}
+
+func isReadOnlyStatement(stmt sqlparser.Statement) bool {
+	switch stmt := stmt.(type) {
+	case sqlparser.SelectStatement:
+		readOnly := true
+		_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+			switch node := node.(type) {
+			case *sqlparser.Select:
+				if node.Lock != sqlparser.NoLock || node.Into != nil {
+					readOnly = false
+				}
+			case *sqlparser.Union:
+				if node.Lock != sqlparser.NoLock || node.Into != nil {
+					readOnly = false
+				}
+			}
+			return readOnly, nil
+		}, stmt)
+		return readOnly
+	case *sqlparser.Show, *sqlparser.ExplainTab:
+		return true
+	case *sqlparser.ExplainStmt:
+		// EXPLAIN ANALYZE runs the statement.
+		return isReadOnlyStatement(stmt.Statement)
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/mysql/fakesqldb"
+	"vitess.io/vitess/go/mysql/sqlerror"
+	"vitess.io/vitess/go/sqltypes"
+)
+
+func TestBenchmarkQuery(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	// The nth run takes at least (n%10 + 1) milliseconds.
+	const query = "select * from t"
+	var runs atomic.Int64
+	db.AddQuery(query, &sqltypes.Result{}).BeforeFunc = func() {
+		time.Sleep(time.Duration(runs.Add(1)%10+1) * time.Millisecond)
+	}
+
+	stats, err := mysqld.BenchmarkQuery(context.Background(), query, 20)
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), runs.Load())
+	assert.Equal(t, 20, stats.Samples)
+	assert.Equal(t, 0, stats.Errors)
+	// The sorted latencies are at least 1, 1, 2, 2, ..., 10, 10 milliseconds.
+	assert.GreaterOrEqual(t, stats.Min, 1*time.Millisecond)
+	assert.GreaterOrEqual(t, stats.P50, 5*time.Millisecond)
+	assert.GreaterOrEqual(t, stats.P90, 9*time.Millisecond)
+	assert.GreaterOrEqual(t, stats.P99, 10*time.Millisecond)
+	assert.LessOrEqual(t, stats.Min, stats.P50)
+	assert.LessOrEqual(t, stats.P50, stats.P90)
+	assert.LessOrEqual(t, stats.P90, stats.P99)
+	assert.Equal(t, stats.P99, stats.Max)
+}
+
+func TestBenchmarkQueryErrors(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	const query = "select * from missing"
+	db.AddRejectedQuery(query, sqlerror.NewSQLError(sqlerror.ERNoSuchTable, sqlerror.SSUnknownTable, "Table 'missing' doesn't exist"))
+
+	stats, err := mysqld.BenchmarkQuery(context.Background(), query, 3)
+	require.NoError(t, err)
+	assert.Equal(t, &LatencyStats{Errors: 3}, stats)
+}
+
+func TestBenchmarkQueryCanceled(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const query = "select 1 from dual"
+	var runs atomic.Int64
+	db.AddQuery(query, &sqltypes.Result{}).BeforeFunc = func() {
+		if runs.Add(1) == 3 {
+			cancel()
+		}
+	}
+
+	stats, err := mysqld.BenchmarkQuery(ctx, query, 10)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, int64(3), runs.Load())
+	// The third run is counted if it completed before the cancellation was
+	// noticed.
+	assert.Contains(t, []int{2, 3}, stats.Samples)
+	assert.Equal(t, 0, stats.Errors)
+}
+
+func TestBenchmarkQueryNotReadOnly(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	for _, query := range []string{
+		"delete from t",
+		"update t set a = 1",
+		"insert into t values (1)",
+		"select * from t for update",
+		"select * from t where a in (select a from u lock in share mode)",
+		"select * from t into outfile '/tmp/t'",
+		"explain analyze delete from t",
+		"drop table t",
+		"not a query",
+	} {
+		_, err := mysqld.BenchmarkQuery(context.Background(), query, 1)
+		assert.ErrorIs(t, err, ErrNotReadOnly, query)
+	}
+
+	_, err := mysqld.BenchmarkQuery(context.Background(), "select 1 from dual", 0)
+	assert.Error(t, err)
+}
+
+func TestIsReadOnlyQuery(t *testing.T) {
+	for _, query := range []string{
+		"select * from t",
+		"select a from t union select b from u",
+		"select * from t where a in (select a from u)",
+		"show tables",
+		"explain select * from t",
+		"describe t",
+	} {
+		assert.True(t, isReadOnlyQuery(query), query)
+	}
+}
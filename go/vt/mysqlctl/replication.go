@@ -416,6 +416,35 @@ func (mysqld *Mysqld) GetGTIDPurged(ctx context.Context) (replication.Position,
 	return conn.GetGTIDPurged()
 }
 
+// ReplicationLagGTID returns how many transactions of the given primary GTID set
+// have not been executed on this server yet. Unlike Seconds_Behind_Master, it is
+// also meaningful when replication is stopped or catching up. It returns an error
+// if this server has executed transactions that are not in primaryGTID, since the
+// lag is meaningless once the two servers have diverged.
+func (mysqld *Mysqld) ReplicationLagGTID(ctx context.Context, primaryGTID string) (behindCount int64, err error) {
+	primarySet, err := replication.ParseMysql56GTIDSet(primaryGTID)
+	if err != nil {
+		return 0, err
+	}
+	vars, err := mysqld.fetchVariables(ctx, "gtid_executed")
+	if err != nil {
+		return 0, err
+	}
+	executed, ok := vars["gtid_executed"]
+	if !ok {
+		return 0, errors.New("gtid_executed not found")
+	}
+	executedSet, err := replication.ParseMysql56GTIDSet(executed)
+	if err != nil {
+		return 0, err
+	}
+
+	if diverged := executedSet.Difference(primarySet); len(diverged) > 0 {
+		return 0, fmt.Errorf("server has executed transactions not in the primary GTID set: %v", diverged)
+	}
+	return primarySet.Difference(executedSet).Count(), nil
+}
+
 // PrimaryPosition returns the primary replication position.
 func (mysqld *Mysqld) PrimaryPosition() (replication.Position, error) {
 	conn, err := getPoolReconnect(context.TODO(), mysqld.dbaPool)
@@ -444,7 +473,7 @@ func (mysqld *Mysqld) SetReplicationPosition(ctx context.Context, pos replicatio
 // SetReplicationSource makes the provided host / port the primary. It optionally
 // stops replication before, and starts it after.
 func (mysqld *Mysqld) SetReplicationSource(ctx context.Context, host string, port int32, stopReplicationBefore bool, startReplicationAfter bool) error {
-	params, err := mysqld.dbcfgs.ReplConnector().MysqlParams()
+	params, err := mysqld.dbConfigs().ReplConnector().MysqlParams()
 	if err != nil {
 		return err
 	}
@@ -17,7 +17,13 @@ limitations under the License.
 package mysqlctl
 
 import (
+	"context"
 	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/mysql/fakesqldb"
+	"vitess.io/vitess/go/sqltypes"
 )
 
 func testRedacted(t *testing.T, source, expected string) {
@@ -79,4 +85,191 @@ func TestRedactPassword(t *testing.T) {
   MASTER_PASSWORD = '****',
   PASSWORD = '****'
 `)
+
+	// two passwords
+	testRedacted(t, `START xxx USER = 'a', PASSWORD = 'AAA'; START yyy USER = 'b', PASSWORD = 'BBB'`,
+		`START xxx USER = 'a', PASSWORD = '****'; START yyy USER = 'b', PASSWORD = '****'`)
+
+	// three passwords, the last one without an end match
+	testRedacted(t, `START xxx PASSWORD = 'AAA'; START yyy PASSWORD = 'BBB'; START zzz PASSWORD = 'CCC`,
+		`START xxx PASSWORD = '****'; START yyy PASSWORD = '****'; START zzz PASSWORD = 'CCC`)
+
+	// three passwords of different kinds
+	testRedacted(t, `CHANGE MASTER TO
+  MASTER_PASSWORD = 'AAA',
+  MASTER_CONNECT_RETRY = 1
+;
+START xxx PASSWORD = 'BBB'; CREATE USER 'c'@'%' IDENTIFIED BY 'CCC'`,
+		`CHANGE MASTER TO
+  MASTER_PASSWORD = '****',
+  MASTER_CONNECT_RETRY = 1
+;
+START xxx PASSWORD = '****'; CREATE USER 'c'@'%' IDENTIFIED BY '****'`)
+}
+
+func TestRedactPasswordCase(t *testing.T) {
+	// upper case
+	testRedacted(t, `CHANGE REPLICATION SOURCE TO SOURCE_USER = 'vt_repl', SOURCE_PASSWORD = 'AAA'`,
+		`CHANGE REPLICATION SOURCE TO SOURCE_USER = 'vt_repl', SOURCE_PASSWORD = '****'`)
+
+	// lower case
+	testRedacted(t, `start xxx user = 'vt_repl', password = 'AAA'`,
+		`start xxx user = 'vt_repl', password = '****'`)
+	testRedacted(t, `change master to master_password = 'AAA', master_connect_retry = 1`,
+		`change master to master_password = '****', master_connect_retry = 1`)
+
+	// mixed case
+	testRedacted(t, `Start xxx User = 'vt_repl', PassWord = 'AAA', Master_Password = 'BBB', Source_PASSWORD='CCC'`,
+		`Start xxx User = 'vt_repl', PassWord = '****', Master_Password = '****', Source_PASSWORD='****'`)
+
+	// identifiers that contain the keyword
+	testRedacted(t, `UPDATE users SET old_password = 'AAA', passwords = 'BBB', mypassword = 'CCC'`,
+		`UPDATE users SET old_password = 'AAA', passwords = 'BBB', mypassword = 'CCC'`)
+	testRedacted(t, "UPDATE users SET `password = ` = 'AAA'",
+		"UPDATE users SET `password = ` = 'AAA'")
+
+	// string literals that contain the keyword
+	testRedacted(t, `INSERT INTO notes VALUES ('reset password = ''AAA''', "identified by 'BBB'")`,
+		`INSERT INTO notes VALUES ('reset password = ''AAA''', "identified by 'BBB'")`)
+	testRedacted(t, `SELECT 'password = ', PASSWORD = 'AAA'`,
+		`SELECT 'password = ', PASSWORD = '****'`)
+}
+
+func TestRedactPasswordStatements(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{{
+		name:     "create user",
+		query:    "CREATE USER 'vt_repl'@'%' IDENTIFIED BY 'AAA'",
+		expected: "CREATE USER 'vt_repl'@'%' IDENTIFIED BY '****'",
+	}, {
+		name:     "alter user",
+		query:    "alter user 'vt_repl'@'%' identified by 'AAA'",
+		expected: "alter user 'vt_repl'@'%' identified by '****'",
+	}, {
+		name:     "identified with a plugin",
+		query:    "ALTER USER 'vt_repl'@'%' IDENTIFIED WITH mysql_native_password BY 'AAA'",
+		expected: "ALTER USER 'vt_repl'@'%' IDENTIFIED WITH mysql_native_password BY '****'",
+	}, {
+		name:     "identified with a hash",
+		query:    "CREATE USER 'vt_repl'@'%' IDENTIFIED WITH 'caching_sha2_password' AS 'AAA'",
+		expected: "CREATE USER 'vt_repl'@'%' IDENTIFIED WITH 'caching_sha2_password' AS '****'",
+	}, {
+		name:     "set password",
+		query:    "SET PASSWORD FOR 'vt_repl'@'%' = 'AAA'",
+		expected: "SET PASSWORD FOR 'vt_repl'@'%' = '****'",
+	}, {
+		name:     "source password",
+		query:    "CHANGE REPLICATION SOURCE TO SOURCE_HOST = 'host', SOURCE_USER = 'vt_repl', SOURCE_PASSWORD = 'AAA', SOURCE_PORT = 3306",
+		expected: "CHANGE REPLICATION SOURCE TO SOURCE_HOST = 'host', SOURCE_USER = 'vt_repl', SOURCE_PASSWORD = '****', SOURCE_PORT = 3306",
+	}, {
+		name:     "lower case source password",
+		query:    "change replication source to source_password='AAA'",
+		expected: "change replication source to source_password='****'",
+	}, {
+		name:     "double quotes",
+		query:    `CREATE USER 'vt_repl'@'%' IDENTIFIED BY "AAA"`,
+		expected: `CREATE USER 'vt_repl'@'%' IDENTIFIED BY "****"`,
+	}, {
+		name:     "escaped quotes",
+		query:    `CREATE USER 'vt_repl'@'%' IDENTIFIED BY 'A\'A''A' PASSWORD EXPIRE NEVER`,
+		expected: `CREATE USER 'vt_repl'@'%' IDENTIFIED BY '****' PASSWORD EXPIRE NEVER`,
+	}, {
+		name:     "escaped backslash",
+		query:    `CREATE USER 'vt_repl'@'%' IDENTIFIED BY 'AA\\', 'vt_app'@'%' IDENTIFIED BY 'BBB'`,
+		expected: `CREATE USER 'vt_repl'@'%' IDENTIFIED BY '****', 'vt_app'@'%' IDENTIFIED BY '****'`,
+	}, {
+		name:     "backslash in a quoted identifier",
+		query:    "CREATE USER `vt_repl\\`@'%' IDENTIFIED BY 'AAA'",
+		expected: "CREATE USER `vt_repl\\`@'%' IDENTIFIED BY '****'",
+	}, {
+		name:     "multiple secrets",
+		query:    "CREATE USER 'a'@'%' IDENTIFIED BY 'AAA', 'b'@'%' IDENTIFIED BY 'BBB'",
+		expected: "CREATE USER 'a'@'%' IDENTIFIED BY '****', 'b'@'%' IDENTIFIED BY '****'",
+	}, {
+		name:     "set global password variable",
+		query:    "SET GLOBAL group_replication_recovery_password = 'AAA'",
+		expected: "SET GLOBAL group_replication_recovery_password = '****'",
+	}, {
+		name:     "set persist secret variable",
+		query:    "set persist my_secret='AAA'",
+		expected: "set persist my_secret='****'",
+	}, {
+		name:     "set global other variable",
+		query:    "SET GLOBAL read_only_reason = 'AAA'",
+		expected: "SET GLOBAL read_only_reason = 'AAA'",
+	}, {
+		name:     "no secret",
+		query:    "CREATE USER 'vt_repl'@'%'",
+		expected: "CREATE USER 'vt_repl'@'%'",
+	}, {
+		name:     "no end quote",
+		query:    "CREATE USER 'vt_repl'@'%' IDENTIFIED BY 'AAA",
+		expected: "CREATE USER 'vt_repl'@'%' IDENTIFIED BY 'AAA",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testRedacted(t, tt.query, tt.expected)
+		})
+	}
+}
+
+func TestReplicationLagGTID(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	const (
+		sid1 = "00010203-0405-0607-0809-0a0b0c0d0e0f"
+		sid2 = "00010203-0405-0607-0809-0a0b0c0d0e10"
+	)
+	tests := []struct {
+		name        string
+		executed    string
+		primary     string
+		behindCount int64
+		wantErr     string
+	}{{
+		name:     "caught up",
+		executed: sid1 + ":1-100",
+		primary:  sid1 + ":1-100",
+	}, {
+		name:        "behind",
+		executed:    sid1 + ":1-90",
+		primary:     sid1 + ":1-100",
+		behindCount: 10,
+	}, {
+		name:        "behind on several sources",
+		executed:    sid1 + ":1-90,\n" + sid2 + ":1-5:8-10",
+		primary:     sid1 + ":1-100,\n" + sid2 + ":1-20",
+		behindCount: 22,
+	}, {
+		name:        "nothing executed",
+		executed:    "",
+		primary:     sid1 + ":1-100",
+		behindCount: 100,
+	}, {
+		name:     "diverged",
+		executed: sid1 + ":1-100," + sid2 + ":1",
+		primary:  sid1 + ":1-100",
+		wantErr:  "server has executed transactions not in the primary GTID set: " + sid2 + ":1",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.AddQuery("SHOW VARIABLES LIKE 'gtid_executed'", sqltypes.MakeTestResult(
+				sqltypes.MakeTestFields("Variable_name|Value", "varchar|varchar"),
+				"gtid_executed|"+tt.executed,
+			))
+			behindCount, err := mysqld.ReplicationLagGTID(context.Background(), tt.primary)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.behindCount, behindCount)
+		})
+	}
 }
@@ -58,7 +58,7 @@ func (e EmptyColumnsErr) Error() string {
 
 // executeSchemaCommands executes some SQL commands. It uses the dba connection parameters, with credentials.
 func (mysqld *Mysqld) executeSchemaCommands(ctx context.Context, sql string) error {
-	params, err := mysqld.dbcfgs.DbaConnector().MysqlParams()
+	params, err := mysqld.dbConfigs().DbaConnector().MysqlParams()
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,167 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// SQLMode is a flag of the sql_mode variable.
+type SQLMode uint32
+
+// The flags of sql_mode known to SQLModeFlags. Combination modes like ANSI
+// and TRADITIONAL are shown along with the flags they stand for, so they are
+// kept as other modes.
+const (
+	SQLModeAllowInvalidDates SQLMode = 1 << iota
+	SQLModeANSIQuotes
+	SQLModeErrorForDivisionByZero
+	SQLModeHighNotPrecedence
+	SQLModeIgnoreSpace
+	SQLModeNoAutoValueOnZero
+	SQLModeNoBackslashEscapes
+	SQLModeNoDirInCreate
+	SQLModeNoEngineSubstitution
+	SQLModeNoUnsignedSubtraction
+	SQLModeNoZeroDate
+	SQLModeNoZeroInDate
+	SQLModeOnlyFullGroupBy
+	SQLModePadCharToFullLength
+	SQLModePipesAsConcat
+	SQLModeRealAsFloat
+	SQLModeStrictAllTables
+	SQLModeStrictTransTables
+	SQLModeTimeTruncateFractional
+)
+
+var sqlModeNames = map[string]SQLMode{
+	"ALLOW_INVALID_DATES":        SQLModeAllowInvalidDates,
+	"ANSI_QUOTES":                SQLModeANSIQuotes,
+	"ERROR_FOR_DIVISION_BY_ZERO": SQLModeErrorForDivisionByZero,
+	"HIGH_NOT_PRECEDENCE":        SQLModeHighNotPrecedence,
+	"IGNORE_SPACE":               SQLModeIgnoreSpace,
+	"NO_AUTO_VALUE_ON_ZERO":      SQLModeNoAutoValueOnZero,
+	"NO_BACKSLASH_ESCAPES":       SQLModeNoBackslashEscapes,
+	"NO_DIR_IN_CREATE":           SQLModeNoDirInCreate,
+	"NO_ENGINE_SUBSTITUTION":     SQLModeNoEngineSubstitution,
+	"NO_UNSIGNED_SUBTRACTION":    SQLModeNoUnsignedSubtraction,
+	"NO_ZERO_DATE":               SQLModeNoZeroDate,
+	"NO_ZERO_IN_DATE":            SQLModeNoZeroInDate,
+	"ONLY_FULL_GROUP_BY":         SQLModeOnlyFullGroupBy,
+	"PAD_CHAR_TO_FULL_LENGTH":    SQLModePadCharToFullLength,
+	"PIPES_AS_CONCAT":            SQLModePipesAsConcat,
+	"REAL_AS_FLOAT":              SQLModeRealAsFloat,
+	"STRICT_ALL_TABLES":          SQLModeStrictAllTables,
+	"STRICT_TRANS_TABLES":        SQLModeStrictTransTables,
+	"TIME_TRUNCATE_FRACTIONAL":   SQLModeTimeTruncateFractional,
+}
+
+// SQLModeFlags is a parsed sql_mode.
+type SQLModeFlags struct {
+	flags SQLMode
+	other []string
+}
+
+// ParseSQLMode parses a comma-separated sql_mode, as returned by @@sql_mode.
+// Modes are case-insensitive.
+func ParseSQLMode(sqlMode string) SQLModeFlags {
+	var f SQLModeFlags
+	for _, mode := range strings.Split(sqlMode, ",") {
+		mode = strings.ToUpper(strings.TrimSpace(mode))
+		if mode == "" {
+			continue
+		}
+		if flag, ok := sqlModeNames[mode]; ok {
+			f.flags |= flag
+		} else {
+			f.other = append(f.other, mode)
+		}
+	}
+	return f
+}
+
+// Has returns true if all the given flags are set.
+func (f SQLModeFlags) Has(flags SQLMode) bool {
+	return f.flags&flags == flags
+}
+
+// Other returns the modes that aren't one of the SQLMode flags, e.g. the
+// ANSI and TRADITIONAL combination modes.
+func (f SQLModeFlags) Other() []string {
+	return f.other
+}
+
+// Strict returns true if either STRICT_TRANS_TABLES or STRICT_ALL_TABLES is
+// set, which is what MySQL calls strict mode.
+func (f SQLModeFlags) Strict() bool {
+	return f.StrictTransTables() || f.StrictAllTables()
+}
+
+// StrictTransTables returns true if STRICT_TRANS_TABLES is set.
+func (f SQLModeFlags) StrictTransTables() bool {
+	return f.Has(SQLModeStrictTransTables)
+}
+
+// StrictAllTables returns true if STRICT_ALL_TABLES is set.
+func (f SQLModeFlags) StrictAllTables() bool {
+	return f.Has(SQLModeStrictAllTables)
+}
+
+// OnlyFullGroupBy returns true if ONLY_FULL_GROUP_BY is set.
+func (f SQLModeFlags) OnlyFullGroupBy() bool {
+	return f.Has(SQLModeOnlyFullGroupBy)
+}
+
+// PipesAsConcat returns true if PIPES_AS_CONCAT is set.
+func (f SQLModeFlags) PipesAsConcat() bool {
+	return f.Has(SQLModePipesAsConcat)
+}
+
+// ANSIQuotes returns true if ANSI_QUOTES is set.
+func (f SQLModeFlags) ANSIQuotes() bool {
+	return f.Has(SQLModeANSIQuotes)
+}
+
+// NoBackslashEscapes returns true if NO_BACKSLASH_ESCAPES is set.
+func (f SQLModeFlags) NoBackslashEscapes() bool {
+	return f.Has(SQLModeNoBackslashEscapes)
+}
+
+// NoZeroDate returns true if NO_ZERO_DATE is set.
+func (f SQLModeFlags) NoZeroDate() bool {
+	return f.Has(SQLModeNoZeroDate)
+}
+
+// NoZeroInDate returns true if NO_ZERO_IN_DATE is set.
+func (f SQLModeFlags) NoZeroInDate() bool {
+	return f.Has(SQLModeNoZeroInDate)
+}
+
+// GetSQLMode returns the sql_mode of mysqld.
+func (mysqld *Mysqld) GetSQLMode(ctx context.Context) (SQLModeFlags, error) {
+	vars, err := mysqld.fetchVariables(ctx, "sql_mode")
+	if err != nil {
+		return SQLModeFlags{}, err
+	}
+	sqlMode, ok := vars["sql_mode"]
+	if !ok {
+		return SQLModeFlags{}, fmt.Errorf("no sql_mode variable in mysql")
+	}
+	return ParseSQLMode(sqlMode), nil
+}
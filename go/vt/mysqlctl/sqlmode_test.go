@@ -0,0 +1,74 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/mysql/fakesqldb"
+	"vitess.io/vitess/go/sqltypes"
+)
+
+func TestParseSQLMode(t *testing.T) {
+	flags := ParseSQLMode("")
+	assert.False(t, flags.Strict())
+	assert.False(t, flags.OnlyFullGroupBy())
+	assert.True(t, flags.Has(0))
+	assert.Empty(t, flags.Other())
+
+	flags = ParseSQLMode("only_full_group_by")
+	assert.True(t, flags.OnlyFullGroupBy())
+	assert.False(t, flags.Strict())
+	assert.Empty(t, flags.Other())
+
+	// ANSI added to the default sql_mode of MySQL 8.0, as @@sql_mode shows it.
+	flags = ParseSQLMode("REAL_AS_FLOAT,PIPES_AS_CONCAT,ANSI_QUOTES,IGNORE_SPACE,ONLY_FULL_GROUP_BY,ANSI,STRICT_TRANS_TABLES,NO_ZERO_IN_DATE,NO_ZERO_DATE,ERROR_FOR_DIVISION_BY_ZERO,NO_ENGINE_SUBSTITUTION")
+	assert.True(t, flags.Strict())
+	assert.True(t, flags.StrictTransTables())
+	assert.False(t, flags.StrictAllTables())
+	assert.True(t, flags.OnlyFullGroupBy())
+	assert.True(t, flags.PipesAsConcat())
+	assert.True(t, flags.ANSIQuotes())
+	assert.False(t, flags.NoBackslashEscapes())
+	assert.True(t, flags.NoZeroDate())
+	assert.True(t, flags.NoZeroInDate())
+	assert.True(t, flags.Has(SQLModeRealAsFloat|SQLModeIgnoreSpace|SQLModeErrorForDivisionByZero|SQLModeNoEngineSubstitution))
+	assert.False(t, flags.Has(SQLModeRealAsFloat|SQLModeAllowInvalidDates))
+	assert.Equal(t, []string{"ANSI"}, flags.Other())
+}
+
+func TestGetSQLMode(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	db.AddQuery("SHOW VARIABLES LIKE 'sql_mode'", sqltypes.MakeTestResult(
+		sqltypes.MakeTestFields("Variable_name|Value", "varchar|varchar"),
+		"sql_mode|STRICT_ALL_TABLES,NO_BACKSLASH_ESCAPES",
+	))
+	flags, err := mysqld.GetSQLMode(context.Background())
+	require.NoError(t, err)
+	assert.True(t, flags.Strict())
+	assert.True(t, flags.StrictAllTables())
+	assert.True(t, flags.NoBackslashEscapes())
+	assert.False(t, flags.OnlyFullGroupBy())
+}
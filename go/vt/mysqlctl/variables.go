@@ -0,0 +1,138 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"vitess.io/vitess/go/mysql/sqlerror"
+	"vitess.io/vitess/go/sqltypes"
+	"vitess.io/vitess/go/vt/log"
+)
+
+// ErrReadOnlyVariable is returned by SetGlobalVariable for a variable that
+// can't be changed at runtime.
+var ErrReadOnlyVariable = errors.New("variable is read only")
+
+// GlobalVariableMismatchError is returned by SetGlobalVariable when the value
+// read back differs from the value that was set, e.g. because MySQL clamped it
+// to the range of the variable.
+type GlobalVariableMismatchError struct {
+	Name string
+	Want string
+	Got  string
+}
+
+// Error is part of the error interface. Values of sensitive variables are
+// redacted.
+func (e *GlobalVariableMismatchError) Error() string {
+	return fmt.Sprintf("global variable %s was set to %s but reads back as %s",
+		e.Name, redactVariableValue(e.Name, e.Want), redactVariableValue(e.Name, e.Got))
+}
+
+var variableNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.]*$`)
+
+// numericValueRegexp matches the plain decimal numbers, with an optional
+// exponent, that MySQL takes as numeric literals. strconv.ParseFloat also
+// accepts Inf, NaN and hexadecimal floats, which MySQL doesn't.
+var numericValueRegexp = regexp.MustCompile(`^[+-]?(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][+-]?[0-9]+)?$`)
+
+// SetGlobalVariable sets a global variable and reads it back to check that
+// the change took effect. Numeric values are set as numbers and other values
+// as strings. The read-back is compared case-insensitively, numerically for
+// numbers, and with ON/OFF equivalent to 1/0.
+func (mysqld *Mysqld) SetGlobalVariable(ctx context.Context, name, value string) error {
+	if !variableNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid variable name %q", name)
+	}
+	log.Infof("SetGlobalVariable setting %s to %s", name, redactVariableValue(name, value))
+
+	// The query is only logged through redactPassword, e.g. when it times
+	// out, which redacts the string values of the sensitive variables.
+	query := fmt.Sprintf("SET GLOBAL %s = %s", name, encodeVariableValue(value))
+	if _, err := mysqld.FetchSuperQuery(ctx, query); err != nil {
+		sqlErr, ok := sqlerror.NewSQLErrorFromError(err).(*sqlerror.SQLError)
+		if ok && sqlErr.Number() == sqlerror.ERIncorrectGlobalLocalVar {
+			return fmt.Errorf("%w: %s", ErrReadOnlyVariable, name)
+		}
+		if ok && isSensitiveVariable(name) {
+			// The error message contains the query.
+			return fmt.Errorf("cannot set global variable %s (errno %v) (sqlstate %v)", name, sqlErr.Number(), sqlErr.SQLState())
+		}
+		return fmt.Errorf("cannot set global variable %s: %w", name, err)
+	}
+
+	vars, err := mysqld.fetchGlobalVariables(ctx, name)
+	if err != nil {
+		return err
+	}
+	got, ok := vars[name]
+	if !ok {
+		return fmt.Errorf("global variable %s not found after setting it", name)
+	}
+	if !variableValuesEqual(value, got) {
+		return &GlobalVariableMismatchError{Name: name, Want: value, Got: got}
+	}
+	return nil
+}
+
+func encodeVariableValue(value string) string {
+	if numericValueRegexp.MatchString(value) {
+		return value
+	}
+	return sqltypes.EncodeStringSQL(value)
+}
+
+func variableValuesEqual(want, got string) bool {
+	if strings.EqualFold(want, got) {
+		return true
+	}
+	wantFloat, wantErr := strconv.ParseFloat(normalizeBoolVariable(want), 64)
+	gotFloat, gotErr := strconv.ParseFloat(normalizeBoolVariable(got), 64)
+	return wantErr == nil && gotErr == nil && wantFloat == gotFloat
+}
+
+// normalizeBoolVariable returns 1 and 0 for the ON and OFF values of boolean
+// variables, which can be set either way.
+func normalizeBoolVariable(value string) string {
+	switch strings.ToUpper(value) {
+	case "ON", "TRUE":
+		return "1"
+	case "OFF", "FALSE":
+		return "0"
+	}
+	return value
+}
+
+// isSensitiveVariable returns true for variables whose values must not be
+// logged, e.g. replication passwords.
+func isSensitiveVariable(name string) bool {
+	name = strings.ToLower(name)
+	return strings.Contains(name, "password") || strings.Contains(name, "secret")
+}
+
+func redactVariableValue(name, value string) string {
+	if isSensitiveVariable(name) {
+		return strings.Repeat("*", 4)
+	}
+	return value
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2023 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlctl
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vitess.io/vitess/go/mysql/fakesqldb"
+	"vitess.io/vitess/go/mysql/sqlerror"
+	"vitess.io/vitess/go/sqltypes"
+)
+
+var variableFields = sqltypes.MakeTestFields("Variable_name|Value", "varchar|varchar")
+
+func TestSetGlobalVariable(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+	ctx := context.Background()
+
+	db.AddQuery("SET GLOBAL max_connections = 500", &sqltypes.Result{})
+	db.AddQuery("SHOW GLOBAL VARIABLES LIKE 'max_connections'", sqltypes.MakeTestResult(variableFields, "max_connections|500"))
+	require.NoError(t, mysqld.SetGlobalVariable(ctx, "max_connections", "500"))
+
+	// Booleans read back as ON/OFF, and floats with more digits.
+	db.AddQuery("SET GLOBAL read_only = 1", &sqltypes.Result{})
+	db.AddQuery("SHOW GLOBAL VARIABLES LIKE 'read_only'", sqltypes.MakeTestResult(variableFields, "read_only|ON"))
+	require.NoError(t, mysqld.SetGlobalVariable(ctx, "read_only", "1"))
+	db.AddQuery("SET GLOBAL long_query_time = 2", &sqltypes.Result{})
+	db.AddQuery("SHOW GLOBAL VARIABLES LIKE 'long_query_time'", sqltypes.MakeTestResult(variableFields, "long_query_time|2.000000"))
+	require.NoError(t, mysqld.SetGlobalVariable(ctx, "long_query_time", "2"))
+	db.AddQuery("SET GLOBAL binlog_format = 'row'", &sqltypes.Result{})
+	db.AddQuery("SHOW GLOBAL VARIABLES LIKE 'binlog_format'", sqltypes.MakeTestResult(variableFields, "binlog_format|ROW"))
+	require.NoError(t, mysqld.SetGlobalVariable(ctx, "binlog_format", "row"))
+
+	err := mysqld.SetGlobalVariable(ctx, "max_connections = 1; DROP TABLE t", "500")
+	require.EqualError(t, err, `invalid variable name "max_connections = 1; DROP TABLE t"`)
+}
+
+func TestEncodeVariableValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"500", "500"},
+		{"-1", "-1"},
+		{"+2.5", "+2.5"},
+		{"2.", "2."},
+		{".5", ".5"},
+		{"1e3", "1e3"},
+		{"1.5E-3", "1.5E-3"},
+		{"row", "'row'"},
+		{"Inf", "'Inf'"},
+		{"-infinity", "'-infinity'"},
+		{"NaN", "'NaN'"},
+		{"0x1p3", "'0x1p3'"},
+		{"0x10", "'0x10'"},
+		{"1_000", "'1_000'"},
+		{"1e", "'1e'"},
+		{".", "'.'"},
+		{"", "''"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			assert.Equal(t, tt.expected, encodeVariableValue(tt.value))
+		})
+	}
+}
+
+func TestSetGlobalVariableMismatch(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	// MySQL clamps max_connections to 100000 with a warning.
+	db.AddQuery("SET GLOBAL max_connections = 200000", &sqltypes.Result{})
+	db.AddQuery("SHOW GLOBAL VARIABLES LIKE 'max_connections'", sqltypes.MakeTestResult(variableFields, "max_connections|100000"))
+	err := mysqld.SetGlobalVariable(context.Background(), "max_connections", "200000")
+	var mismatchErr *GlobalVariableMismatchError
+	require.ErrorAs(t, err, &mismatchErr)
+	assert.Equal(t, &GlobalVariableMismatchError{Name: "max_connections", Want: "200000", Got: "100000"}, mismatchErr)
+	assert.EqualError(t, err, "global variable max_connections was set to 200000 but reads back as 100000")
+}
+
+func TestSetGlobalVariableReadOnly(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+
+	db.AddRejectedQuery("SET GLOBAL datadir = '/tmp'", sqlerror.NewSQLError(sqlerror.ERIncorrectGlobalLocalVar, sqlerror.SSUnknownSQLState, "Variable 'datadir' is a read only variable"))
+	err := mysqld.SetGlobalVariable(context.Background(), "datadir", "/tmp")
+	require.ErrorIs(t, err, ErrReadOnlyVariable)
+}
+
+func TestSetGlobalVariableRedacted(t *testing.T) {
+	db := fakesqldb.New(t)
+	defer db.Close()
+	mysqld := newTestMysqld(db)
+	defer mysqld.Close()
+	ctx := context.Background()
+
+	db.AddQuery("SET GLOBAL validate_password.length = 12", &sqltypes.Result{})
+	db.AddQuery("SHOW GLOBAL VARIABLES LIKE 'validate_password.length'", sqltypes.MakeTestResult(variableFields, "validate_password.length|16"))
+	err := mysqld.SetGlobalVariable(ctx, "validate_password.length", "12")
+	var mismatchErr *GlobalVariableMismatchError
+	require.ErrorAs(t, err, &mismatchErr)
+	assert.Equal(t, "16", mismatchErr.Got)
+	assert.EqualError(t, err, "global variable validate_password.length was set to **** but reads back as ****")
+
+	db.AddRejectedQuery("SET GLOBAL my_secret = 'hunter2'", sqlerror.NewSQLError(sqlerror.ERWrongValueForVar, sqlerror.SSClientError, "Variable 'my_secret' can't be set to the value of 'hunter2'"))
+	err = mysqld.SetGlobalVariable(ctx, "my_secret", "hunter2")
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "hunter2")
+	// The query is logged when it times out.
+	assert.NotContains(t, redactPassword("SET GLOBAL my_secret = 'hunter2'"), "hunter2")
+}